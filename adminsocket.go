@@ -0,0 +1,80 @@
+package warden
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+// listenAdmin listens on the admin socket, replacing one left behind by a
+// warden that didn't exit cleanly. The socket is only accessible to the
+// user warden runs as.
+func (w *Warden) listenAdmin() (net.Listener, error) {
+	if fi, err := os.Lstat(w.adminSocket); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Admin socket %s exists and is not a socket", w.adminSocket)
+		}
+		if conn, err := net.Dial("unix", w.adminSocket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Admin socket %s is in use", w.adminSocket)
+		}
+		if err := os.Remove(w.adminSocket); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", w.adminSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(w.adminSocket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if w.runAs != nil {
+		if err := os.Chown(w.adminSocket, w.runAs.uid, w.runAs.gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (w *Warden) serveAdmin(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", func(rw http.ResponseWriter, r *http.Request) {
+		sessions := w.Sessions()
+		if sessions == nil {
+			sessions = []SessionInfo{}
+		}
+		writeJSON(rw, r, sessions)
+	})
+	mux.HandleFunc("/stats", func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, r, w.Stats())
+	})
+	fmt.Printf("Serving admin requests on %s...\n", w.adminSocket)
+	if err := http.Serve(l, mux); err != nil {
+		w.listenersMu.Lock()
+		closed := w.closed
+		w.listenersMu.Unlock()
+		if !closed {
+			log.Println("Stopped serving admin requests:", err)
+		}
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, r *http.Request, v interface{}) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Println("Failed to write admin response:", err)
+	}
+}
@@ -0,0 +1,153 @@
+package warden
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// adminClient returns a client for the admin socket at path, once warden is
+// serving on it.
+func adminClient(t *testing.T, path string) *http.Client {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Admin socket isn't being served")
+		}
+	}
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func getJSON(t *testing.T, client *http.Client, path string, v interface{}) {
+	resp, err := client.Get("http://warden" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("GET %s = %s, %s", path, resp.Status, resp.Header.Get("Content-Type"))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+}
+
+func TestAdminSocket(t *testing.T) {
+	log := fakeDocker(t, jailDocker)
+	t.Setenv("HOLD_SESSIONS", "1")
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	w, addr := startWarden(t, Config{AdminSocket: socket, HangupGrace: Duration(100 * time.Millisecond)})
+	client := adminClient(t, socket)
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Admin socket is %v, %v, want mode 0600", fi, err)
+	}
+
+	var sessions []SessionInfo
+	getJSON(t, client, "/sessions", &sessions)
+	if sessions == nil || len(sessions) != 0 {
+		t.Errorf("Sessions before any started = %+v, want an empty list", sessions)
+	}
+
+	var channels []ssh.Channel
+	for _, user := range []string{"alice", "bob"} {
+		ch, reqs, err := dialWarden(t, addr, user).OpenChannel("session", nil)
+		if err != nil {
+			t.Fatal("OpenChannel:", err)
+		}
+		go ssh.DiscardRequests(reqs)
+		channels = append(channels, ch)
+		if ok, err := ch.SendRequest("shell", true, nil); !ok || err != nil {
+			t.Fatalf("shell = %v, %v", ok, err)
+		}
+		if line, err := bufio.NewReader(ch).ReadString('\n'); err != nil || !strings.HasPrefix(line, "session in id-") {
+			t.Fatalf("Session printed %q, %v", line, err)
+		}
+	}
+	getJSON(t, client, "/sessions", &sessions)
+	if len(sessions) != 2 || !reflect.DeepEqual(sessions, w.Sessions()) {
+		t.Errorf("Admin socket served sessions %+v, want %+v", sessions, w.Sessions())
+	}
+	users := map[string]bool{}
+	for _, s := range sessions {
+		users[s.User] = s.ContainerID != "" && s.SessionID != ""
+	}
+	if !users["alice"] || !users["bob"] {
+		t.Errorf("Admin socket served sessions %+v, want running sessions for alice and bob", sessions)
+	}
+	var stats Stats
+	getJSON(t, client, "/stats", &stats)
+	if stats != w.Stats() || stats.Sessions != 2 || stats.Jails != 2 {
+		t.Errorf("Admin socket served stats %+v, want %+v", stats, w.Stats())
+	}
+
+	resp, err := client.Post("http://warden/stats", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /stats = %s", resp.Status)
+	}
+
+	for _, ch := range channels {
+		ch.Close()
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(dockerCalls(t, log, "rm")) < 2 || len(w.Sessions()) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Sessions didn't end")
+		}
+	}
+	getJSON(t, client, "/sessions", &sessions)
+	if len(sessions) != 0 {
+		t.Errorf("Sessions after they ended = %+v", sessions)
+	}
+}
+
+func TestListenAdmin(t *testing.T) {
+	dir := t.TempDir()
+	w := &Warden{adminSocket: filepath.Join(dir, "admin.sock")}
+
+	// A socket left behind by a warden that crashed is replaced.
+	stale, err := net.Listen("unix", w.adminSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	l, err := w.listenAdmin()
+	if err != nil {
+		t.Fatal("listenAdmin didn't replace a stale socket:", err)
+	}
+	defer l.Close()
+
+	// One still being served isn't.
+	if _, err := w.listenAdmin(); err == nil || !strings.Contains(err.Error(), "is in use") {
+		t.Errorf("listenAdmin on a socket in use = %v", err)
+	}
+
+	w.adminSocket = filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(w.adminSocket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.listenAdmin(); err == nil || !strings.Contains(err.Error(), "is not a socket") {
+		t.Errorf("listenAdmin on a file = %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package warden
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+const apparmorUnconfined = "unconfined"
+
+var apparmorProfileRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:/-]*$`)
+
+func validateAppArmorProfile(profile string) error {
+	switch {
+	case profile == "":
+		return nil
+	case profile == apparmorUnconfined:
+		log.Println("WARNING: jails are running without AppArmor confinement")
+		return nil
+	case !apparmorProfileRegexp.MatchString(profile):
+		return fmt.Errorf("Invalid AppArmor profile %q", profile)
+	}
+	if !apparmorAvailable() {
+		log.Printf("WARNING: AppArmor profile %q is configured, but the docker daemon doesn't support AppArmor", profile)
+	}
+	return nil
+}
+
+// apparmorAvailable reports whether the docker daemon can apply AppArmor
+// profiles. If docker can't be asked, it is assumed that it can, so that
+// warden still starts while docker is down.
+func apparmorAvailable() bool {
+	out, err := exec.Command("docker", "info", "-f", "{{.SecurityOptions}}").Output()
+	if err != nil {
+		return true
+	}
+	return strings.Contains(string(out), "apparmor")
+}
@@ -0,0 +1,61 @@
+package warden
+
+import (
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// apparmorDocker fakes docker info on a host with the security options in
+// $SECURITY_OPTIONS, or with docker down if it is "down".
+const apparmorDocker = `[ "$1" = info ] || exit 0
+[ "$SECURITY_OPTIONS" = down ] && { echo "Cannot connect to the Docker daemon" >&2; exit 1; }
+echo "$SECURITY_OPTIONS"
+`
+
+func TestValidateAppArmorProfile(t *testing.T) {
+	fakeDocker(t, apparmorDocker)
+	defer log.SetOutput(os.Stderr)
+	for _, test := range []struct {
+		profile, securityOptions string
+		ok                       bool
+		warning                  string
+	}{
+		{"", "[name=seccomp,profile=default]", true, ""},
+		{"warden-jail", "[name=apparmor name=seccomp,profile=default]", true, ""},
+		{"docker-default", "[name=apparmor]", true, ""},
+		{"unconfined", "[name=apparmor]", true, "jails are running without AppArmor confinement"},
+		// Hosts without AppArmor can't apply the profile.
+		{"warden-jail", "[name=seccomp,profile=default name=selinux]", true, `AppArmor profile "warden-jail" is configured, but the docker daemon doesn't support AppArmor`},
+		{"warden-jail", "down", true, ""},
+		{"warden jail", "[name=apparmor]", false, ""},
+		{"-warden", "[name=apparmor]", false, ""},
+		{"warden;reboot", "[name=apparmor]", false, ""},
+	} {
+		var logs syncBuffer
+		log.SetOutput(&logs)
+		t.Setenv("SECURITY_OPTIONS", test.securityOptions)
+		err := (Jail{AppArmorProfile: test.profile}).validate()
+		if (err == nil) != test.ok {
+			t.Errorf("Profile %q on %s: validate() = %v, want ok %v", test.profile, test.securityOptions, err, test.ok)
+		}
+		if got := logs.String(); test.warning == "" && got != "" || test.warning != "" && !strings.Contains(got, "WARNING: "+test.warning) {
+			t.Errorf("Profile %q on %s logged %q, want %q", test.profile, test.securityOptions, got, test.warning)
+		}
+	}
+}
+
+func TestJailAppArmorProfile(t *testing.T) {
+	for _, persistent := range []bool{false, true} {
+		log := fakeDocker(t, jailDocker)
+		_, addr := startWarden(t, Config{Jail: Jail{Persistent: persistent, AppArmorProfile: "unconfined"}})
+		if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+			t.Fatal("Session failed:", err)
+		}
+		creates := append(dockerCalls(t, log, "create"), dockerCalls(t, log, "run -d")...)
+		if len(creates) != 1 || !strings.Contains(creates[0], " --security-opt apparmor=unconfined ") {
+			t.Errorf("Persistent %v: jails created with %q, want them unconfined", persistent, creates)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package warden
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Authenticator decides whether clients may log in, so that programs
+// embedding warden can check them against any backend. method is the ssh
+// authentication method, "publickey" or "password", and cred is the
+// client's public key in wire format or its password. The extensions of the
+// returned permissions are kept for the connection.
+type Authenticator interface {
+	Authenticate(conn ssh.ConnMetadata, method string, cred []byte) (*ssh.Permissions, error)
+}
+
+// allowAll is the Authenticator used by default. It accepts any public key.
+type allowAll struct {
+	samplers samplers
+}
+
+func (a allowAll) Authenticate(conn ssh.ConnMetadata, method string, cred []byte) (*ssh.Permissions, error) {
+	if a.samplers.sample(authEvents) {
+		log.Println("No auth yet! Allowing user:", conn.User())
+	}
+	return &ssh.Permissions{}, nil
+}
+
+func (w *Warden) checkKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	perms, err := w.checkAuth(conn, "publickey", key.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	perms.Extensions[fingerprintExtension] = fingerprint(key)
+	return perms, nil
+}
+
+func (w *Warden) checkPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	return w.checkAuth(conn, "password", password)
+}
+
+// checkAuth maps the client's username to its local one and asks the
+// authenticator whether it may log in.
+func (w *Warden) checkAuth(conn ssh.ConnMetadata, method string, cred []byte) (*ssh.Permissions, error) {
+	// Some clients allow logging in without a username, which would leave
+	// the jail without a user to run the shell as.
+	if strings.TrimSpace(conn.User()) == "" {
+		log.Printf("Rejected login with empty username %q from %v", conn.User(), conn.RemoteAddr())
+		return nil, errors.New("Empty username")
+	}
+	localUser, err := w.usernames.localUser(conn.User())
+	if err != nil {
+		log.Println("Failed to map username:", err)
+		return nil, err
+	}
+	perms, err := w.authenticator.Authenticate(conn, method, cred)
+	if err != nil {
+		return nil, err
+	}
+	if perms == nil {
+		perms = &ssh.Permissions{}
+	}
+	extensions := map[string]string{localUserExtension: localUser}
+	for k, v := range perms.Extensions {
+		if _, ok := extensions[k]; !ok {
+			extensions[k] = v
+		}
+	}
+	perms.Extensions = extensions
+	return perms, nil
+}
@@ -0,0 +1,180 @@
+package warden
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// mockAuthenticator lets alice in with her password or key, and records
+// the methods it was asked about.
+type mockAuthenticator struct {
+	key ssh.PublicKey
+
+	mu      sync.Mutex
+	methods []string
+}
+
+func (a *mockAuthenticator) Authenticate(conn ssh.ConnMetadata, method string, cred []byte) (*ssh.Permissions, error) {
+	a.mu.Lock()
+	a.methods = append(a.methods, method)
+	a.mu.Unlock()
+	if conn.User() != "alice" {
+		return nil, errors.New("Unknown user")
+	}
+	switch {
+	case method == "password" && string(cred) == "hunter2":
+	case method == "publickey" && bytes.Equal(cred, a.key.Marshal()):
+	default:
+		return nil, errors.New("Wrong credentials")
+	}
+	return &ssh.Permissions{Extensions: map[string]string{localUserExtension: "mallory"}}, nil
+}
+
+func TestAuthenticator(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	alice, err := ssh.NewSignerFromKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ssh.NewSignerFromKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &mockAuthenticator{key: alice.PublicKey()}
+	_, addr := startWarden(t, Config{Authenticator: auth})
+	for _, test := range []struct {
+		name string
+		user string
+		auth ssh.AuthMethod
+		ok   bool
+	}{
+		{"password", "alice", ssh.Password("hunter2"), true},
+		{"key", "alice", ssh.PublicKeys(alice), true},
+		{"wrong password", "alice", ssh.Password("hunter3"), false},
+		{"unknown key", "alice", ssh.PublicKeys(other), false},
+		{"unknown user", "bob", ssh.PublicKeys(alice), false},
+	} {
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: test.user, Auth: []ssh.AuthMethod{test.auth}})
+		if !test.ok {
+			if err == nil {
+				client.Close()
+				t.Errorf("%s: login succeeded", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: login failed: %v", test.name, err)
+			continue
+		}
+		// The authenticator can't change which local user the shell
+		// runs as.
+		out, err := runShell(t, client, nil)
+		if err != nil || !strings.Contains(out, "-alice") || strings.Contains(out, "mallory") {
+			t.Errorf("%s: session = %q, %v, want one for alice", test.name, out, err)
+		}
+		client.Close()
+	}
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if methods := strings.Join(auth.methods, " "); !strings.Contains(methods, "password") || !strings.Contains(methods, "publickey") {
+		t.Errorf("Authenticator asked about %q, want both methods", methods)
+	}
+}
+
+func TestDefaultAuthenticator(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	w, addr := startWarden(t, Config{})
+	if _, ok := w.authenticator.(allowAll); !ok || w.passwordAuth {
+		t.Errorf("Default authenticator is %T, password auth %v", w.authenticator, w.passwordAuth)
+	}
+	if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+		t.Error("Session with any key failed:", err)
+	}
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "alice", Auth: []ssh.AuthMethod{ssh.Password("hunter2")}})
+	if err == nil {
+		t.Error("Password login succeeded without an authenticator")
+	}
+}
+
+func TestFingerprintEnv(t *testing.T) {
+	for _, persistent := range []bool{false, true} {
+		log := fakeDocker(t, jailDocker)
+		auth := &mockAuthenticator{}
+		_, addr := startWarden(t, Config{Authenticator: auth, FingerprintEnv: "WARDEN_FINGERPRINT", Jail: Jail{Persistent: persistent}})
+		signer, err := ssh.NewSignerFromKey(testKey(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth.key = signer.PublicKey()
+		for _, method := range []ssh.AuthMethod{ssh.PublicKeys(signer), ssh.Password("hunter2")} {
+			client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "alice", Auth: []ssh.AuthMethod{method}})
+			if err != nil {
+				t.Fatal("Dial:", err)
+			}
+			if _, err := runShell(t, client, nil); err != nil {
+				t.Fatal("Session failed:", err)
+			}
+			client.Close()
+		}
+		// Sessions in ephemeral jails get it when the jail is created, and
+		// in persistent ones when the session is started in it.
+		calls := dockerCalls(t, log, "create")
+		if persistent {
+			calls = nil
+			for _, call := range dockerCalls(t, log, "exec") {
+				if strings.HasPrefix(call, "exec -i") {
+					calls = append(calls, call)
+				}
+			}
+		}
+		want := " -e WARDEN_FINGERPRINT=" + fingerprint(signer.PublicKey()) + " "
+		if len(calls) != 2 || !strings.Contains(calls[0], want) {
+			t.Fatalf("Persistent %v: sessions started with %q, want the key's fingerprint", persistent, calls)
+		}
+		// Clients logging in with a password have no key to identify.
+		if strings.Contains(calls[1], "WARDEN_FINGERPRINT") {
+			t.Errorf("Persistent %v: password session started with %q", persistent, calls[1])
+		}
+	}
+}
+
+func TestInvalidFingerprintEnv(t *testing.T) {
+	_, err := New(Config{PrivateKeys: []string{testHostKey(t)}, FingerprintEnv: "WARDEN-FINGERPRINT"})
+	if err == nil || !strings.Contains(err.Error(), "Invalid fingerprintEnv") {
+		t.Errorf("New = %v, want the env name refused", err)
+	}
+}
+
+func TestEmptyUsername(t *testing.T) {
+	dockerLog := fakeDocker(t, jailDocker)
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	_, addr := startWarden(t, Config{})
+	signer, err := ssh.NewSignerFromKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"", " ", "\t\n"} {
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: user, Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)}})
+		if err == nil {
+			client.Close()
+			t.Errorf("Login as %q succeeded", user)
+		}
+		if want := fmt.Sprintf("Rejected login with empty username %q", user); !strings.Contains(logs.String(), want) {
+			t.Errorf("Login as %q logged %q, want %q", user, logs.String(), want)
+		}
+	}
+	if b, err := ioutil.ReadFile(dockerLog); err == nil {
+		t.Errorf("Ran docker for empty usernames:\n%s", b)
+	}
+}
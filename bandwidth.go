@@ -0,0 +1,75 @@
+package warden
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+)
+
+// NetworkBandwidth limits the rate at which jails send network traffic.
+// The limit is set with tc from a helper container sharing the jail's
+// network namespace, so jails themselves don't need NET_ADMIN.
+type NetworkBandwidth struct {
+	// Rate is in tc's format, e.g. "10mbit".
+	Rate string `json:"rate"`
+	// Burst is how much may be sent at once above the rate, in tc's
+	// format. Defaults to "64kb", which suits rates up to about 500mbit.
+	Burst string `json:"burst"`
+	// Image is the helper image tc is run from, which must have it
+	// installed, e.g. one with iproute2. Jail images usually don't.
+	Image string `json:"image"`
+}
+
+var (
+	tcRateRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kmgt]?(bit|bps)$`)
+	tcSizeRegexp = regexp.MustCompile(`^[0-9]+([kmg]b?|b|[kmg]bit)?$`)
+)
+
+func (b *NetworkBandwidth) validate() error {
+	if !tcRateRegexp.MatchString(b.Rate) {
+		return fmt.Errorf("Invalid network bandwidth rate %q", b.Rate)
+	}
+	if b.Burst != "" && !tcSizeRegexp.MatchString(b.Burst) {
+		return fmt.Errorf("Invalid network bandwidth burst %q", b.Burst)
+	}
+	if b.Image == "" {
+		return errors.New("Network bandwidth limits require an image with tc")
+	}
+	return nil
+}
+
+// args returns the docker arguments limiting the bandwidth of a running
+// jail.
+func (b *NetworkBandwidth) args(jailID string) []string {
+	burst := b.Burst
+	if burst == "" {
+		burst = "64kb"
+	}
+	return []string{"run", "--rm", "--net", "container:" + jailID, "--cap-add", "NET_ADMIN", b.Image,
+		"tc", "qdisc", "replace", "dev", "eth0", "root", "tbf", "rate", b.Rate, "burst", burst, "latency", "400ms"}
+}
+
+// limitBandwidth applies the jail's bandwidth limit, retrying while the
+// jail is still starting.
+func (w *Warden) limitBandwidth(jailID string, attempts int) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		cmd := w.docker(w.jail.NetworkBandwidth.args(jailID)...)
+		if environ := w.registryEnviron(w.jail.NetworkBandwidth.Image); environ != nil {
+			cmd.Env = append(os.Environ(), environ...)
+		}
+		var out []byte
+		out, err = cmd.CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package warden
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestNetworkBandwidthValidate(t *testing.T) {
+	for _, test := range []struct {
+		b  NetworkBandwidth
+		ok bool
+	}{
+		{NetworkBandwidth{Rate: "10mbit", Image: "netshoot"}, true},
+		{NetworkBandwidth{Rate: "1.5gbit", Burst: "128kb", Image: "netshoot"}, true},
+		{NetworkBandwidth{Rate: "100kbps", Burst: "1mbit", Image: "netshoot"}, true},
+		{NetworkBandwidth{Rate: "10mbit"}, false},
+		{NetworkBandwidth{Rate: "fast", Image: "netshoot"}, false},
+		{NetworkBandwidth{Rate: "10", Image: "netshoot"}, false},
+		{NetworkBandwidth{Rate: "10mbit", Burst: "lots", Image: "netshoot"}, false},
+	} {
+		if err := test.b.validate(); (err == nil) != test.ok {
+			t.Errorf("%+v.validate() = %v, want ok %v", test.b, err, test.ok)
+		}
+	}
+}
+
+func TestNetworkBandwidthArgs(t *testing.T) {
+	for _, test := range []struct {
+		b    NetworkBandwidth
+		args string
+	}{
+		{NetworkBandwidth{Rate: "10mbit", Image: "netshoot"},
+			"run --rm --net container:jail-id --cap-add NET_ADMIN netshoot tc qdisc replace dev eth0 root tbf rate 10mbit burst 64kb latency 400ms"},
+		{NetworkBandwidth{Rate: "1gbit", Burst: "1mb", Image: "iproute2"},
+			"run --rm --net container:jail-id --cap-add NET_ADMIN iproute2 tc qdisc replace dev eth0 root tbf rate 1gbit burst 1mb latency 400ms"},
+	} {
+		if args := strings.Join(test.b.args("jail-id"), " "); args != test.args {
+			t.Errorf("%+v.args() = %q, want %q", test.b, args, test.args)
+		}
+	}
+}
+
+// An ephemeral jail's bandwidth is limited before its gate is opened, so
+// nothing runs in it unlimited.
+func TestOpenJailLimitsBandwidth(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		tc    string
+		calls []string
+	}{
+		{"limited", "", []string{"inspect", "run", "exec"}},
+		{"tc failed", "exit 1", []string{"inspect", "run"}},
+	} {
+		log := fakeDocker(t, `case "$1" in
+inspect) echo true;;
+run) `+test.tc+`;;
+esac
+`)
+		w := testJailWarden()
+		w.jail.NetworkBandwidth = &NetworkBandwidth{Rate: "10mbit", Image: "netshoot"}
+		err := w.openJail(&session{log: logger("test")}, "jail-id")
+		if (err == nil) != (test.tc == "") {
+			t.Errorf("%s: openJail = %v", test.name, err)
+		}
+		b, err := ioutil.ReadFile(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var calls []string
+		for _, call := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			calls = append(calls, strings.Fields(call)[0])
+		}
+		if strings.Join(calls, " ") != strings.Join(test.calls, " ") {
+			t.Errorf("%s: openJail ran docker %q, want %q", test.name, calls, test.calls)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package warden
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// limitsBanner describes the limits a session runs under, or returns "" if
+// it has none.
+func limitsBanner(profile Profile, expires time.Time) string {
+	var limits []string
+	if profile.Memory != "" {
+		limits = append(limits, "memory "+profile.Memory)
+	}
+	if profile.CPUs != "" {
+		limits = append(limits, "cpus "+profile.CPUs)
+	}
+	if !expires.IsZero() {
+		left := expires.Sub(time.Now()).Round(time.Minute)
+		limits = append(limits, fmt.Sprintf("access until %s (%s left)", expires.Format(time.RFC1123), left))
+	}
+	if len(limits) == 0 {
+		return ""
+	}
+	return "Session limits: " + strings.Join(limits, ", ") + ".\r\n"
+}
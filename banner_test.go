@@ -0,0 +1,55 @@
+package warden
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLimitsBanner(t *testing.T) {
+	if banner := limitsBanner(Profile{}, time.Time{}); banner != "" {
+		t.Errorf("Banner without limits = %q", banner)
+	}
+	if banner, want := limitsBanner(Profile{Memory: "512m", CPUs: "2"}, time.Time{}), "Session limits: memory 512m, cpus 2.\r\n"; banner != want {
+		t.Errorf("limitsBanner = %q, want %q", banner, want)
+	}
+	expires := time.Now().Add(90*time.Minute + 10*time.Second)
+	banner := limitsBanner(Profile{Memory: "1g"}, expires)
+	if want := "memory 1g, access until " + expires.Format(time.RFC1123) + " (1h30m0s left)"; !strings.Contains(banner, want) {
+		t.Errorf("limitsBanner = %q, want it to contain %q", banner, want)
+	}
+}
+
+func TestLimitsBannerSession(t *testing.T) {
+	if !ptysAvailable() {
+		t.Skip("No ptys available")
+	}
+	fakeDocker(t, jailDocker)
+	_, addr := startWarden(t, Config{LimitsBanner: true, Jail: Jail{Profile: Profile{Memory: "512m", CPUs: "0.5"}}})
+	const want = "Session limits: memory 512m, cpus 0.5."
+	for _, pty := range []bool{true, false} {
+		s, err := dialWarden(t, addr, "alice").NewSession()
+		if err != nil {
+			t.Fatal("NewSession:", err)
+		}
+		if pty {
+			if err := s.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+				t.Fatal("RequestPty:", err)
+			}
+		}
+		var out syncBuffer
+		s.Stdout, s.Stderr = &out, &out
+		if err := s.Shell(); err != nil {
+			t.Fatal("Shell:", err)
+		}
+		s.Wait()
+		if got := strings.Contains(out.String(), want); got != pty {
+			t.Errorf("Pty %v: session printed %q, want banner %v", pty, out.String(), pty)
+		}
+		if !strings.Contains(out.String(), "session in id-") {
+			t.Errorf("Pty %v: session printed %q, want the shell's output", pty, out.String())
+		}
+	}
+}
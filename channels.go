@@ -0,0 +1,39 @@
+package warden
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// disabledChannelTypes are the channel types of SSH features warden doesn't
+// provide, such as port and agent forwarding. Clients asking for them are
+// told the feature is disabled rather than unknown.
+var disabledChannelTypes = map[string]bool{
+	"direct-tcpip":                      true,
+	"forwarded-tcpip":                   true,
+	"x11":                               true,
+	"auth-agent@openssh.com":            true,
+	"direct-streamlocal@openssh.com":    true,
+	"forwarded-streamlocal@openssh.com": true,
+	"tun@openssh.com":                   true,
+}
+
+// rejectChannel refuses a channel of a type other than session, with the
+// configured message for its type if there is one.
+func (w *Warden) rejectChannel(l logger, newChan ssh.NewChannel) {
+	channelType := newChan.ChannelType()
+	l.Printf("Rejected %s channel", channelType)
+	message, configured := w.channelRejections[channelType]
+	switch {
+	case disabledChannelTypes[channelType]:
+		if !configured {
+			message = fmt.Sprintf("%s is disabled on this server", channelType)
+		}
+		newChan.Reject(ssh.Prohibited, message)
+	case configured:
+		newChan.Reject(ssh.Prohibited, message)
+	default:
+		newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+	}
+}
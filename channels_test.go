@@ -0,0 +1,47 @@
+package warden
+
+import (
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRejectChannel(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	fakeDocker(t, jailDocker)
+	_, addr := startWarden(t, Config{ChannelRejections: map[string]string{
+		"x11":            "X11 forwarding is not allowed",
+		"custom@example": "Ask the admins",
+	}})
+	client := dialWarden(t, addr, "alice")
+	for _, test := range []struct {
+		channelType string
+		reason      ssh.RejectionReason
+		message     string
+	}{
+		{"direct-tcpip", ssh.Prohibited, "direct-tcpip is disabled on this server"},
+		{"auth-agent@openssh.com", ssh.Prohibited, "auth-agent@openssh.com is disabled on this server"},
+		{"x11", ssh.Prohibited, "X11 forwarding is not allowed"},
+		{"custom@example", ssh.Prohibited, "Ask the admins"},
+		{"bogus", ssh.UnknownChannelType, "unknown channel type"},
+	} {
+		_, _, err := client.OpenChannel(test.channelType, nil)
+		rejection, ok := err.(*ssh.OpenChannelError)
+		if !ok || rejection.Reason != test.reason || rejection.Message != test.message {
+			t.Errorf("Opening a %s channel = %v, want %v %q", test.channelType, err, test.reason, test.message)
+		}
+		if !strings.Contains(logs.String(), "Rejected "+test.channelType+" channel") {
+			t.Errorf("Rejecting a %s channel wasn't logged", test.channelType)
+		}
+	}
+	// Sessions still work on the same connection.
+	if out, err := runShell(t, client, nil); err != nil || !strings.HasPrefix(out, "session in id-") {
+		t.Errorf("Session after rejected channels = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,70 @@
+package warden
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// cleanupDocker fakes docker rm, taking a moment per jail and recording in
+// $FAKE_DIR/counts how many removals were running as each started. Jails
+// with IDs starting "bad" fail to be removed.
+const cleanupDocker = `[ "$1" = rm ] || exit 0
+mkdir -p "$FAKE_DIR/running"
+touch "$FAKE_DIR/running/$3"
+ls "$FAKE_DIR/running" | wc -l >> "$FAKE_DIR/counts"
+sleep 0.1
+rm "$FAKE_DIR/running/$3"
+case "$3" in bad*) echo "Error: No such container: $3" >&2; exit 1;; esac
+`
+
+func TestCleanup(t *testing.T) {
+	log := fakeDocker(t, cleanupDocker)
+	w := &Warden{jails: make(map[string]string), cleanupWorkers: 3}
+	var want []string
+	for i := 0; i < 12; i++ {
+		id := fmt.Sprintf("jail-%02d", i)
+		w.jails[fmt.Sprintf("user%d", i)] = id
+		want = append(want, "rm -f "+id)
+	}
+	if err := w.Cleanup(); err != nil {
+		t.Fatal("Cleanup failed:", err)
+	}
+	removes := dockerCalls(t, log, "rm")
+	sort.Strings(removes)
+	if strings.Join(removes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Removed %q, want every jail removed once", removes)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(os.Getenv("FAKE_DIR"), "counts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	max := 0
+	for _, field := range strings.Fields(string(b)) {
+		if n, _ := strconv.Atoi(field); n > max {
+			max = n
+		}
+	}
+	if max < 2 || max > 3 {
+		t.Errorf("Up to %d jails removed at once, want 2 or 3 with 3 workers", max)
+	}
+}
+
+func TestCleanupFailures(t *testing.T) {
+	fakeDocker(t, cleanupDocker)
+	w := &Warden{jails: map[string]string{"alice": "bad-1", "bob": "jail-1", "carol": "bad-2"}, cleanupWorkers: 8}
+	err := w.Cleanup()
+	if err == nil || !strings.Contains(err.Error(), "Failed to remove 2 of 3 jails") {
+		t.Fatalf("Cleanup = %v, want both failures reported", err)
+	}
+	for _, id := range []string{"bad-1", "bad-2"} {
+		if !strings.Contains(err.Error(), "No such container: "+id) {
+			t.Errorf("Cleanup error %q doesn't explain why %s wasn't removed", err, id)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package warden
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var versionNumberRegexp = regexp.MustCompile(`^\d+(\.\d+)*`)
+
+func validateMinClientVersions(versions map[string]string) error {
+	for software, version := range versions {
+		if software == "" || !versionNumberRegexp.MatchString(version) {
+			return fmt.Errorf("Invalid minClientVersions entry %q: %q", software, version)
+		}
+	}
+	return nil
+}
+
+// checkClientVersion rejects clients that don't speak SSH 2, or run older
+// software than the configured minimum for it. The software is identified
+// from version strings like "SSH-2.0-OpenSSH_7.4p1 Debian-10".
+func (w *Warden) checkClientVersion(clientVersion string) error {
+	var software string
+	switch {
+	case strings.HasPrefix(clientVersion, "SSH-2.0-"):
+		software = clientVersion[len("SSH-2.0-"):]
+	case strings.HasPrefix(clientVersion, "SSH-1.99-"):
+		software = clientVersion[len("SSH-1.99-"):]
+	default:
+		return fmt.Errorf("Client %q does not support SSH 2", clientVersion)
+	}
+	software = strings.SplitN(software, " ", 2)[0]
+	parts := strings.SplitN(software, "_", 2)
+	min, ok := w.minClientVersions[parts[0]]
+	if !ok {
+		return nil
+	}
+	if len(parts) < 2 || compareVersions(parts[1], min) < 0 {
+		return fmt.Errorf("Client %s is older than the minimum supported version, %s %s", software, parts[0], min)
+	}
+	return nil
+}
+
+// compareVersions compares the dotted version numbers at the start of a and
+// b, ignoring suffixes such as "p1".
+func compareVersions(a, b string) int {
+	as := strings.Split(versionNumberRegexp.FindString(a), ".")
+	bs := strings.Split(versionNumberRegexp.FindString(b), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
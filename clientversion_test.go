@@ -0,0 +1,47 @@
+package warden
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want int
+	}{
+		{"7.4", "7.4", 0},
+		{"7.4p1", "7.4", 0},
+		{"7.4", "7.10", -1},
+		{"8.0", "7.9", 1},
+		{"7", "7.0", 0},
+		{"7.0.1", "7", 1},
+		{"0.48", "0.70", -1},
+		{"", "1", -1},
+	} {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestCheckClientVersion(t *testing.T) {
+	w := &Warden{minClientVersions: map[string]string{"OpenSSH": "7.4", "PuTTY": "0.70"}}
+	for _, test := range []struct {
+		version string
+		ok      bool
+	}{
+		{"SSH-2.0-OpenSSH_7.4p1 Debian-10", true},
+		{"SSH-2.0-OpenSSH_8.9", true},
+		{"SSH-2.0-OpenSSH_7.3", false},
+		{"SSH-2.0-OpenSSH", false},
+		{"SSH-1.99-OpenSSH_7.4", true},
+		{"SSH-2.0-PuTTY_0.69", false},
+		{"SSH-2.0-PuTTY_Release_0.70", false},
+		{"SSH-2.0-Go", true},
+		{"SSH-1.5-OpenSSH_7.4", false},
+		{"garbage", false},
+	} {
+		err := w.checkClientVersion(test.version)
+		if (err == nil) != test.ok {
+			t.Errorf("checkClientVersion(%q) = %v, want ok=%v", test.version, err, test.ok)
+		}
+	}
+}
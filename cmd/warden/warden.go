@@ -5,8 +5,6 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"os/signal"
-	"syscall"
 
 	"github.com/BrianBland/warden"
 )
@@ -25,20 +23,20 @@ func main() {
 	if err != nil {
 		log.Fatalln("Failed to parse config file:", err)
 	}
+	// Shut down on SIGINT or SIGTERM by removing jails before Run returns
+	// nil. Sessions are drained as the config says if it asks for
+	// handleSignals, and otherwise closed straight away as they always
+	// have been, so that a signal doesn't wait for them indefinitely.
+	if !config.HandleSignals {
+		config.HandleSignals = true
+		config.DrainPolicy.Order = "immediate"
+	}
 	w, err := warden.New(config)
 	if err != nil {
 		log.Fatalln("Failed to create warden:", err)
 	}
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		for range signalChan {
-			log.Println("Received an interrupt, stopping warden...")
-			w.Cleanup()
-			os.Exit(1)
-		}
-	}()
-
-	w.Run()
+	if err := w.Run(); err != nil {
+		log.Fatalln("Failed to run warden:", err)
+	}
 }
@@ -1,12 +1,565 @@
 package warden
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
 type Config struct {
-	Addr        string   `json:"addr"`
-	PrivateKeys []string `json:"privateKeys"`
-	Jail        Jail     `json:"jail"`
+	Addr string `json:"addr"`
+	// ProxyProtocol expects every connection to start with a PROXY
+	// protocol header, as sent by load balancers, carrying the client's
+	// address. Only enable it behind such a load balancer.
+	ProxyProtocol bool `json:"proxyProtocol"`
+	// TLS additionally serves SSH wrapped in TLS, for clients on networks
+	// that only allow TLS out.
+	TLS *TLSListener `json:"tls"`
+	// MaxConnections caps how many connections are handled at once.
+	// Connections beyond it are closed as soon as they are accepted. Zero is
+	// unlimited.
+	MaxConnections int `json:"maxConnections"`
+	// AdminSocket is the path of a unix socket serving the current sessions
+	// at /sessions and stats at /stats as JSON, for operators to query with
+	// curl --unix-socket. Only the user warden runs as may connect to it.
+	AdminSocket string          `json:"adminSocket"`
+	PrivateKeys []string        `json:"privateKeys"`
+	Jail        Jail            `json:"jail"`
+	Users       map[string]User `json:"users"`
+	// UsernameMap derives the account names used inside jails from SSH
+	// usernames. Local usernames are up to 32 letters, digits, '.', '_' and
+	// '-', not starting with '.' or '-', and logins mapping to any other
+	// are rejected.
+	UsernameMap UsernameMap `json:"usernameMap"`
+	// Tenants limit the users that belong to them collectively.
+	Tenants map[string]Tenant `json:"tenants"`
+	// Profiles are named sets of jail settings that users can be given.
+	Profiles map[string]Profile `json:"profiles"`
+	// CopyBufferSize is the size in bytes of the pooled buffers used to copy
+	// session IO. Defaults to 32KB.
+	CopyBufferSize int `json:"copyBufferSize"`
+	// LogSampling logs only one in every n routine events of a category
+	// ("auth", "connection" or "session"). Errors are always logged.
+	LogSampling map[string]int `json:"logSampling"`
+	// Expires is a time after which all sessions are closed and no more
+	// are started. Users may have an earlier expiry of their own.
+	Expires time.Time `json:"expires"`
+	// HealthCheckInterval is how often the docker daemon is checked. While
+	// it is unreachable, new sessions are refused. Zero disables the check.
+	HealthCheckInterval Duration `json:"healthCheckInterval"`
+	// Instance identifies this warden in the warden.instance label of its
+	// jails. Defaults to the hostname.
+	Instance string `json:"instance"`
+	// SweepInterval is how often exited jails of this instance that are
+	// older than SweepAge are removed. Zero disables the sweep. SweepAge
+	// must be positive when it is enabled.
+	SweepInterval Duration `json:"sweepInterval"`
+	SweepAge      Duration `json:"sweepAge"`
+	// ImageGCInterval is how often images that this instance's jails were
+	// created from, that no container uses, and that were created more than
+	// ImageGCAge ago, are removed. This cleans up earlier versions of images
+	// whose tags have moved. Other images are left alone, and the configured
+	// images themselves are never removed. Zero disables image garbage
+	// collection.
+	ImageGCInterval Duration `json:"imageGCInterval"`
+	ImageGCAge      Duration `json:"imageGCAge"`
+	// HangupGrace is how long a closing session's processes have to exit
+	// after being sent SIGHUP before they are killed. Defaults to 5s.
+	HangupGrace Duration `json:"hangupGrace"`
+	// WriteTimeout is how long writing a session's output to the client may
+	// block before the client is assumed to have stopped reading, and its
+	// connection is closed. Zero waits indefinitely.
+	WriteTimeout Duration `json:"writeTimeout"`
+	// MaxDockerOps caps how many docker commands creating, starting or
+	// removing containers run at once. Further ones wait for a free slot.
+	// Zero is unlimited.
+	MaxDockerOps int `json:"maxDockerOps"`
+	// RunAsUser and RunAsGroup are the user and group warden switches to
+	// once it is listening, so that it only needs root to bind a privileged
+	// port. The user's supplementary groups are kept, so it should be in the
+	// docker group. RunAsGroup defaults to the user's primary group.
+	RunAsUser  string `json:"runAsUser"`
+	RunAsGroup string `json:"runAsGroup"`
+	// ShutdownMessage is sent to clients that connect once warden has begun
+	// shutting down, e.g. "warden is restarting, please try again shortly".
+	// Empty closes their connections without a handshake.
+	ShutdownMessage string `json:"shutdownMessage"`
+	// MintCredentials, when set by programs embedding warden, issues
+	// credentials for each session before its jail starts. Sessions are
+	// refused if it fails.
+	MintCredentials MintCredentialsFunc `json:"-"`
+	// Authenticator, when set by programs embedding warden, decides which
+	// clients may log in, in place of accepting any public key. Clients are
+	// also offered password authentication.
+	Authenticator Authenticator `json:"-"`
+	// SessionStore, when set by programs embedding warden, is sent a record
+	// of every session when it starts and when it ends.
+	SessionStore SessionStore `json:"-"`
+	// AcceptEnv lists the env variables clients may set in their jails, as
+	// names optionally ending in a * wildcard. Variables that change how
+	// commands are found or loaded, such as PATH and LD_*, are refused even
+	// if accepted unless AllowDangerousEnv is set. Accepting TZ lets users
+	// set their jail's time zone, which must be one the host knows.
+	AcceptEnv         []string `json:"acceptEnv"`
+	AllowDangerousEnv bool     `json:"allowDangerousEnv"`
+	// FingerprintEnv names an env variable set in jails to the fingerprint
+	// of the public key the client authenticated with, e.g.
+	// "WARDEN_FINGERPRINT", so that tools in the jail can tell apart keys
+	// logging in as the same user. Empty doesn't set it.
+	FingerprintEnv string `json:"fingerprintEnv"`
+	// AllowDockerSocketMount permits mounting the docker socket, or a
+	// directory containing it, into jails. That gives jail users root on
+	// the host, so it is refused unless this is set.
+	AllowDockerSocketMount bool `json:"allowDockerSocketMount"`
+	// AllowVolumesFrom permits jail.volumesFrom, which can expose data
+	// across jails.
+	AllowVolumesFrom bool `json:"allowVolumesFrom"`
+	// SecurityLog logs a record of every connection attempt, including
+	// failed ones, with the client's version, the authentication methods
+	// and keys it tried, the algorithms its handshake negotiated, and how
+	// long the handshake took. It is never sampled.
+	SecurityLog bool `json:"securityLog"`
+	// LimitsBanner shows users with a terminal the memory and cpu limits of
+	// their jail and when their access expires, before their shell starts.
+	LimitsBanner bool `json:"limitsBanner"`
+	// TermMap replaces terminal types requested by clients with ones their
+	// jails support, e.g. {"xterm-kitty": "xterm-256color"}. If AllowedTerms
+	// is set, other types not matching any of its names, which may end in a
+	// * wildcard, are replaced by DefaultTerm, which defaults to "xterm".
+	TermMap      map[string]string `json:"termMap"`
+	AllowedTerms []string          `json:"allowedTerms"`
+	DefaultTerm  string            `json:"defaultTerm"`
+	// MinClientVersions refuses sessions to clients running older versions
+	// of the named SSH software, e.g. {"OpenSSH": "7.4"}. Clients running
+	// other software are allowed. Clients that don't speak SSH 2 are always
+	// refused.
+	MinClientVersions map[string]string `json:"minClientVersions"`
+	// Ciphers, MACs and KeyExchanges limit the algorithms warden offers, so
+	// that clients which don't support any of them can't connect. Empty
+	// offers every algorithm warden supports.
+	Ciphers      []string `json:"ciphers"`
+	MACs         []string `json:"macs"`
+	KeyExchanges []string `json:"keyExchanges"`
+	// FIPSMode only offers FIPS approved ciphers, MACs and key exchanges,
+	// and refuses to start with host keys that aren't approved. Configured
+	// algorithms must all be approved. It doesn't make the implementations
+	// of the algorithms FIPS validated.
+	FIPSMode bool `json:"fipsMode"`
+	// AllowedRegistries lists the registry hosts, e.g. "ghcr.io" or
+	// "registry.internal:5000", jail images may come from. Images without a
+	// registry, such as "ubuntu", are from "docker.io". Empty allows every
+	// registry.
+	AllowedRegistries []string `json:"allowedRegistries"`
+	// RegistryAuth holds credentials for pulling jail images, keyed by
+	// registry host, e.g. "ghcr.io", or "docker.io" for Docker Hub.
+	// Images from other registries are pulled with docker's own config.
+	RegistryAuth map[string]RegistryAuth `json:"registryAuth"`
+	// CleanupWorkers is how many jails Cleanup removes at once. Defaults to
+	// 8. maxDockerOps, if lower, still applies.
+	CleanupWorkers int `json:"cleanupWorkers"`
+	// NegotiationTimeout limits how long clients have from connecting to
+	// first trying to authenticate, which unauthenticated clients can't
+	// stretch. AuthTimeout then limits how long they have to finish
+	// authenticating, which can be more generous, e.g. for a second factor.
+	// Zero disables either limit.
+	NegotiationTimeout Duration `json:"negotiationTimeout"`
+	AuthTimeout        Duration `json:"authTimeout"`
+	// KeepOpenOnEOF keeps sessions open when clients finish sending input,
+	// as with "ssh host < script", passing the end of input on to the jail
+	// and sending its output until it exits. Otherwise sessions close as
+	// soon as their input ends.
+	KeepOpenOnEOF bool `json:"keepOpenOnEOF"`
+	// VerifyLimits inspects every new jail and warns if its memory and cpus
+	// limits aren't the ones requested, e.g. because the host lacks the
+	// cgroup support they need and docker discarded them.
+	VerifyLimits bool `json:"verifyLimits"`
+	// HandleSignals makes Run shut down gracefully on SIGINT or SIGTERM,
+	// waiting for sessions to end and removing jails before it returns.
+	// A second signal stops waiting for sessions. Leave it off when the
+	// program embedding warden handles signals itself. The warden command
+	// always shuts down this way, but without handleSignals in its config
+	// it closes sessions immediately rather than following DrainPolicy.
+	HandleSignals bool `json:"handleSignals"`
+	// DrainPolicy is how HandleSignals ends the sessions still running.
+	DrainPolicy DrainPolicy `json:"drainPolicy"`
+	// CreateRetries retries creating jails after transient docker errors.
+	// Nil fails sessions on the first error.
+	CreateRetries *CreateRetries `json:"createRetries"`
+	// WindowBounds are the smallest and largest terminal sizes jails get,
+	// whatever size clients ask for.
+	WindowBounds WindowBounds `json:"windowBounds"`
+	// LoadScaling limits each new jail to a share of memory and cpus
+	// budgets, which shrinks as more jails run. Nil uses the profiles'
+	// limits.
+	LoadScaling *LoadScaling `json:"loadScaling"`
+	// ChannelRejections are the messages clients are sent when they open
+	// a channel of one of these types, e.g. {"direct-tcpip": "Port
+	// forwarding is not allowed, see https://wiki/jails"}. Port, agent and
+	// X11 forwarding are otherwise reported as disabled, and other types as
+	// unknown.
+	ChannelRejections map[string]string `json:"channelRejections"`
+	// UsageWarnings warns users with a terminal when their jail nears its
+	// memory or cpus limit. Nil disables the warnings.
+	UsageWarnings *UsageWarnings `json:"usageWarnings"`
+	// ReconnectCooldown refuses clients that keep reconnecting and
+	// disconnecting for a while. Nil disables it.
+	ReconnectCooldown *ReconnectCooldown `json:"reconnectCooldown"`
+}
+
+type TLSListener struct {
+	Addr     string `json:"addr"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
 }
 
 type Jail struct {
-	Image      string `json:"image"`
-	Persistent bool   `json:"persistent"`
+	// Profile holds the default env, mounts and limits for every jail.
+	Profile
+	Image string `json:"image"`
+	// FallbackImage is used when docker fails to pull Image or to create or
+	// start a jail from it, e.g. during a registry outage. It isn't used for
+	// images warden refuses, e.g. from a registry that isn't allowed. Empty
+	// disables the fallback.
+	FallbackImage string `json:"fallbackImage"`
+	Persistent    bool   `json:"persistent"`
+	// SharedEphemeral makes a user's concurrent sessions share one jail, as
+	// persistent jails do, which is removed once the last of them closes.
+	SharedEphemeral bool `json:"sharedEphemeral"`
+	// NamedJails lets users keep several persistent jails, choosing one by
+	// name with a WARDEN_JAIL env request, e.g. "ssh -o SetEnv=WARDEN_JAIL=work".
+	// Names are lowercase letters, digits, - and _. Sessions that don't
+	// choose one use the user's unnamed jail.
+	NamedJails bool `json:"namedJails"`
+	// MaxNamedJails caps how many named jails each user may keep, besides
+	// their unnamed one. Defaults to 5.
+	MaxNamedJails int `json:"maxNamedJails"`
+	// Command is run instead of a shell in jails whose image has none, such
+	// as distroless images, e.g. ["/app/console"]. It runs as the image's
+	// user, without the usual account setup. Without it, sessions are
+	// refused for such images. Only ephemeral jails support it.
+	Command []string `json:"command"`
+	// HomeVolume names a docker volume mounted as the user's home directory.
+	// It is a template rendered against SessionInfo, so that
+	// "warden-home-{{.Fingerprint}}" gives every authenticating key its own
+	// volume even when several keys log in as the same user. Deployments
+	// with volumes named after the SSH user can keep them by using
+	// "warden-home-{{.User}}", or migrate by copying each volume's contents
+	// into its identity-keyed replacement. Persistent jails are shared per
+	// username, so they mount the volume of the session that created them.
+	// Empty disables home volumes.
+	HomeVolume string `json:"homeVolume"`
+	// ChownHome gives the jail user ownership of everything in their home
+	// volume, which may have been created by a different UID. Leave it off
+	// for volumes intentionally shared between users.
+	ChownHome bool `json:"chownHome"`
+	// UserGroups are supplementary groups the jail user is added to, if they
+	// exist in the image.
+	UserGroups []string `json:"userGroups"`
+	// CommandAudit is a file inside the jail that every command run at the
+	// user's interactive bash prompt is appended to. It is owned by root and
+	// only root can read or write it, so users can't remove what has been
+	// recorded, and it can be collected from persistent jails or a mounted
+	// volume. This is best effort: users can evade it by unsetting
+	// PROMPT_COMMAND, running another shell, or running commands
+	// non-interactively, and can add misleading records of their own.
+	CommandAudit string `json:"commandAudit"`
+	// Labels are applied to every jail container. Values are templates
+	// rendered against the session's SessionInfo, e.g. "{{.Tenant}}".
+	Labels map[string]string `json:"labels"`
+	// CgroupParent places every jail under a cgroup, e.g. "/warden" with
+	// the cgroupfs driver or "warden.slice" with systemd, so that host level
+	// limits apply to all jails collectively. Empty uses docker's default.
+	CgroupParent string `json:"cgroupParent"`
+	// SeccompProfile is the path to a JSON seccomp profile applied to every
+	// jail, or "unconfined" to disable seccomp filtering entirely. Empty
+	// uses docker's default profile.
+	SeccompProfile string `json:"seccompProfile"`
+	// PersistHistory keeps the bash history of each persistent jail,
+	// including each of a user's named jails, in HistoryDir on the host,
+	// copying it into the jail when its first session starts and back out
+	// when its last session ends. It is for users without a home volume,
+	// and requires persistent jails. HistoryDir defaults to
+	// /var/lib/warden/history and must be writable by warden.
+	PersistHistory bool   `json:"persistHistory"`
+	HistoryDir     string `json:"historyDir"`
+	// VerifySignature refuses to create jails from images, including the
+	// fallback image, that aren't signed with the policy's key. Jails are
+	// created from the digest that was verified rather than the image's
+	// tag. Nil disables verification.
+	VerifySignature *SignaturePolicy `json:"verifySignature"`
+	// Detachable runs each user's shell in a tmux session inside their
+	// persistent jail. A dropped connection then only detaches from it, and
+	// the user's next session reattaches to whatever was still running.
+	// Concurrent sessions of a user share the tmux session, unless
+	// ResumeWindow is set. Images without tmux fall back to a plain shell.
+	Detachable bool `json:"detachable"`
+	// ResumeWindow gives each detachable session a tmux session of its
+	// own, which only the client that started it can resume, by
+	// reconnecting within the window with the resume token it was shown,
+	// e.g. "ssh -o SetEnv=WARDEN_RESUME=<token>". Sessions that aren't
+	// resumed in time are killed. Zero shares one tmux session between
+	// all of the user's sessions.
+	ResumeWindow Duration `json:"resumeWindow"`
+	// UsernsMode is passed to docker as --userns. User namespace remapping,
+	// which maps root in a jail to an unprivileged host UID, is enabled for
+	// the whole daemon with dockerd --userns-remap. The only mode docker
+	// accepts per container is "host", which opts jails out of it. Under
+	// remapping, files in home volumes are owned by the remapped UIDs on
+	// the host: volumes created before remapping was enabled need chownHome,
+	// or a one-off chown to the remapped range, before users can write to
+	// them. Empty uses the daemon's setting.
+	UsernsMode string `json:"usernsMode"`
+	// LogDriver and LogOpts configure how docker collects the output of
+	// jail containers, e.g. "journald" or "fluentd". This is separate from
+	// warden's own logs. Empty uses the daemon's default driver.
+	LogDriver string            `json:"logDriver"`
+	LogOpts   map[string]string `json:"logOpts"`
+	// Shell is the absolute path of the shell users get, if the image has
+	// it. Empty uses each user's login shell. Shells lists the other shells
+	// users may be given.
+	Shell  string   `json:"shell"`
+	Shells []string `json:"shells"`
+	// ShellArgs are flags the shell is started with when a client requests
+	// a shell, e.g. ["-l"] for a login shell. They aren't passed to shells
+	// started inside tmux for detachable jails.
+	ShellArgs []string `json:"shellArgs"`
+	// EnvTemplate is the path to a file setting env in every jail, with a
+	// NAME=value variable per line. It is a template rendered against the
+	// session's SessionInfo, e.g. "NAMESPACE=team-{{.Tenant}}". The profile's
+	// env takes precedence over it.
+	EnvTemplate string `json:"envTemplate"`
+	// HostEnv names variables of warden's own environment, such as
+	// http_proxy, that are passed on to jails. No others are, since warden
+	// only sets the variables it is given explicitly. The values are passed
+	// through the docker client's environment, so they don't appear in the
+	// host's process list.
+	HostEnv []string `json:"hostEnv"`
+	// Scratch gives each session temporary space that is removed when it
+	// ends. Nil disables it.
+	Scratch *Scratch `json:"scratch"`
+	// NetworkBandwidth limits the rate at which each jail sends network
+	// traffic, so that one jail can't saturate the host's uplink. Nil
+	// leaves it unlimited.
+	NetworkBandwidth *NetworkBandwidth `json:"networkBandwidth"`
+	// CreateHook is run on the host for every new jail before the user's
+	// shell starts, failing the session if it fails. Nil disables it.
+	CreateHook *CreateHook `json:"createHook"`
+	// ReadinessProbe holds back the user's shell until the jail is ready.
+	// Nil starts it straight away.
+	ReadinessProbe *ReadinessProbe `json:"readinessProbe"`
+	// VolumesFrom names containers, optionally followed by ":ro" or ":rw",
+	// whose volumes every jail gets, e.g. a data container shared by jails.
+	// Every jail sees the same volumes, so this requires allowVolumesFrom.
+	VolumesFrom []string `json:"volumesFrom"`
+	// AppArmorProfile is the name of a loaded AppArmor profile applied to
+	// every jail, or "unconfined" to disable AppArmor for them. Empty uses
+	// docker's default profile.
+	AppArmorProfile string `json:"appArmorProfile"`
+}
+
+// logDrivers are docker's built in log drivers. Plugin drivers are
+// referenced as "org/name".
+var logDrivers = map[string]bool{
+	"none": true, "local": true, "json-file": true, "syslog": true,
+	"journald": true, "gelf": true, "fluentd": true, "awslogs": true,
+	"splunk": true, "etwlogs": true, "gcplogs": true, "logentries": true,
+}
+
+var (
+	logOptRegexp   = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+	shellArgRegexp = regexp.MustCompile(`^--?[A-Za-z0-9][A-Za-z0-9-]*$`)
+)
+
+const seccompUnconfined = "unconfined"
+
+type User struct {
+	Tenant  string    `json:"tenant"`
+	Expires time.Time `json:"expires"`
+	// MaxSessions caps the user's concurrent sessions. Zero is unlimited.
+	MaxSessions int `json:"maxSessions"`
+	// Shell overrides the jail's shell for this user. It must be one of the
+	// jail's Shells.
+	Shell string `json:"shell"`
+	// Profile is applied to the user's jails by default. The user may
+	// instead choose one of Profiles by sending a WARDEN_PROFILE env
+	// request before starting the shell.
+	Profile  string   `json:"profile"`
+	Profiles []string `json:"profiles"`
+}
+
+// Duration is a time.Duration configured as a string, e.g. "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+var groupNameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+var cgroupParentRegexp = regexp.MustCompile(`^/?[A-Za-z0-9_.@:-]+(/[A-Za-z0-9_.@:-]+)*$`)
+
+// validateShells checks that users are only given allowed shells.
+func (j Jail) validateShells(users map[string]User) error {
+	for username, user := range users {
+		if user.Shell == "" || user.Shell == j.Shell {
+			continue
+		}
+		allowed := false
+		for _, shell := range j.Shells {
+			allowed = allowed || user.Shell == shell
+		}
+		if !allowed {
+			return fmt.Errorf("Shell %q for user %q is not one of the jail's shells", user.Shell, username)
+		}
+	}
+	return nil
+}
+
+// shared reports whether a user's sessions share a jail.
+func (j Jail) shared() bool {
+	return j.Persistent || j.SharedEphemeral
+}
+
+func (j Jail) validate() error {
+	for _, group := range j.UserGroups {
+		if !groupNameRegexp.MatchString(group) {
+			return fmt.Errorf("Invalid user group %q", group)
+		}
+	}
+	if j.CommandAudit != "" && !path.IsAbs(j.CommandAudit) {
+		return fmt.Errorf("Command audit file %q must be an absolute path", j.CommandAudit)
+	}
+	if j.CgroupParent != "" {
+		if !cgroupParentRegexp.MatchString(j.CgroupParent) || strings.Contains(j.CgroupParent, "..") {
+			return fmt.Errorf("Invalid cgroup parent %q", j.CgroupParent)
+		}
+	}
+	if j.SharedEphemeral && j.Persistent {
+		return errors.New("sharedEphemeral and persistent can't both be set")
+	}
+	if j.PersistHistory && !j.Persistent {
+		return errors.New("persistHistory requires persistent jails")
+	}
+	if j.UsernsMode != "" && j.UsernsMode != "host" {
+		return fmt.Errorf("Invalid userns mode %q, docker only accepts \"host\"", j.UsernsMode)
+	}
+	if j.LogDriver != "" && !logDrivers[j.LogDriver] && !strings.Contains(j.LogDriver, "/") {
+		return fmt.Errorf("Unknown log driver %q", j.LogDriver)
+	}
+	for opt := range j.LogOpts {
+		if !logOptRegexp.MatchString(opt) {
+			return fmt.Errorf("Invalid log option %q", opt)
+		}
+	}
+	for _, shell := range append(j.Shells, j.Shell) {
+		if shell != "" && !path.IsAbs(shell) {
+			return fmt.Errorf("Shell %q must be an absolute path", shell)
+		}
+	}
+	for _, arg := range j.ShellArgs {
+		if !shellArgRegexp.MatchString(arg) {
+			return fmt.Errorf("Invalid shell argument %q", arg)
+		}
+	}
+	if j.ResumeWindow < 0 || j.ResumeWindow > 0 && !j.Detachable {
+		return errors.New("resumeWindow requires detachable jails")
+	}
+	if j.NamedJails && !j.Persistent {
+		return errors.New("namedJails requires persistent jails")
+	}
+	if j.MaxNamedJails < 0 {
+		return fmt.Errorf("Invalid maxNamedJails %d", j.MaxNamedJails)
+	}
+	if j.Detachable && !j.Persistent {
+		return errors.New("detachable requires persistent jails")
+	}
+	if err := validateSeccompProfile(j.SeccompProfile); err != nil {
+		return err
+	}
+	if err := validateAppArmorProfile(j.AppArmorProfile); err != nil {
+		return err
+	}
+	if j.VerifySignature != nil {
+		if err := j.VerifySignature.validate(); err != nil {
+			return err
+		}
+	}
+	if j.Scratch != nil {
+		if err := j.Scratch.validate(); err != nil {
+			return err
+		}
+	}
+	if j.NetworkBandwidth != nil {
+		if err := j.NetworkBandwidth.validate(); err != nil {
+			return err
+		}
+	}
+	if j.CreateHook != nil {
+		if err := j.CreateHook.validate(); err != nil {
+			return err
+		}
+	}
+	if j.ReadinessProbe != nil {
+		if err := j.ReadinessProbe.validate(); err != nil {
+			return err
+		}
+	}
+	if len(j.Command) > 0 {
+		switch {
+		case j.shared():
+			return errors.New("Jail command requires ephemeral jails")
+		case j.CreateHook != nil || j.ReadinessProbe != nil:
+			return errors.New("Jail command can't be combined with createHook or readinessProbe, which need a shell in the jail")
+		case j.Command[0] == "":
+			return errors.New("Invalid empty jail command")
+		}
+	}
+	for _, name := range j.HostEnv {
+		if !envNameRegexp.MatchString(name) {
+			return fmt.Errorf("Invalid hostEnv variable name %q", name)
+		}
+	}
+	for _, from := range j.VolumesFrom {
+		if !volumesFromRegexp.MatchString(from) {
+			return fmt.Errorf("Invalid volumesFrom container %q", from)
+		}
+	}
+	if err := j.Profile.validate(); err != nil {
+		return fmt.Errorf("Invalid jail profile: %v", err)
+	}
+	return nil
+}
+
+func validateSeccompProfile(profile string) error {
+	switch profile {
+	case "":
+		return nil
+	case seccompUnconfined:
+		log.Println("WARNING: jails are running without seccomp filtering, every syscall is allowed")
+		return nil
+	}
+	profileBytes, err := ioutil.ReadFile(profile)
+	if err != nil {
+		return err
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(profileBytes, &v); err != nil {
+		return fmt.Errorf("Invalid seccomp profile %q: %v", profile, err)
+	}
+	return nil
 }
@@ -0,0 +1,87 @@
+package warden
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// CreateHook is a command run on the host for each new jail, once it has
+// started but before the user's shell runs in it, e.g. to attach it to more
+// networks or set up firewall rules for it. The jail's container ID is
+// passed as the last argument and in WARDEN_CONTAINER_ID.
+type CreateHook struct {
+	Command []string `json:"command"`
+	// Timeout bounds how long the jail may take to start and the hook to
+	// run. Defaults to 30s.
+	Timeout Duration `json:"timeout"`
+}
+
+func (h *CreateHook) validate() error {
+	if len(h.Command) == 0 || h.Command[0] == "" {
+		return errors.New("createHook requires a command")
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("Invalid createHook timeout %v", h.Timeout)
+	}
+	return nil
+}
+
+func (h *CreateHook) timeout() time.Duration {
+	if h.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(h.Timeout)
+}
+
+// runCreateHook runs the create hook for a jail that has been started.
+// Ephemeral jails are started along with the session, so the hook waits
+// for docker to report them running.
+func (w *Warden) runCreateHook(l logger, info SessionInfo, jailID string) error {
+	h := w.jail.CreateHook
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+	defer cancel()
+	if !w.jail.shared() {
+		if err := waitRunning(ctx, jailID); err != nil {
+			return err
+		}
+	}
+	args := append(append([]string{}, h.Command[1:]...), jailID)
+	cmd := exec.Command(h.Command[0], args...)
+	cmd.Env = append(os.Environ(),
+		"WARDEN_CONTAINER_ID="+jailID,
+		"WARDEN_USER="+info.User,
+		"WARDEN_SESSION_ID="+info.SessionID,
+	)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	// Kill everything the hook started when it times out, since anything
+	// left holding its output open would keep it from returning.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Create hook failed: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+	err := cmd.Wait()
+	close(exited)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("Create hook timed out after %v", h.timeout())
+		}
+		return fmt.Errorf("Create hook failed: %v: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package warden
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gateDocker fakes docker with ephemeral jails whose sessions wait for the
+// jail to be opened, as the jail script of a gated jail does.
+const gateDocker = `case "$1" in
+create) echo id-jail;;
+inspect) echo true;;
+start)
+  while [ ! -e "$FAKE_DIR/open" ]; do sleep 0.01; done
+  echo "session in id-jail";;
+exec) case "$*" in *" touch "*) touch "$FAKE_DIR/open";; esac;;
+esac
+`
+
+// testCreateHook writes a create hook that records how it was run in the
+// fake docker's log, and fails if $HOOK_FAIL is set or hangs if $HOOK_HANG
+// is.
+func testCreateHook(t *testing.T) *CreateHook {
+	path := filepath.Join(t.TempDir(), "hook")
+	script := `#!/bin/sh
+echo "hook $WARDEN_CONTAINER_ID $WARDEN_USER $*" >> "$FAKE_DIR/log"
+[ -z "$HOOK_FAIL" ] || { echo "network unreachable"; exit 1; }
+[ -z "$HOOK_HANG" ] || sleep 10
+`
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &CreateHook{Command: []string{path, "--network", "extra"}}
+}
+
+// callsBefore reports whether the first logged docker call starting with
+// first comes before the first starting with second.
+func callsBefore(t *testing.T, log, first, second string) bool {
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, j := strings.Index("\n"+string(b), "\n"+first), strings.Index("\n"+string(b), "\n"+second)
+	return i >= 0 && j >= 0 && i < j
+}
+
+func TestCreateHook(t *testing.T) {
+	log := fakeDocker(t, gateDocker)
+	_, addr := startWarden(t, Config{Jail: Jail{CreateHook: testCreateHook(t)}})
+	out, err := runShell(t, dialWarden(t, addr, "alice"), nil)
+	if err != nil || !strings.HasPrefix(out, "session in id-jail") {
+		t.Fatalf("Session = %q, %v", out, err)
+	}
+	if hooks := dockerCalls(t, log, "hook"); len(hooks) != 1 || hooks[0] != "hook id-jail alice --network extra id-jail" {
+		t.Errorf("Create hook ran as %q, want it run once with the jail's ID", hooks)
+	}
+	// The jail is opened for the user's shell once the hook has run.
+	if !callsBefore(t, log, "hook ", "exec id-jail touch ") {
+		t.Error("Jail was opened before the create hook ran")
+	}
+	waitRemoved(t, log)
+}
+
+// waitRemoved waits for an ephemeral jail to be removed after its session,
+// before the fake docker's directory is.
+func waitRemoved(t *testing.T, log string) {
+	for deadline := time.Now().Add(5 * time.Second); len(dockerCalls(t, log, "rm")) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Jail wasn't removed")
+		}
+	}
+}
+
+func TestCreateHookPersistent(t *testing.T) {
+	log := fakeDocker(t, jailDocker)
+	_, addr := startWarden(t, Config{Jail: Jail{Persistent: true, CreateHook: testCreateHook(t)}})
+	for i := 0; i < 2; i++ {
+		if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+			t.Fatal("Session failed:", err)
+		}
+	}
+	// The hook runs once, when the jail is created, before the first
+	// session's shell.
+	runs := dockerCalls(t, log, "run -d")
+	hooks := dockerCalls(t, log, "hook")
+	if len(runs) != 1 || len(hooks) != 1 {
+		t.Fatalf("Created jails %q and ran create hooks %q, want one of each", runs, hooks)
+	}
+	jailID := "id-" + regexp.MustCompile(`--name (\S+)`).FindStringSubmatch(runs[0])[1]
+	if hooks[0] != "hook "+jailID+" alice --network extra "+jailID {
+		t.Errorf("Create hook ran as %q, want it run with the jail's ID, %s", hooks[0], jailID)
+	}
+	if !callsBefore(t, log, "hook ", "exec ") {
+		t.Error("Session started before the create hook ran")
+	}
+}
+
+func TestCreateHookFailed(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	for _, test := range []struct {
+		env, err string
+	}{
+		{"HOOK_FAIL", "Create hook failed: exit status 1: network unreachable"},
+		{"HOOK_HANG", "Create hook timed out after 200ms"},
+	} {
+		dockerLog := fakeDocker(t, gateDocker)
+		t.Setenv(test.env, "1")
+		hook := testCreateHook(t)
+		hook.Timeout = Duration(200 * time.Millisecond)
+		_, addr := startWarden(t, Config{Jail: Jail{CreateHook: hook}, HangupGrace: Duration(100 * time.Millisecond)})
+		start := time.Now()
+		if out, err := runShell(t, dialWarden(t, addr, "alice"), nil); err == nil || strings.Contains(out, "session in") {
+			t.Errorf("%s: session = %q, %v, want it failed", test.env, out, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: session failed after %v", test.env, elapsed)
+		}
+		// The failure may be logged after the client sees it.
+		for deadline := time.Now().Add(5 * time.Second); !strings.Contains(logs.String(), test.err); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Errorf("%s: logged %q, want %q", test.env, logs.String(), test.err)
+				break
+			}
+		}
+		if opens := dockerCalls(t, dockerLog, "exec id-jail touch"); len(opens) != 0 {
+			t.Errorf("%s: jail opened after its create hook failed", test.env)
+		}
+		waitRemoved(t, dockerLog)
+		t.Setenv(test.env, "")
+	}
+}
+
+func TestCreateHookValidate(t *testing.T) {
+	for _, test := range []struct {
+		hook CreateHook
+		err  string
+	}{
+		{CreateHook{Command: []string{"/usr/local/bin/attach-network"}}, ""},
+		{CreateHook{}, "createHook requires a command"},
+		{CreateHook{Command: []string{""}}, "createHook requires a command"},
+		{CreateHook{Command: []string{"hook"}, Timeout: -1}, "Invalid createHook timeout"},
+	} {
+		err := test.hook.validate()
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v.validate() = %v, want %q", test.hook, err, test.err)
+		}
+	}
+	if timeout := (&CreateHook{}).timeout(); timeout != 30*time.Second {
+		t.Errorf("Default create hook timeout is %v", timeout)
+	}
+}
@@ -0,0 +1,79 @@
+package warden
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// deadlineAfter returns the time d from now, or no deadline if d is zero.
+func deadlineAfter(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// withDeadlines limits how long conn may take to negotiate a connection
+// before authenticating, and then how long it may take to authenticate. It
+// returns a copy of conf that moves conn on to the authentication deadline
+// once the client first tries to authenticate. The caller clears the
+// deadline once the handshake is done.
+func (w *Warden) withDeadlines(conn net.Conn, conf *ssh.ServerConfig) *ssh.ServerConfig {
+	conn.SetDeadline(deadlineAfter(w.negotiationTimeout))
+	var once sync.Once
+	authenticating := func() {
+		once.Do(func() { conn.SetDeadline(deadlineAfter(w.authTimeout)) })
+	}
+	c := *conf
+	if checkKey := conf.PublicKeyCallback; checkKey != nil {
+		c.PublicKeyCallback = func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			authenticating()
+			return checkKey(meta, key)
+		}
+	}
+	if checkPassword := conf.PasswordCallback; checkPassword != nil {
+		c.PasswordCallback = func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			authenticating()
+			return checkPassword(meta, password)
+		}
+	}
+	// Clients usually try the none method first, which doesn't call any of
+	// the callbacks above.
+	logAuth := conf.AuthLogCallback
+	c.AuthLogCallback = func(meta ssh.ConnMetadata, method string, err error) {
+		authenticating()
+		if logAuth != nil {
+			logAuth(meta, method, err)
+		}
+	}
+	return &c
+}
+
+// timeoutWriter closes conn when a write to w doesn't complete within
+// timeout, which unblocks the write. SSH flow control otherwise leaves
+// writes to a client that has stopped reading blocked forever.
+type timeoutWriter struct {
+	w       io.Writer
+	timeout time.Duration
+	expire  func()
+}
+
+func (w *Warden) timeoutWriter(l logger, conn ssh.Conn, ch io.Writer) io.Writer {
+	if w.writeTimeout <= 0 {
+		return ch
+	}
+	return timeoutWriter{ch, w.writeTimeout, func() {
+		l.Printf("Client did not read output for %v, closing connection", w.writeTimeout)
+		conn.Close()
+	}}
+}
+
+func (t timeoutWriter) Write(p []byte) (int, error) {
+	timer := time.AfterFunc(t.timeout, t.expire)
+	defer timer.Stop()
+	return t.w.Write(p)
+}
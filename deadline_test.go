@@ -0,0 +1,154 @@
+package warden
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// slowAuthenticator accepts any password after a delay, like a second
+// factor the user has to go and find.
+type slowAuthenticator time.Duration
+
+func (a slowAuthenticator) Authenticate(conn ssh.ConnMetadata, method string, cred []byte) (*ssh.Permissions, error) {
+	time.Sleep(time.Duration(a))
+	return nil, nil
+}
+
+func TestNegotiationTimeout(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	_, addr := startWarden(t, Config{NegotiationTimeout: Duration(200 * time.Millisecond), AuthTimeout: Duration(5 * time.Second)})
+	// A client that never negotiates is cut off.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ioutil.ReadAll(conn)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Connection that didn't negotiate was closed after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	for _, test := range []struct {
+		delay time.Duration
+		ok    bool
+	}{
+		// Slower than negotiation may take, but within the time allowed
+		// to authenticate.
+		{250 * time.Millisecond, true},
+		{800 * time.Millisecond, false},
+	} {
+		_, addr := startWarden(t, Config{
+			Authenticator:      slowAuthenticator(test.delay),
+			NegotiationTimeout: Duration(100 * time.Millisecond),
+			AuthTimeout:        Duration(400 * time.Millisecond),
+		})
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "alice", Auth: []ssh.AuthMethod{ssh.Password("123456")}})
+		if (err == nil) != test.ok {
+			t.Errorf("Authenticating for %v: Dial = %v, want ok %v", test.delay, err, test.ok)
+		}
+		if err != nil {
+			continue
+		}
+		// Sessions outlast both deadlines once the handshake is done.
+		time.Sleep(500 * time.Millisecond)
+		if _, err := runShell(t, client, nil); err != nil {
+			t.Errorf("Session after a slow login failed: %v", err)
+		}
+		client.Close()
+	}
+}
+
+// blockingConn is an ssh.Conn whose Close unblocks writes to a pipe nothing
+// reads.
+type blockingConn struct {
+	ssh.Conn
+	r *io.PipeReader
+}
+
+func (c blockingConn) Close() error {
+	return c.r.CloseWithError(errors.New("connection closed"))
+}
+
+func TestTimeoutWriter(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	w := &Warden{writeTimeout: 100 * time.Millisecond}
+	r, pw := io.Pipe()
+	tw := w.timeoutWriter(logger("session"), blockingConn{r: r}, pw)
+	go io.CopyN(ioutil.Discard, r, 5)
+	if n, err := tw.Write([]byte("hello")); n != 5 || err != nil {
+		t.Errorf("Write while the client reads = %d, %v", n, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if logs.String() != "" {
+		t.Errorf("Completed write logged %q", logs.String())
+	}
+
+	start := time.Now()
+	if _, err := tw.Write([]byte("unread")); err == nil {
+		t.Error("Write that was never read succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Blocked write returned after %v, want about 100ms", elapsed)
+	}
+	if !strings.Contains(logs.String(), "session Client did not read output for 100ms, closing connection") {
+		t.Errorf("Logged %q, want the connection closing explained", logs.String())
+	}
+
+	// Without a timeout, writes go straight to the channel.
+	if tw := (&Warden{}).timeoutWriter(logger("session"), blockingConn{r: r}, pw); tw != io.Writer(pw) {
+		t.Errorf("timeoutWriter without a timeout = %T", tw)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	log := fakeDocker(t, `case "$1" in
+create) echo id-jail;;
+inspect) echo true;;
+start) yes;;
+esac
+`)
+	_, addr := startWarden(t, Config{WriteTimeout: Duration(200 * time.Millisecond), HangupGrace: Duration(100 * time.Millisecond)})
+	client := dialWarden(t, addr, "alice")
+	// The client never reads the session's output, so once the channel's
+	// window is full, warden's writes block.
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal("OpenChannel:", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	if ok, err := ch.SendRequest("shell", true, nil); !ok || err != nil {
+		t.Fatalf("shell = %v, %v", ok, err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Connection of a client that stopped reading wasn't closed")
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(dockerCalls(t, log, "rm")) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Jail of a client that stopped reading wasn't removed")
+		}
+	}
+}
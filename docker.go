@@ -0,0 +1,73 @@
+package warden
+
+import (
+	"os/exec"
+	"sync"
+)
+
+// dockerOp waits for a free slot for a docker operation that creates,
+// starts or removes a container, and returns a function freeing it.
+// MaxDockerOps sets how many slots there are, so that a burst of sessions
+// doesn't overwhelm the daemon.
+func (w *Warden) dockerOp() (release func()) {
+	if w.dockerOps == nil {
+		return func() {}
+	}
+	w.dockerOps <- struct{}{}
+	return func() { <-w.dockerOps }
+}
+
+// containerOps are the docker commands that create, start or remove
+// containers.
+var containerOps = map[string]bool{"create": true, "run": true, "start": true, "rm": true}
+
+// dockerCmd is a docker command, run in a slot from dockerOp if it is one
+// of containerOps. Every docker command warden runs that creates, starts or
+// removes a container goes through it, or through startingJail for the
+// attached docker start of an ephemeral jail.
+type dockerCmd struct {
+	*exec.Cmd
+	w *Warden
+}
+
+func (w *Warden) docker(args ...string) dockerCmd {
+	return dockerCmd{exec.Command("docker", args...), w}
+}
+
+func (c dockerCmd) slot() (release func()) {
+	if len(c.Args) > 1 && containerOps[c.Args[1]] {
+		return c.w.dockerOp()
+	}
+	return func() {}
+}
+
+func (c dockerCmd) Run() error {
+	defer c.slot()()
+	return c.Cmd.Run()
+}
+
+func (c dockerCmd) Output() ([]byte, error) {
+	defer c.slot()()
+	return c.Cmd.Output()
+}
+
+func (c dockerCmd) CombinedOutput() ([]byte, error) {
+	defer c.slot()()
+	return c.Cmd.CombinedOutput()
+}
+
+// startingJail takes a slot for the attached docker start of an ephemeral
+// jail. The docker client runs for as long as the session does, so the slot
+// is freed once the jail has started or failed to, rather than when the
+// client exits. The returned function frees it early, for a client that
+// failed to run.
+func (w *Warden) startingJail(jailID string) (abort func()) {
+	var once sync.Once
+	release := w.dockerOp()
+	free := func() { once.Do(release) }
+	go func() {
+		waitStarted(jailID)
+		free()
+	}()
+	return free
+}
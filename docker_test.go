@@ -0,0 +1,95 @@
+package warden
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDockerOpBound(t *testing.T) {
+	const slots = 3
+	w := &Warden{dockerOps: make(chan struct{}, slots)}
+	var running, most int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := w.dockerOp()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			release()
+		}()
+	}
+	wg.Wait()
+	if most != slots {
+		t.Errorf("%d docker operations ran at once, want %d", most, slots)
+	}
+	if len(w.dockerOps) != 0 {
+		t.Errorf("%d slots weren't released", len(w.dockerOps))
+	}
+}
+
+func TestDockerOpUnbounded(t *testing.T) {
+	w := &Warden{}
+	var releases []func()
+	for i := 0; i < 100; i++ {
+		releases = append(releases, w.dockerOp())
+	}
+	for _, release := range releases {
+		release()
+	}
+}
+
+func TestDockerCmdSlots(t *testing.T) {
+	fakeDocker(t, "")
+	w := &Warden{dockerOps: make(chan struct{}, 1)}
+	release := w.dockerOp()
+	if err := w.docker("inspect", "jail").Run(); err != nil {
+		t.Fatal("Inspecting a jail without a free slot:", err)
+	}
+	for _, args := range [][]string{{"create", "ubuntu"}, {"run", "--rm", "ubuntu"}, {"start", "jail"}, {"rm", "-f", "jail"}} {
+		done := make(chan error, 1)
+		go func() {
+			_, err := w.docker(args...).CombinedOutput()
+			done <- err
+		}()
+		select {
+		case <-done:
+			t.Fatalf("docker %s ran without a free slot", args[0])
+		case <-time.After(20 * time.Millisecond):
+		}
+		release()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if len(w.dockerOps) != 0 {
+			t.Fatalf("docker %s didn't free its slot", args[0])
+		}
+		release = w.dockerOp()
+	}
+	release()
+}
+
+func TestStartingJail(t *testing.T) {
+	fakeDocker(t, `echo true`)
+	w := &Warden{dockerOps: make(chan struct{}, 1)}
+	w.startingJail("jail")
+	release := w.dockerOp()
+	release()
+	// A client that failed to run frees its slot right away.
+	fakeDocker(t, `echo false`)
+	abort := w.startingJail("jail")
+	abort()
+	abort()
+	release = w.dockerOp()
+	release()
+}
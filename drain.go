@@ -0,0 +1,114 @@
+package warden
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// drainWait waits for sessions to end by themselves.
+	drainWait = ""
+	// drainIdleFirst closes idle sessions, and waits for the others.
+	drainIdleFirst = "idle-first"
+	// drainImmediate closes every session.
+	drainImmediate = "immediate"
+)
+
+// DrainPolicy is how sessions still running when warden shuts down
+// gracefully are ended.
+type DrainPolicy struct {
+	// Order is "idle-first" to close sessions as soon as they are idle,
+	// "immediate" to close them all at once, or empty to wait for them to
+	// end.
+	Order string `json:"order"`
+	// IdleAfter is how long a session must go without input from its
+	// client to be idle. Defaults to 5m.
+	IdleAfter Duration `json:"idleAfter"`
+	// Notice is written to sessions when draining begins, e.g. "this
+	// server is restarting, please save your work".
+	Notice string `json:"notice"`
+	// Grace is how long to wait before closing the sessions left. Zero
+	// waits until they end.
+	Grace Duration `json:"grace"`
+}
+
+func (p DrainPolicy) validate() error {
+	switch p.Order {
+	case drainWait, drainIdleFirst, drainImmediate:
+	default:
+		return fmt.Errorf("Unknown drain order %q", p.Order)
+	}
+	if p.IdleAfter < 0 || p.Grace < 0 {
+		return fmt.Errorf("Invalid drain policy %+v", p)
+	}
+	return nil
+}
+
+// idleFor returns how long it has been since the session's client last
+// sent input.
+func (s *session) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastInput)))
+}
+
+// activityReader records when input is read from a session's client.
+type activityReader struct {
+	s *session
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.s.ch.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&r.s.lastInput, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// drain ends running sessions as the drain policy says, returning once
+// there are none left.
+func (w *Warden) drain() {
+	p := w.drainPolicy
+	idleAfter := time.Duration(p.IdleAfter)
+	if idleAfter == 0 {
+		idleAfter = 5 * time.Minute
+	}
+	if p.Notice != "" {
+		for _, s := range w.runningSessions() {
+			fmt.Fprintf(s.ch, "\r\nwarden: %s\r\n", p.Notice)
+		}
+	}
+	var deadline <-chan time.Time
+	if p.Grace > 0 {
+		deadline = time.After(time.Duration(p.Grace))
+	}
+	closing := make(map[*session]bool)
+	closeAll := p.Order == drainImmediate
+	for {
+		sessions := w.runningSessions()
+		if len(sessions) == 0 {
+			return
+		}
+		for _, s := range sessions {
+			if closing[s] {
+				continue
+			}
+			switch {
+			case closeAll:
+				s.log.Println("Closing session to shut down")
+			case p.Order == drainIdleFirst && s.idleFor() >= idleAfter:
+				s.log.Println("Closing idle session to shut down")
+			default:
+				continue
+			}
+			closing[s] = true
+			go s.hangup()
+		}
+		select {
+		case <-deadline:
+			log.Println("Drain grace period is over, closing the remaining sessions")
+			closeAll, deadline = true, nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
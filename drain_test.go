@@ -0,0 +1,124 @@
+package warden
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrainPolicyValidate(t *testing.T) {
+	for _, test := range []struct {
+		p  DrainPolicy
+		ok bool
+	}{
+		{DrainPolicy{}, true},
+		{DrainPolicy{Order: "idle-first", IdleAfter: Duration(time.Minute)}, true},
+		{DrainPolicy{Order: "immediate", Grace: Duration(time.Minute)}, true},
+		{DrainPolicy{Order: "oldest-first"}, false},
+		{DrainPolicy{IdleAfter: -1}, false},
+		{DrainPolicy{Grace: -1}, false},
+	} {
+		if err := test.p.validate(); (err == nil) != test.ok {
+			t.Errorf("%+v.validate() = %v, want ok %v", test.p, err, test.ok)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		p    DrainPolicy
+		// closed are the sessions drain should close, of "idle" and
+		// "active". Sessions it doesn't close end by themselves.
+		closed string
+	}{
+		{"immediate", DrainPolicy{Order: "immediate"}, "active idle"},
+		{"idle first", DrainPolicy{Order: "idle-first", IdleAfter: Duration(time.Minute)}, "idle"},
+		// Active sessions are only closed once the grace period is over,
+		// after idle ones.
+		{"idle first with grace", DrainPolicy{Order: "idle-first", IdleAfter: Duration(time.Minute), Grace: Duration(150 * time.Millisecond)}, "idle active"},
+		{"wait", DrainPolicy{}, ""},
+		{"grace", DrainPolicy{Grace: Duration(50 * time.Millisecond)}, "active idle"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.p.Notice = "restarting"
+			w := &Warden{drainPolicy: test.p, sessionsByJail: make(map[string][]*session)}
+			var mu sync.Mutex
+			var closed []string
+			sessions := map[string]*session{}
+			for name, idle := range map[string]time.Duration{"idle": 2 * time.Minute, "active": 0} {
+				name := name
+				s := &session{
+					info:      SessionInfo{SessionID: name, ContainerID: "id-" + name},
+					log:       logger(""),
+					ch:        &fakeChannel{},
+					lastInput: time.Now().Add(-idle).UnixNano(),
+				}
+				s.hangup = func() {
+					mu.Lock()
+					closed = append(closed, name)
+					mu.Unlock()
+					w.removeSession(s.info)
+				}
+				sessions[name] = s
+				w.addSession(s)
+			}
+			// Sessions that aren't closed end after a while.
+			end := time.AfterFunc(300*time.Millisecond, func() {
+				for _, s := range sessions {
+					w.removeSession(s.info)
+				}
+			})
+			defer end.Stop()
+
+			done := make(chan struct{})
+			go func() {
+				w.drain()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("drain didn't return")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, name := range closed {
+				if !strings.Contains(test.closed, name) {
+					t.Errorf("Closed the %s session", name)
+				}
+			}
+			if len(closed) != len(strings.Fields(test.closed)) {
+				t.Errorf("Closed %v, want %s", closed, test.closed)
+			}
+			if test.p.Order == "idle-first" && len(closed) > 0 && closed[0] != "idle" {
+				t.Errorf("Closed %v, want the idle session closed first", closed)
+			}
+			for name, s := range sessions {
+				if out := s.ch.(*fakeChannel).String(); !strings.Contains(out, "warden: restarting") {
+					t.Errorf("The %s session got %q, want the notice", name, out)
+				}
+			}
+		})
+	}
+}
+
+func TestActivityReader(t *testing.T) {
+	ch := &fakeChannel{}
+	s := &session{ch: ch, lastInput: time.Now().Add(-time.Hour).UnixNano()}
+	r := activityReader{s}
+	if _, err := r.Read(make([]byte, 10)); err == nil {
+		t.Fatal("Read from an empty channel succeeded")
+	}
+	if idle := s.idleFor(); idle < time.Hour {
+		t.Errorf("Session idle for %v after reading nothing, want an hour", idle)
+	}
+	ch.WriteString("ls\n")
+	if n, err := r.Read(make([]byte, 10)); n != 3 || err != nil {
+		t.Fatalf("Read = %d, %v", n, err)
+	}
+	if idle := s.idleFor(); idle > time.Second {
+		t.Errorf("Session idle for %v after input, want it active", idle)
+	}
+}
@@ -0,0 +1,94 @@
+package warden
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dangerousEnv are variables that change how commands are found or loaded.
+// Clients can't set them, even if they are accepted, unless
+// AllowDangerousEnv is set.
+var dangerousEnv = []string{"LD_*", "PATH", "IFS", "BASH_ENV", "ENV", "SHELLOPTS"}
+
+// matchEnv reports whether name matches any of patterns, which are
+// variable names optionally ending in a * wildcard.
+func matchEnv(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if p == name || strings.HasSuffix(p, "*") && strings.HasPrefix(name, p[:len(p)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateAcceptEnv(patterns []string) error {
+	for _, p := range patterns {
+		if !envNameRegexp.MatchString(strings.TrimSuffix(p, "*")) && p != "*" {
+			return fmt.Errorf("Invalid acceptEnv pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// allowEnv reports whether a client may set the env variable name to value
+// in its jail.
+func (w *Warden) allowEnv(l logger, name, value string) bool {
+	if matchEnv(dangerousEnv, name) && !w.allowDangerousEnv {
+		l.Println("Refused client request to set", name)
+		return false
+	}
+	if !matchEnv(w.acceptEnv, name) {
+		return false
+	}
+	if name == "TZ" && !validTZ(value) {
+		l.Printf("Refused client request to set unknown TZ %q", value)
+		return false
+	}
+	return true
+}
+
+var tzRegexp = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+
+// validTZ reports whether tz names a time zone known to the host, such as
+// "America/New_York". The jail's image is assumed to have the same zones.
+func validTZ(tz string) bool {
+	if !tzRegexp.MatchString(tz) {
+		return false
+	}
+	_, err := time.LoadLocation(tz)
+	return err == nil
+}
+
+// envArgs returns the docker arguments setting env, in a stable order.
+func envArgs(env map[string]string) []string {
+	names := sortedKeys(env)
+	args := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		args = append(args, "-e", name+"="+env[name])
+	}
+	return args
+}
+
+// hostEnvArgs returns the docker arguments passing on the named variables
+// of warden's own environment. Only the names are given, so docker takes
+// the values from its client's environment, which is warden's. Variables
+// warden doesn't have are left unset.
+func hostEnvArgs(names []string) []string {
+	args := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		args = append(args, "-e", name)
+	}
+	return args
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,118 @@
+package warden
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidTZ(t *testing.T) {
+	for tz, want := range map[string]bool{
+		"UTC":                 true,
+		"America/New_York":    true,
+		"Etc/GMT+5":           true,
+		"":                    false,
+		"Nowhere/Land":        false,
+		"../../etc/passwd":    false,
+		"/usr/share/zoneinfo": false,
+		"America/New York":    false,
+		"America//New_York":   false,
+	} {
+		if got := validTZ(tz); got != want {
+			t.Errorf("validTZ(%q) = %v, want %v", tz, got, want)
+		}
+	}
+}
+
+func TestAllowEnv(t *testing.T) {
+	w := &Warden{acceptEnv: []string{"LANG", "LC_*", "TZ", "PATH", "LD_PRELOAD"}}
+	for _, test := range []struct {
+		name, value string
+		want        bool
+	}{
+		{"LANG", "C.UTF-8", true},
+		{"LC_ALL", "C", true},
+		{"LCX", "C", false},
+		{"EDITOR", "vim", false},
+		{"TZ", "Europe/London", true},
+		{"TZ", "Mars/Olympus_Mons", false},
+		{"PATH", "/tmp", false},
+		{"LD_PRELOAD", "/tmp/evil.so", false},
+	} {
+		if got := w.allowEnv(logger("test"), test.name, test.value); got != test.want {
+			t.Errorf("allowEnv(%q, %q) = %v, want %v", test.name, test.value, got, test.want)
+		}
+	}
+
+	w.allowDangerousEnv = true
+	if !w.allowEnv(logger("test"), "PATH", "/opt/bin") {
+		t.Error("allowEnv refused an accepted dangerous variable with allowDangerousEnv set")
+	}
+	if w.allowEnv(logger("test"), "BASH_ENV", "/tmp/x") {
+		t.Error("allowEnv allowed a dangerous variable that isn't accepted")
+	}
+}
+
+// envDocker is jailDocker, also recording in $FAKE_DIR/jailenv the
+// environment a created jail would get, taking the values of variables only
+// named from the client's environment as docker does.
+const envDocker = `if [ "$1" = create ]; then
+  prev=
+  for a; do
+    if [ "$prev" = -e ]; then
+      case "$a" in *=*) echo "$a";; *) printenv "$a" > /dev/null && echo "$a=$(printenv "$a")";; esac
+    fi
+    prev=$a
+  done > "$FAKE_DIR/jailenv"
+fi
+` + jailDocker
+
+func TestHostEnv(t *testing.T) {
+	log := fakeDocker(t, envDocker)
+	t.Setenv("SECRET_TOKEN", "hunter2")
+	t.Setenv("http_proxy", "http://proxy.internal:3128")
+	os.Unsetenv("NO_PROXY")
+	_, addr := startWarden(t, Config{Jail: Jail{HostEnv: []string{"http_proxy", "NO_PROXY"}}})
+	if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+		t.Fatal("Session failed:", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(os.Getenv("FAKE_DIR"), "jailenv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := string(b)
+	if strings.Contains(env, "SECRET_TOKEN") || strings.Contains(env, "hunter2") {
+		t.Errorf("Warden's environment leaked into the jail:\n%s", env)
+	}
+	if !strings.Contains(env, "http_proxy=http://proxy.internal:3128\n") {
+		t.Errorf("Jail environment is\n%s\nwant http_proxy passed on", env)
+	}
+	// Variables warden doesn't have are left unset, not set empty.
+	if strings.Contains(env, "NO_PROXY") {
+		t.Errorf("Jail environment is\n%s\nwant NO_PROXY unset", env)
+	}
+	// Values aren't on docker's command line.
+	creates := dockerCalls(t, log, "create")
+	if len(creates) != 1 || strings.Contains(creates[0], "proxy.internal") || !strings.Contains(creates[0], " -e http_proxy ") {
+		t.Errorf("Jails created with %q, want http_proxy passed by name", creates)
+	}
+	waitRemoved(t, log)
+}
+
+func TestHostEnvArgs(t *testing.T) {
+	if args := hostEnvArgs([]string{"http_proxy", "LANG"}); !reflect.DeepEqual(args, []string{"-e", "http_proxy", "-e", "LANG"}) {
+		t.Errorf("hostEnvArgs = %q", args)
+	}
+	if args := hostEnvArgs(nil); len(args) != 0 {
+		t.Errorf("hostEnvArgs(nil) = %q", args)
+	}
+	if err := (Jail{HostEnv: []string{"http_proxy"}}).validate(); err != nil {
+		t.Errorf("validate() = %v", err)
+	}
+	if err := (Jail{HostEnv: []string{"A=B"}}).validate(); err == nil || !strings.Contains(err.Error(), "Invalid hostEnv variable name") {
+		t.Errorf("validate() with an invalid hostEnv name = %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package warden
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+)
+
+func parseEnvTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("envTemplate").Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid env template: %v", err)
+	}
+	if _, err := renderEnvTemplate(tmpl, SessionInfo{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// renderEnvTemplate renders tmpl against a session and parses the result,
+// which has a NAME=value variable per line. Blank lines and lines starting
+// with # are ignored.
+func renderEnvTemplate(tmpl *template.Template, info SessionInfo) (map[string]string, error) {
+	if tmpl == nil {
+		return nil, nil
+	}
+	out, err := info.render(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to render env template: %v", err)
+	}
+	env := make(map[string]string)
+	for i, line := range strings.Split(out, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || !envNameRegexp.MatchString(parts[0]) {
+			return nil, fmt.Errorf("Env template rendered an invalid variable on line %d: %q", i+1, line)
+		}
+		if strings.ContainsRune(parts[1], 0) {
+			return nil, fmt.Errorf("Env template rendered an invalid value for %s", parts[0])
+		}
+		env[parts[0]] = parts[1]
+	}
+	return env, nil
+}
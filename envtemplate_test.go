@@ -0,0 +1,95 @@
+package warden
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func writeEnvTemplate(t *testing.T, text string) string {
+	path := filepath.Join(t.TempDir(), "env")
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRenderEnvTemplate(t *testing.T) {
+	info := SessionInfo{User: "alice", LocalUser: "alice", Tenant: "infra", SessionID: "0123456789abcdef"}
+	for _, test := range []struct {
+		text string
+		want map[string]string
+		err  string
+	}{
+		{
+			text: "# Computed per session.\nNAMESPACE=team-{{.Tenant}}\n\nOWNER={{.User}}@example.com\r\nSESSION={{.SessionID}}\nEMPTY=\nEQUALS=a=b\n",
+			want: map[string]string{
+				"NAMESPACE": "team-infra",
+				"OWNER":     "alice@example.com",
+				"SESSION":   "0123456789abcdef",
+				"EMPTY":     "",
+				"EQUALS":    "a=b",
+			},
+		},
+		{text: "", want: map[string]string{}},
+		{text: "NAMESPACE\n", err: "invalid variable on line 1"},
+		{text: "A=1\n{{.User}}-ns=x\n", err: "invalid variable on line 2"},
+		{text: "A={{printf \"%c\" 0}}", err: "invalid value for A"},
+		{text: "A={{.Missing}}", err: "Failed to render env template"},
+	} {
+		tmpl := template.Must(template.New("").Parse(test.text))
+		env, err := renderEnvTemplate(tmpl, info)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Rendering %q = %v, %v, want error %q", test.text, env, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(env, test.want) {
+			t.Errorf("Rendering %q = %v, %v, want %v", test.text, env, err, test.want)
+		}
+	}
+	if env, err := renderEnvTemplate(nil, info); env != nil || err != nil {
+		t.Errorf("Rendering without a template = %v, %v", env, err)
+	}
+}
+
+func TestParseEnvTemplate(t *testing.T) {
+	if tmpl, err := parseEnvTemplate(""); tmpl != nil || err != nil {
+		t.Errorf("parseEnvTemplate(\"\") = %v, %v", tmpl, err)
+	}
+	for text, want := range map[string]string{
+		"A={{.User":           "Invalid env template",
+		"A={{.Missing}}\n":    "Failed to render env template",
+		"not a variable\n":    "invalid variable",
+		"NAMESPACE={{.User}}": "",
+	} {
+		_, err := parseEnvTemplate(writeEnvTemplate(t, text))
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("parseEnvTemplate(%q) = %v, want %q", text, err, want)
+		}
+	}
+	if _, err := parseEnvTemplate(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("parseEnvTemplate succeeded on a missing file")
+	}
+}
+
+func TestEnvTemplateSession(t *testing.T) {
+	log := fakeDocker(t, jailDocker)
+	path := writeEnvTemplate(t, "NAMESPACE=ns-{{.LocalUser}}\nEDITOR=nano\n")
+	_, addr := startWarden(t, Config{Jail: Jail{EnvTemplate: path, Profile: Profile{Env: map[string]string{"EDITOR": "vi"}}}})
+	if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+		t.Fatal("Session failed:", err)
+	}
+	creates := dockerCalls(t, log, "create")
+	if len(creates) != 1 || !strings.Contains(creates[0], " -e NAMESPACE=ns-alice ") {
+		t.Fatalf("Jails created with %q, want NAMESPACE computed for alice", creates)
+	}
+	// The profile's env is passed last, so docker gives it precedence.
+	if fromTemplate, fromProfile := strings.Index(creates[0], "EDITOR=nano"), strings.Index(creates[0], "EDITOR=vi"); fromTemplate < 0 || fromProfile < fromTemplate {
+		t.Errorf("Jail created with %q, want the profile's EDITOR after the template's", creates[0])
+	}
+}
@@ -2,10 +2,11 @@ package warden
 
 import (
 	"os"
+	"strings"
 )
 
 func expand(path string) string {
-	if path[:2] == "~/" {
+	if strings.HasPrefix(path, "~/") {
 		path = "$HOME" + path[1:]
 	}
 	return os.ExpandEnv(path)
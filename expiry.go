@@ -0,0 +1,41 @@
+package warden
+
+import (
+	"fmt"
+	"time"
+)
+
+// expiryWarning is how long before a session expires the user is warned.
+const expiryWarning = 5 * time.Minute
+
+// expiry returns when the user's access expires, or the zero time if it
+// doesn't.
+func (w *Warden) expiry(user string) time.Time {
+	expires := w.expires
+	if u := w.users[user].Expires; !u.IsZero() && (expires.IsZero() || u.Before(expires)) {
+		expires = u
+	}
+	return expires
+}
+
+// expireSession warns the user shortly before expires and then closes the
+// session, unless done is closed first.
+func expireSession(s *session, expires time.Time, done <-chan struct{}, closeSession func()) {
+	remaining := expires.Sub(time.Now())
+	warn := time.NewTimer(remaining - expiryWarning)
+	defer warn.Stop()
+	expire := time.NewTimer(remaining)
+	defer expire.Stop()
+	for {
+		select {
+		case <-warn.C:
+			fmt.Fprintf(s.ch, "\r\nwarden: access expires at %s, this session will be closed.\r\n", expires.Format(time.RFC1123))
+		case <-expire.C:
+			s.log.Println("Closing session: access expired")
+			closeSession()
+			return
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package warden
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestExpiry(t *testing.T) {
+	noon := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	later := noon.Add(time.Hour)
+	for _, test := range []struct {
+		global, user, want time.Time
+	}{
+		{time.Time{}, time.Time{}, time.Time{}},
+		{noon, time.Time{}, noon},
+		{time.Time{}, noon, noon},
+		{noon, later, noon},
+		{later, noon, noon},
+	} {
+		w := &Warden{expires: test.global, users: map[string]User{"alice": {Expires: test.user}}}
+		if got := w.expiry("alice"); !got.Equal(test.want) {
+			t.Errorf("expiry with global %v and user %v = %v, want %v", test.global, test.user, got, test.want)
+		}
+	}
+}
+
+func TestExpireSession(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		after  time.Duration
+		done   bool
+		closed bool
+		warned bool
+	}{
+		// An expired session may be closed without a warning.
+		{"expired", -time.Second, false, true, false},
+		{"expires soon", 50 * time.Millisecond, false, true, true},
+		{"ended first", time.Hour, true, false, false},
+	} {
+		ch := &fakeChannel{}
+		s := &session{log: logger("test"), ch: ch}
+		done := make(chan struct{})
+		if test.done {
+			close(done)
+		}
+		var mu sync.Mutex
+		closed := false
+		expireSession(s, time.Now().Add(test.after), done, func() {
+			mu.Lock()
+			closed = true
+			mu.Unlock()
+		})
+		if closed != test.closed {
+			t.Errorf("%s: closed the session: %v, want %v", test.name, closed, test.closed)
+		}
+		// Sessions within the warning period of expiring are warned.
+		if warned := strings.Contains(ch.String(), "access expires at"); test.warned && !warned || !test.closed && warned {
+			t.Errorf("%s: warned %q", test.name, ch.String())
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	t.Setenv("HOLD_SESSIONS", "1")
+	for _, test := range []struct {
+		name    string
+		expires time.Duration
+		output  string
+	}{
+		{"expired", -time.Minute, "Access for alice expired at"},
+		{"expires during the session", 200 * time.Millisecond, "access expires at"},
+	} {
+		_, addr := startWarden(t, Config{
+			Users:       map[string]User{"alice": {Expires: time.Now().Add(test.expires)}},
+			HangupGrace: Duration(100 * time.Millisecond),
+		})
+		ch, reqs, err := dialWarden(t, addr, "alice").OpenChannel("session", nil)
+		if err != nil {
+			t.Fatal("OpenChannel:", err)
+		}
+		go ssh.DiscardRequests(reqs)
+		if _, err := ch.SendRequest("shell", true, nil); err != nil {
+			t.Fatal("Sending shell:", err)
+		}
+		out := make(chan []byte, 1)
+		go func() {
+			b, _ := ioutil.ReadAll(ch)
+			out <- b
+		}()
+		select {
+		case b := <-out:
+			if !strings.Contains(string(b), test.output) {
+				t.Errorf("%s: session output %q, want %q", test.name, b, test.output)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: session wasn't closed", test.name)
+		}
+		ch.Close()
+	}
+}
@@ -0,0 +1,59 @@
+package warden
+
+import (
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The FIPS approved algorithms among those warden supports, in order of
+// preference.
+var (
+	fipsCiphers      = []string{"aes128-gcm@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr"}
+	fipsMACs         = []string{"hmac-sha1"}
+	fipsKeyExchanges = []string{"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521"}
+)
+
+// minFIPSRSABits is the smallest RSA host key FIPS mode accepts.
+const minFIPSRSABits = 2048
+
+// fipsAlgorithms returns the algorithms to offer in FIPS mode: the approved
+// ones if none are configured, or the configured ones if they are all
+// approved.
+func fipsAlgorithms(kind string, configured, approved []string) ([]string, error) {
+	if len(configured) == 0 {
+		return approved, nil
+	}
+	isApproved := make(map[string]bool)
+	for _, algo := range approved {
+		isApproved[algo] = true
+	}
+	for _, algo := range configured {
+		if !isApproved[algo] {
+			return nil, fmt.Errorf("%s %q is not FIPS approved", kind, algo)
+		}
+	}
+	return configured, nil
+}
+
+func checkFIPSHostKey(key ssh.PublicKey) error {
+	switch key.Type() {
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return nil
+	case ssh.KeyAlgoRSA:
+		var rsaKey struct {
+			Name string
+			E    *big.Int
+			N    *big.Int
+		}
+		if err := ssh.Unmarshal(key.Marshal(), &rsaKey); err != nil {
+			return err
+		}
+		if rsaKey.N.BitLen() < minFIPSRSABits {
+			return fmt.Errorf("%d bit RSA host key is too small for FIPS mode, it must be at least %d bits", rsaKey.N.BitLen(), minFIPSRSABits)
+		}
+		return nil
+	}
+	return fmt.Errorf("Host key type %s is not FIPS approved", key.Type())
+}
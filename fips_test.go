@@ -0,0 +1,142 @@
+package warden
+
+import (
+	"crypto/dsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestFIPSAlgorithms(t *testing.T) {
+	for _, test := range []struct {
+		configured []string
+		want       []string
+		err        string
+	}{
+		{nil, fipsCiphers, ""},
+		{[]string{"aes256-ctr", "aes128-ctr"}, []string{"aes256-ctr", "aes128-ctr"}, ""},
+		{[]string{"aes128-ctr", "arcfour256"}, nil, `Cipher "arcfour256" is not FIPS approved`},
+	} {
+		got, err := fipsAlgorithms("Cipher", test.configured, fipsCiphers)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("fipsAlgorithms(%q) = %v, want error %q", test.configured, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("fipsAlgorithms(%q) = %q, %v, want %q", test.configured, got, err, test.want)
+		}
+	}
+}
+
+// testRSAHostKey writes an RSA host key of the given size.
+func testRSAHostKey(t *testing.T, bits int) string {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey := filepath.Join(t.TempDir(), "hostkey")
+	if err := ioutil.WriteFile(hostKey, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return hostKey
+}
+
+func TestCheckFIPSHostKey(t *testing.T) {
+	ecdsaKey, err := ssh.NewPublicKey(&testKey(t).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFIPSHostKey(ecdsaKey); err != nil {
+		t.Errorf("ECDSA host key refused: %v", err)
+	}
+	var dsaKey dsa.PrivateKey
+	if err := dsa.GenerateParameters(&dsaKey.Parameters, rand.Reader, dsa.L1024N160); err != nil {
+		t.Fatal(err)
+	}
+	if err := dsa.GenerateKey(&dsaKey, rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	dsaPublic, err := ssh.NewPublicKey(&dsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFIPSHostKey(dsaPublic); err == nil || !strings.Contains(err.Error(), "ssh-dss is not FIPS approved") {
+		t.Errorf("checkFIPSHostKey(DSA) = %v, want it refused", err)
+	}
+}
+
+func TestFIPSMode(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	w, err := New(Config{PrivateKeys: []string{testHostKey(t)}, FIPSMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(w.ciphers, fipsCiphers) || !reflect.DeepEqual(w.macs, fipsMACs) || !reflect.DeepEqual(w.keyExchanges, fipsKeyExchanges) {
+		t.Errorf("FIPS mode offers ciphers %q, MACs %q, key exchanges %q", w.ciphers, w.macs, w.keyExchanges)
+	}
+	if !strings.Contains(logs.String(), "FIPS mode: host keys ecdsa-sha2-nistp256, ciphers "+strings.Join(fipsCiphers, ",")) {
+		t.Errorf("Logged %q, want the approved algorithms", logs.String())
+	}
+
+	if _, err := New(Config{PrivateKeys: []string{testRSAHostKey(t, 2048)}, FIPSMode: true}); err != nil {
+		t.Errorf("New refused a 2048 bit RSA host key: %v", err)
+	}
+	for name, test := range map[string]struct {
+		config Config
+		err    string
+	}{
+		"small RSA host key": {Config{PrivateKeys: []string{testRSAHostKey(t, 1024)}}, "1024 bit RSA host key is too small"},
+		"cipher":             {Config{Ciphers: []string{"arcfour256"}}, `Cipher "arcfour256" is not FIPS approved`},
+		"MAC":                {Config{MACs: []string{"hmac-sha2-256", "hmac-sha1-96"}}, `MAC "hmac-sha2-256" is not FIPS approved`},
+		"key exchange":       {Config{KeyExchanges: []string{"curve25519-sha256@libssh.org"}}, `Key exchange "curve25519-sha256@libssh.org" is not FIPS approved`},
+	} {
+		if test.config.PrivateKeys == nil {
+			test.config.PrivateKeys = []string{testHostKey(t)}
+		}
+		test.config.FIPSMode = true
+		if _, err := New(test.config); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("New with a non-approved %s = %v, want %q", name, err, test.err)
+		}
+		// Without FIPS mode they're accepted.
+		test.config.FIPSMode = false
+		if _, err := New(test.config); err != nil {
+			t.Errorf("New with %s outside FIPS mode failed: %v", name, err)
+		}
+	}
+}
+
+func TestFIPSModeRefusesClients(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	_, addr := startWarden(t, Config{FIPSMode: true})
+	signer, err := ssh.NewSignerFromKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ClientConfig{User: "alice", Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)}}
+	config.Ciphers = []string{"arcfour256"}
+	if client, err := ssh.Dial("tcp", addr, config); err == nil {
+		client.Close()
+		t.Error("Client offering only arcfour256 connected in FIPS mode")
+	}
+	config.Ciphers = []string{"aes256-ctr"}
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatal("Client offering an approved cipher failed to connect:", err)
+	}
+	client.Close()
+}
@@ -0,0 +1,24 @@
+package warden
+
+import "os/exec"
+
+// sessionPIDFile is where a session's jail script records its PID. The
+// script leads the session's processes inside the jail: docker makes it a
+// session leader when it has a terminal, and otherwise its parent.
+func sessionPIDFile(sessionID string) string {
+	return "/run/warden/" + sessionID + ".pid"
+}
+
+// signalSession sends sig, e.g. "HUP", to a session's processes inside its
+// jail. Signalling the docker client on the host doesn't reach them: it
+// doesn't forward signals to a terminal session, and a docker exec'd shell
+// outlives its client. A jail running the jail command has no shell or PID
+// file, but its session is the jail, so its main process is signalled.
+func (w *Warden) signalSession(jailID, sessionID, sig string) error {
+	if w.runsCommand(jailID) {
+		return exec.Command("docker", "kill", "--signal", sig, jailID).Run()
+	}
+	script := `pid=$(cat "$1") || exit
+pkill -` + sig + ` -s "$pid" || { pkill -` + sig + ` -P "$pid"; kill -` + sig + ` "$pid"; }`
+	return exec.Command("docker", "exec", jailID, "bash", "-c", script, "-", sessionPIDFile(sessionID)).Run()
+}
@@ -0,0 +1,78 @@
+package warden
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hangupDocker fakes docker with sessions that record their PID where the
+// jail script would, and touch $FAKE_DIR/hup when hung up on, unless
+// $IGNORE_HUP is set. docker exec
+// runs its script on the host, with the session's PID file.
+const hangupDocker = `case "$1" in
+create) echo jail-id;;
+inspect) echo true;;
+start)
+  echo $$ > "$FAKE_DIR/session.pid"
+  if [ -n "$IGNORE_HUP" ]; then trap '' HUP; else trap 'touch "$FAKE_DIR/hup"; exit' HUP; fi
+  echo started
+  while :; do sleep 0.01; done;;
+exec) exec bash -c "$5" - "$FAKE_DIR/session.pid";;
+esac
+`
+
+// startHangupSession starts a session with hangupDocker, returning its
+// client once the session is running.
+func startHangupSession(t *testing.T, config Config) *ssh.Client {
+	_, addr := startWarden(t, config)
+	client := dialWarden(t, addr, "alice")
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal("OpenChannel:", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	if ok, err := ch.SendRequest("shell", true, nil); !ok || err != nil {
+		t.Fatalf("shell = %v, %v", ok, err)
+	}
+	if line, err := bufio.NewReader(ch).ReadString('\n'); err != nil || strings.TrimSpace(line) != "started" {
+		t.Fatalf("Session printed %q, %v", line, err)
+	}
+	return client
+}
+
+func TestHangupOnDisconnect(t *testing.T) {
+	fakeDocker(t, hangupDocker)
+	client := startHangupSession(t, Config{})
+	// The client going away hangs up on the shell, rather than killing it.
+	client.Close()
+	waitForFile(t, filepath.Join(os.Getenv("FAKE_DIR"), "hup"))
+}
+
+func TestKillAfterHangupGrace(t *testing.T) {
+	fakeDocker(t, hangupDocker)
+	t.Setenv("IGNORE_HUP", "1")
+	client := startHangupSession(t, Config{HangupGrace: Duration(100 * time.Millisecond)})
+	b, err := ioutil.ReadFile(filepath.Join(os.Getenv("FAKE_DIR"), "session.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	for deadline := time.Now().Add(5 * time.Second); syscall.Kill(pid, 0) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Session ignoring hangups wasn't killed")
+		}
+	}
+}
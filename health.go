@@ -0,0 +1,41 @@
+package warden
+
+import (
+	"log"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+// Degraded reports whether the docker daemon was unreachable when last
+// checked, in which case new sessions are refused.
+func (w *Warden) Degraded() bool {
+	return atomic.LoadInt32(&w.degraded) != 0
+}
+
+func (w *Warden) monitorDocker(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := exec.Command("docker", "info").Run()
+		switch {
+		case err != nil && atomic.CompareAndSwapInt32(&w.degraded, 0, 1):
+			log.Println("Docker is unavailable, refusing new sessions:", err)
+		case err == nil && atomic.CompareAndSwapInt32(&w.degraded, 1, 0):
+			log.Println("Docker is available again")
+			w.readoptJails()
+		}
+	}
+}
+
+// readoptJails restarts persistent jails that were stopped while docker was
+// unavailable, and forgets those that no longer exist.
+func (w *Warden) readoptJails() {
+	w.jailsMu.Lock()
+	defer w.jailsMu.Unlock()
+	for user, jailID := range w.jails {
+		if err := w.startJail(jailID); err != nil {
+			log.Println("Forgetting persistent jail for", user+":", err)
+			delete(w.jails, user)
+			w.jailGone(jailID)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package warden
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// historyStaging is where saved history is copied into a jail. The jail
+// script moves it into the user's home directory once the user exists.
+const historyStaging = "/tmp/.warden_bash_history"
+
+// historyPath is where the history of the persistent jail with the given
+// jailKey is saved. A user's unnamed jail's is named after the user.
+func (w *Warden) historyPath(key string) string {
+	return filepath.Join(w.jail.HistoryDir, url.PathEscape(key)+".bash_history")
+}
+
+// restoreHistory copies the saved bash history of a persistent jail,
+// identified by its jailKey, into it when its first session starts. Every
+// call must be matched by a call to saveHistory.
+func (w *Warden) restoreHistory(jailID, key string) error {
+	w.historyMu.Lock()
+	defer w.historyMu.Unlock()
+	w.historyRefs[key]++
+	if w.historyRefs[key] > 1 {
+		return nil
+	}
+	path := w.historyPath(key)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return dockerCp(path, jailID+":"+historyStaging)
+}
+
+// saveHistory copies user's bash history out of their persistent jail when
+// the last session in it ends. Sessions sharing a jail share its history
+// file, so saving it any earlier would lose the commands of the sessions
+// still running. Each of a user's named jails has a history of its own.
+func (w *Warden) saveHistory(jailID, key, user string) error {
+	w.historyMu.Lock()
+	defer w.historyMu.Unlock()
+	w.historyRefs[key]--
+	if w.historyRefs[key] > 0 {
+		return nil
+	}
+	delete(w.historyRefs, key)
+
+	tmp, err := ioutil.TempFile(w.jail.HistoryDir, ".history")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	src := jailID + ":/home/" + jailUsername(user) + "/.bash_history"
+	if err := dockerCp(src, tmp.Name()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), w.historyPath(key))
+}
+
+func dockerCp(src, dst string) error {
+	out, err := exec.Command("docker", "cp", src, dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
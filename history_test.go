@@ -0,0 +1,146 @@
+package warden
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// historyDocker copies the history out of a jail as "history of" followed
+// by the jail's ID.
+const historyDocker = `case "$1" in
+cp) case "$2" in *:*) echo "history of ${2%%:*}" > "$3";; esac;;
+esac
+`
+
+func TestHistoryPerJail(t *testing.T) {
+	log := fakeDocker(t, historyDocker)
+	w := &Warden{jail: Jail{HistoryDir: t.TempDir()}, historyRefs: make(map[string]int)}
+	alice := SessionInfo{LocalUser: "alice"}
+	work := SessionInfo{LocalUser: "alice", Jail: "work"}
+
+	// Two sessions in alice's work jail, and one in her unnamed jail.
+	for _, restore := range []struct{ jailID, key string }{
+		{"work-jail", work.jailKey()}, {"work-jail", work.jailKey()}, {"jail", alice.jailKey()},
+	} {
+		if err := w.restoreHistory(restore.jailID, restore.key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cps := dockerCalls(t, log, "cp"); len(cps) != 0 {
+		t.Errorf("Restored history that was never saved: %q", cps)
+	}
+	for _, save := range []struct{ jailID, key string }{
+		{"work-jail", work.jailKey()}, {"jail", alice.jailKey()}, {"work-jail", work.jailKey()},
+	} {
+		if err := w.saveHistory(save.jailID, save.key, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each jail's history is saved once its last session ends, and kept
+	// apart from the others'.
+	if cps := dockerCalls(t, log, "cp"); len(cps) != 2 {
+		t.Errorf("History saved with %q, want once per jail", cps)
+	}
+	for key, want := range map[string]string{"alice": "history of jail\n", "alice+work": "history of work-jail\n"} {
+		b, err := ioutil.ReadFile(filepath.Join(w.jail.HistoryDir, key+".bash_history"))
+		if err != nil || string(b) != want {
+			t.Errorf("History of %s = %q, %v, want %q", key, b, err, want)
+		}
+	}
+
+	// The next session in each jail gets its own history back.
+	log = fakeDocker(t, historyDocker)
+	w.restoreHistory("new-work-jail", work.jailKey())
+	w.restoreHistory("new-jail", alice.jailKey())
+	want := []string{
+		"cp " + filepath.Join(w.jail.HistoryDir, "alice+work.bash_history") + " new-work-jail:" + historyStaging,
+		"cp " + filepath.Join(w.jail.HistoryDir, "alice.bash_history") + " new-jail:" + historyStaging,
+	}
+	if cps := dockerCalls(t, log, "cp"); len(cps) != 2 || cps[0] != want[0] || cps[1] != want[1] {
+		t.Errorf("History restored with %q, want %q", cps, want)
+	}
+}
+
+// jailFilesDocker fakes docker cp, with the files of jails under
+// $FAKE_DIR/jails.
+const jailFilesDocker = `case "$1" in
+cp)
+  src=$2 dst=$3
+  case "$src" in *:*) src="$FAKE_DIR/jails/${src%%:*}${src#*:}";; esac
+  case "$dst" in *:*) dst="$FAKE_DIR/jails/${dst%%:*}${dst#*:}"; mkdir -p "$(dirname "$dst")";; esac
+  cp "$src" "$dst";;
+esac
+`
+
+func TestHistoryCycle(t *testing.T) {
+	fakeDocker(t, jailFilesDocker)
+	jails := filepath.Join(os.Getenv("FAKE_DIR"), "jails")
+	w := &Warden{jail: Jail{HistoryDir: t.TempDir(), PersistHistory: true}, historyRefs: make(map[string]int)}
+	writeHistory := func(jailID, history string) {
+		path := filepath.Join(jails, jailID, "home", jailUsername("alice"), ".bash_history")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(history), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.restoreHistory("jail1", "alice"); err != nil {
+		t.Fatal("restoreHistory:", err)
+	}
+	writeHistory("jail1", "ls\nmake\n")
+	if err := w.saveHistory("jail1", "alice", "alice"); err != nil {
+		t.Fatal("saveHistory:", err)
+	}
+	if saved, err := ioutil.ReadFile(w.historyPath("alice")); err != nil || string(saved) != "ls\nmake\n" {
+		t.Errorf("Saved history %q, %v, want the jail's history", saved, err)
+	}
+
+	// The next jail starts with the saved history.
+	if err := w.restoreHistory("jail2", "alice"); err != nil {
+		t.Fatal("restoreHistory:", err)
+	}
+	restored, err := ioutil.ReadFile(filepath.Join(jails, "jail2", historyStaging))
+	if err != nil || string(restored) != "ls\nmake\n" {
+		t.Errorf("Restored history %q, %v, want the saved history", restored, err)
+	}
+	// Failing to copy the history out keeps what was saved.
+	if err := w.saveHistory("jail2", "alice", "alice"); err == nil {
+		t.Error("saveHistory succeeded without a history in the jail")
+	}
+	if saved, err := ioutil.ReadFile(w.historyPath("alice")); err != nil || string(saved) != "ls\nmake\n" {
+		t.Errorf("Saved history is %q, %v after failing to save, want it kept", saved, err)
+	}
+}
+
+func TestHistoryPath(t *testing.T) {
+	w := &Warden{jail: Jail{HistoryDir: "/var/lib/warden/history"}}
+	for key, want := range map[string]string{
+		"alice":       "/var/lib/warden/history/alice.bash_history",
+		"alice/build": "/var/lib/warden/history/alice%2Fbuild.bash_history",
+		"../etc":      "/var/lib/warden/history/..%2Fetc.bash_history",
+	} {
+		if path := w.historyPath(key); path != want {
+			t.Errorf("historyPath(%q) = %q, want %q", key, path, want)
+		}
+	}
+}
+
+func TestJailScriptHistory(t *testing.T) {
+	for _, persist := range []bool{false, true} {
+		w := &Warden{jail: Jail{PersistHistory: persist}}
+		script := w.jailScript("session", "alice", "", "", "")
+		checkScript(t, script)
+		restore := strings.Index(script, "mv '"+historyStaging+"'")
+		if (restore >= 0) != persist {
+			t.Errorf("PersistHistory %v: script restores history: %v:\n%s", persist, restore >= 0, script)
+		}
+		if restore >= 0 && restore < strings.Index(script, "adduser") {
+			t.Errorf("Script restores history before creating the user:\n%s", script)
+		}
+	}
+}
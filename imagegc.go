@@ -0,0 +1,137 @@
+package warden
+
+import (
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// imageRepository returns an image reference without its tag or digest.
+func imageRepository(image string) string {
+	image = strings.SplitN(image, "@", 2)[0]
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+func (w *Warden) collectImages(interval, age time.Duration) {
+	// Jails left from before a restart were created from images too.
+	if images, err := w.containerImages("--filter", "label="+instanceLabel+"="+w.instance); err != nil {
+		log.Println("Failed to list images of jails:", err)
+	} else {
+		w.jailImagesMu.Lock()
+		for id := range images {
+			w.jailImages[id] = true
+		}
+		w.jailImagesMu.Unlock()
+	}
+	for range time.Tick(interval) {
+		w.removeUnusedImages(age)
+	}
+}
+
+// recordJailImage records the image a new jail was created from, so that it
+// can be removed once it is no longer used, e.g. after the jail image's tag
+// has moved on.
+func (w *Warden) recordJailImage(jailID string) {
+	out, err := exec.Command("docker", "inspect", "-f", "{{.Image}}", jailID).Output()
+	if err != nil {
+		log.Println("Failed to inspect jail image:", err)
+		return
+	}
+	w.jailImagesMu.Lock()
+	defer w.jailImagesMu.Unlock()
+	w.jailImages[strings.TrimSpace(string(out))] = true
+}
+
+// removeUnusedImages removes images this instance's jails were created from
+// that were created more than age ago and that no container uses, such as
+// earlier versions of the jail image left behind when its tag moved. Other
+// images, even of the same repositories, are left alone, as are the images
+// warden is currently configured with.
+func (w *Warden) removeUnusedImages(age time.Duration) {
+	keep, err := w.containerImages()
+	if err != nil {
+		log.Println("Failed to list images in use:", err)
+		return
+	}
+	configured := []string{w.jail.Image, w.jail.FallbackImage}
+	if w.jail.NetworkBandwidth != nil {
+		configured = append(configured, w.jail.NetworkBandwidth.Image)
+	}
+	for _, image := range configured {
+		if image == "" {
+			continue
+		}
+		if out, err := exec.Command("docker", "image", "inspect", "-f", "{{.Id}}", image).Output(); err == nil {
+			keep[strings.TrimSpace(string(out))] = true
+		}
+	}
+	w.jailImagesMu.Lock()
+	var ids []string
+	for id := range w.jailImages {
+		if !keep[id] {
+			ids = append(ids, id)
+		}
+	}
+	w.jailImagesMu.Unlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		out, err := exec.Command("docker", "image", "inspect", "-f", "{{.Created}}", id).CombinedOutput()
+		if err != nil {
+			if strings.Contains(string(out), "No such image") {
+				// Removed by someone else.
+				w.forgetJailImage(id)
+				continue
+			}
+			log.Println("Failed to inspect image", id+":", err, string(out))
+			continue
+		}
+		created, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(out)))
+		if err != nil || time.Now().Sub(created) < age {
+			continue
+		}
+		// Without -f, docker refuses to remove an image that a container
+		// started since it was listed is using.
+		release := w.dockerOp()
+		out, err = exec.Command("docker", "rmi", id).CombinedOutput()
+		release()
+		if err != nil {
+			log.Println("Failed to remove unused image", id+":", err, string(out))
+			continue
+		}
+		w.forgetJailImage(id)
+		log.Println("Removed unused image", id)
+	}
+}
+
+func (w *Warden) forgetJailImage(id string) {
+	w.jailImagesMu.Lock()
+	defer w.jailImagesMu.Unlock()
+	delete(w.jailImages, id)
+}
+
+// containerImages returns the IDs of the images of the containers docker ps
+// lists with filters, running or not.
+func (w *Warden) containerImages(filters ...string) (map[string]bool, error) {
+	out, err := exec.Command("docker", append([]string{"ps", "-aq"}, filters...)...).Output()
+	if err != nil {
+		return nil, err
+	}
+	images := make(map[string]bool)
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return images, nil
+	}
+	out, err = exec.Command("docker", append([]string{"inspect", "-f", "{{.Image}}"}, ids...)...).Output()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range strings.Fields(string(out)) {
+		images[id] = true
+	}
+	return images, nil
+}
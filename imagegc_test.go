@@ -0,0 +1,65 @@
+package warden
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// imageDocker fakes docker with a container using sha256:inuse, jail and
+// tc images that are sha256:current and sha256:tc, and sha256:gone having
+// been removed already. sha256:new was created just now, and every other
+// image long ago.
+const imageDocker = `case "$*" in
+"ps -aq"*) echo c1;;
+"inspect -f {{.Image}} c1") echo sha256:inuse;;
+"inspect -f {{.Image}} jail-id") echo sha256:created;;
+"image inspect -f {{.Id}} ubuntu") echo sha256:current;;
+"image inspect -f {{.Id}} netshoot") echo sha256:tc;;
+"image inspect -f {{.Created}} sha256:gone") echo "Error: No such image: sha256:gone" >&2; exit 1;;
+"image inspect -f {{.Created}} sha256:new") date -u +%Y-%m-%dT%H:%M:%SZ;;
+"image inspect -f {{.Created}} "*) echo 2020-01-01T00:00:00Z;;
+"create "*) echo jail-id;;
+esac
+`
+
+func TestRemoveUnusedImages(t *testing.T) {
+	log := fakeDocker(t, imageDocker)
+	w := testJailWarden()
+	w.jail.NetworkBandwidth = &NetworkBandwidth{Rate: "10mbit", Image: "netshoot"}
+	w.jailImages = map[string]bool{}
+	for _, id := range []string{"sha256:old", "sha256:older", "sha256:inuse", "sha256:current", "sha256:tc", "sha256:new", "sha256:gone"} {
+		w.jailImages[id] = true
+	}
+	w.removeUnusedImages(time.Hour)
+
+	removed := dockerCalls(t, log, "rmi")
+	if want := []string{"rmi sha256:old", "rmi sha256:older"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("Removed %q, want %q", removed, want)
+	}
+	var left []string
+	for id := range w.jailImages {
+		left = append(left, id)
+	}
+	sort.Strings(left)
+	if want := []string{"sha256:current", "sha256:inuse", "sha256:new", "sha256:tc"}; !reflect.DeepEqual(left, want) {
+		t.Errorf("Images left to collect = %q, want %q", left, want)
+	}
+}
+
+func TestRecordJailImage(t *testing.T) {
+	for _, interval := range []time.Duration{0, time.Hour} {
+		fakeDocker(t, imageDocker)
+		w := testJailWarden()
+		w.imageGCInterval = interval
+		w.jailImages = map[string]bool{}
+		w.shellProbes["ubuntu"] = true
+		if _, _, err := w.runJail(logger("test"), nil, "warden-alice", []string{"create"}, nil, "ubuntu", []string{"bash"}); err != nil {
+			t.Fatal("runJail failed:", err)
+		}
+		if recorded := w.jailImages["sha256:created"]; recorded != (interval > 0) {
+			t.Errorf("With image GC every %v, recorded the jail's image: %v", interval, recorded)
+		}
+	}
+}
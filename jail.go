@@ -0,0 +1,448 @@
+package warden
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// createJail runs the docker command given by args, with environ added to
+// the docker client's environment, against the jail image and returns the
+// new container's ID and the image it was created from. If docker fails to
+// create the container from the primary image and a fallback image is
+// configured, it retries once with the fallback.
+func (w *Warden) createJail(l logger, ch ssh.Channel, name string, args, environ []string, cmd ...string) (string, string, error) {
+	jailID, name, err := w.createJailFrom(l, ch, name, args, environ, w.jail.Image, cmd)
+	if !w.fallsBack(err) {
+		return jailID, w.jail.Image, err
+	}
+	w.fallBack(l, ch, err)
+	// The primary attempt may have left a created but unstarted container
+	// holding the name it ended up with.
+	w.docker("rm", "-f", name).Run()
+	jailID, _, err = w.createJailFrom(l, ch, name, renameJail(args, name), environ, w.jail.FallbackImage, cmd)
+	return jailID, w.jail.FallbackImage, err
+}
+
+func (w *Warden) createJailFrom(l logger, ch ssh.Channel, name string, args, environ []string, image string, cmd []string) (string, string, error) {
+	jailID, name, err := w.runJail(l, ch, name, args, environ, image, cmd)
+	if err != nil {
+		reportRateLimit(ch, image, err)
+	}
+	return jailID, name, err
+}
+
+// jailStartError is docker failing to pull a jail's image, or to create or
+// start a jail from it, which a fallback image may get around. Images
+// warden refuses to run jails from aren't fallen back from.
+type jailStartError struct {
+	error
+}
+
+// fallsBack reports whether err from the primary image calls for the
+// fallback image.
+func (w *Warden) fallsBack(err error) bool {
+	_, ok := err.(jailStartError)
+	return ok && w.jail.FallbackImage != ""
+}
+
+// fallBack reports falling back to the fallback image after the primary
+// image failed with err. The caller removes whatever the primary attempt
+// left behind.
+func (w *Warden) fallBack(l logger, ch ssh.Channel, err error) {
+	l.Printf("Failed to start jail from %s, falling back to %s: %v", w.jail.Image, w.jail.FallbackImage, err)
+	fmt.Fprintf(ch, "Image %s is unavailable, using %s instead.\r\n", w.jail.Image, w.jail.FallbackImage)
+}
+
+// rateLimited reports whether creating a jail failed because the image's
+// registry is rate limiting pulls, as Docker Hub does for anonymous and
+// free accounts.
+func rateLimited(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "toomanyrequests") || strings.Contains(msg, "429 Too Many Requests") ||
+		strings.Contains(msg, "pull rate limit")
+}
+
+// reportRateLimit tells the operator and the user when image couldn't be
+// pulled because of rate limiting, which only waiting fixes.
+func reportRateLimit(ch ssh.Channel, image string, err error) {
+	if !rateLimited(err) {
+		return
+	}
+	log.Printf("WARNING: registry rate limited pulling %s: %v", image, err)
+	fmt.Fprintf(ch, "Image %s is temporarily unavailable due to registry rate limiting, please try again shortly.\r\n", image)
+}
+
+// startJail makes sure a persistent jail is running, starting it if it was
+// stopped, e.g. by an operator or while docker was unavailable.
+func (w *Warden) startJail(jailID string) error {
+	out, err := exec.Command("docker", "inspect", "-f", "{{.State.Running}}", jailID).Output()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(out)) == "true" {
+		return nil
+	}
+	if out, err := w.docker("start", jailID).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to restart: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// maxNameConflicts is how many times creating a jail is retried when its
+// name is already taken.
+const maxNameConflicts = 3
+
+// runJail creates a jail from image, returning its ID and the name it was
+// created with, which differs from name if that was taken.
+func (w *Warden) runJail(l logger, ch ssh.Channel, name string, args, environ []string, image string, cmd []string) (string, string, error) {
+	if err := checkRegistry(w.allowedRegistries, image); err != nil {
+		fmt.Fprintf(ch, "Image %s is not from an allowed registry.\r\n", image)
+		return "", name, err
+	}
+	if w.jail.VerifySignature != nil {
+		verified, err := w.jail.VerifySignature.verify(image)
+		if err != nil {
+			fmt.Fprintf(ch, "Image %s failed signature verification.\r\n", image)
+			return "", name, err
+		}
+		image = verified
+	}
+	runsCommand := !w.hasShell(l, image)
+	if runsCommand {
+		if len(w.jail.Command) == 0 {
+			fmt.Fprintf(ch, "Image %s has no shell, so sessions can't run in it.\r\n", image)
+			return "", name, fmt.Errorf("Image %s has no shell", image)
+		}
+		l.Printf("Image %s has no shell, running %q instead", image, w.jail.Command)
+		cmd = w.jail.Command
+	}
+	started := time.Now()
+	conflicts, failures := 0, 0
+	for {
+		jailID, err := w.dockerCreate(args, environ, image, cmd)
+		if err == nil {
+			if runsCommand {
+				w.setRunsCommand(jailID, true)
+			}
+			if w.imageGCInterval > 0 {
+				w.recordJailImage(jailID)
+			}
+			return jailID, name, nil
+		}
+		if strings.Contains(err.Error(), "is already in use by container") {
+			if conflicts == maxNameConflicts {
+				return "", name, err
+			}
+			conflicts++
+			if w.removeStaleJail(name) {
+				l.Println("Removed stale jail holding the name", name)
+				continue
+			}
+			renamed := containerName(name + "-" + newID()[:6])
+			l.Printf("Jail name %s is taken, retrying as %s", name, renamed)
+			args, name = renameJail(args, renamed), renamed
+			continue
+		}
+		failures++
+		delay, ok := w.createRetries.backoff(failures, started, err)
+		if !ok {
+			return "", name, jailStartError{err}
+		}
+		l.Printf("Failed to create jail, retrying in %v: %v", delay, err)
+		fmt.Fprintf(ch, "Failed to start your session, retrying in %v...\r\n", delay)
+		time.Sleep(delay)
+	}
+}
+
+// maxContainerName is the longest jail name used, so that names are also
+// valid hostnames.
+const maxContainerName = 63
+
+var invalidContainerNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// containerName makes name a valid docker container name. Characters docker
+// doesn't allow are replaced, and long names truncated, in which case a hash
+// of the original name is appended so that distinct names stay distinct.
+func containerName(name string) string {
+	sanitized := invalidContainerNameRegexp.ReplaceAllString(name, "_")
+	if sanitized == name && len(name) <= maxContainerName {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(sum[:])[:12]
+	if len(sanitized) > maxContainerName-len(suffix) {
+		sanitized = sanitized[:maxContainerName-len(suffix)]
+	}
+	return sanitized + suffix
+}
+
+// removeStaleJail removes the container called name if it is a stopped
+// jail of this instance, e.g. one left behind by a previous run.
+func (w *Warden) removeStaleJail(name string) bool {
+	out, err := exec.Command("docker", "inspect", "-f",
+		`{{index .Config.Labels "`+instanceLabel+`"}} {{.State.Running}}`, name).Output()
+	if err != nil || strings.TrimSpace(string(out)) != w.instance+" false" {
+		return false
+	}
+	return w.docker("rm", name).Run() == nil
+}
+
+// renameJail returns a copy of args with the value of --name replaced.
+func renameJail(args []string, name string) []string {
+	renamed := append([]string(nil), args...)
+	for i := range renamed[:len(renamed)-1] {
+		if renamed[i] == "--name" {
+			renamed[i+1] = name
+		}
+	}
+	return renamed
+}
+
+func (w *Warden) dockerCreate(args, environ []string, image string, cmd []string) (string, error) {
+	args = append(append(args[:len(args):len(args)], image), cmd...)
+	var stderr bytes.Buffer
+	runCmd := w.docker(args...)
+	runCmd.Env = append(append(os.Environ(), environ...), w.registryEnviron(image)...)
+	runCmd.Stderr = &stderr
+	out, err := runCmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// dockerFailedStatus is the status docker run and docker start exit with
+// when docker itself, rather than the jailed command, failed.
+const dockerFailedStatus = 125
+
+// exitStatus returns the exit status to report to the client for the docker
+// command running a session. docker exec and docker start -a both exit with
+// the status of the command inside the jail, except when docker itself
+// fails, which is reported the way ssh reports its own errors. The command
+// may have exited with docker's status itself, so dockerFailed is asked
+// which it was.
+func exitStatus(state *os.ProcessState, dockerFailed func() bool) uint32 {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		if state.Success() {
+			return 0
+		}
+		return 1
+	}
+	switch {
+	case ws.Signaled():
+		return 128 + uint32(ws.Signal())
+	case ws.ExitStatus() == dockerFailedStatus && dockerFailed():
+		log.Println("Docker failed to run the jail command")
+		return 255
+	}
+	return uint32(ws.ExitStatus())
+}
+
+// jailCommandFailed reports whether docker failed to run a session's command
+// in its jail. A session exec'd in a shared jail can't have run if the jail
+// isn't running, and an ephemeral jail's can't have if docker never started
+// the jail. Docker removes ephemeral jails once they exit, including ones it
+// failed to start, so for those it looks for the jail starting in docker's
+// events since it was created.
+func jailCommandFailed(jailID string, shared bool, since time.Time) bool {
+	format := "{{.State.StartedAt}}"
+	if shared {
+		format = "{{.State.Running}}"
+	}
+	out, err := exec.Command("docker", "inspect", "-f", format, jailID).CombinedOutput()
+	if err != nil {
+		if shared || !strings.Contains(string(out), "No such") {
+			return true
+		}
+		return !jailStarted(jailID, since)
+	}
+	if shared {
+		return strings.TrimSpace(string(out)) != "true"
+	}
+	return strings.HasPrefix(string(out), "0001-01-01")
+}
+
+// jailStarted reports whether docker's events show a removed jail, created
+// after the given time, starting. Docker only keeps so many events, so a jail whose
+// creation isn't among them is assumed to have started.
+func jailStarted(jailID string, since time.Time) bool {
+	out, err := exec.Command("docker", "events",
+		"--since", dockerTimestamp(since), "--until", dockerTimestamp(time.Now()),
+		"--filter", "container="+jailID, "--filter", "event=create", "--filter", "event=start",
+		"--format", "{{.Status}}").Output()
+	if err != nil {
+		return true
+	}
+	events := strings.Fields(string(out))
+	for _, event := range events {
+		if event == "start" {
+			return true
+		}
+	}
+	return len(events) == 0
+}
+
+func dockerTimestamp(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+// releaseJail ends a session's use of its user's shared ephemeral jail,
+// removing the jail once none of the user's sessions are using it.
+func (w *Warden) releaseJail(l logger, key, jailID string) {
+	w.jailsMu.Lock()
+	defer w.jailsMu.Unlock()
+	w.jailRefs[key]--
+	if w.jailRefs[key] > 0 {
+		return
+	}
+	delete(w.jailRefs, key)
+	// The jail may have been recreated by a later session.
+	if id, ok := w.jails[key]; ok {
+		jailID = id
+		delete(w.jails, key)
+	}
+	if out, err := w.docker("rm", "-f", jailID).CombinedOutput(); err != nil {
+		l.Printf("Failed to remove jail %s: %v: %s", jailID, err, bytes.TrimSpace(out))
+	}
+	w.jailGone(jailID)
+}
+
+// jailGate is the file the jail script of a gated ephemeral jail waits for
+// before doing anything, so that the create hook and readiness probe can
+// run first.
+const jailGate = "/tmp/.warden-ready"
+
+// gated reports whether ephemeral jails wait for openJail before running
+// the jail script. Jails that may need to fall back are gated so that they
+// can be replaced if they fail to start, before anything runs in them, and
+// jails with a bandwidth limit so that nothing runs in them unlimited.
+func (j Jail) gated() bool {
+	return !j.shared() && (j.CreateHook != nil || j.ReadinessProbe != nil || j.FallbackImage != "" ||
+		j.NetworkBandwidth != nil)
+}
+
+// openJail limits the bandwidth of a gated ephemeral jail and runs its
+// create hook and readiness probe, and then lets its jail script continue.
+// An ephemeral jail's network only exists once docker start has started it.
+func (w *Warden) openJail(s *session, jailID string) error {
+	if err := waitStarted(jailID); err != nil {
+		return err
+	}
+	if w.jail.NetworkBandwidth != nil {
+		if err := w.limitBandwidth(jailID, 1); err != nil {
+			return fmt.Errorf("Failed to limit network bandwidth: %v", err)
+		}
+	}
+	if w.jail.CreateHook != nil {
+		if err := w.runCreateHook(s.log, s.info, jailID); err != nil {
+			return err
+		}
+	}
+	if w.jail.ReadinessProbe != nil {
+		if err := w.waitReady(s, jailID); err != nil {
+			return err
+		}
+	}
+	if w.runsCommand(jailID) {
+		// The jail command doesn't wait for the gate, and there is no
+		// shell in the jail to open it with.
+		return nil
+	}
+	if out, err := exec.Command("docker", "exec", jailID, "touch", jailGate).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to open jail: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// jailStartTimeout bounds how long docker start may take to start a gated
+// jail.
+const jailStartTimeout = 30 * time.Second
+
+// waitStarted waits for docker start to start a gated jail. A gated jail
+// can't exit before it is opened, so one that is gone failed to start and
+// was removed because of --rm.
+func waitStarted(jailID string) error {
+	deadline := time.Now().Add(jailStartTimeout)
+	for {
+		out, err := exec.Command("docker", "inspect", "-f", "{{.State.Running}} {{.State.Error}}", jailID).CombinedOutput()
+		state := strings.TrimSpace(string(out))
+		switch {
+		case err == nil && state == "true":
+			return nil
+		case err == nil && strings.HasPrefix(state, "false "):
+			return jailStartError{fmt.Errorf("Failed to start jail: %s", strings.TrimPrefix(state, "false "))}
+		case err != nil && strings.Contains(state, "No such"):
+			return jailStartError{errors.New("Failed to start jail")}
+		case time.Now().After(deadline):
+			return fmt.Errorf("Jail did not start within %v", jailStartTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// waitRunning waits for docker to report a jail running.
+func waitRunning(ctx context.Context, jailID string) error {
+	for {
+		out, err := exec.CommandContext(ctx, "docker", "inspect", "-f", "{{.State.Running}}", jailID).Output()
+		if err == nil && strings.TrimSpace(string(out)) == "true" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("Jail did not start in time")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// openPersistentJail makes sure s's persistent jail, jailID, is running,
+// and returns its ID. If there is no jail yet, or it fails to restart, a
+// new one is created, running the create hook. The tenant's jail must
+// already be reserved for a jail that doesn't exist yet. The caller doesn't
+// hold jailsMu, since this waits on docker.
+func (w *Warden) openPersistentJail(s *session, jailID, name string, runArgs []string, profile Profile) (string, error) {
+	if jailID != "" {
+		err := w.startJail(jailID)
+		if err == nil {
+			return jailID, nil
+		}
+		s.log.Println("Recreating persistent jail:", err)
+		w.jailGone(jailID)
+		if err := w.reserveJail(s.info.Tenant); err != nil {
+			fmt.Fprintf(s.ch, "%v.\r\n", err)
+			return "", err
+		}
+	}
+	args := append([]string{"run", "-d"}, runArgs...)
+	jailID, _, err := w.createJail(s.log, s.ch, name, args, nil, "bash", "-c", "while true; do sleep 1; done")
+	if err != nil {
+		w.cancelJail(s.info.Tenant)
+		return "", fmt.Errorf("Failed to create jail: %v", err)
+	}
+	w.trackJail(s.info.Tenant, jailID)
+	if w.jail.CreateHook != nil {
+		if err := w.runCreateHook(s.log, s.info, jailID); err != nil {
+			w.docker("rm", "-f", jailID).Run()
+			w.jailGone(jailID)
+			return "", err
+		}
+	}
+	if w.verifyLimits {
+		verifyLimits(s.log, jailID, profile)
+	}
+	return jailID, nil
+}
@@ -0,0 +1,604 @@
+package warden
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestContainerName(t *testing.T) {
+	long := "warden-auto-1234-" + strings.Repeat("a", 60)
+	for _, test := range []struct {
+		name, want string
+	}{
+		{"warden-auto-1234-alice", "warden-auto-1234-alice"},
+		{"warden-auto-1234-alice+dev", "warden-auto-1234-alice_dev-"},
+		{"warden-auto-1234-bob@example.com", "warden-auto-1234-bob_example.com-"},
+		{long, long[:maxContainerName-13] + "-"},
+	} {
+		got := containerName(test.name)
+		if len(got) > maxContainerName {
+			t.Errorf("containerName(%q) = %q, longer than %d", test.name, got, maxContainerName)
+		}
+		if got == test.want {
+			continue
+		}
+		// Changed names end with a hash of the original.
+		if !strings.HasSuffix(test.want, "-") || !strings.HasPrefix(got, test.want) || len(got) != len(test.want)+12 {
+			t.Errorf("containerName(%q) = %q, want %q followed by a hash", test.name, got, test.want)
+		}
+	}
+	if containerName(long+"x") == containerName(long+"y") {
+		t.Error("containerName gave long names differing at the end the same name")
+	}
+	if containerName("alice+dev") == containerName("alice_dev") {
+		t.Error("containerName gave names differing in an invalid character the same name")
+	}
+}
+
+func TestRenameJail(t *testing.T) {
+	args := []string{"create", "-it", "--name", "warden-alice", "-h", "host"}
+	renamed := renameJail(args, "warden-alice-abc123")
+	want := []string{"create", "-it", "--name", "warden-alice-abc123", "-h", "host"}
+	if !reflect.DeepEqual(renamed, want) {
+		t.Errorf("renameJail = %q, want %q", renamed, want)
+	}
+	if args[3] != "warden-alice" {
+		t.Error("renameJail changed its argument")
+	}
+	// A trailing --name has no value to replace.
+	if got := renameJail([]string{"run", "--name"}, "x"); !reflect.DeepEqual(got, []string{"run", "--name"}) {
+		t.Errorf("renameJail with a trailing --name = %q", got)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	for _, test := range []struct {
+		script       string
+		dockerFailed bool
+		want         uint32
+	}{
+		{"exit 0", false, 0},
+		{"exit 3", false, 3},
+		{"exit 125", false, 125},
+		{"exit 125", true, 255},
+		{"exit 126", true, 126},
+		{"kill -9 $$", false, 128 + 9},
+		{"kill -HUP $$", true, 128 + 1},
+	} {
+		cmd := exec.Command("sh", "-c", test.script)
+		cmd.Run()
+		asked := false
+		got := exitStatus(cmd.ProcessState, func() bool {
+			asked = true
+			return test.dockerFailed
+		})
+		if got != test.want {
+			t.Errorf("exitStatus(%q) with dockerFailed=%v = %d, want %d", test.script, test.dockerFailed, got, test.want)
+		}
+		if asked != strings.HasSuffix(test.script, "125") {
+			t.Errorf("exitStatus(%q) asked whether docker failed: %v", test.script, asked)
+		}
+	}
+}
+
+// fakeDocker puts a docker script first in PATH for the rest of the test,
+// and returns the file it logs its arguments to.
+func fakeDocker(t *testing.T, script string) string {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	script = "#!/bin/sh\necho \"$*\" >> " + log + "\n" + script
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FAKE_DIR", dir)
+	// Sessions are still torn down after their clients see them end, so
+	// let docker go quiet before the directory is removed.
+	t.Cleanup(func() {
+		size := int64(-1)
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(30 * time.Millisecond) {
+			fi, err := os.Stat(log)
+			if err != nil && size == 0 || err == nil && fi.Size() == size {
+				return
+			}
+			size = 0
+			if err == nil {
+				size = fi.Size()
+			}
+		}
+	})
+	return log
+}
+
+func dockerCalls(t *testing.T, log, command string) []string {
+	b, err := ioutil.ReadFile(log)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if strings.HasPrefix(line, command+" ") {
+			calls = append(calls, line)
+		}
+	}
+	return calls
+}
+
+// conflictOnce fails to create a jail the first time with a name conflict,
+// and reports the jail holding the name as $HOLDER.
+const conflictOnce = `case "$1" in
+create)
+  if [ ! -e "$FAKE_DIR/conflicted" ] || [ -n "$ALWAYS_CONFLICT" ]; then
+    touch "$FAKE_DIR/conflicted"
+    echo 'Error response from daemon: Conflict. The container name "/x" is already in use by container "abc".' >&2
+    exit 125
+  fi
+  echo jail-id;;
+inspect) echo "$HOLDER";;
+esac
+`
+
+func testJailWarden() *Warden {
+	return &Warden{
+		jail:         Jail{Image: "ubuntu"},
+		instance:     "test",
+		shellProbes:  make(map[string]bool),
+		commandJails: make(map[string]bool),
+	}
+}
+
+func TestRunJailRemovesStaleJail(t *testing.T) {
+	log := fakeDocker(t, conflictOnce)
+	// The name is held by a stopped jail of this instance.
+	t.Setenv("HOLDER", "test false")
+	w := testJailWarden()
+	args := []string{"create", "--name", "warden-alice"}
+	jailID, _, err := w.runJail(logger("test"), nil, "warden-alice", args, nil, "ubuntu", []string{"bash"})
+	if err != nil || jailID != "jail-id" {
+		t.Fatalf("runJail = %q, %v", jailID, err)
+	}
+	if rm := dockerCalls(t, log, "rm"); len(rm) != 1 || rm[0] != "rm warden-alice" {
+		t.Errorf("Stale jail removed with %q", rm)
+	}
+	creates := dockerCalls(t, log, "create")
+	if len(creates) != 2 || creates[1] != "create --name warden-alice ubuntu bash" {
+		t.Errorf("Jail created with %q, want it retried under the same name", creates)
+	}
+}
+
+func TestRunJailRenamesOnConflict(t *testing.T) {
+	for _, holder := range []string{
+		// Running jails and other instances' jails are left alone.
+		"test true",
+		"other false",
+		"",
+	} {
+		log := fakeDocker(t, conflictOnce)
+		t.Setenv("HOLDER", holder)
+		w := testJailWarden()
+		args := []string{"create", "--name", "warden-alice"}
+		jailID, name, err := w.runJail(logger("test"), nil, "warden-alice", args, nil, "ubuntu", []string{"bash"})
+		if err != nil || jailID != "jail-id" {
+			t.Fatalf("Held by %q: runJail = %q, %v", holder, jailID, err)
+		}
+		if rm := dockerCalls(t, log, "rm"); len(rm) != 0 {
+			t.Errorf("Held by %q: removed %q", holder, rm)
+		}
+		creates := dockerCalls(t, log, "create")
+		if len(creates) != 2 || !strings.HasPrefix(creates[1], "create --name warden-alice-") || creates[1] == creates[0] {
+			t.Errorf("Held by %q: jail created with %q, want it retried under a new name", holder, creates)
+		}
+		if creates[1] != "create --name "+name+" ubuntu bash" {
+			t.Errorf("Held by %q: runJail returned name %q, want the one from %q", holder, name, creates[1])
+		}
+	}
+}
+
+func TestRunJailGivesUpOnConflicts(t *testing.T) {
+	log := fakeDocker(t, conflictOnce)
+	t.Setenv("ALWAYS_CONFLICT", "1")
+	w := testJailWarden()
+	_, _, err := w.runJail(logger("test"), nil, "warden-alice", []string{"create", "--name", "warden-alice"}, nil, "ubuntu", []string{"bash"})
+	if err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("runJail = %v, want a name conflict", err)
+	}
+	if _, ok := err.(jailStartError); ok {
+		t.Error("A name conflict would fall back to another image")
+	}
+	if creates := dockerCalls(t, log, "create"); len(creates) != maxNameConflicts+1 {
+		t.Errorf("Jail created %d times, want %d", len(creates), maxNameConflicts+1)
+	}
+}
+
+// conflictTwice fails to create a jail twice with a name conflict. The
+// original name is held by another instance's jail, and any other by a
+// stale jail of this one. Creating from $BAD_IMAGE fails.
+const conflictTwice = `case "$1" in
+create)
+  if [ ! -e "$FAKE_DIR/conflicted2" ]; then
+    [ -e "$FAKE_DIR/conflicted" ] && touch "$FAKE_DIR/conflicted2"
+    touch "$FAKE_DIR/conflicted"
+    echo 'Error response from daemon: Conflict. The container name "/x" is already in use by container "abc".' >&2
+    exit 125
+  fi
+  case " $* " in *" $BAD_IMAGE "*) echo 'Unable to find image' >&2; exit 125;; esac
+  echo jail-id;;
+inspect)
+  case "$*" in *warden-alice-*) echo 'test false';; *) echo 'other false';; esac;;
+esac
+`
+
+func TestRunJailRemovesStaleRenamedJail(t *testing.T) {
+	log := fakeDocker(t, conflictTwice)
+	w := testJailWarden()
+	jailID, name, err := w.runJail(logger("test"), nil, "warden-alice", []string{"create", "--name", "warden-alice"}, nil, "ubuntu", []string{"bash"})
+	if err != nil || jailID != "jail-id" {
+		t.Fatalf("runJail = %q, %v", jailID, err)
+	}
+	// The second conflict is on the renamed jail's name, which is the one
+	// checked for being stale.
+	if rm := dockerCalls(t, log, "rm"); len(rm) != 1 || rm[0] != "rm "+name || name == "warden-alice" {
+		t.Errorf("Removed %q, want only the stale jail holding the new name %q", rm, name)
+	}
+}
+
+func TestCreateJailFallsBackFromRenamedJail(t *testing.T) {
+	log := fakeDocker(t, conflictTwice)
+	t.Setenv("BAD_IMAGE", "ubuntu")
+	w := testJailWarden()
+	w.jail.FallbackImage = "debian"
+	// Only conflict once.
+	if err := ioutil.WriteFile(filepath.Join(os.Getenv("FAKE_DIR"), "conflicted"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ch := &fakeChannel{}
+	jailID, image, err := w.createJail(logger("test"), ch, "warden-alice", []string{"create", "--name", "warden-alice"}, nil, "bash")
+	if err != nil || jailID != "jail-id" || image != "debian" {
+		t.Fatalf("createJail = %q, %q, %v", jailID, image, err)
+	}
+	creates := dockerCalls(t, log, "create")
+	if len(creates) != 3 {
+		t.Fatalf("Jail created with %q", creates)
+	}
+	renamed := strings.Fields(creates[1])[2]
+	if rm := dockerCalls(t, log, "rm"); len(rm) != 1 || rm[0] != "rm -f "+renamed {
+		t.Errorf("Removed %q, want only the renamed jail %s left by the primary image", rm, renamed)
+	}
+	if creates[2] != "create --name "+renamed+" debian bash" {
+		t.Errorf("Fallback jail created with %q", creates[2])
+	}
+}
+
+func TestJailCommandFailedRemovedJail(t *testing.T) {
+	for _, test := range []struct {
+		events string
+		want   bool
+	}{
+		{"create start die destroy", false},
+		// Docker removed the jail it failed to start.
+		{"create destroy", true},
+		// The jail's events are no longer kept.
+		{"", false},
+	} {
+		fakeDocker(t, `case "$1" in
+inspect) echo 'Error: No such object: jail-id' >&2; exit 1;;
+events) for e in $EVENTS; do case "$e" in create|start) echo $e;; esac; done;;
+esac
+`)
+		t.Setenv("EVENTS", test.events)
+		if got := jailCommandFailed("jail-id", false, time.Now()); got != test.want {
+			t.Errorf("With events %q: jailCommandFailed = %v, want %v", test.events, got, test.want)
+		}
+	}
+}
+
+// startFails creates jails, except from the images in $BAD_IMAGES, which
+// can't be found, and probes $NO_SHELL as having no shell.
+const startFails = `case "$1" in
+run) case " $* " in *" $NO_SHELL "*) exit 127;; esac;;
+create)
+  for image in $BAD_IMAGES; do
+    case " $* " in *" $image "*) echo 'Unable to find image' >&2; exit 125;; esac
+  done
+  echo jail-id;;
+esac
+`
+
+func TestCreateJailFallback(t *testing.T) {
+	for _, test := range []struct {
+		name                           string
+		fallback, bad, noShell, denied string
+		image                          string
+		fellBack                       bool
+	}{
+		{name: "primary starts", fallback: "debian", image: "ubuntu"},
+		{name: "falls back", fallback: "debian", bad: "ubuntu", image: "debian", fellBack: true},
+		{name: "no fallback", bad: "ubuntu"},
+		{name: "fallback fails too", fallback: "debian", bad: "ubuntu debian", fellBack: true},
+		// Images warden refuses aren't fallen back from.
+		{name: "no shell", fallback: "debian", noShell: "ubuntu"},
+		{name: "disallowed registry", fallback: "debian", denied: "ubuntu"},
+	} {
+		log := fakeDocker(t, startFails)
+		t.Setenv("BAD_IMAGES", test.bad)
+		t.Setenv("NO_SHELL", test.noShell)
+		w := testJailWarden()
+		w.jail.FallbackImage = test.fallback
+		if test.denied != "" {
+			w.allowedRegistries = []string{"registry.example.com"}
+		}
+		ch := &fakeChannel{}
+		jailID, image, err := w.createJail(logger("test"), ch, "warden-alice", []string{"create", "--name", "warden-alice"}, nil, "bash")
+		if test.image != "" && (err != nil || jailID != "jail-id" || image != test.image) {
+			t.Errorf("%s: createJail = %q, %q, %v, want a jail from %s", test.name, jailID, image, err, test.image)
+		}
+		if test.image == "" && err == nil {
+			t.Errorf("%s: createJail succeeded from %s", test.name, image)
+		}
+		fellBack := strings.Contains(ch.String(), "using debian instead")
+		if fellBack != test.fellBack {
+			t.Errorf("%s: fell back %v, want %v, told the user %q", test.name, fellBack, test.fellBack, ch.String())
+		}
+		if creates := dockerCalls(t, log, "create"); fellBack && len(creates) != 2 {
+			t.Errorf("%s: jail created with %q, want the primary and fallback images tried", test.name, creates)
+		}
+	}
+}
+
+func TestWaitStarted(t *testing.T) {
+	for _, test := range []struct {
+		inspect    string
+		started    bool
+		startError bool
+	}{
+		{"echo true", true, false},
+		{"echo 'false OCI runtime create failed'", false, true},
+		// Gated jails removed because of --rm failed to start.
+		{"echo 'Error: No such object: jail-id' >&2; exit 1", false, true},
+	} {
+		fakeDocker(t, test.inspect)
+		err := waitStarted("jail-id")
+		if (err == nil) != test.started {
+			t.Errorf("%q: waitStarted = %v", test.inspect, err)
+		}
+		if _, ok := err.(jailStartError); ok != test.startError {
+			t.Errorf("%q: waitStarted = %#v, fallen back from: %v", test.inspect, err, ok)
+		}
+	}
+}
+
+func TestGated(t *testing.T) {
+	for _, test := range []struct {
+		jail  Jail
+		gated bool
+	}{
+		{Jail{Image: "ubuntu"}, false},
+		{Jail{Image: "ubuntu", FallbackImage: "debian"}, true},
+		{Jail{Image: "ubuntu", ReadinessProbe: &ReadinessProbe{}}, true},
+		{Jail{Image: "ubuntu", NetworkBandwidth: &NetworkBandwidth{Rate: "10mbit", Image: "netshoot"}}, true},
+		// Shared jails are created with docker run, which reports failing to
+		// start them.
+		{Jail{Image: "ubuntu", FallbackImage: "debian", Persistent: true}, false},
+	} {
+		if gated := test.jail.gated(); gated != test.gated {
+			t.Errorf("%+v gated = %v, want %v", test.jail, gated, test.gated)
+		}
+	}
+}
+
+// stoppedDocker is jailDocker with jails that stop when $FAKE_DIR/stopped
+// exists, and fail to start again if $START_FAILS is set.
+const stoppedDocker = `case "$1" in
+inspect) if [ -e "$FAKE_DIR/stopped" ]; then echo false; else echo true; fi; exit;;
+start) [ -z "$START_FAILS" ] || { echo "Error: No such container" >&2; exit 1; }; rm -f "$FAKE_DIR/stopped"; exit;;
+run) rm -f "$FAKE_DIR/stopped";;
+esac
+` + jailDocker
+
+func TestStoppedPersistentJail(t *testing.T) {
+	for _, startFails := range []bool{false, true} {
+		log := fakeDocker(t, stoppedDocker)
+		if startFails {
+			t.Setenv("START_FAILS", "1")
+		}
+		_, addr := startWarden(t, Config{Jail: Jail{Persistent: true}})
+		if out, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+			t.Fatalf("First session = %q, %v", out, err)
+		}
+		// The jail is stopped behind warden's back between sessions.
+		if err := ioutil.WriteFile(filepath.Join(os.Getenv("FAKE_DIR"), "stopped"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil || !strings.HasPrefix(out, "session in id-") {
+			t.Errorf("Start fails %v: session after the jail stopped = %q, %v", startFails, out, err)
+		}
+		starts, creates := dockerCalls(t, log, "start"), dockerCalls(t, log, "run -d")
+		if len(starts) != 1 || !strings.Contains(starts[0], "id-") {
+			t.Errorf("Start fails %v: started %q, want the stopped jail started", startFails, starts)
+		}
+		// A jail that won't start again is replaced.
+		if want := map[bool]int{false: 1, true: 2}[startFails]; len(creates) != want {
+			t.Errorf("Start fails %v: created %d jails, want %d", startFails, len(creates), want)
+		}
+	}
+}
+
+// sharedDocker fakes docker for shared jails, numbering the jails it
+// creates. Sessions print the jail they are in and then run until their
+// input ends.
+const sharedDocker = `jail=
+for a; do case "$a" in id-*) jail=$a;; esac; done
+case "$1" in
+run)
+  n=$(cat "$FAKE_DIR/jails" 2> /dev/null || echo 0); n=$((n + 1)); echo $n > "$FAKE_DIR/jails"
+  echo "id-$n";;
+inspect) echo true;;
+exec) case "$*" in *" bash -c "*"su "*) echo "session in $jail"; cat > /dev/null;; esac;;
+esac
+`
+
+// sharedSession is a running session, which ends once its input is closed.
+type sharedSession struct {
+	*ssh.Session
+	stdin io.WriteCloser
+	jail  string
+}
+
+func startSharedSession(t *testing.T, addr, user string) sharedSession {
+	s, err := dialWarden(t, addr, user).NewSession()
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Shell(); err != nil {
+		t.Fatal("Shell:", err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("%s's session printed %q, %v", user, line, err)
+	}
+	go io.Copy(ioutil.Discard, stdout)
+	return sharedSession{s, stdin, strings.TrimPrefix(strings.TrimSpace(line), "session in ")}
+}
+
+func (s sharedSession) end() {
+	s.stdin.Close()
+	s.Wait()
+}
+
+func TestSharedEphemeralJail(t *testing.T) {
+	log := fakeDocker(t, sharedDocker)
+	_, addr := startWarden(t, Config{Jail: Jail{SharedEphemeral: true}, HangupGrace: Duration(100 * time.Millisecond)})
+	first := startSharedSession(t, addr, "alice")
+	second := startSharedSession(t, addr, "alice")
+	bob := startSharedSession(t, addr, "bob")
+	if first.jail != second.jail || first.jail == bob.jail {
+		t.Errorf("Sessions ran in %s and %s for alice and %s for bob, want alice's sessions to share a jail", first.jail, second.jail, bob.jail)
+	}
+	if runs := dockerCalls(t, log, "run -d"); len(runs) != 2 {
+		t.Errorf("Created %d jails, want one for each user", len(runs))
+	}
+
+	// The jail outlives the first of alice's sessions to end, and goes with
+	// the last.
+	first.end()
+	if removes := dockerCalls(t, log, "rm"); len(removes) != 0 {
+		t.Errorf("Removed %q while alice still had a session", removes)
+	}
+	second.end()
+	// Jails are removed once their session's channel has closed.
+	for deadline := time.Now().Add(5 * time.Second); len(dockerCalls(t, log, "rm")) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if removes := dockerCalls(t, log, "rm"); len(removes) != 1 || removes[0] != "rm -f "+first.jail {
+		t.Errorf("Removed %q once alice's sessions ended, want her jail removed", removes)
+	}
+
+	// Her next session gets a new jail.
+	third := startSharedSession(t, addr, "alice")
+	if third.jail == first.jail || third.jail == bob.jail {
+		t.Errorf("Alice's next session ran in %s, want a new jail", third.jail)
+	}
+	third.end()
+	bob.end()
+	// Wait for the rest to be removed before the fake's directory is.
+	for deadline := time.Now().Add(5 * time.Second); len(dockerCalls(t, log, "rm")) < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Removed %q once every session ended, want all three jails removed", dockerCalls(t, log, "rm"))
+		}
+	}
+}
+
+func TestJailValidateSharedEphemeral(t *testing.T) {
+	if err := (Jail{SharedEphemeral: true, Persistent: true}).validate(); err == nil {
+		t.Error("Jails both persistent and shared ephemeral were accepted")
+	}
+	if err := (Jail{SharedEphemeral: true}).validate(); err != nil {
+		t.Errorf("Shared ephemeral jails: validate() = %v", err)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	for msg, want := range map[string]bool{
+		"Error response from daemon: toomanyrequests: You have reached your pull rate limit.": true,
+		"Error response from daemon: received unexpected HTTP status: 429 Too Many Requests":  true,
+		"You have reached your pull rate limit. You may increase the limit by authenticating": true,
+		"Unable to find image 'ubuntu:latest' locally":                                        false,
+		"Error response from daemon: Conflict. The container name is already in use":          false,
+	} {
+		if got := rateLimited(errors.New(msg)); got != want {
+			t.Errorf("rateLimited(%q) = %v, want %v", msg, got, want)
+		}
+	}
+}
+
+// rateLimitedDocker creates jails, except from the images in
+// $RATE_LIMITED, whose registry is rate limiting pulls.
+const rateLimitedDocker = `[ "$1" = create ] || exit 0
+for image in $RATE_LIMITED; do
+  case " $* " in *" $image "*)
+    echo 'Error response from daemon: toomanyrequests: You have reached your pull rate limit.' >&2
+    exit 125;;
+  esac
+done
+echo jail-id
+`
+
+func TestCreateJailRateLimited(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	for _, test := range []struct {
+		name, fallback, limited string
+		ok                      bool
+		warned                  []string
+	}{
+		{name: "rate limited", limited: "ubuntu", warned: []string{"ubuntu"}},
+		// A cached fallback image is still available.
+		{name: "falls back", fallback: "debian", limited: "ubuntu", ok: true, warned: []string{"ubuntu"}},
+		{name: "both rate limited", fallback: "debian", limited: "ubuntu debian", warned: []string{"ubuntu", "debian"}},
+		{name: "not rate limited", fallback: "debian", ok: true},
+	} {
+		fakeDocker(t, rateLimitedDocker)
+		t.Setenv("RATE_LIMITED", test.limited)
+		var logs syncBuffer
+		log.SetOutput(&logs)
+		w := testJailWarden()
+		w.jail.FallbackImage = test.fallback
+		ch := &fakeChannel{}
+		_, _, err := w.createJail(logger("test"), ch, "warden-alice", []string{"create", "--name", "warden-alice"}, nil, "bash")
+		if (err == nil) != test.ok {
+			t.Errorf("%s: createJail = %v, want ok %v", test.name, err, test.ok)
+		}
+		for _, image := range []string{"ubuntu", "debian"} {
+			want := false
+			for _, warned := range test.warned {
+				want = want || warned == image
+			}
+			told := strings.Contains(ch.String(), "Image "+image+" is temporarily unavailable due to registry rate limiting, please try again shortly.\r\n")
+			logged := strings.Contains(logs.String(), "WARNING: registry rate limited pulling "+image+": ")
+			if told != want || logged != want {
+				t.Errorf("%s: told the user %q and logged %q about %s, want rate limiting reported %v", test.name, ch.String(), logs.String(), image, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package warden
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+var labelKeyRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
+type label struct {
+	key   string
+	value *template.Template
+}
+
+func parseLabels(labels map[string]string) ([]label, error) {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parsed := make([]label, len(keys))
+	for i, key := range keys {
+		if !labelKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("Invalid label key %q", key)
+		}
+		tmpl, err := template.New(key).Parse(labels[key])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid template for label %q: %v", key, err)
+		}
+		parsed[i] = label{key: key, value: tmpl}
+	}
+	// Render once against an empty session so that references to unknown
+	// fields are reported at startup rather than on first connection.
+	if _, err := renderLabels(parsed, SessionInfo{}); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// renderLabels returns the docker arguments applying labels for a session.
+func renderLabels(labels []label, info SessionInfo) ([]string, error) {
+	args := make([]string, 0, 2*len(labels))
+	for _, l := range labels {
+		value, err := info.render(l.value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to render label %q: %v", l.key, err)
+		}
+		if strings.ContainsAny(value, "\x00\r\n") {
+			return nil, fmt.Errorf("Label %q rendered to an invalid value %q", l.key, value)
+		}
+		args = append(args, "--label", l.key+"="+value)
+	}
+	return args, nil
+}
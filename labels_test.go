@@ -0,0 +1,70 @@
+package warden
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderLabels(t *testing.T) {
+	labels, err := parseLabels(map[string]string{
+		"warden.tenant":  "{{.Tenant}}",
+		"warden.user":    "{{.User}}",
+		"cost-center":    "team-{{.Tenant}}",
+		"warden.managed": "true",
+	})
+	if err != nil {
+		t.Fatal("parseLabels failed:", err)
+	}
+	args, err := renderLabels(labels, SessionInfo{User: "alice", Tenant: "acme"})
+	if err != nil {
+		t.Fatal("renderLabels failed:", err)
+	}
+	// Labels are rendered in key order.
+	want := []string{
+		"--label", "cost-center=team-acme",
+		"--label", "warden.managed=true",
+		"--label", "warden.tenant=acme",
+		"--label", "warden.user=alice",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("renderLabels = %q, want %q", args, want)
+	}
+
+	// Users without a tenant get an empty value rather than an error.
+	args, err = renderLabels(labels, SessionInfo{User: "bob"})
+	if err != nil {
+		t.Fatal("renderLabels without a tenant failed:", err)
+	}
+	if args[1] != "cost-center=team-" || args[5] != "warden.tenant=" {
+		t.Errorf("renderLabels without a tenant = %q", args)
+	}
+}
+
+func TestParseLabelsInvalid(t *testing.T) {
+	for _, test := range []struct {
+		labels map[string]string
+		err    string
+	}{
+		{map[string]string{"warden.cost": "{{.CostCenter}}"}, "CostCenter"},
+		{map[string]string{"warden.tenant": "{{.Tenant"}, "Invalid template"},
+		{map[string]string{"Warden.Tenant": "x"}, "Invalid label key"},
+		{map[string]string{"warden.": "x"}, "Invalid label key"},
+		{map[string]string{"": "x"}, "Invalid label key"},
+	} {
+		_, err := parseLabels(test.labels)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parseLabels(%q) = %v, want an error containing %q", test.labels, err, test.err)
+		}
+	}
+}
+
+func TestRenderLabelsInvalidValue(t *testing.T) {
+	labels, err := parseLabels(map[string]string{"warden.user": "{{.User}}"})
+	if err != nil {
+		t.Fatal("parseLabels failed:", err)
+	}
+	if _, err := renderLabels(labels, SessionInfo{User: "alice\nevil=1"}); err == nil {
+		t.Error("renderLabels accepted a value with a newline")
+	}
+}
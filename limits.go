@@ -0,0 +1,52 @@
+package warden
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// memoryBytes converts a limit in docker's --memory format to bytes, the
+// way docker does.
+func memoryBytes(limit string) (int64, error) {
+	m := memoryLimitRegexp.FindStringSubmatch(limit)
+	if m == nil {
+		return 0, fmt.Errorf("Invalid memory limit %q", limit)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	multiplier := int64(1)
+	if m[2] != "" {
+		multiplier <<= 10 * uint(strings.Index("kmgtp", strings.ToLower(m[2]))+1)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// verifyLimits warns if the memory and cpus limits of a jail aren't the
+// ones requested, which happens when the host doesn't support them, e.g.
+// without memory cgroups, and docker discards them.
+func verifyLimits(l logger, jailID string, p Profile) {
+	out, err := exec.Command("docker", "inspect", "-f", "{{.HostConfig.Memory}} {{.HostConfig.NanoCpus}}", jailID).Output()
+	if err != nil {
+		l.Println("Failed to verify jail limits:", err)
+		return
+	}
+	var memory, nanoCPUs int64
+	if _, err := fmt.Sscan(string(out), &memory, &nanoCPUs); err != nil {
+		l.Println("Failed to verify jail limits:", err)
+		return
+	}
+	if p.Memory != "" {
+		if want, err := memoryBytes(p.Memory); err == nil && memory != want {
+			l.Printf("WARNING: jail %s has a memory limit of %d bytes rather than %s", jailID, memory, p.Memory)
+		}
+	}
+	if p.CPUs != "" {
+		if cpus, err := strconv.ParseFloat(p.CPUs, 64); err == nil && nanoCPUs != int64(cpus*1e9) {
+			l.Printf("WARNING: jail %s has a cpus limit of %g rather than %s", jailID, float64(nanoCPUs)/1e9, p.CPUs)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package warden
+
+import (
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMemoryBytes(t *testing.T) {
+	for _, test := range []struct {
+		limit string
+		bytes int64
+	}{
+		{"1024", 1024},
+		{"100b", 100},
+		{"4k", 4 << 10},
+		{"512m", 512 << 20},
+		{"512MB", 512 << 20},
+		{"1.5g", 3 << 29},
+		{"2GiB", 2 << 30},
+		{"1 g", 1 << 30},
+		{"1t", 1 << 40},
+		{"1p", 1 << 50},
+	} {
+		bytes, err := memoryBytes(test.limit)
+		if err != nil {
+			t.Errorf("memoryBytes(%q) failed: %v", test.limit, err)
+		} else if bytes != test.bytes {
+			t.Errorf("memoryBytes(%q) = %d, want %d", test.limit, bytes, test.bytes)
+		}
+	}
+	for _, limit := range []string{"", "m", "-1m", "1.m", "1x", "1e3", "1gg", "1.5.5g"} {
+		if _, err := memoryBytes(limit); err == nil {
+			t.Errorf("memoryBytes(%q) succeeded", limit)
+		}
+	}
+}
+
+func TestValidateProfilesLimits(t *testing.T) {
+	profiles := map[string]Profile{
+		"small": {Memory: "512m", CPUs: "0.5"},
+		"large": {Memory: "1.5GB", CPUs: "4"},
+		"gpu":   {Memory: "8q", CPUs: "2"},
+	}
+	err := validateProfiles(profiles, nil)
+	if err == nil {
+		t.Fatal("validateProfiles accepted an invalid memory limit")
+	}
+	if !strings.Contains(err.Error(), `"gpu"`) || !strings.Contains(err.Error(), "memory") {
+		t.Errorf("Error %q doesn't name the profile and field", err)
+	}
+
+	profiles["gpu"] = Profile{Memory: "8g", CPUs: "two"}
+	err = validateProfiles(profiles, nil)
+	if err == nil || !strings.Contains(err.Error(), `"gpu"`) || !strings.Contains(err.Error(), "cpus") {
+		t.Errorf("validateProfiles(%v) = %v, want an error naming the gpu profile's cpus", profiles, err)
+	}
+
+	profiles["gpu"] = Profile{Memory: "8g", CPUs: "2"}
+	if err := validateProfiles(profiles, nil); err != nil {
+		t.Errorf("validateProfiles(%v) failed: %v", profiles, err)
+	}
+}
+
+func TestJailValidateProfileLimits(t *testing.T) {
+	j := Jail{Profile: Profile{Memory: "lots"}}
+	if err := j.validate(); err == nil || !strings.Contains(err.Error(), "jail profile") {
+		t.Errorf("Jail.validate() = %v, want an error naming the jail profile", err)
+	}
+}
+
+func TestScratchSize(t *testing.T) {
+	for size, valid := range map[string]bool{"": true, "256m": true, "1G": true, "1.5g": false, "256MB": false} {
+		s := &Scratch{Path: "/scratch", Size: size}
+		if err := s.validate(); (err == nil) != valid {
+			t.Errorf("Scratch size %q: validate() = %v", size, err)
+		}
+	}
+}
+
+// limitsDocker is jailDocker with jails that have the memory and nano cpus
+// limits in $LIMITS, as docker inspect reports them.
+const limitsDocker = `case "$1 $3" in
+"inspect {{.HostConfig.Memory}} {{.HostConfig.NanoCpus}}")
+  [ -n "$LIMITS" ] || { echo "Error: No such object" >&2; exit 1; }
+  echo "$LIMITS"; exit;;
+esac
+` + jailDocker
+
+func TestVerifyLimits(t *testing.T) {
+	fakeDocker(t, limitsDocker)
+	defer log.SetOutput(os.Stderr)
+	for _, test := range []struct {
+		profile Profile
+		limits  string
+		want    []string
+	}{
+		{Profile{Memory: "512m", CPUs: "1.5"}, "536870912 1500000000", nil},
+		{Profile{}, "0 0", nil},
+		// Limits docker discarded.
+		{Profile{Memory: "512m", CPUs: "1.5"}, "0 0", []string{
+			"WARNING: jail jail-id has a memory limit of 0 bytes rather than 512m",
+			"WARNING: jail jail-id has a cpus limit of 0 rather than 1.5",
+		}},
+		{Profile{Memory: "1g"}, "536870912 0", []string{"memory limit of 536870912 bytes rather than 1g"}},
+		{Profile{CPUs: "2"}, "0 1000000000", []string{"cpus limit of 1 rather than 2"}},
+		{Profile{Memory: "1g"}, "", []string{"Failed to verify jail limits"}},
+	} {
+		var logs syncBuffer
+		log.SetOutput(&logs)
+		t.Setenv("LIMITS", test.limits)
+		verifyLimits(logger("session"), "jail-id", test.profile)
+		got := logs.String()
+		if len(test.want) == 0 && got != "" {
+			t.Errorf("Verifying %+v against %q logged %q", test.profile, test.limits, got)
+		}
+		for _, want := range test.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("Verifying %+v against %q logged %q, want %q", test.profile, test.limits, got, want)
+			}
+		}
+	}
+}
+
+func TestVerifyLimitsSession(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	for _, verify := range []bool{false, true} {
+		dockerLog := fakeDocker(t, limitsDocker)
+		t.Setenv("LIMITS", "0 0")
+		var logs syncBuffer
+		log.SetOutput(&logs)
+		_, addr := startWarden(t, Config{VerifyLimits: verify, Jail: Jail{Profile: Profile{Memory: "256m"}}})
+		if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+			t.Fatal("Session failed:", err)
+		}
+		warned := strings.Contains(logs.String(), "has a memory limit of 0 bytes rather than 256m")
+		inspected := len(dockerCalls(t, dockerLog, "inspect -f {{.HostConfig.Memory}}")) > 0
+		if warned != verify || inspected != verify {
+			t.Errorf("Verify %v: inspected %v, warned %v:\n%s", verify, inspected, warned, logs.String())
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package warden
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// LoadScaling shares memory and cpus budgets between jails, so that each
+// new jail is limited to its share of the budgets at the time it starts,
+// e.g. a quarter with three other jails running. Shares are kept within
+// the minimums and maximums, which means the budgets can be exceeded under
+// heavy load. Jails' limits aren't changed once they have started.
+type LoadScaling struct {
+	// Memory and CPUs are the budgets, in docker's --memory and --cpus
+	// formats. Empty leaves that limit to the jail's profile.
+	Memory    string `json:"memory"`
+	MinMemory string `json:"minMemory"`
+	MaxMemory string `json:"maxMemory"`
+	CPUs      string `json:"cpus"`
+	MinCPUs   string `json:"minCpus"`
+	MaxCPUs   string `json:"maxCpus"`
+}
+
+func (ls *LoadScaling) validate() error {
+	for _, limit := range []string{ls.Memory, ls.MinMemory, ls.MaxMemory} {
+		if limit != "" && !memoryLimitRegexp.MatchString(limit) {
+			return fmt.Errorf("Invalid loadScaling memory limit %q", limit)
+		}
+	}
+	for _, limit := range []string{ls.CPUs, ls.MinCPUs, ls.MaxCPUs} {
+		if limit != "" && !cpuLimitRegexp.MatchString(limit) {
+			return fmt.Errorf("Invalid loadScaling cpus limit %q", limit)
+		}
+	}
+	if ls.MinMemory != "" && ls.MaxMemory != "" && mustMemoryBytes(ls.MinMemory) > mustMemoryBytes(ls.MaxMemory) {
+		return fmt.Errorf("loadScaling minMemory %s exceeds maxMemory %s", ls.MinMemory, ls.MaxMemory)
+	}
+	if ls.MinCPUs != "" && ls.MaxCPUs != "" && mustCPUs(ls.MinCPUs) > mustCPUs(ls.MaxCPUs) {
+		return fmt.Errorf("loadScaling minCpus %s exceeds maxCpus %s", ls.MinCPUs, ls.MaxCPUs)
+	}
+	return nil
+}
+
+// mustMemoryBytes and mustCPUs parse validated limits, with empty ones
+// being zero.
+func mustMemoryBytes(limit string) int64 {
+	if limit == "" {
+		return 0
+	}
+	n, _ := memoryBytes(limit)
+	return n
+}
+
+func mustCPUs(limit string) float64 {
+	n, _ := strconv.ParseFloat(limit, 64)
+	return n
+}
+
+// minMemory and minCPUs are the smallest limits docker accepts. Docker
+// refuses smaller memory limits, and takes a cpus limit of 0 to mean
+// unlimited.
+const (
+	minMemory = 6 << 20
+	minCPUs   = 0.01
+)
+
+// scale returns p with its limits set to one jail's share of the budgets
+// when n jails are running. Shares never go below the limits docker
+// accepts, however many jails are running.
+func (ls *LoadScaling) scale(p Profile, n int) Profile {
+	if ls.Memory != "" {
+		memory := mustMemoryBytes(ls.Memory) / int64(n)
+		if min := mustMemoryBytes(ls.MinMemory); memory < min {
+			memory = min
+		}
+		if max := mustMemoryBytes(ls.MaxMemory); max > 0 && memory > max {
+			memory = max
+		}
+		if memory < minMemory {
+			memory = minMemory
+		}
+		p.Memory = strconv.FormatInt(memory, 10)
+	}
+	if ls.CPUs != "" {
+		cpus := mustCPUs(ls.CPUs) / float64(n)
+		if min := mustCPUs(ls.MinCPUs); cpus < min {
+			cpus = min
+		}
+		if max := mustCPUs(ls.MaxCPUs); max > 0 && cpus > max {
+			cpus = max
+		}
+		if cpus < minCPUs {
+			cpus = minCPUs
+		}
+		p.CPUs = strconv.FormatFloat(cpus, 'f', 2, 64)
+	}
+	return p
+}
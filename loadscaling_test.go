@@ -0,0 +1,44 @@
+package warden
+
+import "testing"
+
+func TestLoadScalingScale(t *testing.T) {
+	for _, test := range []struct {
+		ls     LoadScaling
+		n      int
+		memory string
+		cpus   string
+	}{
+		{LoadScaling{Memory: "4g", CPUs: "4"}, 1, "4294967296", "4.00"},
+		{LoadScaling{Memory: "4g", CPUs: "4"}, 4, "1073741824", "1.00"},
+		{LoadScaling{Memory: "4g", MinMemory: "2g", CPUs: "4", MinCPUs: "2"}, 4, "2147483648", "2.00"},
+		{LoadScaling{Memory: "4g", MaxMemory: "1g", CPUs: "4", MaxCPUs: "1"}, 1, "1073741824", "1.00"},
+		{LoadScaling{Memory: "64m", CPUs: "1"}, 200, "6291456", "0.01"},
+		{LoadScaling{Memory: "1g", CPUs: "0.5"}, 1000, "6291456", "0.01"},
+		{LoadScaling{CPUs: "1"}, 2, "", "0.50"},
+		{LoadScaling{Memory: "1g"}, 2, "536870912", ""},
+	} {
+		p := test.ls.scale(Profile{}, test.n)
+		if p.Memory != test.memory || p.CPUs != test.cpus {
+			t.Errorf("%+v.scale(%d) = %q memory, %q cpus, want %q, %q", test.ls, test.n, p.Memory, p.CPUs, test.memory, test.cpus)
+		}
+	}
+}
+
+func TestLoadScalingValidate(t *testing.T) {
+	for _, test := range []struct {
+		ls LoadScaling
+		ok bool
+	}{
+		{LoadScaling{Memory: "4g", MinMemory: "256m", MaxMemory: "1g", CPUs: "4", MinCPUs: "0.5", MaxCPUs: "2"}, true},
+		{LoadScaling{}, true},
+		{LoadScaling{Memory: "4x"}, false},
+		{LoadScaling{CPUs: "four"}, false},
+		{LoadScaling{Memory: "4g", MinMemory: "2g", MaxMemory: "1g"}, false},
+		{LoadScaling{CPUs: "4", MinCPUs: "2", MaxCPUs: "1"}, false},
+	} {
+		if err := test.ls.validate(); (err == nil) != test.ok {
+			t.Errorf("%+v.validate() = %v, want ok %v", test.ls, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package warden
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// logger prefixes log lines with the identifiers of a connection or session
+// so that it can be followed through the logs.
+type logger string
+
+func (l logger) Println(v ...interface{}) {
+	log.Println(append([]interface{}{string(l)}, v...)...)
+}
+
+func (l logger) Printf(format string, v ...interface{}) {
+	log.Printf(string(l)+" "+format, v...)
+}
+
+// Categories of routine events whose logging can be sampled. Errors and
+// rejections are always logged.
+const (
+	authEvents       = "auth"
+	connectionEvents = "connection"
+	sessionEvents    = "session"
+)
+
+// sampler decides which events of a category are logged, logging one in
+// every n.
+type sampler struct {
+	n     uint64
+	count uint64
+}
+
+func (s *sampler) sample() bool {
+	return s == nil || atomic.AddUint64(&s.count, 1)%s.n == 1%s.n
+}
+
+type samplers map[string]*sampler
+
+func newSamplers(rates map[string]int) (samplers, error) {
+	s := make(samplers)
+	for category, n := range rates {
+		switch category {
+		case authEvents, connectionEvents, sessionEvents:
+		default:
+			return nil, fmt.Errorf("Unknown log sampling category %q", category)
+		}
+		if n < 1 {
+			return nil, fmt.Errorf("Invalid log sampling rate %d for %q", n, category)
+		}
+		s[category] = &sampler{n: uint64(n)}
+	}
+	return s, nil
+}
+
+// sample reports whether the next routine event in category should be logged.
+func (s samplers) sample(category string) bool {
+	return s[category].sample()
+}
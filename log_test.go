@@ -0,0 +1,75 @@
+package warden
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSamplers(t *testing.T) {
+	s, err := newSamplers(map[string]int{authEvents: 1, connectionEvents: 10, sessionEvents: 100})
+	if err != nil {
+		t.Fatal("newSamplers failed:", err)
+	}
+	for _, test := range []struct {
+		category string
+		logged   int
+	}{
+		{authEvents, 1000},
+		{connectionEvents, 100},
+		{sessionEvents, 10},
+		// Categories without a rate are always logged.
+		{"other", 1000},
+	} {
+		logged := 0
+		for i := 0; i < 1000; i++ {
+			if s.sample(test.category) {
+				logged++
+			}
+		}
+		if logged != test.logged {
+			t.Errorf("Logged %d of 1000 %s events, want %d", logged, test.category, test.logged)
+		}
+	}
+
+	// The first event is always logged.
+	s, _ = newSamplers(map[string]int{connectionEvents: 10})
+	if !s.sample(connectionEvents) {
+		t.Error("First event wasn't logged")
+	}
+}
+
+func TestSamplersConcurrent(t *testing.T) {
+	s, _ := newSamplers(map[string]int{connectionEvents: 7})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	logged := 0
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 700; i++ {
+				if s.sample(connectionEvents) {
+					mu.Lock()
+					logged++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if logged != 1000 {
+		t.Errorf("Logged %d of 7000 events sampled 1 in 7, want 1000", logged)
+	}
+}
+
+func TestNewSamplersInvalid(t *testing.T) {
+	for _, rates := range []map[string]int{
+		{"connections": 10},
+		{connectionEvents: 0},
+		{sessionEvents: -1},
+	} {
+		if _, err := newSamplers(rates); err == nil {
+			t.Errorf("newSamplers(%v) succeeded", rates)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package warden
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MintCredentialsFunc issues short-lived credentials for a session. They are
+// set as environment variables in its jail, and the returned function,
+// which may be nil, revokes them once the session ends.
+type MintCredentialsFunc func(SessionInfo) (map[string]string, func() error, error)
+
+// credentialEnv returns the docker arguments passing creds into a jail and
+// the environment the docker client must run with to supply their values.
+// Only the names appear on the docker command line, so the values don't
+// show up in the host's process list.
+func credentialEnv(creds map[string]string) (args, environ []string, err error) {
+	names := make([]string, 0, len(creds))
+	for name := range creds {
+		if !envNameRegexp.MatchString(name) {
+			return nil, nil, fmt.Errorf("Invalid credential env variable name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-e", name)
+		environ = append(environ, name+"="+creds[name])
+	}
+	return args, environ, nil
+}
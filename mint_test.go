@@ -0,0 +1,132 @@
+package warden
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mintDocker is jailDocker, also recording which credential the docker
+// client was run with in $FAKE_DIR/env.
+const mintDocker = `echo "$1 TOKEN=$TOKEN" >> "$FAKE_DIR/env"
+` + jailDocker
+
+// credentialMinter mints a token per session and records revocations.
+type credentialMinter struct {
+	mu      sync.Mutex
+	names   []string
+	revoked []string
+	err     error
+}
+
+func (m *credentialMinter) mint(info SessionInfo) (map[string]string, func() error, error) {
+	if m.err != nil {
+		return nil, nil, m.err
+	}
+	token := "secret-" + info.SessionID
+	revoke := func() error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.revoked = append(m.revoked, token)
+		return nil
+	}
+	creds := map[string]string{}
+	for _, name := range m.names {
+		creds[name] = token
+	}
+	return creds, revoke, nil
+}
+
+func (m *credentialMinter) waitRevoked(t *testing.T, n int) []string {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		m.mu.Lock()
+		revoked := append([]string(nil), m.revoked...)
+		m.mu.Unlock()
+		if len(revoked) >= n || time.Now().After(deadline) {
+			return revoked
+		}
+	}
+}
+
+func TestMintCredentials(t *testing.T) {
+	log := fakeDocker(t, mintDocker)
+	minter := &credentialMinter{names: []string{"TOKEN"}}
+	_, addr := startWarden(t, Config{MintCredentials: minter.mint})
+	if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+		t.Fatal("Session failed:", err)
+	}
+	revoked := minter.waitRevoked(t, 1)
+	if len(revoked) != 1 {
+		t.Fatalf("Revoked %q, want the session's credentials", revoked)
+	}
+
+	// The value is passed in the docker client's environment, and only
+	// the name on its command line.
+	creates := dockerCalls(t, log, "create")
+	if len(creates) != 1 || !strings.Contains(creates[0], " -e TOKEN ") {
+		t.Errorf("Jails created with %q, want TOKEN passed in", creates)
+	}
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret-") {
+		t.Errorf("Credentials appear on docker's command line:\n%s", b)
+	}
+	env, err := ioutil.ReadFile(filepath.Join(os.Getenv("FAKE_DIR"), "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(env), "create TOKEN="+revoked[0]+"\n") {
+		t.Errorf("Jail created with environment:\n%s\nwant TOKEN=%s", env, revoked[0])
+	}
+}
+
+func TestMintCredentialsFailed(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		minter *credentialMinter
+		// revoked is whether credentials were issued, and so must be
+		// revoked.
+		revoked bool
+	}{
+		{"mint failed", &credentialMinter{err: errors.New("vault is sealed")}, false},
+		{"invalid name", &credentialMinter{names: []string{"NOT-A-NAME"}}, true},
+	} {
+		log := fakeDocker(t, jailDocker)
+		_, addr := startWarden(t, Config{MintCredentials: test.minter.mint})
+		out, err := runShell(t, dialWarden(t, addr, "alice"), nil)
+		if err == nil {
+			t.Errorf("%s: session succeeded with output %q", test.name, out)
+		}
+		if creates := dockerCalls(t, log, "create"); len(creates) != 0 {
+			t.Errorf("%s: jails created with %q", test.name, creates)
+		}
+		n := 0
+		if test.revoked {
+			n = 1
+		}
+		if revoked := test.minter.waitRevoked(t, n); len(revoked) != n {
+			t.Errorf("%s: revoked %q, want %d credentials revoked", test.name, revoked, n)
+		}
+	}
+}
+
+func TestCredentialEnv(t *testing.T) {
+	args, environ, err := credentialEnv(map[string]string{"B_TOKEN": "b", "A_TOKEN": "a=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(args, " ") != "-e A_TOKEN -e B_TOKEN" || strings.Join(environ, " ") != "A_TOKEN=a=1 B_TOKEN=b" {
+		t.Errorf("credentialEnv = %q, %q", args, environ)
+	}
+	if _, _, err := credentialEnv(map[string]string{"A TOKEN": "a"}); err == nil {
+		t.Error("credentialEnv accepted an invalid name")
+	}
+}
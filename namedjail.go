@@ -0,0 +1,45 @@
+package warden
+
+import (
+	"regexp"
+	"strings"
+)
+
+// jailEnv is the env request a client sends to choose one of its named
+// persistent jails.
+const jailEnv = "WARDEN_JAIL"
+
+var namedJailRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// jailKey identifies the persistent jail a session runs in among those
+// warden keeps.
+func (info SessionInfo) jailKey() string {
+	if info.Jail == "" {
+		return info.LocalUser
+	}
+	return info.LocalUser + "+" + info.Jail
+}
+
+// namedJails returns how many named jails user keeps, including ones being
+// created. The caller must hold jailsMu.
+func (w *Warden) namedJails(user string) int {
+	n := 0
+	for key := range w.jails {
+		if strings.HasPrefix(key, user+"+") {
+			n++
+		}
+	}
+	for key := range w.creatingJails {
+		if _, ok := w.jails[key]; !ok && strings.HasPrefix(key, user+"+") {
+			n++
+		}
+	}
+	return n
+}
+
+func (w *Warden) maxNamedJails() int {
+	if w.jail.MaxNamedJails == 0 {
+		return 5
+	}
+	return w.jail.MaxNamedJails
+}
@@ -0,0 +1,164 @@
+package warden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxKexInitRecord bounds how much a client may send before its key
+// exchange init is no longer recorded.
+const maxKexInitRecord = 64 << 10
+
+// kexInitMsg is the key exchange init a client starts negotiating with
+// (RFC 4253 section 7.1).
+type kexInitMsg struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// kexInitRecorder records what a client sends until it has sent its key
+// exchange init, so that a failed negotiation can be explained.
+type kexInitRecorder struct {
+	net.Conn
+	buf     []byte
+	done    bool
+	kexInit *kexInitMsg
+}
+
+func (r *kexInitRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if !r.done {
+		r.buf = append(r.buf, p[:n]...)
+		if msg, ok := parseKexInit(r.buf); ok || len(r.buf) >= maxKexInitRecord {
+			r.kexInit, r.buf, r.done = msg, nil, true
+		}
+	}
+	return n, err
+}
+
+// parseKexInit parses the key exchange init following the version line at
+// the start of what a client sent, once all of it has arrived.
+func parseKexInit(b []byte) (*kexInitMsg, bool) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return nil, false
+	}
+	packet := b[i+1:]
+	if len(packet) < 5 {
+		return nil, false
+	}
+	length := binary.BigEndian.Uint32(packet)
+	padding := uint32(packet[4])
+	if length > maxKexInitRecord || padding+1 > length || uint32(len(packet)) < 4+length {
+		return nil, false
+	}
+	var msg kexInitMsg
+	if err := ssh.Unmarshal(packet[5:4+length-padding], &msg); err != nil {
+		return nil, false
+	}
+	return &msg, true
+}
+
+// offeredAlgorithms returns the algorithms warden offers clients in its
+// key exchange init, in the order it prefers them.
+func (w *Warden) offeredAlgorithms() *kexInitMsg {
+	var hostKeyAlgos []string
+	for _, pk := range w.privateKeys {
+		hostKeyAlgos = append(hostKeyAlgos, pk.PublicKey().Type())
+	}
+	defaults := ssh.Config{Ciphers: w.ciphers, MACs: w.macs, KeyExchanges: w.keyExchanges}
+	defaults.SetDefaults()
+	return &kexInitMsg{
+		KexAlgos:            defaults.KeyExchanges,
+		ServerHostKeyAlgos:  hostKeyAlgos,
+		CiphersClientServer: defaults.Ciphers,
+		CiphersServerClient: defaults.Ciphers,
+		MACsClientServer:    defaults.MACs,
+		MACsServerClient:    defaults.MACs,
+	}
+}
+
+// explainNegotiation logs which algorithms the client and warden failed to
+// agree on, and what each side offered, once a handshake has failed for
+// lack of common algorithms.
+func (w *Warden) explainNegotiation(l logger, r *kexInitRecorder) {
+	if r.kexInit == nil {
+		l.Println("Could not tell which algorithms the client offered")
+		return
+	}
+	client, offered := r.kexInit, w.offeredAlgorithms()
+	mismatches := []struct {
+		kind, fix      string
+		client, warden []string
+	}{
+		{"key exchange", "keyExchanges", client.KexAlgos, offered.KexAlgos},
+		{"host key algorithm", "privateKeys", client.ServerHostKeyAlgos, offered.ServerHostKeyAlgos},
+		{"cipher", "ciphers", client.CiphersClientServer, offered.CiphersClientServer},
+		{"MAC", "macs", client.MACsClientServer, offered.MACsClientServer},
+	}
+	for _, m := range mismatches {
+		if shareAlgorithm(m.client, m.warden) {
+			continue
+		}
+		l.Printf("Client shares no %s with warden, check %s: client offered %s, warden offers %s",
+			m.kind, m.fix, strings.Join(m.client, ","), strings.Join(m.warden, ","))
+	}
+}
+
+// negotiatedAlgorithms returns the key exchange, host key, cipher and MAC
+// algorithms a client's handshake settled on. The ssh package doesn't
+// expose them, so they are worked out from the client's key exchange init
+// the way it picks them: the first algorithm the client lists that warden
+// offers. Ciphers and MACs that differ by direction are given as
+// client-to-server/server-to-client. Algorithms that can't be told are
+// empty.
+func (w *Warden) negotiatedAlgorithms(r *kexInitRecorder) (kex, hostKey, cipher, mac string) {
+	if r.kexInit == nil {
+		return
+	}
+	client, offered := r.kexInit, w.offeredAlgorithms()
+	both := func(a, b string) string {
+		if a == b {
+			return a
+		}
+		return a + "/" + b
+	}
+	return commonAlgorithm(client.KexAlgos, offered.KexAlgos),
+		commonAlgorithm(client.ServerHostKeyAlgos, offered.ServerHostKeyAlgos),
+		both(commonAlgorithm(client.CiphersClientServer, offered.CiphersClientServer),
+			commonAlgorithm(client.CiphersServerClient, offered.CiphersServerClient)),
+		both(commonAlgorithm(client.MACsClientServer, offered.MACsClientServer),
+			commonAlgorithm(client.MACsServerClient, offered.MACsServerClient))
+}
+
+// commonAlgorithm returns the first of the client's algorithms that warden
+// offers, or empty if there is none.
+func commonAlgorithm(client, warden []string) string {
+	for _, x := range client {
+		for _, y := range warden {
+			if x == y {
+				return x
+			}
+		}
+	}
+	return ""
+}
+
+func shareAlgorithm(a, b []string) bool {
+	return commonAlgorithm(a, b) != ""
+}
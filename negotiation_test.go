@@ -0,0 +1,73 @@
+package warden
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// kexInitPacket returns what a client sends up to the end of its key
+// exchange init.
+func kexInitPacket(msg *kexInitMsg) []byte {
+	payload := ssh.Marshal(msg)
+	padding := 8 - (5+len(payload))%8
+	if padding < 4 {
+		padding += 8
+	}
+	packet := make([]byte, 5, 5+len(payload)+padding)
+	binary.BigEndian.PutUint32(packet, uint32(1+len(payload)+padding))
+	packet[4] = byte(padding)
+	packet = append(packet, payload...)
+	packet = append(packet, make([]byte, padding)...)
+	return append([]byte("SSH-2.0-OpenSSH_7.4\r\n"), packet...)
+}
+
+func TestParseKexInit(t *testing.T) {
+	sent := &kexInitMsg{
+		KexAlgos:            []string{"curve25519-sha256"},
+		ServerHostKeyAlgos:  []string{"ssh-ed25519"},
+		CiphersClientServer: []string{"aes128-ctr"},
+		CiphersServerClient: []string{"aes128-ctr"},
+		MACsClientServer:    []string{"hmac-sha2-256"},
+		MACsServerClient:    []string{"hmac-sha2-256"},
+	}
+	b := kexInitPacket(sent)
+
+	msg, ok := parseKexInit(b)
+	if !ok {
+		t.Fatal("parseKexInit failed on a complete key exchange init")
+	}
+	if !reflect.DeepEqual(msg.KexAlgos, sent.KexAlgos) || !reflect.DeepEqual(msg.MACsClientServer, sent.MACsClientServer) {
+		t.Errorf("parseKexInit = %+v, want %+v", msg, sent)
+	}
+
+	// Trailing data, e.g. the client's next packet, is ignored.
+	if _, ok := parseKexInit(append(b, 0, 0, 0, 1)); !ok {
+		t.Error("parseKexInit failed with trailing data")
+	}
+
+	for name, partial := range map[string][]byte{
+		"no version line":  b[:10],
+		"no packet length": b[:len("SSH-2.0-OpenSSH_7.4\r\n")+3],
+		"partial packet":   b[:len(b)-1],
+	} {
+		if _, ok := parseKexInit(partial); ok {
+			t.Errorf("parseKexInit succeeded with %s", name)
+		}
+	}
+}
+
+func TestParseKexInitInvalid(t *testing.T) {
+	version := []byte("SSH-2.0-x\r\n")
+	for name, packet := range map[string][]byte{
+		"oversized length": {0xff, 0xff, 0xff, 0xff, 4},
+		"padding too long": {0, 0, 0, 4, 8, 0, 0, 0, 0},
+		"not a kex init":   {0, 0, 0, 6, 4, 21, 0, 0, 0, 0},
+	} {
+		if _, ok := parseKexInit(append(version, packet...)); ok {
+			t.Errorf("parseKexInit succeeded with %s", name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package warden
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/kr/pty"
+)
+
+// ptysAvailable probes whether ptys can be allocated, which isn't the case
+// on some platforms and in some container runtimes.
+func ptysAvailable() bool {
+	p, tty, err := pty.Open()
+	if err != nil {
+		return false
+	}
+	p.Close()
+	tty.Close()
+	return true
+}
+
+// pipes stands in for a pty when none are available, with the command's
+// output and errors read from one pipe and its input written to another.
+type pipes struct {
+	stdin  io.WriteCloser
+	output *os.File
+}
+
+func (p pipes) Read(b []byte) (int, error)  { return p.output.Read(b) }
+func (p pipes) Write(b []byte) (int, error) { return p.stdin.Write(b) }
+
+func (p pipes) Close() error {
+	p.stdin.Close()
+	return p.output.Close()
+}
+
+// startWithPipes starts cmd in a new session, as pty.Start does, but
+// connected to pipes rather than a terminal.
+func startWithPipes(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = w, w
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return pipes{stdin, r}, nil
+}
+
+// interactiveFlags returns the docker flags for running a session's shell,
+// which only gets a terminal if ptys are available.
+func (w *Warden) interactiveFlags() string {
+	if w.ptys {
+		return "-it"
+	}
+	return "-i"
+}
+
+// closeInput ends a jail's input, by closing its input pipe or by typing
+// the terminal's end of file character, which ends input to a shell
+// reading a fresh line.
+func closeInput(term io.ReadWriteCloser) error {
+	if p, ok := term.(pipes); ok {
+		return p.stdin.Close()
+	}
+	_, err := term.Write([]byte{4})
+	return err
+}
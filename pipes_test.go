@@ -0,0 +1,86 @@
+package warden
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestStartWithPipes(t *testing.T) {
+	cmd := exec.Command("sh", "-c", `read line; echo "got $line"; echo oops >&2; cat`)
+	p, err := startWithPipes(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err := p.Write([]byte("hello\nrest\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Closing its input ends the command's cat.
+	if err := closeInput(p); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadAll(p)
+	if string(out) != "got hello\noops\nrest\n" {
+		t.Errorf("Command printed %q, want its output and errors", out)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Error("Command failed:", err)
+	}
+	if cmd.SysProcAttr == nil || !cmd.SysProcAttr.Setsid {
+		t.Error("Command wasn't started in a new session")
+	}
+}
+
+func TestSessionWithoutPtys(t *testing.T) {
+	log := fakeDocker(t, `case "$1" in
+create) echo id-jail;;
+inspect) echo true;;
+start) echo started; cat;;
+esac
+`)
+	w, err := New(Config{Addr: "127.0.0.1:0", PrivateKeys: []string{testHostKey(t)}, Instance: "test", KeepOpenOnEOF: true})
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	// As if the probe found no ptys.
+	w.ptys = false
+	l, errs := startRun(t, w)
+	defer func() {
+		w.Close()
+		waitRun(t, errs)
+	}()
+
+	ch, reqs, err := dialWarden(t, l.Addr().String(), "alice").OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal("OpenChannel:", err)
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	pty := ssh.Marshal(&ptyRequestMsg{Term: "xterm", Columns: 80, Rows: 24})
+	if ok, err := ch.SendRequest("pty-req", true, pty); !ok || err != nil {
+		t.Fatalf("pty-req = %v, %v", ok, err)
+	}
+	if ok, err := ch.SendRequest("shell", true, nil); !ok || err != nil {
+		t.Fatalf("shell = %v, %v", ok, err)
+	}
+	// Without a terminal to resize, window changes do nothing.
+	resize := ssh.Marshal(&windowChangeMsg{Columns: 100, Rows: 40})
+	if ok, err := ch.SendRequest("window-change", true, resize); !ok || err != nil {
+		t.Errorf("window-change = %v, %v", ok, err)
+	}
+	// The end of the client's input closes the jail's, ending its cat.
+	ch.Write([]byte("hello\n"))
+	ch.CloseWrite()
+	out, _ := ioutil.ReadAll(ch)
+	if want := "warden: no terminal is available, running without one\r\nstarted\nhello\n"; string(out) != want {
+		t.Errorf("Session printed %q, want %q", out, want)
+	}
+	creates := dockerCalls(t, log, "create")
+	if len(creates) != 1 || !strings.HasPrefix(creates[0], "create -i --rm ") {
+		t.Errorf("Jails created with %q, want them without a terminal", creates)
+	}
+}
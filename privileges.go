@@ -0,0 +1,80 @@
+package warden
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// credentials are the user and groups that warden switches to after it has
+// bound its listener.
+type credentials struct {
+	uid, gid int
+	groups   []int
+}
+
+// lookupCredentials resolves RunAsUser and RunAsGroup. The user's
+// supplementary groups are kept, which is how warden retains access to the
+// docker socket after dropping root.
+func lookupCredentials(username, group string) (*credentials, error) {
+	if username == "" && group == "" {
+		return nil, nil
+	}
+	if username == "" {
+		return nil, fmt.Errorf("runAsGroup %q requires runAsUser", group)
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	creds := &credentials{}
+	if creds.uid, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, err
+	}
+	gid := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		gid = g.Gid
+	}
+	if creds.gid, err = strconv.Atoi(gid); err != nil {
+		return nil, err
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range groupIDs {
+		g, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, err
+		}
+		creds.groups = append(creds.groups, g)
+	}
+	return creds, nil
+}
+
+// drop switches the process to the credentials. Groups must be changed
+// before the uid, while the process still has permission to do so.
+func (c *credentials) drop() error {
+	if err := syscall.Setgroups(c.groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(c.gid); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(c.uid); err != nil {
+		return err
+	}
+	if c.uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("Still able to regain root after switching to uid %d", c.uid)
+	}
+	if os.Getuid() != c.uid || os.Getgid() != c.gid {
+		return fmt.Errorf("Running as uid %d gid %d after switching to uid %d gid %d", os.Getuid(), os.Getgid(), c.uid, c.gid)
+	}
+	return nil
+}
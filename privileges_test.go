@@ -0,0 +1,79 @@
+package warden
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupCredentials(t *testing.T) {
+	root, err := user.Lookup("root")
+	if err != nil {
+		t.Skip("No root user:", err)
+	}
+	if creds, err := lookupCredentials("", ""); creds != nil || err != nil {
+		t.Errorf("lookupCredentials without a user = %+v, %v, want nothing", creds, err)
+	}
+	for _, test := range []struct {
+		user, group string
+	}{
+		{"", root.Gid},
+		{"warden-no-such-user", ""},
+		{"root", "warden-no-such-group"},
+	} {
+		if creds, err := lookupCredentials(test.user, test.group); err == nil {
+			t.Errorf("lookupCredentials(%q, %q) = %+v, want an error", test.user, test.group, creds)
+		}
+	}
+
+	creds, err := lookupCredentials("root", "")
+	if err != nil {
+		t.Fatal("lookupCredentials:", err)
+	}
+	if creds.uid != 0 || creds.gid != 0 || len(creds.groups) == 0 {
+		t.Errorf("Credentials for root = %+v, want uid and gid 0 with root's groups", creds)
+	}
+	group, err := user.LookupGroupId("1")
+	if err != nil {
+		return
+	}
+	if creds, err := lookupCredentials("root", group.Name); err != nil || creds.gid != 1 {
+		t.Errorf("lookupCredentials(root, %q) = %+v, %v, want gid 1", group.Name, creds, err)
+	}
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv("WARDEN_TEST_DROP") != "" {
+		creds, err := lookupCredentials("nobody", "")
+		if err != nil {
+			t.Fatal("lookupCredentials:", err)
+		}
+		if err := creds.drop(); err != nil {
+			t.Fatal("drop:", err)
+		}
+		if _, err := os.Open(os.Getenv("WARDEN_TEST_DROP")); !os.IsPermission(err) {
+			t.Errorf("Opening a file only root can read after dropping root = %v, want a permission error", err)
+		}
+		return
+	}
+	if os.Getuid() != 0 {
+		t.Skip("Dropping privileges requires root")
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("No nobody user:", err)
+	}
+	// Privileges can't be regained, so they are dropped in a copy of the
+	// test.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$")
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(secret, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Env = append(os.Environ(), "WARDEN_TEST_DROP="+secret)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Dropping privileges failed: %v\n%s", err, out)
+	}
+}
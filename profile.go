@@ -0,0 +1,176 @@
+package warden
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// profileEnv is the env request a client sends to choose a profile.
+const profileEnv = "WARDEN_PROFILE"
+
+type Profile struct {
+	Env map[string]string `json:"env"`
+	// Mounts are docker volume specs, e.g. "/srv/data:/data:ro".
+	Mounts []string `json:"mounts"`
+	// Memory and CPUs limit each jail's resources, in docker's --memory
+	// (e.g. "512m" or "1.5GB") and --cpus (e.g. "1.5") formats.
+	Memory string `json:"memory"`
+	CPUs   string `json:"cpus"`
+}
+
+var (
+	envNameRegexp     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	memoryLimitRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?) ?([kKmMgGtTpP]?)[iI]?[bB]?$`)
+	cpuLimitRegexp    = regexp.MustCompile(`^([0-9]+(\.[0-9]*)?|\.[0-9]+)$`)
+)
+
+func (p Profile) validate() error {
+	for name := range p.Env {
+		if !envNameRegexp.MatchString(name) {
+			return fmt.Errorf("Invalid env variable name %q", name)
+		}
+	}
+	for _, mount := range p.Mounts {
+		if !strings.Contains(mount, ":") {
+			return fmt.Errorf("Invalid mount %q", mount)
+		}
+	}
+	if p.Memory != "" && !memoryLimitRegexp.MatchString(p.Memory) {
+		return fmt.Errorf("Invalid memory limit %q", p.Memory)
+	}
+	if p.CPUs != "" && !cpuLimitRegexp.MatchString(p.CPUs) {
+		return fmt.Errorf("Invalid cpus limit %q", p.CPUs)
+	}
+	return nil
+}
+
+// apply returns p with the settings of other layered over it.
+func (p Profile) apply(other Profile) Profile {
+	env := make(map[string]string, len(p.Env)+len(other.Env))
+	for name, value := range p.Env {
+		env[name] = value
+	}
+	for name, value := range other.Env {
+		env[name] = value
+	}
+	p.Env = env
+	p.Mounts = append(p.Mounts[:len(p.Mounts):len(p.Mounts)], other.Mounts...)
+	if other.Memory != "" {
+		p.Memory = other.Memory
+	}
+	if other.CPUs != "" {
+		p.CPUs = other.CPUs
+	}
+	return p
+}
+
+// envArgs returns the docker arguments setting the profile's environment.
+func (p Profile) envArgs() []string {
+	return envArgs(p.Env)
+}
+
+// runArgs returns the docker arguments applying the profile's mounts and
+// resource limits, which can only be set when a jail is created.
+func (p Profile) runArgs() []string {
+	var args []string
+	for _, mount := range p.Mounts {
+		args = append(args, "-v", mount)
+	}
+	if p.Memory != "" {
+		args = append(args, "--memory", p.Memory)
+	}
+	if p.CPUs != "" {
+		args = append(args, "--cpus", p.CPUs)
+	}
+	return args
+}
+
+// engineSockets are container engine sockets. A jail that can reach one can
+// start privileged containers, which gives its user root on the host.
+var engineSockets = []string{
+	"/var/run/docker.sock",
+	"/run/docker.sock",
+	"/var/run/containerd/containerd.sock",
+	"/run/containerd/containerd.sock",
+	"/run/podman/podman.sock",
+}
+
+// socketMount returns the engine socket exposed by the mount, if any. This
+// includes mounts of a directory containing the socket.
+func socketMount(mount string) (string, bool) {
+	source := strings.SplitN(mount, ":", 2)[0]
+	if !path.IsAbs(source) {
+		// Named volumes can't contain the host's sockets.
+		return "", false
+	}
+	source = path.Clean(source)
+	for _, socket := range engineSockets {
+		if source == socket || strings.HasPrefix(socket, strings.TrimSuffix(source, "/")+"/") {
+			return socket, true
+		}
+		// Sockets can also be found at other paths, e.g. rootless docker's.
+		if path.Base(source) == path.Base(socket) {
+			return source, true
+		}
+	}
+	return "", false
+}
+
+// checkSocketMounts refuses profiles that mount a container engine socket
+// into jails, unless allowed.
+func checkSocketMounts(profiles map[string]Profile, allow bool) error {
+	for name, profile := range profiles {
+		for _, mount := range profile.Mounts {
+			socket, ok := socketMount(mount)
+			if !ok {
+				continue
+			}
+			if !allow {
+				return fmt.Errorf("Mount %q in %s exposes %s, which gives jail users root on the host", mount, name, socket)
+			}
+			log.Printf("WARNING: mount %q in %s exposes %s, jail users have root on the host", mount, name, socket)
+		}
+	}
+	return nil
+}
+
+func validateProfiles(profiles map[string]Profile, users map[string]User) error {
+	for name, profile := range profiles {
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("Invalid profile %q: %v", name, err)
+		}
+	}
+	for username, user := range users {
+		for _, name := range append([]string{user.Profile}, user.Profiles...) {
+			if _, ok := profiles[name]; name != "" && !ok {
+				return fmt.Errorf("User %q refers to unknown profile %q", username, name)
+			}
+		}
+	}
+	return nil
+}
+
+// profile returns the jail profile for a session: the one the client asked
+// for if it is allowed, otherwise the user's default, layered over the jail
+// defaults.
+func (w *Warden) profile(user, requested string) (Profile, error) {
+	u := w.users[user]
+	name := u.Profile
+	if requested != "" && requested != name {
+		allowed := false
+		for _, p := range u.Profiles {
+			allowed = allowed || p == requested
+		}
+		if !allowed {
+			return Profile{}, fmt.Errorf("Profile %q is not available to %s", requested, user)
+		}
+		name = requested
+	}
+	if name == "" {
+		return w.jail.Profile, nil
+	}
+	return w.jail.Profile.apply(w.profiles[name]), nil
+}
@@ -0,0 +1,211 @@
+package warden
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProfile(t *testing.T) {
+	w := &Warden{
+		jail: Jail{Image: "ubuntu", Profile: Profile{
+			Env:    map[string]string{"LANG": "C", "EDITOR": "vi"},
+			Mounts: []string{"/srv/shared:/shared:ro"},
+			Memory: "512m",
+		}},
+		users: map[string]User{
+			"alice": {Profile: "dev", Profiles: []string{"gpu"}},
+			"bob":   {Profiles: []string{"gpu"}},
+			"carol": {},
+		},
+		profiles: map[string]Profile{
+			"dev": {Env: map[string]string{"EDITOR": "emacs"}, Mounts: []string{"/srv/dev:/dev-data"}},
+			"gpu": {Memory: "8g", CPUs: "4"},
+		},
+	}
+	for _, test := range []struct {
+		user, requested string
+		want            Profile
+		err             string
+	}{
+		{
+			// The user's default profile is layered over the jail's.
+			user: "alice",
+			want: Profile{
+				Env:    map[string]string{"LANG": "C", "EDITOR": "emacs"},
+				Mounts: []string{"/srv/shared:/shared:ro", "/srv/dev:/dev-data"},
+				Memory: "512m",
+			},
+		},
+		{
+			user:      "alice",
+			requested: "dev",
+			want: Profile{
+				Env:    map[string]string{"LANG": "C", "EDITOR": "emacs"},
+				Mounts: []string{"/srv/shared:/shared:ro", "/srv/dev:/dev-data"},
+				Memory: "512m",
+			},
+		},
+		{
+			// A requested profile replaces the default rather than
+			// being layered over it.
+			user:      "alice",
+			requested: "gpu",
+			want: Profile{
+				Env:    map[string]string{"LANG": "C", "EDITOR": "vi"},
+				Mounts: []string{"/srv/shared:/shared:ro"},
+				Memory: "8g",
+				CPUs:   "4",
+			},
+		},
+		{
+			user: "bob",
+			want: w.jail.Profile,
+		},
+		{
+			user:      "bob",
+			requested: "dev",
+			err:       `Profile "dev" is not available to bob`,
+		},
+		{
+			user:      "carol",
+			requested: "missing",
+			err:       `Profile "missing" is not available to carol`,
+		},
+	} {
+		profile, err := w.profile(test.user, test.requested)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("profile(%q, %q) = %v, want error %q", test.user, test.requested, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("profile(%q, %q) failed: %v", test.user, test.requested, err)
+			continue
+		}
+		if !reflect.DeepEqual(profile, test.want) {
+			t.Errorf("profile(%q, %q) = %+v, want %+v", test.user, test.requested, profile, test.want)
+		}
+	}
+	// Layering mustn't change the jail's own profile.
+	if len(w.jail.Profile.Env) != 2 || w.jail.Profile.Env["EDITOR"] != "vi" || len(w.jail.Profile.Mounts) != 1 {
+		t.Errorf("Jail profile changed to %+v", w.jail.Profile)
+	}
+}
+
+func TestValidateProfilesReferences(t *testing.T) {
+	profiles := map[string]Profile{"dev": {}}
+	for _, test := range []struct {
+		user User
+		err  string
+	}{
+		{User{}, ""},
+		{User{Profile: "dev", Profiles: []string{"dev"}}, ""},
+		{User{Profile: "ops"}, `User "alice" refers to unknown profile "ops"`},
+		{User{Profiles: []string{"dev", "ops"}}, `User "alice" refers to unknown profile "ops"`},
+	} {
+		err := validateProfiles(profiles, map[string]User{"alice": test.user})
+		if test.err == "" && err != nil || test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("validateProfiles(%+v) = %v, want %q", test.user, err, test.err)
+		}
+	}
+}
+
+func TestProfileValidate(t *testing.T) {
+	for _, test := range []struct {
+		profile Profile
+		err     string
+	}{
+		{Profile{Env: map[string]string{"GOPATH": "/go"}, Mounts: []string{"data:/data"}}, ""},
+		{Profile{Env: map[string]string{"1X": "y"}}, "env variable name"},
+		{Profile{Env: map[string]string{"A-B": "y"}}, "env variable name"},
+		{Profile{Mounts: []string{"/data"}}, "mount"},
+	} {
+		err := test.profile.validate()
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v.validate() = %v, want %q", test.profile, err, test.err)
+		}
+	}
+}
+
+func TestProfileArgs(t *testing.T) {
+	p := Profile{Mounts: []string{"/a:/a", "b:/b:ro"}, Memory: "1g", CPUs: "0.5"}
+	want := []string{"-v", "/a:/a", "-v", "b:/b:ro", "--memory", "1g", "--cpus", "0.5"}
+	if args := p.runArgs(); !reflect.DeepEqual(args, want) {
+		t.Errorf("runArgs() = %q, want %q", args, want)
+	}
+	if args := (Profile{}).runArgs(); len(args) != 0 {
+		t.Errorf("Empty profile's runArgs() = %q", args)
+	}
+}
+
+func TestSocketMount(t *testing.T) {
+	for _, test := range []struct {
+		mount  string
+		socket string
+	}{
+		{"/var/run/docker.sock:/var/run/docker.sock", "/var/run/docker.sock"},
+		{"/run/docker.sock:/sock:ro", "/run/docker.sock"},
+		{"/var/run/docker.sock/:/var/run/docker.sock", "/var/run/docker.sock"},
+		{"/var/lib/../run/docker.sock:/docker.sock", "/var/run/docker.sock"},
+		// Directories containing a socket expose it too.
+		{"/var/run:/host-run", "/var/run/docker.sock"},
+		{"/:/host", "/var/run/docker.sock"},
+		{"/run/containerd:/containerd", "/run/containerd/containerd.sock"},
+		// Sockets outside their usual directory, e.g. rootless docker's.
+		{"/run/user/1000/docker.sock:/var/run/docker.sock", "/run/user/1000/docker.sock"},
+		{"/run/podman/podman.sock:/podman.sock", "/run/podman/podman.sock"},
+		{"/srv/data:/data", ""},
+		{"/var/lib/docker-data:/data", ""},
+		{"docker.sock:/data", ""},
+	} {
+		socket, ok := socketMount(test.mount)
+		if ok != (test.socket != "") || socket != test.socket {
+			t.Errorf("socketMount(%q) = %q, %v, want %q", test.mount, socket, ok, test.socket)
+		}
+	}
+}
+
+func TestCheckSocketMounts(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	safe := Profile{Mounts: []string{"/srv/data:/data"}}
+	dangerous := Profile{Mounts: []string{"/srv/data:/data", "/var/run/docker.sock:/var/run/docker.sock"}}
+	if err := checkSocketMounts(map[string]Profile{"profile safe": safe}, false); err != nil {
+		t.Errorf("checkSocketMounts refused safe mounts: %v", err)
+	}
+	err := checkSocketMounts(map[string]Profile{"profile safe": safe, "profile ci": dangerous}, false)
+	if err == nil || !strings.Contains(err.Error(), "profile ci") || !strings.Contains(err.Error(), "/var/run/docker.sock") {
+		t.Errorf("checkSocketMounts = %v, want an error naming the ci profile and the socket", err)
+	}
+	if logs.String() != "" {
+		t.Errorf("Logged %q without the override", logs.String())
+	}
+	if err := checkSocketMounts(map[string]Profile{"profile ci": dangerous}, true); err != nil {
+		t.Errorf("checkSocketMounts refused an allowed socket mount: %v", err)
+	}
+	if !strings.Contains(logs.String(), "WARNING: mount \"/var/run/docker.sock:/var/run/docker.sock\" in profile ci exposes /var/run/docker.sock") {
+		t.Errorf("Allowing a socket mount logged %q, want a warning", logs.String())
+	}
+}
+
+func TestNewRefusesSocketMounts(t *testing.T) {
+	for _, config := range []Config{
+		{Jail: Jail{Profile: Profile{Mounts: []string{"/var/run/docker.sock:/var/run/docker.sock"}}}},
+		{Profiles: map[string]Profile{"ci": {Mounts: []string{"/run:/host-run"}}}},
+	} {
+		config.PrivateKeys = []string{testHostKey(t)}
+		if _, err := New(config); err == nil || !strings.Contains(err.Error(), "root on the host") {
+			t.Errorf("New(%+v) = %v, want the socket mount refused", config, err)
+		}
+		config.AllowDockerSocketMount = true
+		if _, err := New(config); err != nil && strings.Contains(err.Error(), "root on the host") {
+			t.Errorf("New refused %+v with the override: %v", config, err)
+		}
+	}
+}
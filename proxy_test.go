@@ -0,0 +1,112 @@
+package warden
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func proxyV2Header(verCmd, family byte, addrs []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return string(append(header, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xc8, 0x22, 0, 22}
+	ipv6 := append(append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...), 0xc8, 0x22, 0, 22)
+	for _, test := range []struct {
+		header string
+		// remote is the address the connection reports, or "" if it
+		// is the proxy's.
+		remote string
+		err    bool
+	}{
+		{header: "PROXY TCP4 203.0.113.7 10.0.0.1 51234 22\r\n", remote: "203.0.113.7:51234"},
+		{header: "PROXY TCP6 2001:db8::7 2001:db8::1 51234 22\r\n", remote: "[2001:db8::7]:51234"},
+		{header: "PROXY UNKNOWN\r\n"},
+		{header: "PROXY TCP4 203.0.113.7 10.0.0.1 51234\r\n", err: true},
+		{header: "PROXY TCP4 not-an-ip 10.0.0.1 51234 22\r\n", err: true},
+		{header: "PROXY TCP4 203.0.113.7 10.0.0.1 65536 22\r\n", err: true},
+		{header: "PROXY TCP4 203.0.113.7 10.0.0.1 51234 22\n", err: true},
+		{header: "SSH-2.0-OpenSSH_8.9\r\n", err: true},
+		{header: proxyV2Header(0x21, 0x11, ipv4), remote: "203.0.113.7:51234"},
+		{header: proxyV2Header(0x21, 0x21, ipv6), remote: "[2001:db8::7]:51234"},
+		// LOCAL connections and unsupported families keep the proxy's
+		// address.
+		{header: proxyV2Header(0x20, 0x11, ipv4)},
+		{header: proxyV2Header(0x21, 0x31, make([]byte, 216))},
+		{header: proxyV2Header(0x21, 0x11, ipv4[:8]), err: true},
+		{header: proxyV2Header(0x11, 0x11, ipv4), err: true},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(test.header + "SSH-2.0-Go\r\n"))
+			client.Close()
+		}()
+		conn, err := readProxyHeader(server)
+		if test.err {
+			if err == nil {
+				t.Errorf("readProxyHeader(%q) accepted a malformed header", test.header)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("readProxyHeader(%q) failed: %v", test.header, err)
+			server.Close()
+			continue
+		}
+		remote := conn.RemoteAddr()
+		if test.remote == "" && remote != server.RemoteAddr() || test.remote != "" && remote.String() != test.remote {
+			t.Errorf("readProxyHeader(%q) remote address = %v, want %q", test.header, remote, test.remote)
+		}
+		// Whatever follows the header is left for the SSH handshake.
+		if rest, err := ioutil.ReadAll(conn); err != nil || string(rest) != "SSH-2.0-Go\r\n" {
+			t.Errorf("After header %q read %q, %v", test.header, rest, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyProtocolAddress(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	_, addr := startWarden(t, Config{ProxyProtocol: true, SecurityLog: true})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 22\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{User: "alice", Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)}})
+	if err != nil {
+		t.Fatal("NewClientConn:", err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if strings.Contains(logs.String(), "Security event:") {
+			break
+		}
+	}
+	if !strings.Contains(logs.String(), "Security event: remote=203.0.113.7:51234 ") {
+		t.Errorf("Security event doesn't record the proxied address:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,88 @@
+package warden
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// ReadinessProbe is a command run in each jail with docker exec until it
+// succeeds, before the user's shell starts, for images that take a while
+// to set themselves up, e.g. ["test", "-e", "/run/setup-done"].
+type ReadinessProbe struct {
+	Command []string `json:"command"`
+	// Interval is how long to wait between attempts. Defaults to 1s.
+	Interval Duration `json:"interval"`
+	// Timeout is how long the jail has to become ready before the session
+	// fails. Defaults to 60s.
+	Timeout Duration `json:"timeout"`
+}
+
+func (p *ReadinessProbe) validate() error {
+	if len(p.Command) == 0 || p.Command[0] == "" {
+		return errors.New("readinessProbe requires a command")
+	}
+	if p.Interval < 0 || p.Timeout < 0 {
+		return fmt.Errorf("Invalid readinessProbe interval %v or timeout %v", p.Interval, p.Timeout)
+	}
+	return nil
+}
+
+func (p *ReadinessProbe) interval() time.Duration {
+	if p.Interval == 0 {
+		return time.Second
+	}
+	return time.Duration(p.Interval)
+}
+
+func (p *ReadinessProbe) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return time.Minute
+	}
+	return time.Duration(p.Timeout)
+}
+
+// waitReady runs the readiness probe in a started jail until it succeeds.
+// Users with a terminal are told what they are waiting for.
+func (w *Warden) waitReady(s *session, jailID string) error {
+	p := w.jail.ReadinessProbe
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+	defer cancel()
+	if !w.jail.shared() {
+		if err := waitRunning(ctx, jailID); err != nil {
+			return err
+		}
+	}
+	started := time.Now()
+	waiting := false
+	for {
+		err := exec.CommandContext(ctx, "docker", append([]string{"exec", jailID}, p.Command...)...).Run()
+		if err == nil {
+			if waiting && s.ptyRequested {
+				fmt.Fprint(s.ch, " ready.\r\n")
+			}
+			if s.verbose {
+				s.log.Printf("Jail %s ready after %v", jailID, time.Since(started).Round(time.Millisecond))
+			}
+			return nil
+		}
+		if s.ptyRequested {
+			if !waiting {
+				fmt.Fprint(s.ch, "Waiting for your jail to be ready...")
+			} else {
+				fmt.Fprint(s.ch, ".")
+			}
+		}
+		waiting = true
+		select {
+		case <-ctx.Done():
+			if s.ptyRequested {
+				fmt.Fprint(s.ch, " timed out.\r\n")
+			}
+			return fmt.Errorf("Jail %s was not ready after %v: %v", jailID, p.timeout(), err)
+		case <-time.After(p.interval()):
+		}
+	}
+}
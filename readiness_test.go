@@ -0,0 +1,146 @@
+package warden
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// probeDocker fakes docker with gated jails, as gateDocker does, whose
+// readiness probe fails the first $PROBE_FAILURES times it runs.
+const probeDocker = `case "$1" in
+run) echo id-jail;;
+create) echo id-jail;;
+inspect) echo true;;
+start)
+  while [ ! -e "$FAKE_DIR/open" ]; do sleep 0.01; done
+  echo "session in id-jail";;
+exec)
+  case "$*" in
+  *" touch "*) touch "$FAKE_DIR/open";;
+  *" test -e /run/setup-done")
+    n=$(cat "$FAKE_DIR/probes" 2> /dev/null || echo 0); n=$((n + 1)); echo $n > "$FAKE_DIR/probes"
+    [ $n -gt "$PROBE_FAILURES" ];;
+  *" bash -c "*"su "*) echo "session in id-jail";;
+  esac;;
+esac
+`
+
+func testProbe(timeout time.Duration) *ReadinessProbe {
+	return &ReadinessProbe{
+		Command:  []string{"test", "-e", "/run/setup-done"},
+		Interval: Duration(20 * time.Millisecond),
+		Timeout:  Duration(timeout),
+	}
+}
+
+func TestReadinessProbe(t *testing.T) {
+	log := fakeDocker(t, probeDocker)
+	t.Setenv("PROBE_FAILURES", "2")
+	_, addr := startWarden(t, Config{Jail: Jail{ReadinessProbe: testProbe(5 * time.Second)}})
+	out, err := runShell(t, dialWarden(t, addr, "alice"), nil)
+	if err != nil || !strings.HasPrefix(out, "session in id-jail") {
+		t.Fatalf("Session = %q, %v", out, err)
+	}
+	// Users without a terminal aren't shown progress.
+	if strings.Contains(out, "Waiting") {
+		t.Errorf("Session without a pty printed %q", out)
+	}
+	if probes := dockerCalls(t, log, "exec id-jail test"); len(probes) != 3 {
+		t.Errorf("Probed %d times, want until the third attempt succeeded", len(probes))
+	}
+	// The shell is only let in once the last probe has succeeded.
+	if !callsBefore(t, log, "exec id-jail test", "exec id-jail touch") {
+		t.Error("Jail was opened before it was probed")
+	}
+	waitRemoved(t, log)
+}
+
+func TestReadinessProbeProgress(t *testing.T) {
+	if !ptysAvailable() {
+		t.Skip("No ptys")
+	}
+	log := fakeDocker(t, probeDocker)
+	t.Setenv("PROBE_FAILURES", "2")
+	_, addr := startWarden(t, Config{Jail: Jail{ReadinessProbe: testProbe(5 * time.Second)}})
+	s, err := dialWarden(t, addr, "alice").NewSession()
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	if err := s.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal("RequestPty:", err)
+	}
+	var out syncBuffer
+	s.Stdout = &out
+	if err := s.Shell(); err != nil {
+		t.Fatal("Shell:", err)
+	}
+	s.Wait()
+	if want := "Waiting for your jail to be ready.... ready.\r\nsession in id-jail"; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("Session printed %q, want %q first", out.String(), want)
+	}
+	waitRemoved(t, log)
+}
+
+func TestReadinessProbeTimeout(t *testing.T) {
+	log := fakeDocker(t, probeDocker)
+	t.Setenv("PROBE_FAILURES", "1000")
+	_, addr := startWarden(t, Config{Jail: Jail{ReadinessProbe: testProbe(200 * time.Millisecond)}, HangupGrace: Duration(100 * time.Millisecond)})
+	start := time.Now()
+	if out, err := runShell(t, dialWarden(t, addr, "alice"), nil); err == nil || strings.Contains(out, "session in") {
+		t.Errorf("Session in a jail that never became ready = %q, %v", out, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Session failed after %v, want about 200ms", elapsed)
+	}
+	if opens := dockerCalls(t, log, "exec id-jail touch"); len(opens) != 0 {
+		t.Error("Jail that never became ready was opened")
+	}
+	waitRemoved(t, log)
+}
+
+func TestReadinessProbePersistent(t *testing.T) {
+	log := fakeDocker(t, probeDocker)
+	t.Setenv("PROBE_FAILURES", "1")
+	_, addr := startWarden(t, Config{Jail: Jail{Persistent: true, ReadinessProbe: testProbe(5 * time.Second)}})
+	for i := 0; i < 2; i++ {
+		if out, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil || !strings.HasPrefix(out, "session in id-jail") {
+			t.Fatalf("Session = %q, %v", out, err)
+		}
+	}
+	// Each session probes the jail before its shell starts.
+	probes := dockerCalls(t, log, "exec id-jail test")
+	if len(probes) != 3 {
+		t.Errorf("Probed %d times, want twice for the first session and once for the second", len(probes))
+	}
+	if !callsBefore(t, log, "exec id-jail test", "exec -i") {
+		t.Error("Shell started before the jail was probed")
+	}
+	if b, err := ioutil.ReadFile(log); err == nil && strings.Contains(string(b), "touch") {
+		t.Error("Persistent jail was opened like a gated ephemeral one")
+	}
+}
+
+func TestReadinessProbeValidate(t *testing.T) {
+	for _, test := range []struct {
+		probe ReadinessProbe
+		err   string
+	}{
+		{ReadinessProbe{Command: []string{"test", "-e", "/run/setup-done"}}, ""},
+		{ReadinessProbe{}, "readinessProbe requires a command"},
+		{ReadinessProbe{Command: []string{"true"}, Interval: -1}, "Invalid readinessProbe"},
+		{ReadinessProbe{Command: []string{"true"}, Timeout: -1}, "Invalid readinessProbe"},
+	} {
+		err := test.probe.validate()
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v.validate() = %v, want %q", test.probe, err, test.err)
+		}
+	}
+	if p := (&ReadinessProbe{}); p.interval() != time.Second || p.timeout() != time.Minute {
+		t.Errorf("Default readiness probe interval %v and timeout %v", p.interval(), p.timeout())
+	}
+	if err := (Jail{Command: []string{"serve"}, ReadinessProbe: testProbe(time.Second)}).validate(); err == nil || !strings.Contains(err.Error(), "readinessProbe") {
+		t.Errorf("Jail command combined with a readiness probe: validate() = %v", err)
+	}
+}
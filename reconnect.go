@@ -0,0 +1,149 @@
+package warden
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ReconnectCooldown refuses clients caught in a reconnect loop, such as a
+// misconfigured script that keeps connecting and immediately
+// disconnecting, each time creating a jail. Unlike tenants' connection
+// rates, it only counts connections that end quickly, and it applies to
+// each user connecting from each address.
+type ReconnectCooldown struct {
+	// ShortConnection is how long a connection may last and still count
+	// towards a cooldown. Defaults to 10s.
+	ShortConnection Duration `json:"shortConnection"`
+	// Threshold is how many short connections in a row start a cooldown.
+	// Defaults to 5.
+	Threshold int `json:"threshold"`
+	// Cooldown is how long the first cooldown lasts. Each one that follows
+	// without a longer connection in between lasts twice as long as the
+	// last, up to MaxCooldown. They default to 30s and 10m.
+	Cooldown    Duration `json:"cooldown"`
+	MaxCooldown Duration `json:"maxCooldown"`
+}
+
+func (c *ReconnectCooldown) validate() error {
+	if c.ShortConnection < 0 || c.Threshold < 0 || c.Cooldown < 0 || c.MaxCooldown < 0 {
+		return fmt.Errorf("Invalid reconnectCooldown %+v", *c)
+	}
+	return nil
+}
+
+// reconnects tracks each client's short connections.
+type reconnects struct {
+	short       time.Duration
+	threshold   int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*reconnectState
+}
+
+type reconnectState struct {
+	short    int
+	cooldown time.Duration
+	until    time.Time
+	last     time.Time
+}
+
+func newReconnects(c *ReconnectCooldown) *reconnects {
+	if c == nil {
+		return nil
+	}
+	r := &reconnects{
+		short:       time.Duration(c.ShortConnection),
+		threshold:   c.Threshold,
+		cooldown:    time.Duration(c.Cooldown),
+		maxCooldown: time.Duration(c.MaxCooldown),
+		clients:     make(map[string]*reconnectState),
+	}
+	if r.short == 0 {
+		r.short = 10 * time.Second
+	}
+	if r.threshold == 0 {
+		r.threshold = 5
+	}
+	if r.cooldown == 0 {
+		r.cooldown = 30 * time.Second
+	}
+	if r.maxCooldown == 0 {
+		r.maxCooldown = 10 * time.Minute
+	}
+	if r.maxCooldown < r.cooldown {
+		r.maxCooldown = r.cooldown
+	}
+	return r
+}
+
+// reconnectClient identifies a user connecting from an address.
+func reconnectClient(user string, addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return user + "@" + host
+}
+
+// coolingDown returns how much longer client's cooldown lasts, if it has
+// one.
+func (r *reconnects) coolingDown(client string) (time.Duration, bool) {
+	if r == nil {
+		return 0, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state, ok := r.clients[client]
+	if !ok {
+		return 0, false
+	}
+	left := state.until.Sub(time.Now())
+	return left, left > 0
+}
+
+// closed records that one of client's connections closed after lasting d,
+// starting a cooldown once it has made too many short ones in a row.
+func (r *reconnects) closed(l logger, client string, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.forget(now)
+	if d >= r.short {
+		delete(r.clients, client)
+		return
+	}
+	state, ok := r.clients[client]
+	if !ok {
+		state = &reconnectState{}
+		r.clients[client] = state
+	}
+	state.last = now
+	if state.short++; state.short < r.threshold {
+		return
+	}
+	state.short = 0
+	if state.cooldown == 0 {
+		state.cooldown = r.cooldown
+	} else if state.cooldown *= 2; state.cooldown > r.maxCooldown {
+		state.cooldown = r.maxCooldown
+	}
+	state.until = now.Add(state.cooldown)
+	l.Printf("Refusing %s for %v after %d connections shorter than %v", client, state.cooldown, r.threshold, r.short)
+}
+
+// forget drops clients that haven't connected for long enough that a
+// cooldown would no longer escalate.
+func (r *reconnects) forget(now time.Time) {
+	for client, state := range r.clients {
+		if now.Sub(state.last) > 2*r.maxCooldown && now.After(state.until) {
+			delete(r.clients, client)
+		}
+	}
+}
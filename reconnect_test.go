@@ -0,0 +1,57 @@
+package warden
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectsClosed(t *testing.T) {
+	const client = "alice@192.0.2.1"
+	short, long := time.Second, time.Minute
+	for _, test := range []struct {
+		name        string
+		connections []time.Duration
+		coolingDown bool
+		cooldown    time.Duration
+	}{
+		{"none", nil, false, 0},
+		{"under threshold", []time.Duration{short, short}, false, 0},
+		{"at threshold", []time.Duration{short, short, short}, true, 30 * time.Second},
+		{"long connection resets", []time.Duration{short, short, long, short, short}, false, 0},
+		{"escalates", []time.Duration{short, short, short, short, short, short}, true, time.Minute},
+		{"capped", []time.Duration{
+			short, short, short, short, short, short,
+			short, short, short, short, short, short,
+		}, true, 2 * time.Minute},
+	} {
+		r := newReconnects(&ReconnectCooldown{
+			Threshold:   3,
+			Cooldown:    Duration(30 * time.Second),
+			MaxCooldown: Duration(2 * time.Minute),
+		})
+		for _, d := range test.connections {
+			r.closed(logger("test"), client, d)
+		}
+		left, coolingDown := r.coolingDown(client)
+		if coolingDown != test.coolingDown {
+			t.Errorf("%s: coolingDown = %v, want %v", test.name, coolingDown, test.coolingDown)
+			continue
+		}
+		if coolingDown && (left > test.cooldown || left < test.cooldown-time.Second) {
+			t.Errorf("%s: cooldown has %v left, want %v", test.name, left, test.cooldown)
+		}
+		if _, other := r.coolingDown("alice@192.0.2.2"); other {
+			t.Errorf("%s: another address is cooling down", test.name)
+		}
+	}
+}
+
+func TestReconnectsDisabled(t *testing.T) {
+	var r *reconnects
+	for i := 0; i < 10; i++ {
+		r.closed(logger("test"), "alice@192.0.2.1", 0)
+	}
+	if _, coolingDown := r.coolingDown("alice@192.0.2.1"); coolingDown {
+		t.Error("Disabled reconnect cooldown is cooling down")
+	}
+}
@@ -0,0 +1,39 @@
+package warden
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dockerHub is the registry of image references that don't name one, such
+// as "ubuntu" or "library/ubuntu".
+const dockerHub = "docker.io"
+
+// imageRegistry returns the registry host an image is pulled from. As in
+// docker, the first component of the reference is only a registry if it
+// contains a "." or ":", or is "localhost".
+func imageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 || !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost" {
+		return dockerHub
+	}
+	if parts[0] == "index.docker.io" {
+		return dockerHub
+	}
+	return parts[0]
+}
+
+// checkRegistry returns an error if image isn't from one of the allowed
+// registries. An empty list allows every registry.
+func checkRegistry(allowed []string, image string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	registry := imageRegistry(image)
+	for _, r := range allowed {
+		if r == registry {
+			return nil
+		}
+	}
+	return fmt.Errorf("Image %s is from %s, which is not an allowed registry", image, registry)
+}
@@ -0,0 +1,44 @@
+package warden
+
+import "testing"
+
+func TestImageRegistry(t *testing.T) {
+	for image, want := range map[string]string{
+		"ubuntu":                              "docker.io",
+		"ubuntu:22.04":                        "docker.io",
+		"library/ubuntu":                      "docker.io",
+		"docker.io/library/ubuntu":            "docker.io",
+		"index.docker.io/library/ubuntu":      "docker.io",
+		"ghcr.io/org/image:tag":               "ghcr.io",
+		"registry.internal:5000/team/image":   "registry.internal:5000",
+		"localhost/image":                     "localhost",
+		"localhost:5000/image":                "localhost:5000",
+		"org/image@sha256:abcdef":             "docker.io",
+		"quay.io/org/image@sha256:abcdef0123": "quay.io",
+	} {
+		if got := imageRegistry(image); got != want {
+			t.Errorf("imageRegistry(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
+
+func TestCheckRegistry(t *testing.T) {
+	allowed := []string{"docker.io", "registry.internal:5000"}
+	for _, test := range []struct {
+		allowed []string
+		image   string
+		ok      bool
+	}{
+		{nil, "evil.example/image", true},
+		{allowed, "ubuntu", true},
+		{allowed, "registry.internal:5000/team/image", true},
+		{allowed, "registry.internal/team/image", false},
+		{allowed, "evil.example/ubuntu", false},
+		{allowed, "localhost/image", false},
+	} {
+		err := checkRegistry(test.allowed, test.image)
+		if (err == nil) != test.ok {
+			t.Errorf("checkRegistry(%q, %q) = %v, want ok=%v", test.allowed, test.image, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package warden
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// RegistryAuth holds the credentials for pulling jail images from a private
+// registry. Set one of Password, PasswordEnv, the name of an env variable
+// holding the password or token, or CredHelper, the suffix of a
+// docker-credential-* helper on warden's PATH, e.g. "ecr-login".
+type RegistryAuth struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	PasswordEnv string `json:"passwordEnv"`
+	CredHelper  string `json:"credHelper"`
+}
+
+var (
+	registryHostRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?(:[0-9]+)?$`)
+	credHelperRegexp   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+)
+
+// password returns the configured password. Errors never include it.
+func (a RegistryAuth) password() (string, error) {
+	if a.PasswordEnv == "" {
+		return a.Password, nil
+	}
+	if !envNameRegexp.MatchString(a.PasswordEnv) {
+		return "", fmt.Errorf("Invalid passwordEnv %q", a.PasswordEnv)
+	}
+	password := os.Getenv(a.PasswordEnv)
+	if password == "" {
+		return "", fmt.Errorf("$%s is not set", a.PasswordEnv)
+	}
+	return password, nil
+}
+
+func (a RegistryAuth) validate() error {
+	set := 0
+	for _, s := range []string{a.Password, a.PasswordEnv, a.CredHelper} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("Set one of password, passwordEnv and credHelper")
+	}
+	if a.CredHelper != "" {
+		if !credHelperRegexp.MatchString(a.CredHelper) {
+			return fmt.Errorf("Invalid credHelper %q", a.CredHelper)
+		}
+		return nil
+	}
+	if a.Username == "" {
+		return fmt.Errorf("A username is required with a password")
+	}
+	_, err := a.password()
+	return err
+}
+
+// dockerConfigKey returns the key docker looks a registry's credentials up
+// by in its config.
+func dockerConfigKey(registry string) string {
+	if registry == dockerHub {
+		return "https://index.docker.io/v1/"
+	}
+	return registry
+}
+
+func validateRegistryAuth(auths map[string]RegistryAuth) error {
+	for registry, auth := range auths {
+		if !registryHostRegexp.MatchString(registry) {
+			return fmt.Errorf("Invalid registryAuth registry %q", registry)
+		}
+		if err := auth.validate(); err != nil {
+			return fmt.Errorf("Invalid registryAuth for %s: %v", registry, err)
+		}
+	}
+	return nil
+}
+
+// writeRegistryAuth writes a docker client config holding the credentials
+// for each registry to a new directory only warden can read, and returns
+// its path.
+func writeRegistryAuth(auths map[string]RegistryAuth, runAs *credentials) (string, error) {
+	if len(auths) == 0 {
+		return "", nil
+	}
+	type authEntry struct {
+		Auth string `json:"auth"`
+	}
+	var config struct {
+		Auths       map[string]authEntry `json:"auths"`
+		CredHelpers map[string]string    `json:"credHelpers"`
+	}
+	config.Auths = make(map[string]authEntry)
+	config.CredHelpers = make(map[string]string)
+	for registry, auth := range auths {
+		key := dockerConfigKey(registry)
+		if auth.CredHelper != "" {
+			config.CredHelpers[key] = auth.CredHelper
+			continue
+		}
+		password, _ := auth.password()
+		config.Auths[key] = authEntry{base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + password))}
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir("", "warden-registry-auth")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	// Warden reads it after dropping root.
+	if runAs != nil {
+		for _, p := range []string{dir, path} {
+			if err := os.Chown(p, runAs.uid, runAs.gid); err != nil {
+				os.RemoveAll(dir)
+				return "", err
+			}
+		}
+	}
+	return dir, nil
+}
+
+// registryEnviron returns the environment docker commands that may pull
+// image must run with, which points them at the registry credentials if
+// any are configured for its registry. Docker's own config is used for
+// other registries.
+func (w *Warden) registryEnviron(image string) []string {
+	if _, ok := w.registryAuth[imageRegistry(image)]; !ok {
+		return nil
+	}
+	return []string{"DOCKER_CONFIG=" + w.registryAuthDir}
+}
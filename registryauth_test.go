@@ -0,0 +1,143 @@
+package warden
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// registryDocker is jailDocker, also recording the docker config each
+// command was run with in $FAKE_DIR/env.
+const registryDocker = `echo "$1 DOCKER_CONFIG=$DOCKER_CONFIG" >> "$FAKE_DIR/env"
+` + jailDocker
+
+func TestValidateRegistryAuth(t *testing.T) {
+	t.Setenv("GHCR_TOKEN", "s3cret")
+	os.Unsetenv("MISSING_TOKEN")
+	for _, test := range []struct {
+		registry string
+		auth     RegistryAuth
+		err      string
+	}{
+		{"ghcr.io", RegistryAuth{Username: "bot", Password: "s3cret"}, ""},
+		{"registry.internal:5000", RegistryAuth{Username: "bot", PasswordEnv: "GHCR_TOKEN"}, ""},
+		{"123.dkr.ecr.us-east-1.amazonaws.com", RegistryAuth{CredHelper: "ecr-login"}, ""},
+		{"https://ghcr.io", RegistryAuth{Username: "bot", Password: "s3cret"}, "Invalid registryAuth registry"},
+		{"ghcr.io", RegistryAuth{Username: "bot"}, "Set one of"},
+		{"ghcr.io", RegistryAuth{Username: "bot", Password: "s3cret", CredHelper: "ecr-login"}, "Set one of"},
+		{"ghcr.io", RegistryAuth{Password: "s3cret"}, "A username is required"},
+		{"ghcr.io", RegistryAuth{Username: "bot", PasswordEnv: "MISSING_TOKEN"}, "$MISSING_TOKEN is not set"},
+		{"ghcr.io", RegistryAuth{Username: "bot", PasswordEnv: "NOT-A-NAME"}, "Invalid passwordEnv"},
+		{"ghcr.io", RegistryAuth{CredHelper: "../evil"}, "Invalid credHelper"},
+	} {
+		err := validateRegistryAuth(map[string]RegistryAuth{test.registry: test.auth})
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("validateRegistryAuth(%s: %+v) = %v, want %q", test.registry, test.auth, err, test.err)
+		}
+		if err != nil && strings.Contains(err.Error(), "s3cret") {
+			t.Errorf("Error %q includes the password", err)
+		}
+	}
+}
+
+func TestWriteRegistryAuth(t *testing.T) {
+	t.Setenv("GHCR_TOKEN", "token")
+	dir, err := writeRegistryAuth(map[string]RegistryAuth{
+		"docker.io": {Username: "hub", Password: "hub-password"},
+		"ghcr.io":   {Username: "bot", PasswordEnv: "GHCR_TOKEN"},
+		"ecr.local": {CredHelper: "ecr-login"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Registry credentials written as %v, %v, want mode 0600", info, err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Auths       map[string]struct{ Auth string }
+		CredHelpers map[string]string
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"https://index.docker.io/v1/": "hub:hub-password", "ghcr.io": "bot:token"} {
+		if auth, _ := base64.StdEncoding.DecodeString(config.Auths[key].Auth); string(auth) != want {
+			t.Errorf("Credentials for %s are %q, want %q", key, auth, want)
+		}
+	}
+	if len(config.Auths) != 2 || len(config.CredHelpers) != 1 || config.CredHelpers["ecr.local"] != "ecr-login" {
+		t.Errorf("Wrote docker config %s", b)
+	}
+
+	if dir, err := writeRegistryAuth(nil, nil); dir != "" || err != nil {
+		t.Errorf("writeRegistryAuth(nil) = %q, %v, want nothing written", dir, err)
+	}
+}
+
+func TestRegistryAuthPull(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	auth := map[string]RegistryAuth{"ghcr.io": {Username: "bot", Password: "s3cret"}}
+	for _, test := range []struct {
+		image string
+		auth  bool
+	}{
+		{"ghcr.io/acme/jail", true},
+		{"ubuntu", false},
+		{"quay.io/acme/jail", false},
+	} {
+		fakeDocker(t, registryDocker)
+		w, addr := startWarden(t, Config{Jail: Jail{Image: test.image}, RegistryAuth: auth})
+		t.Cleanup(func() { os.RemoveAll(w.registryAuthDir) })
+		if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+			t.Fatalf("%s: session failed: %v", test.image, err)
+		}
+		env, err := ioutil.ReadFile(filepath.Join(os.Getenv("FAKE_DIR"), "env"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "create DOCKER_CONFIG=\n"
+		if test.auth {
+			want = "create DOCKER_CONFIG=" + w.registryAuthDir + "\n"
+		}
+		if !strings.Contains(string(env), want) {
+			t.Errorf("%s: docker ran with\n%s\nwant %q", test.image, env, want)
+		}
+	}
+	if strings.Contains(logs.String(), "s3cret") {
+		t.Errorf("Logged the registry password:\n%s", logs.String())
+	}
+}
+
+func TestCleanupRemovesRegistryAuth(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	w, err := New(Config{
+		PrivateKeys:  []string{testHostKey(t)},
+		RegistryAuth: map[string]RegistryAuth{"ghcr.io": {Username: "bot", Password: "s3cret"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(w.registryAuthDir); err != nil {
+		t.Fatal("Registry credentials weren't written:", err)
+	}
+	if err := w.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(w.registryAuthDir); !os.IsNotExist(err) {
+		t.Errorf("Cleanup left the registry credentials at %s", w.registryAuthDir)
+	}
+}
@@ -0,0 +1,85 @@
+package warden
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// resumeEnv is the env request a client sends to resume a detached session.
+const resumeEnv = "WARDEN_RESUME"
+
+// resumable is a detachable session's tmux session, which can be resumed
+// with its token while no client is attached to it.
+type resumable struct {
+	key      string
+	user     string
+	tmux     string
+	attached int
+	expiry   *time.Timer
+}
+
+// claimResume returns the token and tmux session for a session in a
+// detachable jail: the ones of the session being resumed if the client
+// sent a resume token, otherwise new ones. The returned function must be
+// called once the session has ended, with the ID of its jail if it got one.
+func (w *Warden) claimResume(info SessionInfo, token string) (string, string, func(jailID string), error) {
+	w.resumeMu.Lock()
+	defer w.resumeMu.Unlock()
+	if token == "" {
+		token = newID() + newID()
+		w.resumables[token] = &resumable{key: info.jailKey(), user: info.LocalUser, tmux: "warden-" + info.SessionID}
+	}
+	r, ok := w.resumables[token]
+	if !ok || r.key != info.jailKey() {
+		return "", "", nil, errors.New("Invalid or expired resume token")
+	}
+	if r.attached > 0 {
+		return "", "", nil, errors.New("The session for this resume token is still connected")
+	}
+	if r.expiry != nil {
+		r.expiry.Stop()
+	}
+	r.attached++
+	var once sync.Once
+	release := func(jailID string) {
+		once.Do(func() { w.releaseResume(token, jailID) })
+	}
+	return token, r.tmux, release, nil
+}
+
+// releaseResume detaches a session from its tmux session, which expires
+// if it isn't resumed within the resume window.
+func (w *Warden) releaseResume(token, jailID string) {
+	w.resumeMu.Lock()
+	defer w.resumeMu.Unlock()
+	r := w.resumables[token]
+	r.attached--
+	if r.attached > 0 {
+		return
+	}
+	r.expiry = time.AfterFunc(time.Duration(w.jail.ResumeWindow), func() {
+		w.resumeMu.Lock()
+		if r.attached > 0 {
+			w.resumeMu.Unlock()
+			return
+		}
+		delete(w.resumables, token)
+		w.resumeMu.Unlock()
+		if jailID == "" {
+			return
+		}
+		// Nothing can resume the tmux session any more.
+		exec.Command("docker", "exec", "-u", jailUsername(r.user), jailID, "tmux", "kill-session", "-t", r.tmux).Run()
+	})
+}
+
+// resumeNotice tells the user how to resume their session.
+func (w *Warden) resumeNotice(ch ssh.Channel, token string) {
+	fmt.Fprintf(ch, "warden: to resume this session if you are disconnected, reconnect within %v with %s=%s\r\n",
+		time.Duration(w.jail.ResumeWindow), resumeEnv, token)
+}
@@ -0,0 +1,120 @@
+package warden
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testResumeWarden(window time.Duration) *Warden {
+	return &Warden{
+		jail:       Jail{Persistent: true, Detachable: true, ResumeWindow: Duration(window)},
+		resumables: make(map[string]*resumable),
+	}
+}
+
+func TestClaimResume(t *testing.T) {
+	w := testResumeWarden(time.Hour)
+	alice := SessionInfo{SessionID: "s1", User: "alice", LocalUser: "alice"}
+	token, tmux, release, err := w.claimResume(alice, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == "" || tmux != "warden-s1" {
+		t.Errorf("New session got token %q and tmux session %q", token, tmux)
+	}
+	// Only one client is attached at a time.
+	if _, _, _, err := w.claimResume(alice, token); err == nil || !strings.Contains(err.Error(), "still connected") {
+		t.Errorf("Resuming an attached session = %v", err)
+	}
+	release("jail-id")
+	release("jail-id")
+
+	for name, info := range map[string]SessionInfo{
+		"another user":  {SessionID: "s2", User: "bob", LocalUser: "bob"},
+		"another jail":  {SessionID: "s2", User: "alice", LocalUser: "alice", Jail: "build"},
+		"a wrong token": alice,
+	} {
+		claimed := token
+		if name == "a wrong token" {
+			claimed = token + "x"
+		}
+		if _, _, _, err := w.claimResume(info, claimed); err == nil || err.Error() != "Invalid or expired resume token" {
+			t.Errorf("Resuming with %s = %v", name, err)
+		}
+	}
+
+	resumed, tmux, release, err := w.claimResume(SessionInfo{SessionID: "s3", User: "alice", LocalUser: "alice"}, token)
+	if err != nil {
+		t.Fatal("Resuming a detached session failed:", err)
+	}
+	if resumed != token || tmux != "warden-s1" {
+		t.Errorf("Resumed session got token %q and tmux session %q, want the original's", resumed, tmux)
+	}
+	release("jail-id")
+}
+
+func TestResumeExpires(t *testing.T) {
+	log := fakeDocker(t, "")
+	w := testResumeWarden(50 * time.Millisecond)
+	info := SessionInfo{SessionID: "s1", User: "root", LocalUser: "root"}
+	token, _, release, err := w.claimResume(info, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release("jail-id")
+	for deadline := time.Now().Add(5 * time.Second); len(dockerCalls(t, log, "exec")) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expired tmux session wasn't killed")
+		}
+	}
+	if calls := dockerCalls(t, log, "exec"); len(calls) != 1 || calls[0] != "exec -u r00t jail-id tmux kill-session -t warden-s1" {
+		t.Errorf("Expiry ran %q", calls)
+	}
+	if _, _, _, err := w.claimResume(info, token); err == nil || err.Error() != "Invalid or expired resume token" {
+		t.Errorf("Resuming an expired session = %v", err)
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	log := fakeDocker(t, jailDocker)
+	w, addr := startWarden(t, Config{Jail: Jail{Persistent: true, Detachable: true, ResumeWindow: Duration(time.Minute)}})
+	out, err := runShell(t, dialWarden(t, addr, "alice"), nil)
+	if err != nil {
+		t.Fatal("Session failed:", err)
+	}
+	m := regexp.MustCompile(`reconnect within 1m0s with WARDEN_RESUME=(\w+)\r\n`).FindStringSubmatch(out)
+	if m == nil {
+		t.Fatalf("Session printed %q, want a resume token", out)
+	}
+	// The session is detached once warden has finished with it, which may
+	// be after the client sees it end.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		w.resumeMu.Lock()
+		attached := w.resumables[m[1]].attached
+		w.resumeMu.Unlock()
+		if attached == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Session wasn't detached")
+		}
+	}
+	if out, err := runShell(t, dialWarden(t, addr, "alice"), map[string]string{"WARDEN_RESUME": m[1]}); err != nil || !strings.Contains(out, "WARDEN_RESUME="+m[1]) {
+		t.Errorf("Resumed session = %q, %v", out, err)
+	}
+	if out, err := runShell(t, dialWarden(t, addr, "alice"), map[string]string{"WARDEN_RESUME": "bogus"}); err == nil {
+		t.Errorf("Session with a wrong token = %q, %v", out, err)
+	}
+	// Both sessions attached to the first session's tmux session.
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := regexp.MustCompile(`tmux new-session -A -s \W*(warden-\w+)`).FindAllStringSubmatch(string(b), -1)
+	if len(sessions) != 2 || sessions[0][1] != sessions[1][1] {
+		t.Errorf("Sessions attached to %q, want the same tmux session", sessions)
+	}
+}
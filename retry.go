@@ -0,0 +1,80 @@
+package warden
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CreateRetries retries creating jails that failed because of transient
+// errors, such as the docker daemon being briefly unreachable or registry
+// hiccups while pulling the image. Errors that can't go away by themselves,
+// such as a missing image, fail the session right away.
+type CreateRetries struct {
+	// Attempts is how many times creating a jail is retried. Defaults to 3.
+	Attempts int `json:"attempts"`
+	// Backoff is how long to wait before the first retry. It doubles for
+	// each later one. Defaults to 1s.
+	Backoff Duration `json:"backoff"`
+	// MaxTime caps the time spent creating a jail, including retries, after
+	// which no more are made. Zero only limits the number of attempts.
+	MaxTime Duration `json:"maxTime"`
+}
+
+func (r *CreateRetries) validate() error {
+	if r.Attempts < 0 || r.Backoff < 0 || r.MaxTime < 0 {
+		return fmt.Errorf("Invalid create retries %+v", *r)
+	}
+	return nil
+}
+
+// transientErrors are parts of docker's error messages for failures that
+// are worth retrying. Registry rate limits aren't among them, since they
+// last far longer than retries wait.
+var transientErrors = []string{
+	"Cannot connect to the Docker daemon",
+	"connection refused",
+	"connection reset",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"request canceled",
+	"resource temporarily unavailable",
+	"Service Unavailable",
+	"Bad Gateway",
+	"Gateway Timeout",
+	"unexpected EOF",
+}
+
+func isTransient(err error) bool {
+	msg := err.Error()
+	for _, s := range transientErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait before retrying to create a jail after
+// the given failed attempt, counting from 1, or false if it shouldn't be
+// retried. A nil CreateRetries never retries.
+func (r *CreateRetries) backoff(attempt int, started time.Time, err error) (time.Duration, bool) {
+	if r == nil || !isTransient(err) {
+		return 0, false
+	}
+	attempts, delay := r.Attempts, time.Duration(r.Backoff)
+	if attempts == 0 {
+		attempts = 3
+	}
+	if delay == 0 {
+		delay = time.Second
+	}
+	if attempt > attempts {
+		return 0, false
+	}
+	delay <<= uint(attempt - 1)
+	if r.MaxTime > 0 && time.Since(started)+delay >= time.Duration(r.MaxTime) {
+		return 0, false
+	}
+	return delay, true
+}
@@ -0,0 +1,93 @@
+package warden
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	transient := errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock")
+	for _, test := range []struct {
+		name    string
+		retries *CreateRetries
+		attempt int
+		elapsed time.Duration
+		err     error
+		delay   time.Duration
+		ok      bool
+	}{
+		{"disabled", nil, 1, 0, transient, 0, false},
+		{"defaults", &CreateRetries{}, 1, 0, transient, time.Second, true},
+		{"doubles", &CreateRetries{}, 3, 0, transient, 4 * time.Second, true},
+		{"attempts used up", &CreateRetries{}, 4, 0, transient, 0, false},
+		{"configured", &CreateRetries{Attempts: 5, Backoff: Duration(100 * time.Millisecond)}, 5, 0, transient, 1600 * time.Millisecond, true},
+		{"within max time", &CreateRetries{MaxTime: Duration(10 * time.Second)}, 2, 5 * time.Second, transient, 2 * time.Second, true},
+		{"past max time", &CreateRetries{MaxTime: Duration(10 * time.Second)}, 2, 9 * time.Second, transient, 0, false},
+		{"missing image", &CreateRetries{}, 1, 0, errors.New("Unable to find image 'nope:latest' locally"), 0, false},
+		{"rate limited", &CreateRetries{}, 1, 0, errors.New("toomanyrequests: You have reached your pull rate limit"), 0, false},
+	} {
+		delay, ok := test.retries.backoff(test.attempt, time.Now().Add(-test.elapsed), test.err)
+		if delay != test.delay || ok != test.ok {
+			t.Errorf("%s: backoff = %v, %v, want %v, %v", test.name, delay, ok, test.delay, test.ok)
+		}
+	}
+}
+
+func TestCreateRetriesValidate(t *testing.T) {
+	for _, r := range []CreateRetries{{Attempts: -1}, {Backoff: -1}, {MaxTime: -1}} {
+		if err := r.validate(); err == nil {
+			t.Errorf("%+v is valid", r)
+		}
+	}
+	if err := (&CreateRetries{Attempts: 2, Backoff: Duration(time.Second)}).validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+// failTwice fails to create jails twice with $ERROR, and then creates them.
+const failTwice = `case "$1" in
+create)
+  n=$(cat "$FAKE_DIR/failures" 2> /dev/null || echo 0)
+  if [ "$n" -lt 2 ]; then
+    echo $((n + 1)) > "$FAKE_DIR/failures"
+    echo "$ERROR" >&2
+    exit 1
+  fi
+  echo jail-id;;
+esac
+`
+
+func TestRunJailRetries(t *testing.T) {
+	for _, test := range []struct {
+		name, err string
+		retries   *CreateRetries
+		creates   int
+		ok        bool
+	}{
+		{"transient", "Cannot connect to the Docker daemon", &CreateRetries{Backoff: Duration(time.Millisecond)}, 3, true},
+		{"not retried", "Cannot connect to the Docker daemon", nil, 1, false},
+		{"permanent", "Unable to find image", &CreateRetries{Backoff: Duration(time.Millisecond)}, 1, false},
+		{"too few attempts", "i/o timeout", &CreateRetries{Attempts: 1, Backoff: Duration(time.Millisecond)}, 2, false},
+	} {
+		log := fakeDocker(t, failTwice)
+		t.Setenv("ERROR", test.err)
+		w := testJailWarden()
+		w.createRetries = test.retries
+		ch := &fakeChannel{}
+		jailID, _, err := w.runJail(logger("test"), ch, "warden-alice", []string{"create"}, nil, "ubuntu", []string{"bash"})
+		if (err == nil) != test.ok || test.ok && jailID != "jail-id" {
+			t.Errorf("%s: runJail = %q, %v", test.name, jailID, err)
+		}
+		if _, isStartError := err.(jailStartError); err != nil && !isStartError {
+			t.Errorf("%s: runJail = %#v, want a jailStartError", test.name, err)
+		}
+		if creates := dockerCalls(t, log, "create"); len(creates) != test.creates {
+			t.Errorf("%s: tried creating the jail %d times, want %d", test.name, len(creates), test.creates)
+		}
+		if retries := strings.Count(ch.String(), "retrying"); retries != test.creates-1 {
+			t.Errorf("%s: told the user about %d retries: %q", test.name, retries, ch.String())
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package warden
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+)
+
+var tmpfsSizeRegexp = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+
+// Scratch is temporary space for sessions, mounted in jails as a tmpfs.
+// Sessions in ephemeral jails get all of it, while sessions sharing a
+// persistent jail each get a directory in it. Either way, a session's
+// scratch space is removed when it ends, and its path is in the
+// WARDEN_SCRATCH env variable.
+type Scratch struct {
+	Path string `json:"path"`
+	// Size limits the tmpfs, e.g. "256m". Docker passes it to the kernel,
+	// which only takes whole numbers with a k, m or g suffix.
+	// Empty uses docker's default of half the host's memory.
+	Size string `json:"size"`
+}
+
+func (s *Scratch) validate() error {
+	if !path.IsAbs(s.Path) || path.Clean(s.Path) == "/" {
+		return fmt.Errorf("Scratch path %q must be an absolute path other than /", s.Path)
+	}
+	if s.Size != "" && !tmpfsSizeRegexp.MatchString(s.Size) {
+		return fmt.Errorf("Invalid scratch size %q", s.Size)
+	}
+	return nil
+}
+
+func (s *Scratch) runArgs() []string {
+	if s.Size == "" {
+		return []string{"--tmpfs", s.Path}
+	}
+	return []string{"--tmpfs", s.Path + ":size=" + s.Size}
+}
+
+// dir returns the session's scratch directory.
+func (s *Scratch) dir(persistent bool, sessionID string) string {
+	if !persistent {
+		return s.Path
+	}
+	return path.Join(s.Path, sessionID)
+}
+
+// removeScratch removes a session's scratch directory from the persistent
+// jail it shares.
+func removeScratch(jailID, dir string) error {
+	if out, err := exec.Command("docker", "exec", jailID, "rm", "-rf", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
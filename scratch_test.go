@@ -0,0 +1,100 @@
+package warden
+
+import (
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScratchValidate(t *testing.T) {
+	for _, test := range []struct {
+		scratch Scratch
+		ok      bool
+	}{
+		{Scratch{Path: "/scratch"}, true},
+		{Scratch{Path: "/tmp/scratch", Size: "256m"}, true},
+		{Scratch{Path: "/scratch", Size: "1073741824"}, true},
+		{Scratch{Path: "scratch"}, false},
+		{Scratch{Path: "/"}, false},
+		{Scratch{Path: "/scratch/.."}, false},
+		{Scratch{Path: "/scratch", Size: "1.5g"}, false},
+		{Scratch{Path: "/scratch", Size: "256m,exec"}, false},
+	} {
+		if err := test.scratch.validate(); (err == nil) != test.ok {
+			t.Errorf("%+v.validate() = %v, want ok %v", test.scratch, err, test.ok)
+		}
+	}
+}
+
+func TestScratchArgs(t *testing.T) {
+	s := &Scratch{Path: "/scratch"}
+	if args := s.runArgs(); !reflect.DeepEqual(args, []string{"--tmpfs", "/scratch"}) {
+		t.Errorf("runArgs() = %q", args)
+	}
+	s.Size = "64m"
+	if args := s.runArgs(); !reflect.DeepEqual(args, []string{"--tmpfs", "/scratch:size=64m"}) {
+		t.Errorf("runArgs() with a size = %q", args)
+	}
+	if dir := s.dir(false, "0123"); dir != "/scratch" {
+		t.Errorf("Ephemeral scratch dir = %q", dir)
+	}
+	if dir := s.dir(true, "0123"); dir != "/scratch/0123" {
+		t.Errorf("Shared scratch dir = %q", dir)
+	}
+}
+
+func TestJailScriptScratch(t *testing.T) {
+	w := &Warden{}
+	script := w.jailScript("session", "alice", "", "/scratch/0123", "")
+	checkScript(t, script)
+	if !strings.Contains(script, `mkdir -p '/scratch/0123' && chown "$user:" '/scratch/0123'`) || !strings.Contains(script, "export WARDEN_SCRATCH='/scratch/0123'") {
+		t.Errorf("Script doesn't set up scratch space:\n%s", script)
+	}
+	if script := w.jailScript("session", "alice", "", "", ""); strings.Contains(script, "WARDEN_SCRATCH") {
+		t.Errorf("Script without scratch space sets it up:\n%s", script)
+	}
+}
+
+func TestScratchSession(t *testing.T) {
+	scratch := &Scratch{Path: "/scratch", Size: "64m"}
+	for _, persistent := range []bool{false, true} {
+		log := fakeDocker(t, jailDocker)
+		_, addr := startWarden(t, Config{Jail: Jail{Persistent: persistent, Scratch: scratch}})
+		if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+			t.Fatal("Session failed:", err)
+		}
+		creates := append(dockerCalls(t, log, "create"), dockerCalls(t, log, "run -d")...)
+		if len(creates) != 1 || !strings.Contains(creates[0], " --tmpfs /scratch:size=64m ") {
+			t.Errorf("Persistent %v: jails created with %q, want a scratch tmpfs", persistent, creates)
+		}
+		if !persistent {
+			// The tmpfs goes with the jail.
+			if removes := dockerCalls(t, log, "exec"); len(removes) != 0 {
+				t.Errorf("Ephemeral jail ran %q", removes)
+			}
+			continue
+		}
+		// Sessions sharing a persistent jail get their own directory,
+		// which is removed once they end.
+		b, err := ioutil.ReadFile(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := regexp.MustCompile(`WARDEN_SCRATCH='(/scratch/[0-9a-f]{16})'`).FindStringSubmatch(string(b))
+		if dir == nil {
+			t.Fatalf("Session wasn't given a scratch directory:\n%s", b)
+		}
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			execs := dockerCalls(t, log, "exec")
+			if strings.HasSuffix(execs[len(execs)-1], " rm -rf "+dir[1]) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Scratch directory %s wasn't removed, ran %q", dir[1], execs)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package warden
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// connRecord collects what a client did while connecting, to be logged as
+// a single security event.
+type connRecord struct {
+	start   time.Time
+	client  string
+	user    string
+	methods []string
+	keys    []string
+	// kex, hostKey, cipher and mac are the algorithms the handshake
+	// negotiated.
+	kex, hostKey, cipher, mac string
+}
+
+// withRecord returns a copy of conf that records authentication attempts
+// in r.
+func (r *connRecord) withRecord(conf *ssh.ServerConfig) *ssh.ServerConfig {
+	recorded := *conf
+	checkKey := conf.PublicKeyCallback
+	recorded.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		r.keys = append(r.keys, key.Type()+":"+fingerprint(key))
+		return checkKey(conn, key)
+	}
+	recorded.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		r.client, r.user = string(conn.ClientVersion()), conn.User()
+		result := "ok"
+		if err != nil {
+			result = "failed"
+		}
+		r.methods = append(r.methods, method+":"+result)
+	}
+	return &recorded
+}
+
+func (r *connRecord) log(l logger, remote string, err error) {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	l.Printf("Security event: remote=%s client=%q user=%q auth=%s keys=%s kex=%s hostkey=%s cipher=%s mac=%s handshake=%s result=%q",
+		remote, r.client, r.user, strings.Join(r.methods, ","), strings.Join(r.keys, ","),
+		r.kex, r.hostKey, r.cipher, r.mac, time.Now().Sub(r.start), result)
+}
@@ -0,0 +1,147 @@
+package warden
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keyAuthenticator accepts only its key.
+type keyAuthenticator struct {
+	key ssh.PublicKey
+}
+
+func (a keyAuthenticator) Authenticate(conn ssh.ConnMetadata, method string, cred []byte) (*ssh.Permissions, error) {
+	if method != "publickey" || !bytes.Equal(cred, a.key.Marshal()) {
+		return nil, errors.New("Unknown key")
+	}
+	return &ssh.Permissions{}, nil
+}
+
+func TestSecurityRecord(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	rejected, err := ssh.NewSignerFromKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := ssh.NewSignerFromKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startWarden(t, Config{SecurityLog: true, Authenticator: keyAuthenticator{accepted.PublicKey()}})
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		Config: ssh.Config{
+			KeyExchanges: []string{"ecdh-sha2-nistp384", "ecdh-sha2-nistp256"},
+			Ciphers:      []string{"aes256-ctr", "aes128-ctr"},
+			MACs:         []string{"hmac-sha1-96"},
+		},
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(rejected, accepted)},
+	})
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer client.Close()
+
+	var record string
+	for deadline := time.Now().Add(5 * time.Second); record == "" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, "Security event:") {
+				record = line
+			}
+		}
+	}
+	if record == "" {
+		t.Fatal("No security event was logged")
+	}
+	for _, field := range []string{
+		`client="SSH-2.0-Go"`,
+		`user="alice"`,
+		"auth=none:failed,publickey:failed,publickey:ok",
+		"keys=" + rejected.PublicKey().Type() + ":" + fingerprint(rejected.PublicKey()) + "," +
+			accepted.PublicKey().Type() + ":" + fingerprint(accepted.PublicKey()) + " ",
+		"kex=ecdh-sha2-nistp384 ",
+		"hostkey=ecdsa-sha2-nistp256 ",
+		"cipher=aes256-ctr ",
+		"mac=hmac-sha1-96 ",
+		`result="ok"`,
+	} {
+		if !strings.Contains(record, field) {
+			t.Errorf("Security event %q doesn't record %s", record, field)
+		}
+	}
+}
+
+func TestNegotiatedAlgorithms(t *testing.T) {
+	for _, test := range []struct {
+		name                      string
+		client                    *kexInitMsg
+		w                         *Warden
+		kex, hostKey, cipher, mac string
+	}{
+		{
+			"client's preference",
+			&kexInitMsg{
+				KexAlgos:            []string{"curve25519-sha256", "ecdh-sha2-nistp521", "ecdh-sha2-nistp256"},
+				ServerHostKeyAlgos:  []string{"ssh-ed25519", "ecdsa-sha2-nistp256"},
+				CiphersClientServer: []string{"aes256-ctr", "aes128-ctr"},
+				CiphersServerClient: []string{"aes256-ctr", "aes128-ctr"},
+				MACsClientServer:    []string{"hmac-sha2-256", "hmac-sha1"},
+				MACsServerClient:    []string{"hmac-sha2-256", "hmac-sha1"},
+			},
+			&Warden{},
+			"ecdh-sha2-nistp521", "ecdsa-sha2-nistp256", "aes256-ctr", "hmac-sha1",
+		},
+		{
+			"configured algorithms",
+			&kexInitMsg{
+				KexAlgos:            []string{"ecdh-sha2-nistp256", "diffie-hellman-group14-sha1"},
+				CiphersClientServer: []string{"aes128-ctr", "aes128-gcm@openssh.com"},
+				CiphersServerClient: []string{"aes128-ctr", "aes128-gcm@openssh.com"},
+				MACsClientServer:    []string{"hmac-sha1", "hmac-sha1-96"},
+				MACsServerClient:    []string{"hmac-sha1", "hmac-sha1-96"},
+			},
+			&Warden{
+				keyExchanges: []string{"diffie-hellman-group14-sha1"},
+				ciphers:      []string{"aes128-gcm@openssh.com"},
+				macs:         []string{"hmac-sha1-96"},
+			},
+			"diffie-hellman-group14-sha1", "", "aes128-gcm@openssh.com", "hmac-sha1-96",
+		},
+		{
+			"directions differ",
+			&kexInitMsg{
+				KexAlgos:            []string{"ecdh-sha2-nistp256"},
+				CiphersClientServer: []string{"aes128-ctr"},
+				CiphersServerClient: []string{"aes256-ctr"},
+				MACsClientServer:    []string{"hmac-sha1"},
+				MACsServerClient:    []string{"hmac-sha1-96"},
+			},
+			&Warden{},
+			"ecdh-sha2-nistp256", "", "aes128-ctr/aes256-ctr", "hmac-sha1/hmac-sha1-96",
+		},
+		{"unrecorded", nil, &Warden{}, "", "", "", ""},
+	} {
+		if test.w.privateKeys == nil && test.client != nil && test.client.ServerHostKeyAlgos != nil {
+			signer, err := ssh.NewSignerFromKey(testKey(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.w.privateKeys = []ssh.Signer{signer}
+		}
+		kex, hostKey, cipher, mac := test.w.negotiatedAlgorithms(&kexInitRecorder{kexInit: test.client})
+		if kex != test.kex || hostKey != test.hostKey || cipher != test.cipher || mac != test.mac {
+			t.Errorf("%s: negotiatedAlgorithms = %q, %q, %q, %q, want %q, %q, %q, %q", test.name,
+				kex, hostKey, cipher, mac, test.kex, test.hostKey, test.cipher, test.mac)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package warden
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const fingerprintExtension = "warden-fingerprint"
+
+type SessionInfo struct {
+	ConnectionID string `json:"connectionId"`
+	SessionID    string `json:"sessionId"`
+	User         string `json:"user"`
+	// LocalUser is the account name used inside the jail.
+	LocalUser   string `json:"localUser"`
+	Tenant      string `json:"tenant,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Jail is the name of the persistent jail the client chose, if any.
+	Jail string `json:"jail,omitempty"`
+	// ContainerID is the ID of the session's jail container, once it has
+	// been created.
+	ContainerID string `json:"containerId"`
+}
+
+// session tracks the state of a session channel. Requests on a channel are
+// handled sequentially, so it needs no locking.
+type session struct {
+	info SessionInfo
+	log  logger
+	conn ssh.Conn
+	ch   ssh.Channel
+	// verbose is whether routine events are logged for this session.
+	verbose bool
+
+	ptyRequested  bool
+	term          string
+	width, height uint32
+	profile       string
+	resumeToken   string
+	// env holds the accepted env variables the client has set.
+	env map[string]string
+
+	started bool
+	pty     *os.File
+	// hangup closes the session once it has started.
+	hangup func()
+	// lastInput is when the client last sent input, in Unix nanoseconds.
+	lastInput int64
+}
+
+// envRequestMsg is the payload of an "env" request (RFC 4254 section 6.4).
+type envRequestMsg struct {
+	Name  string
+	Value string
+}
+
+func (w *Warden) sessionInfo(conn *ssh.ServerConn, connID string) SessionInfo {
+	info := SessionInfo{
+		ConnectionID: connID,
+		SessionID:    newID(),
+		User:         conn.User(),
+		LocalUser:    conn.User(),
+		Tenant:       w.users[conn.User()].Tenant,
+	}
+	if conn.Permissions != nil {
+		info.Fingerprint = conn.Permissions.Extensions[fingerprintExtension]
+		if localUser, ok := conn.Permissions.Extensions[localUserExtension]; ok {
+			info.LocalUser = localUser
+		}
+	}
+	return info
+}
+
+func (info SessionInfo) logger() logger {
+	return logger(fmt.Sprintf("conn=%s session=%s", info.ConnectionID, info.SessionID))
+}
+
+// newID returns a random identifier for correlating a connection or session
+// across logs and containers.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func (info SessionInfo) render(tmpl *template.Template) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, info); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// sendRequest sends a request the client doesn't reply to, such as
+// exit-status. The channel or connection having already closed, e.g.
+// because the client went away first, is expected during teardown, so it
+// is only logged when verbose.
+func sendRequest(l logger, verbose bool, ch ssh.Channel, name string, payload []byte) {
+	_, err := ch.SendRequest(name, false, payload)
+	switch {
+	case err == nil:
+	case err == io.EOF || strings.Contains(err.Error(), "use of closed network connection"):
+		if verbose {
+			l.Printf("Not sending %s, the channel is closed", name)
+		}
+	default:
+		l.Printf("Failed to send %s: %v", name, err)
+	}
+}
+
+// outputDrainTimeout bounds how long a closing session waits for the jail's
+// remaining output to be written to the client.
+const outputDrainTimeout = time.Second
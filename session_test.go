@@ -0,0 +1,183 @@
+package warden
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := newID()
+		if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(id) {
+			t.Fatalf("newID() = %q, want 16 hex digits", id)
+		}
+		if seen[id] {
+			t.Fatalf("newID() returned %q twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+// A session's IDs label its jail, name it, and prefix its log lines.
+func TestSessionIDs(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	dockerLog := fakeDocker(t, jailDocker)
+	_, addr := startWarden(t, Config{})
+	if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+		t.Fatal("Session failed:", err)
+	}
+
+	creates := dockerCalls(t, dockerLog, "create")
+	if len(creates) != 1 {
+		t.Fatalf("Created jails %q, want one", creates)
+	}
+	m := regexp.MustCompile(`--label warden.connection=(\S+) --label warden.session=(\S+)`).FindStringSubmatch(creates[0])
+	if m == nil {
+		t.Fatalf("Jail %q isn't labelled with the session's IDs", creates[0])
+	}
+	connID, sessionID := m[1], m[2]
+	if !strings.Contains(creates[0], "--name warden-auto-") || !strings.Contains(creates[0], "-alice-"+sessionID+" ") {
+		t.Errorf("Jail %q isn't named after session %s", creates[0], sessionID)
+	}
+	if !strings.Contains(logs.String(), "conn="+connID+" session="+sessionID+" ") {
+		t.Errorf("No log line names the session:\n%s", logs.String())
+	}
+}
+
+// failingChannel is a channel whose requests fail with err.
+type failingChannel struct {
+	fakeChannel
+	err error
+}
+
+func (c *failingChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, c.err
+}
+
+func TestSendRequest(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	for _, test := range []struct {
+		err     error
+		verbose bool
+		want    string
+	}{
+		{nil, true, ""},
+		// The channel closing first is expected during teardown.
+		{io.EOF, false, ""},
+		{errors.New("write tcp 127.0.0.1:22: use of closed network connection"), false, ""},
+		{io.EOF, true, "session Not sending exit-status, the channel is closed"},
+		{errors.New("ssh: disconnect, reason 11"), false, "session Failed to send exit-status: ssh: disconnect, reason 11"},
+	} {
+		var logs syncBuffer
+		log.SetOutput(&logs)
+		sendRequest(logger("session"), test.verbose, &failingChannel{err: test.err}, "exit-status", nil)
+		if got := strings.TrimSpace(logs.String()); !strings.HasSuffix(got, test.want) || test.want == "" && got != "" {
+			t.Errorf("Sending with error %v, verbose %v logged %q, want %q", test.err, test.verbose, got, test.want)
+		}
+	}
+}
+
+// scriptDocker runs the commands given on its input as a shell would, once
+// it has turned off the terminal's echo and said so, then keeps printing
+// output for a while after its input ends.
+const scriptDocker = `case "$1" in
+create) echo id-jail;;
+inspect) echo true;;
+start)
+  stty -echo 2> /dev/null
+  echo ready
+  while read -r line; do eval "$line"; done
+  sleep 0.3
+  echo finished;;
+esac
+`
+
+func TestKeepOpenOnEOF(t *testing.T) {
+	for _, keepOpen := range []bool{false, true} {
+		fakeDocker(t, scriptDocker)
+		_, addr := startWarden(t, Config{KeepOpenOnEOF: keepOpen, HangupGrace: Duration(100 * time.Millisecond)})
+		s, err := dialWarden(t, addr, "alice").NewSession()
+		if err != nil {
+			t.Fatal("NewSession:", err)
+		}
+		// As with "ssh host < script".
+		stdin, err := s.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out syncBuffer
+		s.Stdout, s.Stderr = &out, &out
+		if err := s.Shell(); err != nil {
+			t.Fatal("Shell:", err)
+		}
+		// Input sent before echo is off would be echoed back.
+		for deadline := time.Now().Add(5 * time.Second); !strings.Contains(out.String(), "ready"); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Session printed %q, want it ready for input", out.String())
+			}
+		}
+		io.WriteString(stdin, "echo one\necho two\n")
+		stdin.Close()
+		s.Wait()
+		got := strings.Replace(out.String(), "\r\n", "\n", -1)
+		if keepOpen && got != "ready\none\ntwo\nfinished\n" {
+			t.Errorf("Session kept open printed %q, want all of its output", got)
+		}
+		// Otherwise the end of input hangs up on the session.
+		if !keepOpen && strings.Contains(got, "finished") {
+			t.Errorf("Session printed %q after its input ended", got)
+		}
+	}
+}
+
+func TestKeepOpenOnEOFClosed(t *testing.T) {
+	fakeDocker(t, `case "$1" in
+create) echo id-jail;;
+inspect) echo true;;
+start) echo $$ > "$FAKE_DIR/pid"; echo started; while :; do sleep 0.01; done;;
+esac
+`)
+	_, addr := startWarden(t, Config{KeepOpenOnEOF: true, HangupGrace: Duration(100 * time.Millisecond)})
+	ch, reqs, err := dialWarden(t, addr, "alice").OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal("OpenChannel:", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	if ok, err := ch.SendRequest("shell", true, nil); !ok || err != nil {
+		t.Fatalf("shell = %v, %v", ok, err)
+	}
+	ch.CloseWrite()
+	if _, err := io.ReadFull(ch, make([]byte, len("started"))); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(os.Getenv("FAKE_DIR"), "pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing the channel still ends a session whose input has ended.
+	ch.Close()
+	for deadline := time.Now().Add(5 * time.Second); syscall.Kill(pid, 0) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Session wasn't ended when its channel closed")
+		}
+	}
+}
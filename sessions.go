@@ -0,0 +1,103 @@
+package warden
+
+import (
+	"sort"
+	"strings"
+)
+
+// SessionByContainer returns the session running in the jail container
+// with the given ID, as shown by docker ps. Persistent jails can be shared
+// by several sessions, in which case the most recently started one is
+// returned.
+func (w *Warden) SessionByContainer(id string) (SessionInfo, bool) {
+	w.sessionsMu.Lock()
+	defer w.sessionsMu.Unlock()
+	for containerID, sessions := range w.sessionsByJail {
+		// docker ps shows shortened IDs.
+		if containerID == id || len(id) >= 12 && strings.HasPrefix(containerID, id) {
+			return sessions[len(sessions)-1].info, true
+		}
+	}
+	return SessionInfo{}, false
+}
+
+func (w *Warden) addSession(s *session) {
+	w.sessionsMu.Lock()
+	defer w.sessionsMu.Unlock()
+	w.sessionsByJail[s.info.ContainerID] = append(w.sessionsByJail[s.info.ContainerID], s)
+}
+
+func (w *Warden) removeSession(info SessionInfo) {
+	w.sessionsMu.Lock()
+	defer w.sessionsMu.Unlock()
+	sessions := w.sessionsByJail[info.ContainerID]
+	for i, s := range sessions {
+		if s.info.SessionID == info.SessionID {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(w.sessionsByJail, info.ContainerID)
+	} else {
+		w.sessionsByJail[info.ContainerID] = sessions
+	}
+}
+
+// runningSessions returns the sessions that have a running jail.
+func (w *Warden) runningSessions() []*session {
+	w.sessionsMu.Lock()
+	defer w.sessionsMu.Unlock()
+	var running []*session
+	for _, sessions := range w.sessionsByJail {
+		running = append(running, sessions...)
+	}
+	return running
+}
+
+// activeJails returns how many jails have sessions running in them.
+func (w *Warden) activeJails() int {
+	w.sessionsMu.Lock()
+	defer w.sessionsMu.Unlock()
+	return len(w.sessionsByJail)
+}
+
+// Sessions returns the sessions running in jails, ordered by connection.
+func (w *Warden) Sessions() []SessionInfo {
+	var infos []SessionInfo
+	for _, s := range w.runningSessions() {
+		infos = append(infos, s.info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].ConnectionID != infos[j].ConnectionID {
+			return infos[i].ConnectionID < infos[j].ConnectionID
+		}
+		return infos[i].SessionID < infos[j].SessionID
+	})
+	return infos
+}
+
+// Stats summarizes the state of a Warden.
+type Stats struct {
+	Sessions int `json:"sessions"`
+	// Jails is the number of jails with sessions running in them.
+	Jails int `json:"jails"`
+	// PersistentJails is the number of persistent jails kept between
+	// sessions, whether or not they are in use.
+	PersistentJails int  `json:"persistentJails"`
+	Degraded        bool `json:"degraded"`
+	ShuttingDown    bool `json:"shuttingDown"`
+}
+
+func (w *Warden) Stats() Stats {
+	w.jailsMu.Lock()
+	persistent := len(w.jails)
+	w.jailsMu.Unlock()
+	return Stats{
+		Sessions:        len(w.runningSessions()),
+		Jails:           w.activeJails(),
+		PersistentJails: persistent,
+		Degraded:        w.Degraded(),
+		ShuttingDown:    w.ShuttingDown(),
+	}
+}
@@ -0,0 +1,85 @@
+package warden
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSessionByContainer(t *testing.T) {
+	const (
+		shared    = "4f2a9c7d1e3b5a6c8d0e2f4a6b8c0d1e3f5a7b9c1d3e5f7a9b1c3d5e7f9a1b3c"
+		ephemeral = "9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d"
+	)
+	w := &Warden{sessionsByJail: make(map[string][]*session)}
+	alice := SessionInfo{SessionID: "1", User: "alice", ContainerID: shared}
+	alice2 := SessionInfo{SessionID: "2", User: "alice", ContainerID: shared}
+	bob := SessionInfo{SessionID: "3", User: "bob", ContainerID: ephemeral}
+	for _, info := range []SessionInfo{alice, alice2, bob} {
+		w.addSession(&session{info: info})
+	}
+	for _, test := range []struct {
+		id   string
+		want string
+	}{
+		{ephemeral, "3"},
+		// As docker ps shows them.
+		{ephemeral[:12], "3"},
+		// The most recent of a shared jail's sessions.
+		{shared, "2"},
+		{ephemeral[:6], ""},
+		{"", ""},
+		{"0123456789ab", ""},
+	} {
+		info, ok := w.SessionByContainer(test.id)
+		if ok != (test.want != "") || info.SessionID != test.want {
+			t.Errorf("SessionByContainer(%q) = %+v, %v, want session %q", test.id, info, ok, test.want)
+		}
+	}
+	w.removeSession(alice2)
+	if info, ok := w.SessionByContainer(shared); !ok || info != alice {
+		t.Errorf("SessionByContainer after the latest session ended = %+v, %v, want %+v", info, ok, alice)
+	}
+	w.removeSession(alice)
+	if info, ok := w.SessionByContainer(shared); ok {
+		t.Errorf("SessionByContainer after the jail's sessions ended = %+v", info)
+	}
+}
+
+func TestSessionByContainerRunning(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	t.Setenv("HOLD_SESSIONS", "1")
+	w, addr := startWarden(t, Config{HangupGrace: Duration(100 * time.Millisecond)})
+	client := dialWarden(t, addr, "alice")
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal("OpenChannel:", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	if ok, err := ch.SendRequest("shell", true, nil); !ok || err != nil {
+		t.Fatalf("shell = %v, %v", ok, err)
+	}
+	// The session prints its container's ID once it is running.
+	out := make([]byte, 200)
+	n, err := ch.Read(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimPrefix(strings.TrimSpace(string(out[:n])), "session in ")
+	info, ok := w.SessionByContainer(id)
+	if !ok || info.User != "alice" || info.ContainerID != id {
+		t.Errorf("SessionByContainer(%q) = %+v, %v, want alice's session", id, info, ok)
+	}
+
+	ch.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := w.SessionByContainer(id); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Ended session still found by its container")
+		}
+	}
+}
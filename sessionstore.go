@@ -0,0 +1,140 @@
+package warden
+
+import (
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SessionRecord describes a session for a SessionStore.
+type SessionRecord struct {
+	SessionInfo
+	// Image is the image the session's jail was created from.
+	Image   string
+	Started time.Time
+	// Ended is zero while the session is running.
+	Ended time.Time
+	// BytesIn and BytesOut count the data the client sent to the jail and
+	// the jail's output sent to the client.
+	BytesIn  int64
+	BytesOut int64
+	// ExitStatus is the status reported to the client, or -1 if the
+	// session's shell couldn't be waited for.
+	ExitStatus int
+}
+
+// Duration returns how long the session ran for, or has been running.
+func (r SessionRecord) Duration() time.Duration {
+	if r.Ended.IsZero() {
+		return time.Since(r.Started)
+	}
+	return r.Ended.Sub(r.Started)
+}
+
+// SessionStore records sessions, so that programs embedding warden can keep
+// their history in a database. SessionStarted is called once a session's
+// jail is running, and SessionEnded with the same record updated once it
+// has closed. Calls are made one at a time, in order, from a goroutine of
+// their own, so a slow store doesn't hold up sessions.
+type SessionStore interface {
+	SessionStarted(SessionRecord) error
+	SessionEnded(SessionRecord) error
+}
+
+// sessionStoreBuffer is how many records can wait to be written to the
+// session store before more are dropped.
+const sessionStoreBuffer = 1024
+
+type storeOp struct {
+	record SessionRecord
+	jailID string
+	ended  bool
+}
+
+// sessionRecorder writes session records to a SessionStore in the
+// background. A nil sessionRecorder records nothing.
+type sessionRecorder struct {
+	store SessionStore
+	ops   chan storeOp
+}
+
+func newSessionRecorder(store SessionStore) *sessionRecorder {
+	if store == nil {
+		return nil
+	}
+	r := &sessionRecorder{store: store, ops: make(chan storeOp, sessionStoreBuffer)}
+	go r.run()
+	return r
+}
+
+func (r *sessionRecorder) started(record SessionRecord, jailID string) {
+	r.send(storeOp{record: record, jailID: jailID})
+}
+
+func (r *sessionRecorder) ended(record SessionRecord) {
+	r.send(storeOp{record: record, ended: true})
+}
+
+func (r *sessionRecorder) send(op storeOp) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.ops <- op:
+	default:
+		log.Println("Session store is falling behind, dropping record of session", op.record.SessionID)
+	}
+}
+
+func (r *sessionRecorder) run() {
+	// Ephemeral jails' sessions are recorded with the image they were just
+	// created from, since the jail may be gone by now. The image of a shared
+	// jail, which outlives its sessions, is looked up here rather than when
+	// the session starts, so that the docker call doesn't delay it.
+	images := make(map[string]string)
+	for op := range r.ops {
+		var err error
+		if op.ended {
+			if op.record.Image == "" {
+				op.record.Image = images[op.record.SessionID]
+			}
+			delete(images, op.record.SessionID)
+			err = r.store.SessionEnded(op.record)
+		} else {
+			if op.record.Image == "" {
+				op.record.Image = jailImage(op.jailID)
+				images[op.record.SessionID] = op.record.Image
+			}
+			err = r.store.SessionStarted(op.record)
+		}
+		if err != nil {
+			log.Println("Failed to store session record:", err)
+		}
+	}
+}
+
+// jailImage returns the image a jail was created from, or "" if it can't be
+// inspected.
+func jailImage(jailID string) string {
+	out, err := exec.Command("docker", "inspect", "-f", "{{.Config.Image}}", jailID).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// countingWriter counts the bytes written through it, which can be read
+// while writes are ongoing.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,93 @@
+package warden
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore is a SessionStore keeping records in memory.
+type memoryStore struct {
+	mu              sync.Mutex
+	started, ended  []SessionRecord
+	endedRecordings chan struct{}
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{endedRecordings: make(chan struct{}, 16)}
+}
+
+func (m *memoryStore) SessionStarted(r SessionRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started = append(m.started, r)
+	return nil
+}
+
+func (m *memoryStore) SessionEnded(r SessionRecord) error {
+	m.mu.Lock()
+	m.ended = append(m.ended, r)
+	m.mu.Unlock()
+	m.endedRecordings <- struct{}{}
+	return nil
+}
+
+func (m *memoryStore) waitEnded(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-m.endedRecordings:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Session end wasn't recorded")
+		}
+	}
+}
+
+func TestSessionRecorderImages(t *testing.T) {
+	// Only the shared jail can still be inspected.
+	fakeDocker(t, `case "$*" in
+*shared-id) echo debian;;
+*) echo "Error: No such object" >&2; exit 1;;
+esac
+`)
+	store := newMemoryStore()
+	r := newSessionRecorder(store)
+	for _, test := range []struct {
+		sessionID, jailID, image string
+	}{
+		{"ephemeral", "gone-id", "ubuntu"},
+		{"shared", "shared-id", ""},
+	} {
+		record := SessionRecord{SessionInfo: SessionInfo{SessionID: test.sessionID}, Image: test.image}
+		r.started(record, test.jailID)
+		r.ended(record)
+	}
+	store.waitEnded(t, 2)
+
+	want := map[string]string{"ephemeral": "ubuntu", "shared": "debian"}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, records := range [][]SessionRecord{store.started, store.ended} {
+		for _, record := range records {
+			if record.Image != want[record.SessionID] {
+				t.Errorf("Session %s recorded with image %q, want %q", record.SessionID, record.Image, want[record.SessionID])
+			}
+		}
+	}
+}
+
+// An ephemeral jail is removed when its session ends, which may be before
+// the session's start is recorded.
+func TestSessionRecordEphemeralImage(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	store := newMemoryStore()
+	_, addr := startWarden(t, Config{Jail: Jail{Image: "alpine"}, SessionStore: store})
+	if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+		t.Fatal("Session failed:", err)
+	}
+	store.waitEnded(t, 1)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.started) != 1 || store.started[0].Image != "alpine" || store.ended[0].Image != "alpine" {
+		t.Errorf("Recorded %+v, %+v, want sessions in alpine", store.started, store.ended)
+	}
+}
@@ -0,0 +1,64 @@
+package warden
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// hasShell reports whether image has bash, which the jail script and
+// persistent jails run under. Minimal and distroless images often have no
+// shell at all. The result is cached per image, unless docker failed to run
+// the probe for some other reason, in which case the image is assumed to
+// have one and creating the jail reports the failure.
+func (w *Warden) hasShell(l logger, image string) bool {
+	w.shellProbesMu.Lock()
+	ok, probed := w.shellProbes[image]
+	w.shellProbesMu.Unlock()
+	if probed {
+		return ok
+	}
+	cmd := w.docker("run", "--rm", "--net", "none", "--entrypoint", "bash", image, "-c", "true")
+	cmd.Env = append(os.Environ(), w.registryEnviron(image)...)
+	err := cmd.Run()
+	if err != nil {
+		exitErr, isExit := err.(*exec.ExitError)
+		// docker run exits with 126 or 127 when the command can't be run
+		// or found in the image.
+		if !isExit || !noShellStatus(exitErr) {
+			l.Printf("Failed to probe %s for a shell: %v", image, err)
+			return true
+		}
+		l.Printf("Image %s has no shell", image)
+		ok = false
+	} else {
+		ok = true
+	}
+	w.shellProbesMu.Lock()
+	w.shellProbes[image] = ok
+	w.shellProbesMu.Unlock()
+	return ok
+}
+
+// runsCommand reports whether a jail runs the jail command rather than the
+// jail script, because its image has no shell.
+func (w *Warden) runsCommand(jailID string) bool {
+	w.shellProbesMu.Lock()
+	defer w.shellProbesMu.Unlock()
+	return w.commandJails[jailID]
+}
+
+func (w *Warden) setRunsCommand(jailID string, runs bool) {
+	w.shellProbesMu.Lock()
+	defer w.shellProbesMu.Unlock()
+	if runs {
+		w.commandJails[jailID] = true
+	} else {
+		delete(w.commandJails, jailID)
+	}
+}
+
+func noShellStatus(err *exec.ExitError) bool {
+	status, ok := err.Sys().(syscall.WaitStatus)
+	return ok && (status.ExitStatus() == 126 || status.ExitStatus() == 127)
+}
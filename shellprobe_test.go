@@ -0,0 +1,103 @@
+package warden
+
+import (
+	"strings"
+	"testing"
+)
+
+// noShell fakes docker for an image without bash: the shell probe can't
+// run it, and jails are created as "jail-id".
+const noShell = `case "$1" in
+run) exit 127;;
+create) echo jail-id;;
+inspect) echo true;;
+esac
+`
+
+func TestJailCommandValidate(t *testing.T) {
+	command := []string{"/app/console"}
+	for _, test := range []struct {
+		name string
+		jail Jail
+		ok   bool
+	}{
+		{"ephemeral", Jail{Command: command}, true},
+		{"fallback image", Jail{Command: command, FallbackImage: "ubuntu"}, true},
+		{"persistent", Jail{Command: command, Persistent: true}, false},
+		{"create hook", Jail{Command: command, CreateHook: &CreateHook{Command: []string{"true"}}}, false},
+		{"readiness probe", Jail{Command: command, ReadinessProbe: &ReadinessProbe{Command: []string{"true"}}}, false},
+		{"empty", Jail{Command: []string{""}}, false},
+	} {
+		if err := test.jail.validate(); (err == nil) != test.ok {
+			t.Errorf("%s: validate() = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestRunJailCommand(t *testing.T) {
+	log := fakeDocker(t, noShell)
+	w := testJailWarden()
+	w.jail.Command = []string{"/app/console"}
+	for i := 0; i < 2; i++ {
+		jailID, _, err := w.runJail(logger("test"), nil, "warden-alice", []string{"create"}, nil, "distroless", []string{"bash", "-c", "script"})
+		if err != nil || jailID != "jail-id" {
+			t.Fatalf("runJail = %q, %v", jailID, err)
+		}
+	}
+	if probes := dockerCalls(t, log, "run"); len(probes) != 1 {
+		t.Errorf("Probed for a shell %d times, want once: %q", len(probes), probes)
+	}
+	for _, create := range dockerCalls(t, log, "create") {
+		if !strings.HasSuffix(create, " distroless /app/console") {
+			t.Errorf("Created jail with %q, want the jail command", create)
+		}
+	}
+	if !w.runsCommand("jail-id") {
+		t.Error("Jail isn't known to run the jail command")
+	}
+
+	// Without a jail command, sessions are refused.
+	w = testJailWarden()
+	ch := &fakeChannel{}
+	if _, _, err := w.runJail(logger("test"), ch, "warden-alice", []string{"create"}, nil, "distroless", []string{"bash"}); err == nil {
+		t.Error("runJail succeeded without a shell or jail command")
+	}
+	if !strings.Contains(ch.String(), "has no shell") {
+		t.Errorf("Told the user %q, want that the image has no shell", ch.String())
+	}
+}
+
+func TestSignalSession(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		runsCommand bool
+		call        string
+	}{
+		{"jail script", false, "exec jail-id bash -c"},
+		{"jail command", true, "kill --signal HUP jail-id"},
+	} {
+		log := fakeDocker(t, "")
+		w := testJailWarden()
+		w.setRunsCommand("jail-id", test.runsCommand)
+		if err := w.signalSession("jail-id", "session", "HUP"); err != nil {
+			t.Errorf("%s: signalSession failed: %v", test.name, err)
+		}
+		calls := append(dockerCalls(t, log, "exec"), dockerCalls(t, log, "kill")...)
+		if len(calls) != 1 || !strings.HasPrefix(calls[0], test.call) {
+			t.Errorf("%s: signalSession ran %q, want %q", test.name, calls, test.call)
+		}
+	}
+}
+
+func TestOpenCommandJail(t *testing.T) {
+	log := fakeDocker(t, noShell)
+	w := testJailWarden()
+	w.jail.FallbackImage = "ubuntu"
+	w.setRunsCommand("jail-id", true)
+	if err := w.openJail(&session{log: logger("test")}, "jail-id"); err != nil {
+		t.Fatal("openJail failed:", err)
+	}
+	if execs := dockerCalls(t, log, "exec"); len(execs) != 0 {
+		t.Errorf("openJail ran %q in a jail without a shell", execs)
+	}
+}
@@ -0,0 +1,78 @@
+package warden
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Shutdown stops warden from starting new sessions. Sessions already
+// running are left alone until Cleanup. Connections arriving after
+// Shutdown are closed, or sent the shutdown message if one is configured.
+func (w *Warden) Shutdown() {
+	if atomic.CompareAndSwapInt32(&w.shuttingDown, 0, 1) {
+		log.Println("Shutting down, refusing new sessions")
+	}
+}
+
+// ShuttingDown reports whether Shutdown has been called.
+func (w *Warden) ShuttingDown() bool {
+	return atomic.LoadInt32(&w.shuttingDown) != 0
+}
+
+// refuseSession tells a client that opened a session while warden is
+// shutting down to try again later, once it has asked for a shell or
+// command and so is ready to display output.
+func (w *Warden) refuseSession(l logger, newChan ssh.NewChannel) {
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		l.Println("newChan.Accept failed:", err)
+		return
+	}
+	defer ch.Close()
+	for req := range reqs {
+		switch req.Type {
+		case "shell", "exec":
+			reply(req, true)
+			fmt.Fprintf(ch, "%s\r\n", w.shutdownMessage)
+			sendRequest(l, false, ch, "exit-status", ssh.Marshal(&struct{ Status uint32 }{1}))
+			return
+		case "pty-req", "env", "window-change":
+			reply(req, true)
+		default:
+			reply(req, false)
+		}
+	}
+}
+
+// shutdownOnSignal shuts warden down gracefully on SIGINT or SIGTERM: it
+// refuses new sessions, drains running ones as the drain policy says, then
+// removes the jails and stops Run. A second signal stops waiting for
+// sessions.
+func (w *Warden) shutdownOnSignal() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	<-signals
+	log.Println("Received an interrupt, waiting for sessions to end...")
+	w.Shutdown()
+	drained := make(chan struct{})
+	go func() {
+		w.drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-signals:
+		log.Println("Received a second interrupt, stopping now")
+	}
+	if err := w.Cleanup(); err != nil {
+		log.Println("Failed to clean up:", err)
+	}
+	w.Close()
+}
@@ -0,0 +1,49 @@
+package warden
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestShutdownMessage(t *testing.T) {
+	log := fakeDocker(t, jailDocker)
+	const message = "warden is restarting, try again shortly"
+	w, addr := startWarden(t, Config{ShutdownMessage: message})
+	// Connections from before the shutdown get the message too.
+	before := dialWarden(t, addr, "alice")
+	w.Shutdown()
+	for name, client := range map[string]*ssh.Client{"before": before, "during": dialWarden(t, addr, "alice")} {
+		out, err := runShell(t, client, map[string]string{"LANG": "C"})
+		if exit, ok := err.(*ssh.ExitError); !ok || exit.ExitStatus() != 1 {
+			t.Errorf("Session %s shutdown ended with %v, want exit status 1", name, err)
+		}
+		if out != message+"\r\n" {
+			t.Errorf("Session %s shutdown printed %q, want the shutdown message", name, out)
+		}
+	}
+	if creates := dockerCalls(t, log, "create"); len(creates) != 0 {
+		t.Errorf("Jails created during shutdown: %q", creates)
+	}
+}
+
+func TestShutdownWithoutMessage(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	w, addr := startWarden(t, Config{})
+	before := dialWarden(t, addr, "alice")
+	w.Shutdown()
+	if _, err := before.NewSession(); err == nil || !strings.Contains(err.Error(), "warden is shutting down") {
+		t.Errorf("NewSession during shutdown = %v, want it refused", err)
+	}
+	// New connections are closed without a handshake.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, _, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{User: "alice"}); err == nil {
+		t.Error("Handshake succeeded during shutdown")
+	}
+}
@@ -0,0 +1,104 @@
+package warden
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// SignaturePolicy requires jail images to be signed before jails are
+// created from them.
+type SignaturePolicy struct {
+	// Key is the cosign public key, or a KMS URI, images must be signed
+	// with.
+	Key string `json:"key"`
+	// Command is the cosign binary to run. Defaults to "cosign".
+	Command string `json:"command"`
+}
+
+func (p *SignaturePolicy) validate() error {
+	if p.Key == "" {
+		return errors.New("Signature verification requires a key")
+	}
+	return nil
+}
+
+// verify checks image's signature with cosign, and returns the image pinned
+// to the digest that was verified. Jails are created from the pinned image,
+// so that neither the tag moving after verification nor a local image with
+// the same tag can put an unverified image in a jail. Images are verified
+// every time a jail is created, since their tags can be moved to other
+// images.
+func (p *SignaturePolicy) verify(image string) (string, error) {
+	command := p.Command
+	if command == "" {
+		command = "cosign"
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(command, "verify", "--key", p.Key, image)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to verify signature of %s: %v: %s", image, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	digest, err := verifiedDigest(out)
+	if err != nil {
+		return "", fmt.Errorf("Failed to verify signature of %s: %v", image, err)
+	}
+	return imageRepository(image) + "@" + digest, nil
+}
+
+// cosignPayload is the part of a signature payload cosign verify prints
+// that names the signed image's digest.
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			Digest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// verifiedDigest returns the digest cosign verify's output says was signed.
+// Depending on its version, cosign prints a JSON array of payloads or one
+// payload per line, and every payload must be for the same digest.
+func verifiedDigest(out []byte) (string, error) {
+	var payloads []cosignPayload
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("Failed to parse cosign output: %v", err)
+		}
+		if bytes.HasPrefix(raw, []byte("[")) {
+			var ps []cosignPayload
+			if err := json.Unmarshal(raw, &ps); err != nil {
+				return "", fmt.Errorf("Failed to parse cosign output: %v", err)
+			}
+			payloads = append(payloads, ps...)
+			continue
+		}
+		var payload cosignPayload
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			return "", fmt.Errorf("Failed to parse cosign output: %v", err)
+		}
+		payloads = append(payloads, payload)
+	}
+	var digest string
+	for _, p := range payloads {
+		d := p.Critical.Image.Digest
+		if !strings.HasPrefix(d, "sha256:") || digest != "" && d != digest {
+			return "", fmt.Errorf("Unexpected signed digest %q", d)
+		}
+		digest = d
+	}
+	if digest == "" {
+		return "", errors.New("Cosign verified no signatures")
+	}
+	return digest, nil
+}
@@ -0,0 +1,80 @@
+package warden
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	digestA = "sha256:aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000"
+	digestB = "sha256:bbbb0000bbbb0000bbbb0000bbbb0000bbbb0000bbbb0000bbbb0000bbbb0000"
+)
+
+func cosignPayloadJSON(digest string) string {
+	return `{"critical":{"identity":{"docker-reference":"example"},"image":{"docker-manifest-digest":"` + digest + `"},"type":"cosign container image signature"},"optional":null}`
+}
+
+func TestVerifiedDigest(t *testing.T) {
+	for _, test := range []struct {
+		name, out, want string
+	}{
+		{"array", "[" + cosignPayloadJSON(digestA) + "," + cosignPayloadJSON(digestA) + "]\n", digestA},
+		{"lines", cosignPayloadJSON(digestA) + "\n" + cosignPayloadJSON(digestA) + "\n", digestA},
+		{"different digests", "[" + cosignPayloadJSON(digestA) + "," + cosignPayloadJSON(digestB) + "]", ""},
+		{"no digest", `[{"critical":{}}]`, ""},
+		{"no payloads", "[]", ""},
+		{"not JSON", "Verified OK", ""},
+	} {
+		got, err := verifiedDigest([]byte(test.out))
+		if got != test.want || (err == nil) != (test.want != "") {
+			t.Errorf("%s: verifiedDigest = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+// fakeCosign returns a policy running a cosign script instead of cosign.
+func fakeCosign(t *testing.T, script string) *SignaturePolicy {
+	command := filepath.Join(t.TempDir(), "cosign")
+	if err := ioutil.WriteFile(command, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &SignaturePolicy{Key: "cosign.pub", Command: command}
+}
+
+func TestVerify(t *testing.T) {
+	p := fakeCosign(t, `echo '[`+cosignPayloadJSON(digestA)+`]'`)
+	for image, want := range map[string]string{
+		"ubuntu":                          "ubuntu@" + digestA,
+		"ubuntu:22.04":                    "ubuntu@" + digestA,
+		"registry.example.com:5000/app:1": "registry.example.com:5000/app@" + digestA,
+		"registry.example.com:5000/app":   "registry.example.com:5000/app@" + digestA,
+		"app@" + digestB:                  "app@" + digestA,
+	} {
+		if got, err := p.verify(image); err != nil || got != want {
+			t.Errorf("verify(%q) = %q, %v, want %q", image, got, err, want)
+		}
+	}
+
+	p = fakeCosign(t, "echo 'Error: no matching signatures' >&2; exit 1")
+	if _, err := p.verify("ubuntu"); err == nil || !strings.Contains(err.Error(), "no matching signatures") {
+		t.Errorf("verify of an unsigned image = %v", err)
+	}
+}
+
+func TestRunJailPinsVerifiedDigest(t *testing.T) {
+	log := fakeDocker(t, "echo jail-id")
+	w := testJailWarden()
+	w.jail.VerifySignature = fakeCosign(t, `echo '[`+cosignPayloadJSON(digestA)+`]'`)
+	if _, _, err := w.runJail(logger("test"), nil, "warden-alice", []string{"create"}, nil, "ubuntu:22.04", []string{"bash"}); err != nil {
+		t.Fatal(err)
+	}
+	// Neither the tag nor a local image with it is used.
+	if creates := dockerCalls(t, log, "create"); len(creates) != 1 || creates[0] != "create ubuntu@"+digestA+" bash" {
+		t.Errorf("Jail created with %q, want the verified digest", creates)
+	}
+	if runs := dockerCalls(t, log, "run"); len(runs) != 1 || !strings.Contains(runs[0], " ubuntu@"+digestA+" ") {
+		t.Errorf("Image probed for a shell with %q, want the verified digest", runs)
+	}
+}
@@ -0,0 +1,64 @@
+package warden
+
+import (
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// instanceLabel is the label identifying which warden created a jail.
+const instanceLabel = "warden.instance"
+
+func (w *Warden) sweepJails(interval, age time.Duration) {
+	for range time.Tick(interval) {
+		w.sweepExitedJails(age)
+	}
+}
+
+// sweepExitedJails removes this instance's jails that exited more than age
+// ago but were never removed, e.g. because warden crashed. Persistent jails
+// warden still tracks are kept, since they may have been stopped by an
+// operator or a docker outage and are restarted when next used.
+func (w *Warden) sweepExitedJails(age time.Duration) {
+	out, err := exec.Command("docker", "ps", "-aq",
+		"--filter", "label="+instanceLabel+"="+w.instance,
+		"--filter", "status=exited").Output()
+	if err != nil {
+		log.Println("Failed to list exited jails:", err)
+		return
+	}
+	for _, id := range strings.Fields(string(out)) {
+		if w.tracked(id) {
+			continue
+		}
+		out, err := exec.Command("docker", "inspect", "-f", "{{.State.FinishedAt}}", id).Output()
+		if err != nil {
+			log.Println("Failed to inspect exited jail", id+":", err)
+			continue
+		}
+		finished, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(out)))
+		if err != nil || time.Now().Sub(finished) < age {
+			continue
+		}
+		out, err = w.docker("rm", id).CombinedOutput()
+		if err != nil {
+			log.Println("Failed to remove exited jail", id+":", err, string(out))
+			continue
+		}
+		log.Println("Removed exited jail", id)
+	}
+}
+
+// tracked reports whether id, possibly shortened as by docker ps, is one of
+// the persistent jails warden keeps between sessions.
+func (w *Warden) tracked(id string) bool {
+	w.jailsMu.Lock()
+	defer w.jailsMu.Unlock()
+	for _, jailID := range w.jails {
+		if strings.HasPrefix(jailID, id) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package warden
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sweepDocker fakes docker with exited jails of the test instance: old and
+// tracked exited long ago, recent just now, and broken can't be inspected.
+// Jails of other instances are only listed without the label filter.
+const sweepDocker = `case "$*" in
+"ps -aq --filter label=warden.instance=test --filter status=exited") echo old recent tracked broken;;
+"ps -aq"*) echo old recent tracked broken other;;
+"inspect -f {{.State.FinishedAt}} recent") date -u +%Y-%m-%dT%H:%M:%SZ;;
+"inspect -f {{.State.FinishedAt}} broken") exit 1;;
+"inspect -f {{.State.FinishedAt}} "*) echo 2020-01-01T00:00:00.123456789Z;;
+esac
+`
+
+func TestSweepExitedJails(t *testing.T) {
+	log := fakeDocker(t, sweepDocker)
+	w := testJailWarden()
+	w.jails = map[string]string{"bob": "tracked0123456789"}
+	w.sweepExitedJails(time.Hour)
+
+	if ps := dockerCalls(t, log, "ps"); len(ps) != 1 {
+		t.Errorf("Listed jails with %q", ps)
+	}
+	removed := dockerCalls(t, log, "rm")
+	if want := []string{"rm old"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("Removed %q, want %q", removed, want)
+	}
+}
+
+func TestTracked(t *testing.T) {
+	w := testJailWarden()
+	w.jails = map[string]string{"alice": "0123456789abcdef"}
+	for _, test := range []struct {
+		id      string
+		tracked bool
+	}{
+		{"0123456789abcdef", true},
+		{"0123456789ab", true},
+		{"fedcba987654", false},
+	} {
+		if tracked := w.tracked(test.id); tracked != test.tracked {
+			t.Errorf("tracked(%q) = %v, want %v", test.id, tracked, test.tracked)
+		}
+	}
+}
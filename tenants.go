@@ -0,0 +1,144 @@
+package warden
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Tenant limits the users that belong to it collectively.
+type Tenant struct {
+	// MaxJails caps the jails all the tenant's users have at once. A jail
+	// shared by several sessions is only counted once, and persistent jails
+	// count until they are removed. Zero is unlimited.
+	MaxJails int `json:"maxJails"`
+	// ConnectionsPerMinute caps how often the tenant's users may connect,
+	// allowing bursts of up to ConnectionBurst connections. Zero is
+	// unlimited.
+	ConnectionsPerMinute float64 `json:"connectionsPerMinute"`
+	ConnectionBurst      int     `json:"connectionBurst"`
+}
+
+func validateTenants(tenants map[string]Tenant, users map[string]User) error {
+	for name, tenant := range tenants {
+		if tenant.MaxJails < 0 || tenant.ConnectionsPerMinute < 0 || tenant.ConnectionBurst < 0 {
+			return fmt.Errorf("Invalid limits for tenant %q", name)
+		}
+	}
+	for username, user := range users {
+		if user.MaxSessions < 0 {
+			return fmt.Errorf("Invalid session limit for user %q", username)
+		}
+	}
+	return nil
+}
+
+// rateLimiter is a token bucket.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: perMinute / 60, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (r *rateLimiter) allow() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// allowConnection reports whether user's tenant is within its connection
+// rate.
+func (w *Warden) allowConnection(user string) bool {
+	limiter, ok := w.connLimiters[w.users[user].Tenant]
+	return !ok || limiter.allow()
+}
+
+// acquireSession reserves a session for info's user, unless they are
+// already at their limit. Each successful call must be matched by a call to
+// releaseSession.
+func (w *Warden) acquireSession(info SessionInfo) error {
+	w.limitsMu.Lock()
+	defer w.limitsMu.Unlock()
+	if max := w.users[info.User].MaxSessions; max > 0 && w.userSessions[info.User] >= max {
+		return fmt.Errorf("User %s has reached the limit of %d concurrent sessions", info.User, max)
+	}
+	w.userSessions[info.User]++
+	return nil
+}
+
+func (w *Warden) releaseSession(info SessionInfo) {
+	w.limitsMu.Lock()
+	defer w.limitsMu.Unlock()
+	if w.userSessions[info.User]--; w.userSessions[info.User] <= 0 {
+		delete(w.userSessions, info.User)
+	}
+}
+
+// reserveJail counts a jail about to be created for tenant, unless the
+// tenant is already at its limit. The reservation is then either handed to
+// the created jail with trackJail, or cancelled with cancelJail.
+func (w *Warden) reserveJail(tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+	w.limitsMu.Lock()
+	defer w.limitsMu.Unlock()
+	if max := w.tenants[tenant].MaxJails; max > 0 && w.tenantJails[tenant] >= max {
+		return fmt.Errorf("Tenant %s has reached the limit of %d concurrent jails", tenant, max)
+	}
+	w.tenantJails[tenant]++
+	return nil
+}
+
+func (w *Warden) trackJail(tenant, jailID string) {
+	if tenant == "" {
+		return
+	}
+	w.limitsMu.Lock()
+	defer w.limitsMu.Unlock()
+	w.jailTenants[jailID] = tenant
+}
+
+func (w *Warden) cancelJail(tenant string) {
+	if tenant == "" {
+		return
+	}
+	w.limitsMu.Lock()
+	defer w.limitsMu.Unlock()
+	w.uncountJail(tenant)
+}
+
+// jailGone stops counting a jail that has been removed, or forgotten.
+func (w *Warden) jailGone(jailID string) {
+	w.limitsMu.Lock()
+	defer w.limitsMu.Unlock()
+	if tenant, ok := w.jailTenants[jailID]; ok {
+		delete(w.jailTenants, jailID)
+		w.uncountJail(tenant)
+	}
+}
+
+func (w *Warden) uncountJail(tenant string) {
+	if w.tenantJails[tenant]--; w.tenantJails[tenant] <= 0 {
+		delete(w.tenantJails, tenant)
+	}
+}
@@ -0,0 +1,73 @@
+package warden
+
+import "testing"
+
+func testTenantWarden() *Warden {
+	return &Warden{
+		tenants: map[string]Tenant{"acme": {MaxJails: 3}},
+		users: map[string]User{
+			"alice": {Tenant: "acme", MaxSessions: 2},
+			"bob":   {Tenant: "acme", MaxSessions: 2},
+			"carol": {MaxSessions: 2},
+		},
+		userSessions: make(map[string]int),
+		tenantJails:  make(map[string]int),
+		jailTenants:  make(map[string]string),
+	}
+}
+
+func TestTenantJailsCappedAcrossUsers(t *testing.T) {
+	w := testTenantWarden()
+	start := func(user, jailID string) error {
+		info := SessionInfo{User: user, Tenant: w.users[user].Tenant}
+		if err := w.acquireSession(info); err != nil {
+			return err
+		}
+		if err := w.reserveJail(info.Tenant); err != nil {
+			w.releaseSession(info)
+			return err
+		}
+		w.trackJail(info.Tenant, jailID)
+		return nil
+	}
+	for _, jail := range []struct{ user, id string }{{"alice", "a1"}, {"bob", "b1"}, {"alice", "a2"}} {
+		if err := start(jail.user, jail.id); err != nil {
+			t.Fatalf("Starting %s's jail %s failed: %v", jail.user, jail.id, err)
+		}
+	}
+	// Bob is under their own limit, but the tenant is at its limit.
+	if err := start("bob", "b2"); err == nil {
+		t.Error("Tenant acme exceeded its limit of 3 jails")
+	}
+	// Users without a tenant aren't limited by it.
+	if err := start("carol", "c1"); err != nil {
+		t.Errorf("Starting carol's jail failed: %v", err)
+	}
+
+	w.jailGone("a1")
+	if err := start("bob", "b2"); err != nil {
+		t.Errorf("Starting bob's jail after one was removed failed: %v", err)
+	}
+	if n := w.tenantJails["acme"]; n != 3 {
+		t.Errorf("Tenant acme has %d jails counted, want 3", n)
+	}
+}
+
+func TestTenantJailsCancelled(t *testing.T) {
+	w := testTenantWarden()
+	for i := 0; i < 5; i++ {
+		if err := w.reserveJail("acme"); err != nil {
+			t.Fatalf("Reserving jail %d failed: %v", i, err)
+		}
+		// The jail failed to be created.
+		w.cancelJail("acme")
+	}
+	if n := w.tenantJails["acme"]; n != 0 {
+		t.Errorf("Tenant acme has %d jails counted after cancelling them all", n)
+	}
+	// Jails that were never counted don't change the count.
+	w.jailGone("unknown")
+	if len(w.tenantJails) != 0 || len(w.jailTenants) != 0 {
+		t.Errorf("Unexpected jails counted: %v %v", w.tenantJails, w.jailTenants)
+	}
+}
@@ -0,0 +1,40 @@
+package warden
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var termNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+func validateTerms(termMap map[string]string, allowed []string, fallback string) error {
+	for from, to := range termMap {
+		if !termNameRegexp.MatchString(from) || !termNameRegexp.MatchString(to) {
+			return fmt.Errorf("Invalid termMap entry %q: %q", from, to)
+		}
+	}
+	for _, p := range allowed {
+		if !termNameRegexp.MatchString(strings.TrimSuffix(p, "*")) {
+			return fmt.Errorf("Invalid allowedTerms pattern %q", p)
+		}
+	}
+	if !termNameRegexp.MatchString(fallback) {
+		return fmt.Errorf("Invalid defaultTerm %q", fallback)
+	}
+	return nil
+}
+
+// term returns the TERM to set in a jail for the terminal type a client
+// requested, substituting ones the jail's tools may not support.
+func (w *Warden) term(l logger, requested string) string {
+	if mapped, ok := w.termMap[requested]; ok {
+		l.Printf("Remapped TERM %q to %q", requested, mapped)
+		return mapped
+	}
+	if requested == "" || termNameRegexp.MatchString(requested) && (len(w.allowedTerms) == 0 || matchEnv(w.allowedTerms, requested)) {
+		return requested
+	}
+	l.Printf("Unsupported TERM %q, using %q", requested, w.defaultTerm)
+	return w.defaultTerm
+}
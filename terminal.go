@@ -1,17 +1,95 @@
 package warden
 
 import (
-	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
 	"syscall"
 	"unsafe"
+
+	"github.com/kr/pty"
+)
+
+// Larger dimensions than these are never legitimate and are clamped before
+// being handed to the pty.
+const (
+	maxWindowWidth  = 1000
+	maxWindowHeight = 1000
 )
 
-func parseDimensions(b []byte) (uint32, uint32) {
-	w := binary.BigEndian.Uint32(b)
-	h := binary.BigEndian.Uint32(b[4:])
+// ptyRequestMsg is the payload of a "pty-req" request (RFC 4254 section 6.2).
+type ptyRequestMsg struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+// windowChangeMsg is the payload of a "window-change" request (RFC 4254
+// section 6.7).
+type windowChangeMsg struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+func clampDimensions(w, h uint32) (uint32, uint32) {
+	if w <= maxWindowWidth && h <= maxWindowHeight {
+		return w, h
+	}
+	log.Printf("Clamping window size %dx%d to at most %dx%d", w, h, maxWindowWidth, maxWindowHeight)
+	if w > maxWindowWidth {
+		w = maxWindowWidth
+	}
+	if h > maxWindowHeight {
+		h = maxWindowHeight
+	}
 	return w, h
 }
 
+// WindowBounds are the smallest and largest terminal dimensions given to
+// jails. Window sizes outside them are raised or capped, so that e.g. a
+// 1x1 window doesn't break full screen programs. Zero leaves a bound open.
+type WindowBounds struct {
+	MinColumns uint32 `json:"minColumns"`
+	MinRows    uint32 `json:"minRows"`
+	MaxColumns uint32 `json:"maxColumns"`
+	MaxRows    uint32 `json:"maxRows"`
+}
+
+func (b WindowBounds) validate() error {
+	if b.MaxColumns > maxWindowWidth || b.MaxRows > maxWindowHeight {
+		return fmt.Errorf("Window bounds can't exceed %dx%d", maxWindowWidth, maxWindowHeight)
+	}
+	if b.MaxColumns != 0 && b.MinColumns > b.MaxColumns || b.MaxRows != 0 && b.MinRows > b.MaxRows {
+		return fmt.Errorf("Invalid window bounds %+v, minimums exceed maximums", b)
+	}
+	return nil
+}
+
+// clamp applies the bounds to a window size requested by a client. Zero
+// dimensions, which clients send when they don't know their size, are kept.
+func (b WindowBounds) clamp(w, h uint32) (uint32, uint32) {
+	w, h = clampDimensions(w, h)
+	return bound(w, b.MinColumns, b.MaxColumns), bound(h, b.MinRows, b.MaxRows)
+}
+
+func bound(n, min, max uint32) uint32 {
+	switch {
+	case n == 0:
+		return n
+	case n < min:
+		return min
+	case max != 0 && n > max:
+		return max
+	}
+	return n
+}
+
 type windowSize struct {
 	height, width uint16
 	x, y          uint16 // unused
@@ -24,3 +102,23 @@ func setWindowSize(fd uintptr, width, height uint32) {
 	}
 	syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCSWINSZ), uintptr(unsafe.Pointer(ws)))
 }
+
+// startPty starts cmd on a new pty, as pty.Start does, but sizes the pty
+// first so that cmd never sees it before it has its window size.
+func startPty(cmd *exec.Cmd, width, height uint32) (*os.File, error) {
+	p, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+	if width != 0 && height != 0 {
+		setWindowSize(p.Fd(), width, height)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setctty: true, Setsid: true}
+	if err := cmd.Start(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,178 @@
+package warden
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/kr/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestClampDimensions(t *testing.T) {
+	for _, test := range []struct {
+		w, h, wantW, wantH uint32
+	}{
+		{80, 24, 80, 24},
+		{0, 0, 0, 0},
+		{1000, 1000, 1000, 1000},
+		{1001, 24, 1000, 24},
+		{80, 1 << 31, 80, 1000},
+		{^uint32(0), ^uint32(0), 1000, 1000},
+	} {
+		if w, h := clampDimensions(test.w, test.h); w != test.wantW || h != test.wantH {
+			t.Errorf("clampDimensions(%d, %d) = %d, %d, want %d, %d", test.w, test.h, w, h, test.wantW, test.wantH)
+		}
+	}
+}
+
+func TestWindowBounds(t *testing.T) {
+	b := WindowBounds{MinColumns: 20, MinRows: 5, MaxColumns: 200, MaxRows: 60}
+	for _, test := range []struct {
+		w, h, wantW, wantH uint32
+	}{
+		{80, 24, 80, 24},
+		{1, 1, 20, 5},
+		{19, 60, 20, 60},
+		{201, 61, 200, 60},
+		{^uint32(0), 24, 200, 24},
+		// Unknown sizes are left for the client to fill in later.
+		{0, 0, 0, 0},
+	} {
+		if w, h := b.clamp(test.w, test.h); w != test.wantW || h != test.wantH {
+			t.Errorf("clamp(%d, %d) = %d, %d, want %d, %d", test.w, test.h, w, h, test.wantW, test.wantH)
+		}
+	}
+	// Open bounds only apply the absolute cap.
+	if w, h := (WindowBounds{}).clamp(1, 5000); w != 1 || h != maxWindowHeight {
+		t.Errorf("Unbounded clamp(1, 5000) = %d, %d", w, h)
+	}
+}
+
+func TestValidateWindowBounds(t *testing.T) {
+	for _, test := range []struct {
+		bounds WindowBounds
+		err    string
+	}{
+		{WindowBounds{}, ""},
+		{WindowBounds{MinColumns: 80, MinRows: 24}, ""},
+		{WindowBounds{MinColumns: 80, MaxColumns: 80}, ""},
+		{WindowBounds{MaxColumns: 1001}, "can't exceed"},
+		{WindowBounds{MinRows: 50, MaxRows: 40}, "minimums exceed maximums"},
+	} {
+		err := test.bounds.validate()
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v.validate() = %v, want %q", test.bounds, err, test.err)
+		}
+	}
+	_, err := New(Config{PrivateKeys: []string{testHostKey(t)}, WindowBounds: WindowBounds{MinColumns: 100, MaxColumns: 10}})
+	if err == nil || !strings.Contains(err.Error(), "minimums exceed maximums") {
+		t.Errorf("New accepted inverted window bounds: %v", err)
+	}
+}
+
+// Absurd dimensions would wrap around when truncated to the pty's 16 bits,
+// rather than being capped.
+func TestSetClampedWindowSize(t *testing.T) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skip("No ptys:", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+	w, h := clampDimensions(1<<16+80, 1<<20)
+	setWindowSize(ptmx.Fd(), w, h)
+	var ws windowSize
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws))); errno != 0 {
+		t.Fatal(errno)
+	}
+	if ws.width != maxWindowWidth || ws.height != maxWindowHeight {
+		t.Errorf("Window size is %dx%d, want %dx%d", ws.width, ws.height, maxWindowWidth, maxWindowHeight)
+	}
+}
+
+func TestTerm(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	w := &Warden{
+		termMap:      map[string]string{"xterm-kitty": "xterm-256color"},
+		allowedTerms: []string{"xterm", "xterm-*", "screen*", "vt100"},
+		defaultTerm:  "xterm",
+	}
+	for requested, want := range map[string]string{
+		"xterm":          "xterm",
+		"xterm-256color": "xterm-256color",
+		"screen.xterm":   "screen.xterm",
+		"vt100":          "vt100",
+		"":               "",
+		"xterm-kitty":    "xterm-256color",
+		"wezterm":        "xterm",
+		"vt220":          "xterm",
+		"../../x":        "xterm",
+	} {
+		if term := w.term(logger("session"), requested); term != want {
+			t.Errorf("term(%q) = %q, want %q", requested, term, want)
+		}
+	}
+	if !strings.Contains(logs.String(), `Unsupported TERM "wezterm", using "xterm"`) || !strings.Contains(logs.String(), `Remapped TERM "xterm-kitty" to "xterm-256color"`) {
+		t.Errorf("Substitutions logged %q", logs.String())
+	}
+	// Without an allowlist, any valid name passes through.
+	w.allowedTerms = nil
+	if term := w.term(logger("session"), "wezterm"); term != "wezterm" {
+		t.Errorf("term(\"wezterm\") without allowedTerms = %q", term)
+	}
+}
+
+func TestValidateTerms(t *testing.T) {
+	for _, test := range []struct {
+		termMap  map[string]string
+		allowed  []string
+		fallback string
+		ok       bool
+	}{
+		{map[string]string{"xterm-kitty": "xterm-256color"}, []string{"xterm*"}, "xterm", true},
+		{map[string]string{"xterm-kitty": "xterm 256color"}, nil, "xterm", false},
+		{nil, []string{"*"}, "xterm", false},
+		{nil, []string{"xterm;reboot"}, "xterm", false},
+		{nil, nil, "", false},
+	} {
+		if err := validateTerms(test.termMap, test.allowed, test.fallback); (err == nil) != test.ok {
+			t.Errorf("validateTerms(%v, %q, %q) = %v, want ok %v", test.termMap, test.allowed, test.fallback, err, test.ok)
+		}
+	}
+}
+
+func TestRemappedTermReachesJail(t *testing.T) {
+	if !ptysAvailable() {
+		t.Skip("No ptys available")
+	}
+	log := fakeDocker(t, jailDocker)
+	_, addr := startWarden(t, Config{AllowedTerms: []string{"xterm*"}})
+	client := dialWarden(t, addr, "alice")
+	for _, term := range []string{"xterm-256color", "wezterm"} {
+		ch, reqs, err := client.OpenChannel("session", nil)
+		if err != nil {
+			t.Fatal("OpenChannel:", err)
+		}
+		go ssh.DiscardRequests(reqs)
+		msg := ptyRequestMsg{Term: term, Columns: 80, Rows: 24}
+		if ok, err := ch.SendRequest("pty-req", true, ssh.Marshal(&msg)); !ok || err != nil {
+			t.Fatalf("pty-req = %v, %v", ok, err)
+		}
+		if ok, err := ch.SendRequest("shell", true, nil); !ok || err != nil {
+			t.Fatalf("shell = %v, %v", ok, err)
+		}
+		ioutil.ReadAll(ch)
+		ch.Close()
+	}
+	creates := dockerCalls(t, log, "create")
+	if len(creates) != 2 || !strings.Contains(creates[0], " TERM=xterm-256color ") || !strings.Contains(creates[1], " TERM=xterm ") {
+		t.Errorf("Jails created with %q, want xterm-256color passed through and wezterm replaced", creates)
+	}
+}
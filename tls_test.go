@@ -0,0 +1,101 @@
+package warden
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key, returning their paths and a pool trusting it.
+func testCertificate(t *testing.T) (certFile, keyFile string, roots *x509.CertPool) {
+	key := testKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "warden"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+	return certFile, keyFile, roots
+}
+
+func TestTLSListener(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	certFile, keyFile, roots := testCertificate(t)
+	w, addr := startWarden(t, Config{TLS: &TLSListener{Addr: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile}})
+	w.listenersMu.Lock()
+	tlsAddr := w.listeners[1].Addr().String()
+	w.listenersMu.Unlock()
+
+	conn, err := tls.Dial("tcp", tlsAddr, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal("TLS handshake failed:", err)
+	}
+	signer, err := ssh.NewSignerFromKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, tlsAddr, &ssh.ClientConfig{User: "alice", Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)}})
+	if err != nil {
+		t.Fatal("SSH handshake over TLS failed:", err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+	if out, err := runShell(t, client, nil); err != nil || !strings.HasPrefix(out, "session in id-") {
+		t.Errorf("Session over TLS = %q, %v", out, err)
+	}
+	// Plain SSH keeps working alongside it.
+	if out, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil || !strings.HasPrefix(out, "session in id-") {
+		t.Errorf("Plain session = %q, %v", out, err)
+	}
+}
+
+func TestTLSCertificateValidated(t *testing.T) {
+	certFile, keyFile, _ := testCertificate(t)
+	otherCert, _, _ := testCertificate(t)
+	for name, tlsListener := range map[string]*TLSListener{
+		"missing certificate":    {CertFile: certFile + ".missing", KeyFile: keyFile},
+		"missing key":            {CertFile: certFile, KeyFile: keyFile + ".missing"},
+		"mismatched certificate": {CertFile: otherCert, KeyFile: keyFile},
+		"key as certificate":     {CertFile: keyFile, KeyFile: keyFile},
+	} {
+		_, err := New(Config{PrivateKeys: []string{testHostKey(t)}, TLS: tlsListener})
+		if err == nil || !strings.Contains(err.Error(), "TLS certificate") {
+			t.Errorf("New with a %s = %v, want it refused", name, err)
+		}
+	}
+}
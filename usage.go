@@ -0,0 +1,87 @@
+package warden
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UsageWarnings tells users with a terminal when their jail is close to
+// its memory or cpus limit, so that they can react before, e.g., being
+// killed for running out of memory.
+type UsageWarnings struct {
+	// Interval is how often jails' usage is sampled. Defaults to 30s.
+	Interval Duration `json:"interval"`
+	// Threshold is the percentage of a limit that usage is warned about
+	// at. Defaults to 90.
+	Threshold float64 `json:"threshold"`
+}
+
+func (u *UsageWarnings) validate() error {
+	if u.Interval < 0 || u.Threshold < 0 || u.Threshold > 100 {
+		return fmt.Errorf("Invalid usage warnings %+v", *u)
+	}
+	return nil
+}
+
+// jailUsage returns a jail's cpu usage, as a percentage of one cpu, and
+// its memory usage, as a percentage of its limit.
+func jailUsage(jailID string) (cpu, memory float64, err error) {
+	out, err := exec.Command("docker", "stats", "--no-stream", "--format", "{{.CPUPerc}} {{.MemPerc}}", jailID).Output()
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(strings.Replace(string(out), "%", "", -1))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("Unexpected docker stats output %q", out)
+	}
+	if cpu, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return 0, 0, err
+	}
+	memory, err = strconv.ParseFloat(fields[1], 64)
+	return cpu, memory, err
+}
+
+// warnUsage samples the usage of a session's jail and writes a notice to
+// the session when it crosses the threshold of one of the profile's limits.
+// Each limit is warned about once until usage falls back below the
+// threshold.
+func (w *Warden) warnUsage(s *session, jailID string, p Profile, done <-chan struct{}) {
+	interval, threshold := time.Duration(w.usageWarnings.Interval), w.usageWarnings.Threshold
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+	if threshold == 0 {
+		threshold = 90
+	}
+	cpus, _ := strconv.ParseFloat(p.CPUs, 64)
+	var cpuWarned, memoryWarned bool
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		cpu, memory, err := jailUsage(jailID)
+		if err != nil {
+			s.log.Println("Failed to sample jail usage:", err)
+			continue
+		}
+		if p.Memory != "" {
+			if memory >= threshold && !memoryWarned {
+				fmt.Fprintf(s.ch, "\r\nwarden: this session is using %.0f%% of its memory limit of %s.\r\n", memory, p.Memory)
+			}
+			memoryWarned = memory >= threshold
+		}
+		if cpus > 0 {
+			if used := cpu / cpus; used >= threshold && !cpuWarned {
+				fmt.Fprintf(s.ch, "\r\nwarden: this session is using %.0f%% of its limit of %s cpus.\r\n", used, p.CPUs)
+			}
+			cpuWarned = cpu/cpus >= threshold
+		}
+	}
+}
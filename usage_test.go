@@ -0,0 +1,147 @@
+package warden
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// statsDocker fakes docker stats, printing a line of $FAKE_DIR/stats per
+// call, then repeating the last, and counting the calls in $FAKE_DIR/n.
+const statsDocker = `[ "$1" = stats ] || exit 0
+n=$(cat "$FAKE_DIR/n" 2> /dev/null || echo 0); n=$((n + 1)); echo $n > "$FAKE_DIR/n"
+line=$(sed -n "${n}p" "$FAKE_DIR/stats")
+[ -n "$line" ] || line=$(tail -n 1 "$FAKE_DIR/stats")
+echo "$line"
+`
+
+func writeStats(t *testing.T, lines ...string) {
+	if err := ioutil.WriteFile(filepath.Join(os.Getenv("FAKE_DIR"), "stats"), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJailUsage(t *testing.T) {
+	fakeDocker(t, statsDocker)
+	writeStats(t, "12.50% 95.01%", "12.5%", "n/a 1%")
+	if cpu, memory, err := jailUsage("jail-id"); err != nil || cpu != 12.5 || memory != 95.01 {
+		t.Errorf("jailUsage = %v, %v, %v, want 12.5, 95.01", cpu, memory, err)
+	}
+	for i := 0; i < 2; i++ {
+		if cpu, memory, err := jailUsage("jail-id"); err == nil {
+			t.Errorf("jailUsage of invalid stats = %v, %v", cpu, memory)
+		}
+	}
+}
+
+func TestWarnUsage(t *testing.T) {
+	fakeDocker(t, statsDocker)
+	// Memory and cpu usage as docker stats gives them: cpu as a percentage
+	// of one cpu, and memory of the limit.
+	writeStats(t,
+		"10.00% 95.00%",
+		"10.00% 97.00%",
+		"190.00% 50.00%",
+		"10.00% 50.00%",
+		"10.00% 92.00%",
+	)
+	w := &Warden{usageWarnings: &UsageWarnings{Interval: Duration(5 * time.Millisecond)}}
+	ch := &fakeChannel{}
+	done, returned := make(chan struct{}), make(chan struct{})
+	go func() {
+		w.warnUsage(&session{ch: ch, log: logger("test")}, "jail-id", Profile{Memory: "1g", CPUs: "2"}, done)
+		close(returned)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		b, _ := ioutil.ReadFile(filepath.Join(os.Getenv("FAKE_DIR"), "n"))
+		if n, _ := strconv.Atoi(strings.TrimSpace(string(b))); n >= 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Jail usage wasn't sampled")
+		}
+	}
+	close(done)
+	<-returned
+
+	// Each limit is warned about when usage crosses its threshold, and not
+	// again until usage has fallen back below it.
+	want := "\r\nwarden: this session is using 95% of its memory limit of 1g.\r\n" +
+		"\r\nwarden: this session is using 95% of its limit of 2 cpus.\r\n" +
+		"\r\nwarden: this session is using 92% of its memory limit of 1g.\r\n"
+	if got := ch.String(); got != want {
+		t.Errorf("Warned %q, want %q", got, want)
+	}
+}
+
+func TestUsageWarningsSession(t *testing.T) {
+	if !ptysAvailable() {
+		t.Skip("No ptys available")
+	}
+	for _, pty := range []bool{false, true} {
+		log := fakeDocker(t, `case "$1" in
+create) echo id-jail;;
+inspect) echo true;;
+stats) echo "1.00% 95.00%";;
+start) sleep 0.3; echo done;;
+esac
+`)
+		_, addr := startWarden(t, Config{
+			UsageWarnings: &UsageWarnings{Interval: Duration(20 * time.Millisecond)},
+			Jail:          Jail{Profile: Profile{Memory: "512m"}},
+		})
+		s, err := dialWarden(t, addr, "alice").NewSession()
+		if err != nil {
+			t.Fatal("NewSession:", err)
+		}
+		if pty {
+			if err := s.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+				t.Fatal("RequestPty:", err)
+			}
+		}
+		// Keep the session's input open, so that it runs until the jail
+		// exits.
+		stdin, err := s.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stdin.Close()
+		var out syncBuffer
+		s.Stdout = &out
+		if err := s.Shell(); err != nil {
+			t.Fatal("Shell:", err)
+		}
+		s.Wait()
+		warnings := strings.Count(out.String(), "95% of its memory limit of 512m")
+		sampled := len(dockerCalls(t, log, "stats"))
+		if pty && (warnings != 1 || sampled < 2) {
+			t.Errorf("Warned %d times in %d samples, want one warning:\n%s", warnings, sampled, out.String())
+		}
+		if !pty && (warnings != 0 || sampled != 0) {
+			t.Errorf("Session without a pty warned %d times in %d samples", warnings, sampled)
+		}
+	}
+}
+
+func TestUsageWarningsValidate(t *testing.T) {
+	for _, test := range []struct {
+		u  UsageWarnings
+		ok bool
+	}{
+		{UsageWarnings{}, true},
+		{UsageWarnings{Interval: Duration(time.Minute), Threshold: 80}, true},
+		{UsageWarnings{Threshold: 101}, false},
+		{UsageWarnings{Threshold: -1}, false},
+		{UsageWarnings{Interval: Duration(-time.Second)}, false},
+	} {
+		if err := test.u.validate(); (err == nil) != test.ok {
+			t.Errorf("%+v.validate() = %v, want ok %v", test.u, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package warden
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const localUserExtension = "warden-local-user"
+
+// UsernameMap rewrites SSH usernames into the account names used inside
+// jails. Static entries take precedence, then the first rewrite whose
+// pattern matches the whole username. Unmatched usernames are used as is.
+// Logins are rejected if their local username isn't one that is safe to
+// name a jail, home directory and account with: up to 32 letters, digits,
+// '.', '_' and '-', not starting with '.' or '-'. Uppercase letters and
+// dots are allowed, as they were before usernames were checked, although
+// some images' adduser refuses them.
+type UsernameMap struct {
+	Static   map[string]string `json:"static"`
+	Rewrites []UsernameRewrite `json:"rewrites"`
+}
+
+// UsernameRewrite replaces a username matching Pattern with Replacement,
+// which may refer to capture groups as $1 or ${name}.
+type UsernameRewrite struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+var localUsernameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,31}$`)
+
+type usernameRewrite struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+type usernameMap struct {
+	static   map[string]string
+	rewrites []usernameRewrite
+}
+
+func parseUsernameMap(m UsernameMap) (usernameMap, error) {
+	for user, local := range m.Static {
+		if !localUsernameRegexp.MatchString(local) {
+			return usernameMap{}, fmt.Errorf("Invalid local username %q for user %q", local, user)
+		}
+	}
+	parsed := usernameMap{static: m.Static}
+	for _, rw := range m.Rewrites {
+		re, err := regexp.Compile("^(?:" + rw.Pattern + ")$")
+		if err != nil {
+			return usernameMap{}, fmt.Errorf("Invalid username pattern %q: %v", rw.Pattern, err)
+		}
+		parsed.rewrites = append(parsed.rewrites, usernameRewrite{re, rw.Replacement})
+	}
+	return parsed, nil
+}
+
+// localUser returns the account name used inside jails for an SSH user.
+// Whichever way it is found, it must match localUsernameRegexp, since it
+// names the user's home directory and jail, and is used by the jail script.
+func (m usernameMap) localUser(user string) (string, error) {
+	local, ok := m.static[user]
+	if !ok {
+		local = user
+		for _, rw := range m.rewrites {
+			if rw.re.MatchString(user) {
+				local = rw.re.ReplaceAllString(user, rw.replacement)
+				break
+			}
+		}
+	}
+	if !localUsernameRegexp.MatchString(local) {
+		if local == user {
+			return "", fmt.Errorf("Invalid username %q", user)
+		}
+		return "", fmt.Errorf("User %q maps to invalid local username %q", user, local)
+	}
+	return local, nil
+}
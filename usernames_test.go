@@ -0,0 +1,63 @@
+package warden
+
+import "testing"
+
+func TestLocalUser(t *testing.T) {
+	m, err := parseUsernameMap(UsernameMap{
+		Static: map[string]string{"admin@example.com": "admin"},
+		Rewrites: []UsernameRewrite{
+			{Pattern: `(?P<name>[a-z]+)@example\.com`, Replacement: "${name}"},
+			{Pattern: `bad-(.*)`, Replacement: "-$1"},
+		},
+	})
+	if err != nil {
+		t.Fatal("parseUsernameMap failed:", err)
+	}
+	for _, test := range []struct {
+		user, local string
+	}{
+		{"alice", "alice"},
+		// Usernames accepted before they were validated still are.
+		{"john.doe", "john.doe"},
+		{"JohnDoe", "JohnDoe"},
+		{"_svc-1", "_svc-1"},
+		{"42", "42"},
+		{"admin@example.com", "admin"},
+		{"bob@example.com", "bob"},
+		{"", ""},
+		{"-rf", ""},
+		{".profile", ""},
+		{"alice bob", ""},
+		{"alice;reboot", ""},
+		{"a/b", ""},
+		{"bad-x", ""},
+		{"carol@example.org", ""},
+		{"abcdefghijklmnopqrstuvwxyz0123456", ""},
+	} {
+		local, err := m.localUser(test.user)
+		if test.local == "" {
+			if err == nil {
+				t.Errorf("localUser(%q) = %q, want an error", test.user, local)
+			}
+		} else if err != nil || local != test.local {
+			t.Errorf("localUser(%q) = %q, %v, want %q", test.user, local, err, test.local)
+		}
+	}
+}
+
+func TestParseUsernameMap(t *testing.T) {
+	for _, test := range []struct {
+		m  UsernameMap
+		ok bool
+	}{
+		{UsernameMap{}, true},
+		{UsernameMap{Static: map[string]string{"a": "John.Doe"}}, true},
+		{UsernameMap{Static: map[string]string{"a": "-x"}}, false},
+		{UsernameMap{Static: map[string]string{"a": "x y"}}, false},
+		{UsernameMap{Rewrites: []UsernameRewrite{{Pattern: "(", Replacement: "x"}}}, false},
+	} {
+		if _, err := parseUsernameMap(test.m); (err == nil) != test.ok {
+			t.Errorf("parseUsernameMap(%+v) = %v, want ok %v", test.m, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package warden
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+var volumeNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+func parseHomeVolume(name string) (*template.Template, error) {
+	if name == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("homeVolume").Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid home volume template: %v", err)
+	}
+	if _, err := (SessionInfo{}).render(tmpl); err != nil {
+		return nil, fmt.Errorf("Invalid home volume template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// renderHomeVolume returns the docker arguments mounting the session's home
+// volume, if one is configured.
+func (w *Warden) renderHomeVolume(info SessionInfo) ([]string, error) {
+	if w.homeVolume == nil {
+		return nil, nil
+	}
+	name, err := info.render(w.homeVolume)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to render home volume name: %v", err)
+	}
+	if !volumeNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("Home volume rendered to an invalid name %q", name)
+	}
+	return []string{"-v", name + ":/home/" + jailUsername(info.LocalUser)}, nil
+}
+
+var volumesFromRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*(:(ro|rw))?$`)
+
+// volumesFromArgs returns the docker arguments giving a jail the volumes of
+// the jail's volumesFrom containers, which must exist.
+func (w *Warden) volumesFromArgs() ([]string, error) {
+	var args []string
+	for _, from := range w.jail.VolumesFrom {
+		container := strings.SplitN(from, ":", 2)[0]
+		if err := exec.Command("docker", "inspect", "-f", "{{.Id}}", container).Run(); err != nil {
+			return nil, fmt.Errorf("Container %s to share volumes from does not exist: %v", container, err)
+		}
+		args = append(args, "--volumes-from", from)
+	}
+	return args, nil
+}
@@ -0,0 +1,68 @@
+package warden
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJailValidateVolumesFrom(t *testing.T) {
+	for from, ok := range map[string]bool{
+		"data":          true,
+		"data:ro":       true,
+		"shared-data_1": true,
+		"data:rw":       true,
+		"data:z":        false,
+		"-data":         false,
+		"":              false,
+		"data;reboot":   false,
+		"data:ro:rw":    false,
+	} {
+		j := Jail{VolumesFrom: []string{from}}
+		if err := j.validate(); (err == nil) != ok {
+			t.Errorf("volumesFrom %q: validate() = %v, want ok %v", from, err, ok)
+		}
+	}
+}
+
+func TestNewRequiresAllowVolumesFrom(t *testing.T) {
+	config := Config{PrivateKeys: []string{testHostKey(t)}, Jail: Jail{VolumesFrom: []string{"data"}}}
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), "requires allowVolumesFrom") {
+		t.Errorf("New = %v, want volumesFrom refused without allowVolumesFrom", err)
+	}
+	config.AllowVolumesFrom = true
+	if _, err := New(config); err != nil && strings.Contains(err.Error(), "allowVolumesFrom") {
+		t.Errorf("New refused volumesFrom with allowVolumesFrom: %v", err)
+	}
+}
+
+// volumesFromDocker is jailDocker without a container named "missing".
+const volumesFromDocker = `[ "$1 $4" = "inspect missing" ] && { echo "Error: No such object: missing" >&2; exit 1; }
+` + jailDocker
+
+func TestVolumesFrom(t *testing.T) {
+	for _, persistent := range []bool{false, true} {
+		log := fakeDocker(t, volumesFromDocker)
+		_, addr := startWarden(t, Config{AllowVolumesFrom: true, Jail: Jail{Persistent: persistent, VolumesFrom: []string{"data:ro", "cache"}}})
+		if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+			t.Fatal("Session failed:", err)
+		}
+		creates := append(dockerCalls(t, log, "create"), dockerCalls(t, log, "run -d")...)
+		if len(creates) != 1 || !strings.Contains(creates[0], " --volumes-from data:ro --volumes-from cache ") {
+			t.Errorf("Persistent %v: jails created with %q, want volumes from data and cache", persistent, creates)
+		}
+		if inspects := dockerCalls(t, log, "inspect -f {{.Id}}"); len(inspects) != 2 {
+			t.Errorf("Persistent %v: checked containers with %q, want data and cache checked", persistent, inspects)
+		}
+	}
+
+	// Jails aren't created without the containers they share volumes from.
+	log := fakeDocker(t, volumesFromDocker)
+	_, addr := startWarden(t, Config{AllowVolumesFrom: true, Jail: Jail{VolumesFrom: []string{"data", "missing:ro"}}})
+	out, err := runShell(t, dialWarden(t, addr, "alice"), nil)
+	if err == nil {
+		t.Errorf("Session sharing volumes from a missing container succeeded: %q", out)
+	}
+	if creates := dockerCalls(t, log, "create"); len(creates) != 0 {
+		t.Errorf("Jails created with %q despite a missing container", creates)
+	}
+}
@@ -1,6 +1,10 @@
 package warden
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -11,16 +15,123 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
 
-	"github.com/kr/pty"
 	"golang.org/x/crypto/ssh"
 )
 
 type Warden struct {
-	addr        string
-	privateKeys []ssh.Signer
-	jail        Jail
-	jails       map[string]string
+	addr          string
+	tlsAddr       string
+	adminSocket   string
+	tlsConfig     *tls.Config
+	proxyProtocol bool
+	connSlots     chan struct{}
+	privateKeys   []ssh.Signer
+	jail          Jail
+	homeVolume    *template.Template
+	envTemplate   *template.Template
+	labels        []label
+	users         map[string]User
+	usernames     usernameMap
+	profiles      map[string]Profile
+	jailsMu       sync.Mutex
+	jails         map[string]string
+	jailRefs      map[string]int
+	// creatingJails holds a channel, closed once the jail is ready, for
+	// each persistent jail being started or created.
+	creatingJails map[string]chan struct{}
+	// shellProbes caches whether images have a shell. commandJails holds
+	// the jails running the jail command because theirs has none.
+	shellProbesMu sync.Mutex
+	shellProbes   map[string]bool
+	commandJails  map[string]bool
+	historyMu     sync.Mutex
+	historyRefs   map[string]int
+	resumeMu      sync.Mutex
+	resumables    map[string]*resumable
+	buffers       sync.Pool
+	samplers      samplers
+	expires       time.Time
+
+	healthCheckInterval time.Duration
+	degraded            int32
+
+	instance      string
+	sweepInterval time.Duration
+	sweepAge      time.Duration
+
+	imageGCInterval time.Duration
+	imageGCAge      time.Duration
+	// jailImages holds the IDs of the images this instance's jails were
+	// created from, which are the only ones image garbage collection
+	// removes.
+	jailImagesMu sync.Mutex
+	jailImages   map[string]bool
+
+	runAs *credentials
+
+	listenersMu sync.Mutex
+	listeners   []net.Listener
+	closed      bool
+
+	hangupGrace     time.Duration
+	writeTimeout    time.Duration
+	dockerOps       chan struct{}
+	mintCredentials MintCredentialsFunc
+	sessionRecorder *sessionRecorder
+	authenticator   Authenticator
+	passwordAuth    bool
+
+	acceptEnv         []string
+	allowDangerousEnv bool
+	fingerprintEnv    string
+	securityLog       bool
+	limitsBanner      bool
+
+	termMap      map[string]string
+	allowedTerms []string
+	defaultTerm  string
+
+	minClientVersions map[string]string
+	ciphers           []string
+	macs              []string
+	keyExchanges      []string
+	allowedRegistries []string
+	registryAuth      map[string]RegistryAuth
+	registryAuthDir   string
+	cleanupWorkers    int
+	ptys              bool
+	keepOpenOnEOF     bool
+	verifyLimits      bool
+	handleSignals     bool
+	usageWarnings     *UsageWarnings
+	reconnects        *reconnects
+	drainPolicy       DrainPolicy
+	createRetries     *CreateRetries
+	windowBounds      WindowBounds
+	loadScaling       *LoadScaling
+	channelRejections map[string]string
+
+	negotiationTimeout time.Duration
+	authTimeout        time.Duration
+
+	shutdownMessage string
+	shuttingDown    int32
+
+	tenants      map[string]Tenant
+	connLimiters map[string]*rateLimiter
+	limitsMu     sync.Mutex
+	userSessions map[string]int
+	tenantJails  map[string]int
+	// jailTenants holds the tenant of each jail counted in tenantJails.
+	jailTenants map[string]string
+
+	sessionsMu     sync.Mutex
+	sessionsByJail map[string][]*session
 }
 
 func New(config Config) (*Warden, error) {
@@ -39,161 +150,1174 @@ func New(config Config) (*Warden, error) {
 		}
 		privateKeys[i] = pk
 	}
+	ciphers, macs, keyExchanges := config.Ciphers, config.MACs, config.KeyExchanges
+	if config.FIPSMode {
+		var hostKeyTypes []string
+		for i, pk := range privateKeys {
+			if err := checkFIPSHostKey(pk.PublicKey()); err != nil {
+				return nil, fmt.Errorf("%s: %v", config.PrivateKeys[i], err)
+			}
+			hostKeyTypes = append(hostKeyTypes, pk.PublicKey().Type())
+		}
+		var err error
+		if ciphers, err = fipsAlgorithms("Cipher", ciphers, fipsCiphers); err != nil {
+			return nil, err
+		}
+		if macs, err = fipsAlgorithms("MAC", macs, fipsMACs); err != nil {
+			return nil, err
+		}
+		if keyExchanges, err = fipsAlgorithms("Key exchange", keyExchanges, fipsKeyExchanges); err != nil {
+			return nil, err
+		}
+		log.Printf("FIPS mode: host keys %s, ciphers %s, MACs %s, key exchanges %s",
+			strings.Join(hostKeyTypes, ","), strings.Join(ciphers, ","), strings.Join(macs, ","), strings.Join(keyExchanges, ","))
+	}
 	addr := config.Addr
 	if addr == "" {
 		addr = ":22"
 	}
+	var dockerOps chan struct{}
+	if config.MaxDockerOps > 0 {
+		dockerOps = make(chan struct{}, config.MaxDockerOps)
+	}
+	var connSlots chan struct{}
+	if config.MaxConnections > 0 {
+		connSlots = make(chan struct{}, config.MaxConnections)
+	}
+	var tlsAddr string
+	var tlsConfig *tls.Config
+	if config.TLS != nil {
+		cert, err := tls.LoadX509KeyPair(expand(config.TLS.CertFile), expand(config.TLS.KeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load TLS certificate: %v", err)
+		}
+		tlsAddr = config.TLS.Addr
+		if tlsAddr == "" {
+			tlsAddr = ":443"
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
 	jail := config.Jail
 	if jail.Image == "" {
 		jail.Image = "ubuntu"
 	}
+	if jail.HistoryDir == "" {
+		jail.HistoryDir = "/var/lib/warden/history"
+	}
+	jail.HistoryDir = expand(jail.HistoryDir)
+	if jail.SeccompProfile != seccompUnconfined {
+		jail.SeccompProfile = expand(jail.SeccompProfile)
+	}
+	if err := jail.validate(); err != nil {
+		return nil, err
+	}
+	images := []string{jail.Image, jail.FallbackImage}
+	if jail.NetworkBandwidth != nil {
+		images = append(images, jail.NetworkBandwidth.Image)
+	}
+	for _, image := range images {
+		if image == "" {
+			continue
+		}
+		if err := checkRegistry(config.AllowedRegistries, image); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateRegistryAuth(config.RegistryAuth); err != nil {
+		return nil, err
+	}
+	if err := jail.validateShells(config.Users); err != nil {
+		return nil, err
+	}
+	if err := validateProfiles(config.Profiles, config.Users); err != nil {
+		return nil, err
+	}
+	mounts := map[string]Profile{"the jail": jail.Profile}
+	for name, profile := range config.Profiles {
+		mounts["profile "+name] = profile
+	}
+	if err := checkSocketMounts(mounts, config.AllowDockerSocketMount); err != nil {
+		return nil, err
+	}
+	if len(jail.VolumesFrom) > 0 && !config.AllowVolumesFrom {
+		return nil, errors.New("volumesFrom can expose data across jails and requires allowVolumesFrom")
+	}
+	if err := validateTenants(config.Tenants, config.Users); err != nil {
+		return nil, err
+	}
+	if err := validateAcceptEnv(config.AcceptEnv); err != nil {
+		return nil, err
+	}
+	if config.FingerprintEnv != "" && !envNameRegexp.MatchString(config.FingerprintEnv) {
+		return nil, fmt.Errorf("Invalid fingerprintEnv %q", config.FingerprintEnv)
+	}
+	defaultTerm := config.DefaultTerm
+	if defaultTerm == "" {
+		defaultTerm = "xterm"
+	}
+	if err := validateMinClientVersions(config.MinClientVersions); err != nil {
+		return nil, err
+	}
+	if err := config.DrainPolicy.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.WindowBounds.validate(); err != nil {
+		return nil, err
+	}
+	if config.LoadScaling != nil {
+		if err := config.LoadScaling.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.CreateRetries != nil {
+		if err := config.CreateRetries.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.UsageWarnings != nil {
+		if err := config.UsageWarnings.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.SweepInterval > 0 && config.SweepAge <= 0 {
+		return nil, errors.New("sweepAge must be positive when sweepInterval is set")
+	}
+	if config.ReconnectCooldown != nil {
+		if err := config.ReconnectCooldown.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateTerms(config.TermMap, config.AllowedTerms, defaultTerm); err != nil {
+		return nil, err
+	}
+	connLimiters := make(map[string]*rateLimiter)
+	for name, tenant := range config.Tenants {
+		if tenant.ConnectionsPerMinute > 0 {
+			connLimiters[name] = newRateLimiter(tenant.ConnectionsPerMinute, tenant.ConnectionBurst)
+		}
+	}
+	labels, err := parseLabels(jail.Labels)
+	if err != nil {
+		return nil, err
+	}
+	homeVolume, err := parseHomeVolume(jail.HomeVolume)
+	if err != nil {
+		return nil, err
+	}
+	envTemplate, err := parseEnvTemplate(expand(jail.EnvTemplate))
+	if err != nil {
+		return nil, err
+	}
+	usernames, err := parseUsernameMap(config.UsernameMap)
+	if err != nil {
+		return nil, err
+	}
 
+	samplers, err := newSamplers(config.LogSampling)
+	if err != nil {
+		return nil, err
+	}
+	instance := config.Instance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	runAs, err := lookupCredentials(config.RunAsUser, config.RunAsGroup)
+	if err != nil {
+		return nil, err
+	}
+	if jail.PersistHistory {
+		if err := os.MkdirAll(jail.HistoryDir, 0700); err != nil {
+			return nil, err
+		}
+		// History is saved after dropping root.
+		if runAs != nil {
+			if err := os.Chown(jail.HistoryDir, runAs.uid, runAs.gid); err != nil {
+				return nil, err
+			}
+		}
+	}
+	authenticator := config.Authenticator
+	if authenticator == nil {
+		authenticator = allowAll{samplers}
+	}
+	ptys := ptysAvailable()
+	if !ptys {
+		log.Println("Ptys are unavailable, sessions will run without a terminal")
+	}
+	cleanupWorkers := config.CleanupWorkers
+	if cleanupWorkers <= 0 {
+		cleanupWorkers = 8
+	}
+	hangupGrace := time.Duration(config.HangupGrace)
+	if hangupGrace <= 0 {
+		hangupGrace = 5 * time.Second
+	}
+	bufferSize := config.CopyBufferSize
+	if bufferSize <= 0 {
+		bufferSize = 32 * 1024
+	}
+
+	registryAuthDir, err := writeRegistryAuth(config.RegistryAuth, runAs)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write registry credentials: %v", err)
+	}
 	return &Warden{
-		addr:        addr,
-		privateKeys: privateKeys,
-		jail:        jail,
-		jails:       make(map[string]string),
+		addr:          addr,
+		tlsAddr:       tlsAddr,
+		adminSocket:   config.AdminSocket,
+		tlsConfig:     tlsConfig,
+		proxyProtocol: config.ProxyProtocol,
+		connSlots:     connSlots,
+		privateKeys:   privateKeys,
+		jail:          jail,
+		homeVolume:    homeVolume,
+		envTemplate:   envTemplate,
+		labels:        labels,
+		users:         config.Users,
+		usernames:     usernames,
+		profiles:      config.Profiles,
+		jails:         make(map[string]string),
+		creatingJails: make(map[string]chan struct{}),
+		jailRefs:      make(map[string]int),
+		shellProbes:   make(map[string]bool),
+		commandJails:  make(map[string]bool),
+		historyRefs:   make(map[string]int),
+		resumables:    make(map[string]*resumable),
+		buffers: sync.Pool{New: func() interface{} {
+			buf := make([]byte, bufferSize)
+			return &buf
+		}},
+		samplers:            samplers,
+		expires:             config.Expires,
+		healthCheckInterval: time.Duration(config.HealthCheckInterval),
+		instance:            instance,
+		sweepInterval:       time.Duration(config.SweepInterval),
+		sweepAge:            time.Duration(config.SweepAge),
+		imageGCInterval:     time.Duration(config.ImageGCInterval),
+		imageGCAge:          time.Duration(config.ImageGCAge),
+		jailImages:          make(map[string]bool),
+		runAs:               runAs,
+		hangupGrace:         hangupGrace,
+		writeTimeout:        time.Duration(config.WriteTimeout),
+		dockerOps:           dockerOps,
+		mintCredentials:     config.MintCredentials,
+		sessionRecorder:     newSessionRecorder(config.SessionStore),
+		authenticator:       authenticator,
+		passwordAuth:        config.Authenticator != nil,
+		acceptEnv:           config.AcceptEnv,
+		allowDangerousEnv:   config.AllowDangerousEnv,
+		fingerprintEnv:      config.FingerprintEnv,
+		securityLog:         config.SecurityLog,
+		limitsBanner:        config.LimitsBanner,
+		termMap:             config.TermMap,
+		allowedTerms:        config.AllowedTerms,
+		defaultTerm:         defaultTerm,
+		minClientVersions:   config.MinClientVersions,
+		ciphers:             ciphers,
+		macs:                macs,
+		keyExchanges:        keyExchanges,
+		allowedRegistries:   config.AllowedRegistries,
+		registryAuth:        config.RegistryAuth,
+		registryAuthDir:     registryAuthDir,
+		cleanupWorkers:      cleanupWorkers,
+		ptys:                ptys,
+		keepOpenOnEOF:       config.KeepOpenOnEOF,
+		verifyLimits:        config.VerifyLimits,
+		handleSignals:       config.HandleSignals,
+		usageWarnings:       config.UsageWarnings,
+		reconnects:          newReconnects(config.ReconnectCooldown),
+		drainPolicy:         config.DrainPolicy,
+		createRetries:       config.CreateRetries,
+		windowBounds:        config.WindowBounds,
+		loadScaling:         config.LoadScaling,
+		channelRejections:   config.ChannelRejections,
+		negotiationTimeout:  time.Duration(config.NegotiationTimeout),
+		authTimeout:         time.Duration(config.AuthTimeout),
+		shutdownMessage:     config.ShutdownMessage,
+		tenants:             config.Tenants,
+		connLimiters:        connLimiters,
+		userSessions:        make(map[string]int),
+		tenantJails:         make(map[string]int),
+		jailTenants:         make(map[string]string),
+		sessionsByJail:      make(map[string][]*session),
 	}, nil
 }
 
+// Run listens for and serves connections until every listener has stopped.
+// It returns nil if they were stopped by Close, and an error if they can't
+// be set up or all failed.
 func (w *Warden) Run() error {
-	config := &ssh.ServerConfig{PublicKeyCallback: checkAuth}
+	config := &ssh.ServerConfig{PublicKeyCallback: w.checkKey}
+	if w.passwordAuth {
+		config.PasswordCallback = w.checkPassword
+	}
+	config.Ciphers, config.MACs, config.KeyExchanges = w.ciphers, w.macs, w.keyExchanges
 	for _, pk := range w.privateKeys {
 		config.AddHostKey(pk)
 	}
 	listener, err := net.Listen("tcp", w.addr)
 	if err != nil {
-		log.Fatalln("Failed to listen for connections:", err)
+		return err
+	}
+	listeners := []net.Listener{listener}
+	if w.tlsConfig != nil {
+		tlsListener, err := net.Listen("tcp", w.tlsAddr)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listeners = append(listeners, tls.NewListener(tlsListener, w.tlsConfig))
+	}
+	if w.adminSocket != "" {
+		adminListener, err := w.listenAdmin()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		defer adminListener.Close()
+		go w.serveAdmin(adminListener)
+	}
+	w.listenersMu.Lock()
+	w.listeners = listeners
+	closed := w.closed
+	w.listenersMu.Unlock()
+	if closed {
+		w.Close()
+		return nil
+	}
+	if w.runAs != nil {
+		if err := w.runAs.drop(); err != nil {
+			w.Close()
+			return err
+		}
 	}
 	fmt.Printf("Listening on %s...\n", w.addr)
+	if w.tlsConfig != nil {
+		fmt.Printf("Listening for TLS on %s...\n", w.tlsAddr)
+	}
+	if w.healthCheckInterval > 0 {
+		go w.monitorDocker(w.healthCheckInterval)
+	}
+	if w.sweepInterval > 0 {
+		go w.sweepJails(w.sweepInterval, w.sweepAge)
+	}
+	if w.imageGCInterval > 0 {
+		go w.collectImages(w.imageGCInterval, w.imageGCAge)
+	}
+	if w.handleSignals {
+		go w.shutdownOnSignal()
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- w.serve(l, config)
+		}(l)
+	}
+	var failures []string
+	for range listeners {
+		err := <-errs
+		w.listenersMu.Lock()
+		closed := w.closed
+		w.listenersMu.Unlock()
+		if !closed {
+			log.Println("Stopped listening:", err)
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) == len(listeners) {
+		return fmt.Errorf("All listeners failed: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Close stops warden from accepting connections, making Run return.
+// Sessions already running are left alone.
+func (w *Warden) Close() error {
+	w.listenersMu.Lock()
+	defer w.listenersMu.Unlock()
+	w.closed = true
+	var err error
+	for _, l := range w.listeners {
+		if closeErr := l.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// serve accepts connections on listener until it fails or is closed.
+func (w *Warden) serve(listener net.Listener, config *ssh.ServerConfig) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("Failed to accept incoming connection:", err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("Failed to accept incoming connection:", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if w.connSlots == nil {
+			go w.handleConn(conn, config)
 			continue
 		}
-		go w.handleConn(conn, config)
+		select {
+		case w.connSlots <- struct{}{}:
+			go func() {
+				w.handleConn(conn, config)
+				<-w.connSlots
+			}()
+		default:
+			log.Println("Rejected connection from", conn.RemoteAddr(), "over the connection limit")
+			conn.Close()
+		}
 	}
 }
 
+// Cleanup removes the persistent jails warden created, the jails of any
+// sessions still running, and the registry credentials it wrote.
 func (w *Warden) Cleanup() error {
+	w.jailsMu.Lock()
 	jailIDs := make([]string, 0, len(w.jails))
+	seen := make(map[string]bool)
 	for _, id := range w.jails {
 		jailIDs = append(jailIDs, id)
+		seen[id] = true
+	}
+	w.jailsMu.Unlock()
+	w.sessionsMu.Lock()
+	for id := range w.sessionsByJail {
+		if !seen[id] {
+			jailIDs = append(jailIDs, id)
+		}
+	}
+	w.sessionsMu.Unlock()
+
+	// Remove jails in parallel so that shutdown stays quick with many
+	// persistent jails, with a bounded number of workers so as not to
+	// swamp the docker daemon.
+	ids := make(chan string)
+	failures := make(chan string, len(jailIDs))
+	var wg sync.WaitGroup
+	for i := 0; i < w.cleanupWorkers && i < len(jailIDs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				out, err := w.docker("rm", "-f", id).CombinedOutput()
+				if err != nil {
+					failures <- fmt.Sprintf("%s: %v: %s", id, err, bytes.TrimSpace(out))
+					continue
+				}
+				w.jailGone(id)
+			}
+		}()
+	}
+	for _, id := range jailIDs {
+		ids <- id
+	}
+	close(ids)
+	wg.Wait()
+	close(failures)
+	var errs []string
+	for failure := range failures {
+		errs = append(errs, failure)
+	}
+	if w.registryAuthDir != "" {
+		os.RemoveAll(w.registryAuthDir)
 	}
-	args := append([]string{"rm", "-f"}, jailIDs...)
-	cleanupCmd := exec.Command("docker", args...)
-	return cleanupCmd.Run()
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to remove %d of %d jails: %s", len(errs), len(jailIDs), strings.Join(errs, "; "))
+	}
+	return nil
 }
 
-func checkAuth(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-	log.Println("No auth yet! Allowing user:", conn.User())
-	return nil, nil
+func fingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return hex.EncodeToString(sum[:])
 }
 
 func (w *Warden) handleConn(conn net.Conn, conf *ssh.ServerConfig) {
 	defer conn.Close()
-	sshConn, chans, reqs, err := ssh.NewServerConn(conn, conf)
+	connID := newID()
+	l := logger("conn=" + connID)
+	if w.ShuttingDown() && w.shutdownMessage == "" {
+		return
+	}
+	if w.proxyProtocol {
+		var err error
+		conn, err = readProxyHeader(conn)
+		if err != nil {
+			l.Println("Failed to read PROXY protocol header:", err)
+			return
+		}
+	}
+	var record *connRecord
+	if w.securityLog {
+		record = &connRecord{start: time.Now()}
+		conf = record.withRecord(conf)
+	}
+	if w.negotiationTimeout > 0 || w.authTimeout > 0 {
+		conf = w.withDeadlines(conn, conf)
+	}
+	recorder := &kexInitRecorder{Conn: conn}
+	sshConn, chans, reqs, err := ssh.NewServerConn(recorder, conf)
+	conn.SetDeadline(time.Time{})
+	if record != nil {
+		record.kex, record.hostKey, record.cipher, record.mac = w.negotiatedAlgorithms(recorder)
+		record.log(l, conn.RemoteAddr().String(), err)
+	}
 	if err != nil {
-		log.Println("Failed to handshake:", err)
+		l.Println("Failed to handshake:", err)
+		if strings.Contains(err.Error(), "no common algorithms") {
+			w.explainNegotiation(l, recorder)
+		}
 		return
 	}
+	if err := w.checkClientVersion(string(sshConn.ClientVersion())); err != nil {
+		l.Printf("Rejected connection from %s: %v", conn.RemoteAddr(), err)
+		// Clients show why a session was refused, but not why the
+		// connection closed.
+		go ssh.DiscardRequests(reqs)
+		if ch, ok := <-chans; ok {
+			ch.Reject(ssh.Prohibited, err.Error())
+		}
+		return
+	}
+	if !w.allowConnection(sshConn.User()) {
+		l.Println("Rejected connection from", conn.RemoteAddr(), "for user", sshConn.User(), "over their tenant's connection rate")
+		return
+	}
+	client := reconnectClient(sshConn.User(), conn.RemoteAddr())
+	if left, ok := w.reconnects.coolingDown(client); ok {
+		l.Printf("Rejected connection from %s, which is cooling down for %v", client, left.Round(time.Second))
+		go ssh.DiscardRequests(reqs)
+		if ch, ok := <-chans; ok {
+			ch.Reject(ssh.ResourceShortage, fmt.Sprintf("Too many short connections, try again in %v", left.Round(time.Second)))
+		}
+		return
+	}
+	connected := time.Now()
+	defer func() { w.reconnects.closed(l, client, time.Since(connected)) }()
+	if w.samplers.sample(connectionEvents) {
+		l.Println("Accepted connection from", conn.RemoteAddr(), "for user", sshConn.User())
+	}
 	go ssh.DiscardRequests(reqs)
 	for ch := range chans {
 		if ch.ChannelType() != "session" {
-			ch.Reject(ssh.UnknownChannelType, "unknown channel type")
+			w.rejectChannel(l, ch)
 			continue
 		}
-		go w.handleChannel(sshConn, ch)
+		if w.ShuttingDown() {
+			if w.shutdownMessage == "" {
+				ch.Reject(ssh.ResourceShortage, "warden is shutting down")
+			} else {
+				go w.refuseSession(l, ch)
+			}
+			continue
+		}
+		go w.handleChannel(sshConn, connID, ch)
 	}
 }
 
-func (w *Warden) handleChannel(conn *ssh.ServerConn, newChan ssh.NewChannel) {
+func (w *Warden) handleChannel(conn *ssh.ServerConn, connID string, newChan ssh.NewChannel) {
+	info := w.sessionInfo(conn, connID)
+	l := info.logger()
 	ch, reqs, err := newChan.Accept()
 	if err != nil {
-		log.Println("newChan.Accept failed:", err)
+		l.Println("newChan.Accept failed:", err)
 		return
 	}
+	s := &session{info: info, log: l, conn: conn, ch: ch, verbose: w.samplers.sample(sessionEvents)}
 
-	var bash *exec.Cmd
-
-	if w.jail.Persistent {
-		jailID, ok := w.jails[conn.User()]
-		if !ok {
-			startJailCmd := exec.Command("docker", "run", "-d", "-h", w.hostname(), "--name", jailName(conn), w.jail.Image, "bash", "-c", "while true; do sleep 1; done")
-			out, err := startJailCmd.CombinedOutput()
+	// The jail is only created once the client asks for a shell, so that
+	// the pty-req and window-change requests preceding it can be applied.
+	for req := range reqs {
+		switch req.Type {
+		case "shell":
+			if s.started {
+				l.Println("Rejected duplicate shell request")
+				reply(req, false)
+				continue
+			}
+			if len(req.Payload) != 0 {
+				l.Printf("Rejected shell request with %d byte payload", len(req.Payload))
+				reply(req, false)
+				continue
+			}
+			err := w.startShell(s)
+			reply(req, err == nil)
 			if err != nil {
-				log.Println("Failed to create jail:", err, string(out))
+				l.Println(err)
 				ch.Close()
-				return
 			}
-			jailID = strings.TrimSpace(string(out))
-			w.jails[conn.User()] = jailID
+		case "pty-req":
+			var msg ptyRequestMsg
+			if s.started || ssh.Unmarshal(req.Payload, &msg) != nil {
+				reply(req, false)
+				continue
+			}
+			// Only the first pty-req sets the terminal type; later ones
+			// before the shell starts just resize it.
+			if !s.ptyRequested {
+				s.ptyRequested = true
+				s.term = w.term(l, msg.Term)
+			} else {
+				l.Println("Duplicate pty request, updating window size only")
+			}
+			s.width, s.height = w.windowBounds.clamp(msg.Columns, msg.Rows)
+			reply(req, true)
+		case "window-change":
+			var msg windowChangeMsg
+			if ssh.Unmarshal(req.Payload, &msg) != nil {
+				reply(req, false)
+				continue
+			}
+			// Window changes only make sense for sessions with a pty.
+			if !s.ptyRequested {
+				l.Println("Rejected window change without a pty")
+				reply(req, false)
+				continue
+			}
+			s.width, s.height = w.windowBounds.clamp(msg.Columns, msg.Rows)
+			if s.pty != nil {
+				setWindowSize(s.pty.Fd(), s.width, s.height)
+			}
+			reply(req, true)
+		case "env":
+			var msg envRequestMsg
+			if s.started || ssh.Unmarshal(req.Payload, &msg) != nil {
+				reply(req, false)
+				continue
+			}
+			if msg.Name == profileEnv {
+				s.profile = msg.Value
+				reply(req, true)
+				continue
+			}
+			if w.jail.ResumeWindow > 0 && msg.Name == resumeEnv {
+				s.resumeToken = msg.Value
+				reply(req, true)
+				continue
+			}
+			if w.jail.NamedJails && msg.Name == jailEnv {
+				s.info.Jail = msg.Value
+				reply(req, true)
+				continue
+			}
+			ok := w.allowEnv(l, msg.Name, msg.Value)
+			if ok {
+				if s.env == nil {
+					s.env = make(map[string]string)
+				}
+				s.env[msg.Name] = msg.Value
+			}
+			reply(req, ok)
+		default:
+			reply(req, false)
 		}
-		bash = exec.Command("docker", "exec", "-it", jailID, "bash", "-c", jailScript(conn.User()))
-	} else {
-		bash = exec.Command("docker", "run", "-it", "--rm", "-h", w.hostname(), "--name", jailName(conn), w.jail.Image, "bash", "-c", jailScript(conn.User()))
 	}
+	// The channel has been closed, which the session doesn't otherwise
+	// notice if it is kept open after the client's input ends.
+	if s.hangup != nil {
+		s.hangup()
+	}
+}
 
-	close := func() {
-		ch.Close()
-		_, err := bash.Process.Wait()
+func reply(req *ssh.Request, ok bool) {
+	if req.WantReply {
+		req.Reply(ok, nil)
+	}
+}
+
+func (w *Warden) startShell(s *session) (err error) {
+	if w.Degraded() {
+		fmt.Fprint(s.ch, "warden is temporarily unavailable, please try again shortly.\r\n")
+		return errors.New("Refusing session while docker is unavailable")
+	}
+	expires := w.expiry(s.info.User)
+	if !expires.IsZero() && !time.Now().Before(expires) {
+		fmt.Fprintf(s.ch, "Access for %s expired at %s.\r\n", s.info.User, expires.Format(time.RFC1123))
+		return fmt.Errorf("Access for %s expired at %s", s.info.User, expires)
+	}
+
+	profile, err := w.profile(s.info.User, s.profile)
+	if err != nil {
+		fmt.Fprintf(s.ch, "%v.\r\n", err)
+		return err
+	}
+	if w.loadScaling != nil {
+		// This session's jail is counted too, even if it is a running
+		// persistent jail, whose limits don't change.
+		jails := w.activeJails() + 1
+		profile = w.loadScaling.scale(profile, jails)
+		if s.verbose {
+			s.log.Printf("Scaled limits for %d jails to memory=%s cpus=%s", jails, profile.Memory, profile.CPUs)
+		}
+	}
+	if s.info.Jail != "" && !namedJailRegexp.MatchString(s.info.Jail) {
+		fmt.Fprintf(s.ch, "Invalid jail name %q, names are lowercase letters, digits, - and _.\r\n", s.info.Jail)
+		return fmt.Errorf("Invalid jail name %q", s.info.Jail)
+	}
+	if err := w.acquireSession(s.info); err != nil {
+		fmt.Fprintf(s.ch, "%v.\r\n", err)
+		return err
+	}
+	revokeCredentials := func() {}
+	defer func() {
 		if err != nil {
-			log.Println("Failed to exit bash:", err)
+			revokeCredentials()
+			w.releaseSession(s.info)
 		}
-		log.Println("Session closed")
+	}()
+	var tmuxSession string
+	releaseResume := func(jailID string) {}
+	if w.jail.Detachable {
+		tmuxSession = "warden"
 	}
-
-	log.Println("Creating pty...")
-	bashf, err := pty.Start(bash)
+	if w.jail.ResumeWindow > 0 {
+		var token string
+		token, tmuxSession, releaseResume, err = w.claimResume(s.info, s.resumeToken)
+		if err != nil {
+			fmt.Fprintf(s.ch, "%v.\r\n", err)
+			return err
+		}
+		defer func() {
+			if err != nil {
+				releaseResume("")
+			}
+		}()
+		w.resumeNotice(s.ch, token)
+	}
+	var credArgs, credEnviron []string
+	if w.mintCredentials != nil {
+		creds, revoke, err := w.mintCredentials(s.info)
+		if err != nil {
+			fmt.Fprint(s.ch, "Failed to issue credentials for this session.\r\n")
+			return fmt.Errorf("Failed to mint credentials: %v", err)
+		}
+		if revoke != nil {
+			l := s.log
+			revokeCredentials = func() {
+				if err := revoke(); err != nil {
+					l.Println("Failed to revoke credentials:", err)
+				}
+			}
+		}
+		credArgs, credEnviron, err = credentialEnv(creds)
+		if err != nil {
+			return fmt.Errorf("Failed to mint credentials: %v", err)
+		}
+	}
+	labels, err := renderLabels(w.labels, s.info)
 	if err != nil {
-		log.Println("Failed to start pty:", err)
-		close()
-		return
+		return fmt.Errorf("Failed to create jail: %v", err)
+	}
+	volumes, err := w.renderHomeVolume(s.info)
+	if err != nil {
+		return fmt.Errorf("Failed to create jail: %v", err)
+	}
+	templateEnv, err := renderEnvTemplate(w.envTemplate, s.info)
+	if err != nil {
+		return fmt.Errorf("Failed to create jail: %v", err)
+	}
+	volumesFrom, err := w.volumesFromArgs()
+	if err != nil {
+		return fmt.Errorf("Failed to create jail: %v", err)
+	}
+	labels = append(labels,
+		"--label", instanceLabel+"="+w.instance,
+		"--label", "warden.connection="+s.info.ConnectionID,
+		"--label", "warden.session="+s.info.SessionID)
+	name := w.jailName(s.info)
+	runArgs := append([]string{"-h", w.hostname(), "--name", name}, labels...)
+	runArgs = append(runArgs, volumes...)
+	runArgs = append(runArgs, volumesFrom...)
+	runArgs = append(runArgs, profile.runArgs()...)
+	if w.jail.CgroupParent != "" {
+		runArgs = append(runArgs, "--cgroup-parent", w.jail.CgroupParent)
+	}
+	if w.jail.LogDriver != "" {
+		runArgs = append(runArgs, "--log-driver", w.jail.LogDriver)
+	}
+	for _, opt := range sortedKeys(w.jail.LogOpts) {
+		runArgs = append(runArgs, "--log-opt", opt+"="+w.jail.LogOpts[opt])
+	}
+	if w.jail.UsernsMode != "" {
+		runArgs = append(runArgs, "--userns", w.jail.UsernsMode)
+	}
+	if w.jail.SeccompProfile != "" {
+		runArgs = append(runArgs, "--security-opt", "seccomp="+w.jail.SeccompProfile)
+	}
+	if w.jail.AppArmorProfile != "" {
+		runArgs = append(runArgs, "--security-opt", "apparmor="+w.jail.AppArmorProfile)
+	}
+	var scratch string
+	if w.jail.Scratch != nil {
+		runArgs = append(runArgs, w.jail.Scratch.runArgs()...)
+		scratch = w.jail.Scratch.dir(w.jail.shared(), s.info.SessionID)
 	}
 
-	var once sync.Once
-	go func() {
-		io.Copy(ch, bashf)
-		once.Do(close)
-	}()
-	go func() {
-		io.Copy(bashf, ch)
-		once.Do(close)
-	}()
+	// The host's env comes first, then the client's and the env template's,
+	// so that the profile's takes precedence.
+	env := append(hostEnvArgs(w.jail.HostEnv), envArgs(s.env)...)
+	env = append(env, envArgs(templateEnv)...)
+	env = append(env, profile.envArgs()...)
+	if w.fingerprintEnv != "" && s.info.Fingerprint != "" {
+		env = append(env, "-e", w.fingerprintEnv+"="+s.info.Fingerprint)
+	}
+	env = append(env, credArgs...)
+	if s.term != "" {
+		env = append(env, "-e", "TERM="+s.term)
+	}
 
-	go func() {
-		for req := range reqs {
-			switch req.Type {
-			case "shell":
-				ok := len(req.Payload) == 0
-				if req.WantReply {
-					req.Reply(ok, nil)
-				}
-			case "pty-req":
-				termLen := req.Payload[3]
-				w, h := parseDimensions(req.Payload[termLen+4:])
-				setWindowSize(bashf.Fd(), w, h)
-				if req.WantReply {
-					req.Reply(true, nil)
+	if w.limitsBanner && s.ptyRequested {
+		fmt.Fprint(s.ch, limitsBanner(profile, expires))
+	}
+
+	var bash *exec.Cmd
+	// afterExit tears down what the session leaves in the jail. It runs once
+	// the session's shell has exited and its channel has been closed.
+	// Cleanups added later run first, so that a shared jail is only
+	// released once the session's state in it has been saved.
+	afterExit := func() {}
+
+	var jailID, image string
+	var jailCreated time.Time
+	var createEphemeral func(fallback bool) error
+	if w.jail.shared() {
+		key := s.info.jailKey()
+		w.jailsMu.Lock()
+		// Wait for another session that is still starting or creating this
+		// jail.
+		for {
+			creating, ok := w.creatingJails[key]
+			if !ok {
+				break
+			}
+			w.jailsMu.Unlock()
+			<-creating
+			w.jailsMu.Lock()
+		}
+		jailID = w.jails[key]
+		if jailID == "" && s.info.Jail != "" && w.namedJails(s.info.LocalUser) >= w.maxNamedJails() {
+			w.jailsMu.Unlock()
+			fmt.Fprintf(s.ch, "You already have %d named jails, the most allowed. Use one of them, or ask an administrator to remove one.\r\n", w.maxNamedJails())
+			return fmt.Errorf("User %s has reached the limit of %d named jails", s.info.LocalUser, w.maxNamedJails())
+		}
+		if jailID == "" {
+			if err := w.reserveJail(s.info.Tenant); err != nil {
+				w.jailsMu.Unlock()
+				fmt.Fprintf(s.ch, "%v.\r\n", err)
+				return err
+			}
+		}
+		if w.jail.SharedEphemeral {
+			// Hold a reference meanwhile, so that the last of the user's
+			// other sessions ending doesn't remove the jail.
+			w.jailRefs[key]++
+		}
+		// Starting and creating jails waits on docker, so jailsMu is
+		// released meanwhile, and only sessions for this jail wait.
+		creating := make(chan struct{})
+		w.creatingJails[key] = creating
+		w.jailsMu.Unlock()
+		id, err := w.openPersistentJail(s, jailID, name, runArgs, profile)
+		w.jailsMu.Lock()
+		delete(w.creatingJails, key)
+		close(creating)
+		if err != nil {
+			// A jail that failed to restart has been given up on.
+			if jailID != "" && w.jails[key] == jailID {
+				delete(w.jails, key)
+			}
+			if w.jail.SharedEphemeral {
+				if w.jailRefs[key]--; w.jailRefs[key] <= 0 {
+					delete(w.jailRefs, key)
 				}
-			case "window-change":
-				w, h := parseDimensions(req.Payload)
-				setWindowSize(bashf.Fd(), w, h)
-				if req.WantReply {
-					req.Reply(true, nil)
+			}
+			w.jailsMu.Unlock()
+			return err
+		}
+		jailID = id
+		w.jails[key] = jailID
+		if w.jail.SharedEphemeral {
+			afterExit = func() { w.releaseJail(s.log, key, jailID) }
+		}
+		w.jailsMu.Unlock()
+		// The limit is set again for every session, since it is lost
+		// whenever the jail restarts.
+		if w.jail.NetworkBandwidth != nil {
+			if err := w.limitBandwidth(jailID, 1); err != nil {
+				afterExit()
+				return fmt.Errorf("Failed to limit network bandwidth: %v", err)
+			}
+		}
+		if w.jail.ReadinessProbe != nil {
+			if err := w.waitReady(s, jailID); err != nil {
+				afterExit()
+				return err
+			}
+		}
+		if w.jail.PersistHistory {
+			user := s.info.LocalUser
+			if err := w.restoreHistory(jailID, key); err != nil {
+				s.log.Println("Failed to restore history:", err)
+			}
+			previous := afterExit
+			afterExit = func() {
+				if err := w.saveHistory(jailID, key, user); err != nil {
+					s.log.Println("Failed to save history:", err)
 				}
-			case "env":
-				if req.WantReply {
-					req.Reply(true, nil)
+				previous()
+			}
+		}
+		if w.jail.ResumeWindow > 0 {
+			previous := afterExit
+			afterExit = func() {
+				releaseResume(jailID)
+				previous()
+			}
+		}
+		if scratch != "" {
+			previous := afterExit
+			afterExit = func() {
+				if err := removeScratch(jailID, scratch); err != nil {
+					s.log.Println("Failed to remove scratch space:", err)
 				}
-			default:
-				if req.WantReply {
-					req.Reply(false, nil)
+				previous()
+			}
+		}
+		previous := afterExit
+		afterExit = func() {
+			id := s.info.SessionID
+			script := `kill $(cat "$3" 2> /dev/null) 2> /dev/null; rm -f "$@"`
+			exec.Command("docker", "exec", jailID, "bash", "-c", script, "-", sessionPIDFile(id), auditFIFO(id), auditReaderPIDFile(id)).Run()
+			previous()
+		}
+		args := append(append([]string{"exec", w.interactiveFlags()}, env...), jailID, "bash", "-c", w.jailScript(s.info.SessionID, s.info.LocalUser, w.shell(s.info.User), scratch, tmuxSession))
+		bash = exec.Command("docker", args...)
+		bash.Env = append(os.Environ(), credEnviron...)
+	} else {
+		args := append(append([]string{"create", w.interactiveFlags(), "--rm"}, env...), runArgs...)
+		cmd := []string{"bash", "-c", w.jailScript(s.info.SessionID, s.info.LocalUser, w.shell(s.info.User), scratch, tmuxSession)}
+		// createEphemeral creates the session's jail, from the fallback
+		// image if the primary one failed to start.
+		createEphemeral = func(fallback bool) error {
+			if err := w.reserveJail(s.info.Tenant); err != nil {
+				fmt.Fprintf(s.ch, "%v.\r\n", err)
+				return err
+			}
+			var err error
+			jailCreated = time.Now()
+			if fallback {
+				image = w.jail.FallbackImage
+				jailID, _, err = w.createJailFrom(s.log, s.ch, name, args, credEnviron, image, cmd)
+			} else {
+				jailID, image, err = w.createJail(s.log, s.ch, name, args, credEnviron, cmd...)
+			}
+			if err != nil {
+				w.cancelJail(s.info.Tenant)
+				return fmt.Errorf("Failed to create jail: %v", err)
+			}
+			w.trackJail(s.info.Tenant, jailID)
+			if w.verifyLimits {
+				verifyLimits(s.log, jailID, profile)
+			}
+			bash = exec.Command("docker", "start", "-ai", jailID)
+			id := jailID
+			afterExit = func() {
+				// The jail is removed on exit because of --rm, but it
+				// outlives a docker client that was killed rather than hung
+				// up on.
+				w.docker("rm", "-f", id).Run()
+				w.jailGone(id)
+				w.setRunsCommand(id, false)
+			}
+			return nil
+		}
+		if err := createEphemeral(false); err != nil {
+			return err
+		}
+	}
+
+	var bashf io.ReadWriteCloser
+	startClient := func() (err error) {
+		if !w.jail.shared() {
+			abort := w.startingJail(jailID)
+			defer func() {
+				if err != nil {
+					abort()
 				}
+			}()
+		}
+		if w.ptys {
+			if s.verbose {
+				s.log.Println("Creating pty...")
+			}
+			f, err := startPty(bash, s.width, s.height)
+			if err != nil {
+				return fmt.Errorf("Failed to start pty: %v", err)
+			}
+			s.pty, bashf = f, f
+			return nil
+		}
+		if bashf, err = startWithPipes(bash); err != nil {
+			return fmt.Errorf("Failed to start jail: %v", err)
+		}
+		return nil
+	}
+	stopClient := func() {
+		syscall.Kill(-bash.Process.Pid, syscall.SIGKILL)
+		bash.Process.Wait()
+		bashf.Close()
+	}
+	if !w.ptys && s.ptyRequested {
+		fmt.Fprint(s.ch, "warden: no terminal is available, running without one\r\n")
+	}
+	if err := startClient(); err != nil {
+		afterExit()
+		return err
+	}
+	if w.jail.gated() {
+		err := w.openJail(s, jailID)
+		// Ephemeral jails are only started by docker start, so the primary
+		// image failing to start is only found out here.
+		if image == w.jail.Image && w.fallsBack(err) {
+			stopClient()
+			afterExit()
+			w.fallBack(s.log, s.ch, err)
+			if err := createEphemeral(true); err != nil {
+				return err
+			}
+			if err := startClient(); err != nil {
+				afterExit()
+				return err
+			}
+			err = w.openJail(s, jailID)
+		}
+		if err != nil {
+			stopClient()
+			afterExit()
+			return err
+		}
+	}
+	s.started = true
+	s.info.ContainerID = jailID
+	if s.verbose {
+		s.log.Println("Session started in jail", jailID)
+	}
+
+	ch, l, verbose, info := s.ch, s.log, s.verbose, s.info
+	record := SessionRecord{SessionInfo: info, Image: image, Started: time.Now(), ExitStatus: -1}
+	var bytesIn, bytesOut int64
+	done := make(chan struct{})
+	outputDone := make(chan struct{})
+	// closeSession tears the session down in a fixed order, so that the
+	// client sees all of the jail's output and its exit status before the
+	// channel closes, and nothing is stopped underneath a client that is
+	// still reading:
+	//  1. hang up on the jail and wait for the docker client to exit,
+	//  2. let the remaining output drain to the channel,
+	//  3. send exit-status, then close the channel,
+	//  4. stop the container and release the session's resources.
+	closeSession := func() {
+		close(done)
+		// Hang up on the session inside the jail in case it is still
+		// running, e.g. because the client went away first, so that its
+		// shell can run its logout handlers and save its history. Neither
+		// closing the pty nor signalling the docker client reaches the
+		// jail. The docker client exits once the session's processes have.
+		// If they are still running after the grace period, they are killed,
+		// along with the docker client's process group.
+		select {
+		case <-outputDone:
+			// The docker client's output ended, so the session has exited.
+		default:
+			if err := w.signalSession(jailID, info.SessionID, "HUP"); err != nil {
+				l.Println("Failed to hang up on the session in its jail:", err)
 			}
 		}
+		pgid := bash.Process.Pid
+		kill := time.AfterFunc(w.hangupGrace, func() {
+			l.Println("Session did not exit after hangup, killing it")
+			w.signalSession(jailID, info.SessionID, "KILL")
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		state, err := bash.Process.Wait()
+		kill.Stop()
+		// The pty's output is readable until the last of it has been copied
+		// once the docker client is gone, but don't let a stalled client
+		// hold up the teardown.
+		select {
+		case <-outputDone:
+		case <-time.After(outputDrainTimeout):
+		}
+		bashf.Close()
+		if err != nil {
+			l.Println("Failed to exit bash:", err)
+		} else {
+			status := exitStatus(state, func() bool {
+				return jailCommandFailed(jailID, w.jail.shared(), jailCreated)
+			})
+			record.ExitStatus = int(status)
+			sendRequest(l, verbose, ch, "exit-status", ssh.Marshal(&struct{ Status uint32 }{status}))
+		}
+		ch.Close()
+		afterExit()
+		revokeCredentials()
+		w.releaseSession(info)
+		w.removeSession(info)
+		record.Ended = time.Now()
+		record.BytesIn, record.BytesOut = atomic.LoadInt64(&bytesIn), atomic.LoadInt64(&bytesOut)
+		w.sessionRecorder.ended(record)
+		if verbose {
+			l.Println("Session closed")
+		}
+	}
+
+	var once sync.Once
+	s.hangup = func() { once.Do(closeSession) }
+	atomic.StoreInt64(&s.lastInput, time.Now().UnixNano())
+	w.addSession(s)
+	w.sessionRecorder.started(record, jailID)
+	if !expires.IsZero() {
+		go expireSession(s, expires, done, s.hangup)
+	}
+	if w.usageWarnings != nil && s.ptyRequested && (profile.Memory != "" || profile.CPUs != "") {
+		go w.warnUsage(s, jailID, profile, done)
+	}
+	go func() {
+		w.copy(countingWriter{w.timeoutWriter(l, s.conn, ch), &bytesOut}, bashf)
+		close(outputDone)
+		once.Do(closeSession)
+	}()
+	go func() {
+		w.copy(countingWriter{bashf, &bytesIn}, activityReader{s})
+		if !w.keepOpenOnEOF {
+			once.Do(closeSession)
+			return
+		}
+		// The client may only have finished sending input, so pass that on
+		// and leave the session to end when the jail exits, or when the
+		// client closes the channel.
+		if err := closeInput(bashf); err != nil {
+			l.Println("Failed to close jail input:", err)
+		}
 	}()
+	return nil
+}
+
+// copy copies from src to dst using a buffer from the warden's pool, returning
+// the buffer once the copy completes.
+func (w *Warden) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := w.buffers.Get().(*[]byte)
+	defer w.buffers.Put(buf)
+	// Hide any ReaderFrom or WriterTo implementations, which would bypass
+	// the pooled buffer.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
 }
 
 func (w *Warden) hostname() string {
@@ -204,24 +1328,153 @@ func (w *Warden) hostname() string {
 	return hostname
 }
 
-func jailName(conn *ssh.ServerConn) string {
-	return fmt.Sprintf("warden-auto-%d-%s", os.Getpid(), conn.User())
+func (w *Warden) jailName(info SessionInfo) string {
+	if w.jail.shared() {
+		return containerName(fmt.Sprintf("warden-auto-%d-%s", os.Getpid(), info.jailKey()))
+	}
+	return containerName(fmt.Sprintf("warden-auto-%d-%s-%s", os.Getpid(), info.LocalUser, info.SessionID))
 }
 
-const jailScriptFmt = `
-user=%s
+func jailUsername(username string) string {
+	if username == "root" {
+		return "r00t"
+	}
+	return username
+}
+
+var jailScriptTemplate = template.Must(template.New("jailScript").Funcs(template.FuncMap{
+	"quote":        shellQuote,
+	"auditCommand": auditCommand,
+}).Parse(`
+{{- if .Gate}}
+until [ -e {{quote .Gate}} ]; do sleep 0.1; done
+rm -f {{quote .Gate}}
+{{- end}}
+mkdir -p -m 700 /run/warden && echo $$ > {{quote .PIDFile}}
+user={{quote .User}}
 if [ "$user" == root ]; then
   user=r00t
 fi
 exists=false
-(getent passwd $user && exists=true
+(getent passwd "$user" && exists=true
 if ! $exists; then
-  adduser --disabled-password --gecos '' $user
+  adduser --disabled-password --gecos '' "$user"
 fi) > /dev/null 2>&1
-cd /home/$user
-su $user
-`
+{{- if .ChownHome}}
+chown -R "$user:" "/home/$user"
+{{- end}}
+{{- range .Groups}}
+if getent group {{quote .}} > /dev/null 2>&1; then
+  usermod -aG {{quote .}} "$user"
+else
+  echo "warden: group "{{quote .}}" does not exist in this jail" >&2
+fi
+{{- end}}
+{{- with .HistoryStaging}}
+if [ -f {{quote .}} ]; then
+  mv {{quote .}} "/home/$user/.bash_history" && chown "$user:" "/home/$user/.bash_history"
+fi
+{{- end}}
+{{- with .Scratch}}
+mkdir -p {{quote .}} && chown "$user:" {{quote .}}
+export WARDEN_SCRATCH={{quote .}}
+{{- end}}
+{{- with .CommandAudit}}
+touch {{quote .}} && chown root: {{quote .}} && chmod 600 {{quote .}}
+rm -f {{quote $.AuditFIFO}} && mkfifo -m 622 {{quote $.AuditFIFO}}
+cat 0<> {{quote $.AuditFIFO}} >> {{quote .}} 2> /dev/null &
+echo $! > {{quote $.AuditReaderPIDFile}}
+export PROMPT_COMMAND={{quote (auditCommand $.AuditFIFO)}}
+{{- end}}
+cd "/home/$user"
+{{- with .Shell}}
+shell={{quote .}}
+if [ ! -x "$shell" ]; then
+  echo "warden: $shell is not installed in this jail, using your login shell" >&2
+  shell=$(getent passwd "$user" | cut -d: -f7)
+fi
+{{- end}}
+{{- with .TmuxSession}}
+if command -v tmux > /dev/null 2>&1; then
+  exec su{{if $.Shell}} -s "$shell"{{end}} "$user" -c {{quote (printf "exec tmux new-session -A -s %s" (quote .))}}
+fi
+echo "warden: tmux is not installed in this jail, this session can't be resumed" >&2
+{{- end}}
+su{{if .Shell}} -s "$shell"{{end}} "$user"{{with .ShellArgs}} --{{range .}} {{quote .}}{{end}}{{end}}
+`))
+
+type jailScriptParams struct {
+	User           string
+	Groups         []string
+	ChownHome      bool
+	HistoryStaging string
+	Scratch        string
+	ShellArgs      []string
+	CommandAudit   string
+	TmuxSession    string
+	Shell          string
+	// Gate is the file to wait for before doing anything.
+	Gate string
+	// PIDFile is where the script records its PID, for signalSession.
+	PIDFile string
+	// AuditFIFO is where the user's shell writes commands for the audit
+	// reader, which runs as root and records its PID in AuditReaderPIDFile.
+	AuditFIFO          string
+	AuditReaderPIDFile string
+}
+
+// shell returns the shell for user's jails.
+func (w *Warden) shell(user string) string {
+	if shell := w.users[user].Shell; shell != "" {
+		return shell
+	}
+	return w.jail.Shell
+}
+
+func (w *Warden) jailScript(sessionID, username, shell, scratch, tmuxSession string) string {
+	params := jailScriptParams{
+		PIDFile:            sessionPIDFile(sessionID),
+		AuditFIFO:          auditFIFO(sessionID),
+		AuditReaderPIDFile: auditReaderPIDFile(sessionID),
+		User:               username,
+		Groups:             w.jail.UserGroups,
+		ChownHome:          w.jail.ChownHome && w.homeVolume != nil,
+		CommandAudit:       w.jail.CommandAudit,
+		TmuxSession:        tmuxSession,
+		Shell:              shell,
+		Scratch:            scratch,
+		ShellArgs:          w.jail.ShellArgs,
+	}
+	if w.jail.PersistHistory {
+		params.HistoryStaging = historyStaging
+	}
+	if w.jail.gated() {
+		params.Gate = jailGate
+	}
+	var buf bytes.Buffer
+	jailScriptTemplate.Execute(&buf, params)
+	return buf.String()
+}
+
+// auditFIFO is where a session's shell sends its audit records. The audit
+// file itself is only writable by root, so the user can't truncate or edit
+// it, and a reader running as root copies records into it. It is in /tmp
+// so the user can write to it, but can't remove it.
+func auditFIFO(sessionID string) string {
+	return "/tmp/.warden-audit-" + sessionID
+}
+
+func auditReaderPIDFile(sessionID string) string {
+	return "/run/warden/" + sessionID + ".audit.pid"
+}
+
+// auditCommand returns a bash PROMPT_COMMAND that writes each command the
+// user runs to path.
+func auditCommand(path string) string {
+	return `echo "$(date -u +%FT%TZ) $USER: $(history 1 | sed 's/^ *[0-9]* *//')" >> ` + shellQuote(path)
+}
 
-func jailScript(username string) string {
-	return fmt.Sprintf(jailScriptFmt, username)
+// shellQuote quotes s for safe use as a single word in a shell script.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
 }
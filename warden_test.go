@@ -0,0 +1,1035 @@
+package warden
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startRun runs w until it returns, once it is listening.
+func startRun(t *testing.T, w *Warden) (net.Listener, <-chan error) {
+	errs := make(chan error, 1)
+	go func() { errs <- w.Run() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w.listenersMu.Lock()
+		listeners := w.listeners
+		w.listenersMu.Unlock()
+		if len(listeners) > 0 {
+			return listeners[0], errs
+		}
+		select {
+		case err := <-errs:
+			t.Fatal("Run failed to start:", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("Run didn't start listening")
+	return nil, nil
+}
+
+func waitRun(t *testing.T, errs <-chan error) error {
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return")
+		return nil
+	}
+}
+
+func TestRunClosed(t *testing.T) {
+	w := &Warden{addr: "127.0.0.1:0"}
+	_, errs := startRun(t, w)
+	w.Close()
+	if err := waitRun(t, errs); err != nil {
+		t.Errorf("Run returned %v after Close, want nil", err)
+	}
+}
+
+func TestRunListenerFailed(t *testing.T) {
+	w := &Warden{addr: "127.0.0.1:0"}
+	l, errs := startRun(t, w)
+	// The listener failing, rather than being closed by Close.
+	l.Close()
+	err := waitRun(t, errs)
+	if err == nil || !strings.Contains(err.Error(), "All listeners failed") {
+		t.Errorf("Run returned %v after its listener failed, want an error", err)
+	}
+}
+
+func TestRunListenFailed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	w := &Warden{addr: l.Addr().String()}
+	if err := w.Run(); err == nil {
+		t.Error("Run succeeded on an address in use")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	w, addr := startWarden(t, Config{MaxConnections: 2})
+	waitSlots := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); len(w.connSlots) != n; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d connections handled, want %d", len(w.connSlots), n)
+			}
+		}
+	}
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	// Two connections that never finish their handshake hold the slots.
+	held := []net.Conn{dial(), dial()}
+	waitSlots(2)
+	goroutines := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		conn := dial()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Connection over the limit read %v, want it closed", err)
+		}
+		conn.Close()
+	}
+	if n := runtime.NumGoroutine(); n > goroutines+5 {
+		t.Errorf("%d goroutines after a flood of connections, up from %d", n, goroutines)
+	}
+
+	for _, conn := range held {
+		conn.Close()
+	}
+	waitSlots(0)
+	if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+		t.Error("Session failed once connections had ended:", err)
+	}
+}
+
+// opaqueReader hides a reader's WriterTo, as ssh channels and ptys have
+// none, so that copies go through a buffer.
+type opaqueReader struct {
+	io.Reader
+}
+
+func TestCopy(t *testing.T) {
+	w := &Warden{buffers: sync.Pool{New: func() interface{} {
+		buf := make([]byte, 7)
+		return &buf
+	}}}
+	data := bytes.Repeat([]byte("jail output "), 100)
+	var out bytes.Buffer
+	n, err := w.copy(&out, opaqueReader{bytes.NewReader(data)})
+	if err != nil || n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("copy = %d, %v, copied %d of %d bytes", n, err, out.Len(), len(data))
+	}
+}
+
+var copyData = bytes.Repeat([]byte("x"), 4096)
+
+// BenchmarkCopy copies a session's output through a pooled buffer, which
+// BenchmarkCopyUnpooled compares with io.Copy allocating one per copy.
+func BenchmarkCopy(b *testing.B) {
+	w := &Warden{buffers: sync.Pool{New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	}}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.copy(ioutil.Discard, opaqueReader{bytes.NewReader(copyData)})
+	}
+}
+
+func BenchmarkCopyUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		io.Copy(struct{ io.Writer }{ioutil.Discard}, opaqueReader{bytes.NewReader(copyData)})
+	}
+}
+
+// fakeChannel is an ssh channel that records what is written and sent
+// on it.
+type fakeChannel struct {
+	bytes.Buffer
+	requests []string
+	closed   bool
+}
+
+func (c *fakeChannel) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeChannel) CloseWrite() error {
+	return nil
+}
+
+func (c *fakeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	c.requests = append(c.requests, name)
+	return true, nil
+}
+
+func (c *fakeChannel) Stderr() io.ReadWriter {
+	return &c.Buffer
+}
+
+// jailDocker fakes docker well enough for sessions to run. Jails are given
+// the ID "id-" followed by their name, and their sessions print "session
+// in" followed by the ID. With $HOLD_SESSIONS set, ephemeral sessions then
+// run until their input ends. A persistent jail whose name contains
+// $SLOW_JAIL isn't created until $FAKE_DIR/release exists.
+const jailDocker = `name= prev= jail=
+for a; do
+  [ "$prev" = --name ] && name=$a
+  case "$a" in id-*) jail=$a;; esac
+  prev=$a
+done
+case "$1" in
+run)
+  [ "$2" = -d ] || exit 0
+  case "$name" in *"$SLOW_JAIL"*)
+    [ -n "$SLOW_JAIL" ] && touch "$FAKE_DIR/creating"
+    while [ -n "$SLOW_JAIL" ] && [ ! -e "$FAKE_DIR/release" ]; do sleep 0.01; done;;
+  esac
+  echo "id-$name";;
+create) echo "id-$name";;
+inspect) echo true;;
+start) echo "session in $jail"; [ -z "$HOLD_SESSIONS" ] || cat > /dev/null;;
+exec) case "$*" in *" bash -c "*"su "*) echo "session in $jail";; esac;;
+esac
+`
+
+// testKey returns a new ECDSA key.
+func testKey(t testing.TB) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testHostKey writes a new host key, returning its path.
+func testHostKey(t *testing.T) string {
+	der, err := x509.MarshalECPrivateKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey := filepath.Join(t.TempDir(), "hostkey")
+	if err := ioutil.WriteFile(hostKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return hostKey
+}
+
+// startWarden runs a warden for config on a free port until the test ends,
+// returning it and its address. Docker should be faked with fakeDocker.
+func startWarden(t *testing.T, config Config) (*Warden, string) {
+	config.Addr = "127.0.0.1:0"
+	config.PrivateKeys = []string{testHostKey(t)}
+	if config.Instance == "" {
+		config.Instance = "test"
+	}
+	w, err := New(config)
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	l, errs := startRun(t, w)
+	t.Cleanup(func() {
+		w.Close()
+		waitRun(t, errs)
+	})
+	return w, l.Addr().String()
+}
+
+// dialWarden connects to a test warden as user.
+func dialWarden(t *testing.T, addr, user string) *ssh.Client {
+	signer, err := ssh.NewSignerFromKey(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: user, Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)}})
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// runShell runs a shell in a new session, after sending env requests for
+// env, and returns its output and what Wait returned. The session's input
+// stays open until it ends.
+func runShell(t *testing.T, client *ssh.Client, env map[string]string) (string, error) {
+	s, err := client.NewSession()
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	defer s.Close()
+	for name, value := range env {
+		if err := s.Setenv(name, value); err != nil {
+			return "", err
+		}
+	}
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	var out syncBuffer
+	s.Stdout, s.Stderr = &out, &out
+	if err := s.Shell(); err != nil {
+		return out.String(), err
+	}
+	err = s.Wait()
+	return out.String(), err
+}
+
+// syncBuffer is a buffer that can be written concurrently, as a session's
+// output and errors are.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitForFile(t *testing.T, path string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(path, "wasn't created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPersistentJailCreationDoesntBlockOthers(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	t.Setenv("SLOW_JAIL", "alice")
+	w, addr := startWarden(t, Config{Jail: Jail{Persistent: true}})
+	alice := make(chan string, 1)
+	go func() {
+		out, _ := runShell(t, dialWarden(t, addr, "alice"), nil)
+		alice <- out
+	}()
+	waitForFile(t, filepath.Join(os.Getenv("FAKE_DIR"), "creating"))
+
+	// Other users' sessions, and anything else needing jailsMu, go ahead
+	// while alice's jail is being created.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.tracked("id")
+		if out, err := runShell(t, dialWarden(t, addr, "bob"), nil); err != nil || !strings.Contains(out, "session in id-") {
+			t.Errorf("Bob's session = %q, %v", out, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Bob's session waited for alice's jail to be created")
+	}
+	select {
+	case out := <-alice:
+		t.Fatalf("Alice's session ran before her jail was created: %q", out)
+	default:
+	}
+
+	// Alice's other sessions wait for her jail, and then share it.
+	second := make(chan string, 1)
+	go func() {
+		out, _ := runShell(t, dialWarden(t, addr, "alice"), nil)
+		second <- out
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := ioutil.WriteFile(filepath.Join(os.Getenv("FAKE_DIR"), "release"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	first, other := <-alice, <-second
+	if !strings.Contains(first, "session in id-") || first != other {
+		t.Errorf("Alice's sessions = %q and %q, want them in the same jail", first, other)
+	}
+	if runs := dockerCalls(t, filepath.Join(os.Getenv("FAKE_DIR"), "log"), "run -d"); len(runs) != 2 {
+		t.Errorf("Created %d persistent jails, want one for each user", len(runs))
+	}
+}
+
+// checkScript fails the test if script isn't valid bash.
+func checkScript(t *testing.T, script string) {
+	t.Helper()
+	if out, err := exec.Command("bash", "-n", "-c", script).CombinedOutput(); err != nil {
+		t.Errorf("Invalid script: %v: %s\n%s", err, out, script)
+	}
+}
+
+func TestJailScriptUserGroups(t *testing.T) {
+	for _, test := range []struct {
+		groups []string
+		want   []string
+	}{
+		{nil, nil},
+		{[]string{"sudo"}, []string{`usermod -aG 'sudo' "$user"`}},
+		{[]string{"sudo", "docker"}, []string{`usermod -aG 'sudo' "$user"`, `usermod -aG 'docker' "$user"`}},
+	} {
+		w := &Warden{jail: Jail{UserGroups: test.groups}}
+		script := w.jailScript("session", "alice", "", "", "")
+		checkScript(t, script)
+		if n := strings.Count(script, "usermod"); n != len(test.want) {
+			t.Errorf("Script for groups %q runs usermod %d times:\n%s", test.groups, n, script)
+		}
+		// Users are added to their groups once they exist, and before
+		// their shell starts.
+		created, shell := strings.Index(script, "adduser"), strings.LastIndex(script, "su ")
+		for _, want := range test.want {
+			if i := strings.Index(script, want); i < created || i > shell {
+				t.Errorf("Script for groups %q doesn't run %s between adduser and su:\n%s", test.groups, want, script)
+			}
+		}
+	}
+}
+
+func TestJailValidateUserGroups(t *testing.T) {
+	for _, test := range []struct {
+		group string
+		ok    bool
+	}{
+		{"sudo", true},
+		{"_docker-users", true},
+		{"wheel2", true},
+		{"", false},
+		{"Sudo", false},
+		{"-x", false},
+		{"sudo;reboot", false},
+		{"a'b", false},
+	} {
+		j := Jail{UserGroups: []string{test.group}}
+		if err := j.validate(); (err == nil) != test.ok {
+			t.Errorf("Group %q: validate() = %v, want ok %v", test.group, err, test.ok)
+		}
+	}
+}
+
+func TestJailValidateCgroupParent(t *testing.T) {
+	for parent, ok := range map[string]bool{
+		"":                  true,
+		"/warden":           true,
+		"warden.slice":      true,
+		"/sandbox/warden-1": true,
+		"/warden/../system": false,
+		"..":                false,
+		"/warden/":          false,
+		"warden slice":      false,
+		"warden;reboot":     false,
+	} {
+		j := Jail{CgroupParent: parent}
+		if err := j.validate(); (err == nil) != ok {
+			t.Errorf("Cgroup parent %q: validate() = %v, want ok %v", parent, err, ok)
+		}
+	}
+}
+
+func TestJailUsernsMode(t *testing.T) {
+	for mode, ok := range map[string]bool{"": true, "host": true, "private": false, "default": false, "host;reboot": false} {
+		if err := (Jail{UsernsMode: mode}).validate(); (err == nil) != ok {
+			t.Errorf("Userns mode %q: validate() = %v, want ok %v", mode, err, ok)
+		}
+	}
+	for _, persistent := range []bool{false, true} {
+		for _, mode := range []string{"", "host"} {
+			log := fakeDocker(t, jailDocker)
+			_, addr := startWarden(t, Config{Jail: Jail{Persistent: persistent, UsernsMode: mode}})
+			if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+				t.Fatal("Session failed:", err)
+			}
+			// Without a mode, the daemon's remapping applies.
+			want := " --userns " + mode + " "
+			creates := append(dockerCalls(t, log, "create"), dockerCalls(t, log, "run -d")...)
+			if len(creates) != 1 || strings.Contains(creates[0], "--userns") != (mode != "") || mode != "" && !strings.Contains(creates[0], want) {
+				t.Errorf("Persistent %v, mode %q: jails created with %q", persistent, mode, creates)
+			}
+		}
+	}
+}
+
+func TestJailValidateLogDriver(t *testing.T) {
+	for _, test := range []struct {
+		driver string
+		opts   map[string]string
+		ok     bool
+	}{
+		{"", nil, true},
+		{"journald", map[string]string{"tag": "{{.Name}}"}, true},
+		{"json-file", map[string]string{"max-size": "10m", "max-file": "3"}, true},
+		{"grafana/loki", map[string]string{"loki-url": "http://loki:3100"}, true},
+		{"journal", nil, false},
+		{"fluentd", map[string]string{"Tag": "warden"}, false},
+		{"fluentd", map[string]string{"tag=x --privileged": "warden"}, false},
+	} {
+		j := Jail{LogDriver: test.driver, LogOpts: test.opts}
+		if err := j.validate(); (err == nil) != test.ok {
+			t.Errorf("Log driver %q with %v: validate() = %v, want ok %v", test.driver, test.opts, err, test.ok)
+		}
+	}
+}
+
+func TestJailLogDriver(t *testing.T) {
+	for _, persistent := range []bool{false, true} {
+		log := fakeDocker(t, jailDocker)
+		_, addr := startWarden(t, Config{Jail: Jail{
+			Persistent: persistent,
+			LogDriver:  "json-file",
+			LogOpts:    map[string]string{"max-size": "10m", "max-file": "3"},
+		}})
+		if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+			t.Fatal("Session failed:", err)
+		}
+		// Options are passed in order, so that the arguments are the same
+		// for every jail.
+		want := " --log-driver json-file --log-opt max-file=3 --log-opt max-size=10m "
+		creates := append(dockerCalls(t, log, "create"), dockerCalls(t, log, "run -d")...)
+		if len(creates) != 1 || !strings.Contains(creates[0], want) {
+			t.Errorf("Persistent %v: jails created with %q, want %q", persistent, creates, want)
+		}
+	}
+}
+
+func TestValidateSeccompProfile(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	if err := ioutil.WriteFile(valid, []byte(`{"defaultAction": "SCMP_ACT_ERRNO", "syscalls": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalid, []byte(`{"defaultAction": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		profile string
+		ok      bool
+	}{
+		{"", true},
+		{valid, true},
+		{"unconfined", true},
+		{invalid, false},
+		{filepath.Join(dir, "missing.json"), false},
+	} {
+		if err := validateSeccompProfile(test.profile); (err == nil) != test.ok {
+			t.Errorf("validateSeccompProfile(%q) = %v, want ok %v", test.profile, err, test.ok)
+		}
+	}
+	if warnings := strings.Count(logs.String(), "WARNING: jails are running without seccomp filtering"); warnings != 1 {
+		t.Errorf("Logged %d warnings about running unconfined, want 1:\n%s", warnings, logs.String())
+	}
+}
+
+func TestJailSeccompProfile(t *testing.T) {
+	profile := filepath.Join(t.TempDir(), "seccomp.json")
+	if err := ioutil.WriteFile(profile, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, persistent := range []bool{false, true} {
+		for _, seccomp := range []string{profile, "unconfined"} {
+			log := fakeDocker(t, jailDocker)
+			_, addr := startWarden(t, Config{Jail: Jail{Persistent: persistent, SeccompProfile: seccomp}})
+			if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+				t.Fatal("Session failed:", err)
+			}
+			creates := append(dockerCalls(t, log, "create"), dockerCalls(t, log, "run -d")...)
+			if len(creates) != 1 || !strings.Contains(creates[0], " --security-opt seccomp="+seccomp+" ") {
+				t.Errorf("Persistent %v: jails created with %q, want seccomp=%s", persistent, creates, seccomp)
+			}
+		}
+	}
+	// A bad profile is refused when warden starts, not when a jail is
+	// created.
+	_, err := New(Config{PrivateKeys: []string{testHostKey(t)}, Jail: Jail{SeccompProfile: profile + ".missing"}})
+	if err == nil || !strings.Contains(err.Error(), ".missing") {
+		t.Errorf("New with a missing seccomp profile = %v, want it refused", err)
+	}
+}
+
+func TestJailCgroupParent(t *testing.T) {
+	for _, persistent := range []bool{false, true} {
+		log := fakeDocker(t, jailDocker)
+		_, addr := startWarden(t, Config{Jail: Jail{Persistent: persistent, CgroupParent: "warden.slice"}})
+		if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+			t.Fatal("Session failed:", err)
+		}
+		creates := append(dockerCalls(t, log, "create"), dockerCalls(t, log, "run -d")...)
+		if len(creates) != 1 || !strings.Contains(creates[0], " --cgroup-parent warden.slice ") {
+			t.Errorf("Persistent %v: jails created with %q, want them under warden.slice", persistent, creates)
+		}
+	}
+}
+
+// sessionRequests opens a session and sends it requests, returning which
+// were accepted. Requests are given as their type, with pty-req and
+// window-change getting an 80x24 window.
+func sessionRequests(t *testing.T, client *ssh.Client, types ...string) []bool {
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal("OpenChannel:", err)
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	go io.Copy(ioutil.Discard, ch)
+	var replies []bool
+	for _, typ := range types {
+		var payload []byte
+		switch typ {
+		case "pty-req":
+			payload = ssh.Marshal(&ptyRequestMsg{Term: "xterm", Columns: 80, Rows: 24})
+		case "window-change":
+			payload = ssh.Marshal(&windowChangeMsg{Columns: 80, Rows: 24})
+		case "exec":
+			payload = ssh.Marshal(&struct{ Command string }{"true"})
+		}
+		ok, err := ch.SendRequest(typ, true, payload)
+		if err != nil {
+			t.Fatalf("Sending %s: %v", typ, err)
+		}
+		replies = append(replies, ok)
+	}
+	return replies
+}
+
+func TestRequestOrder(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	t.Setenv("HOLD_SESSIONS", "1")
+	_, addr := startWarden(t, Config{})
+	client := dialWarden(t, addr, "alice")
+	for _, test := range []struct {
+		requests []string
+		replies  []bool
+	}{
+		{[]string{"shell"}, []bool{true}},
+		{[]string{"pty-req", "shell"}, []bool{true, true}},
+		{[]string{"pty-req", "pty-req", "shell"}, []bool{true, true, true}},
+		{[]string{"pty-req", "window-change", "shell", "window-change"}, []bool{true, true, true, true}},
+		{[]string{"shell", "pty-req"}, []bool{true, false}},
+		{[]string{"shell", "shell"}, []bool{true, false}},
+		{[]string{"window-change", "shell"}, []bool{false, true}},
+		{[]string{"exec", "pty-req", "shell"}, []bool{false, true, true}},
+	} {
+		replies := sessionRequests(t, client, test.requests...)
+		if fmt.Sprint(replies) != fmt.Sprint(test.replies) {
+			t.Errorf("Replies to %q = %v, want %v", test.requests, replies, test.replies)
+		}
+	}
+}
+
+func TestWindowChangeWithoutPty(t *testing.T) {
+	fakeDocker(t, jailDocker)
+	t.Setenv("HOLD_SESSIONS", "1")
+	_, addr := startWarden(t, Config{HangupGrace: Duration(100 * time.Millisecond)})
+	ch, reqs, err := dialWarden(t, addr, "alice").OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal("OpenChannel:", err)
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	if ok, err := ch.SendRequest("shell", true, nil); !ok || err != nil {
+		t.Fatalf("shell = %v, %v", ok, err)
+	}
+	// The shell's output is a pipe, which can't be resized.
+	resize := ssh.Marshal(&windowChangeMsg{Columns: 100, Rows: 40})
+	if ok, err := ch.SendRequest("window-change", true, resize); ok || err != nil {
+		t.Errorf("window-change without a pty = %v, %v, want it rejected", ok, err)
+	}
+	ch.CloseWrite()
+	if out, _ := ioutil.ReadAll(ch); !strings.HasPrefix(string(out), "session in id-") {
+		t.Errorf("Session printed %q after a rejected window-change", out)
+	}
+}
+
+func TestDuplicatePtyRequests(t *testing.T) {
+	if !ptysAvailable() {
+		t.Skip("No ptys available")
+	}
+	log := fakeDocker(t, `case "$1" in
+create) echo id-jail;;
+inspect) echo true;;
+start) stty size;;
+esac
+`)
+	_, addr := startWarden(t, Config{})
+	ch, reqs, err := dialWarden(t, addr, "alice").OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal("OpenChannel:", err)
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	for _, msg := range []ptyRequestMsg{
+		{Term: "xterm", Columns: 80, Rows: 24},
+		{Term: "vt100", Columns: 100, Rows: 40},
+	} {
+		if ok, err := ch.SendRequest("pty-req", true, ssh.Marshal(&msg)); !ok || err != nil {
+			t.Fatalf("pty-req %+v = %v, %v", msg, ok, err)
+		}
+	}
+	if ok, err := ch.SendRequest("shell", true, nil); !ok || err != nil {
+		t.Fatalf("shell = %v, %v", ok, err)
+	}
+	out, _ := ioutil.ReadAll(ch)
+
+	// The second pty-req resizes the pty, but keeps the first's TERM.
+	if strings.TrimSpace(string(out)) != "40 100" {
+		t.Errorf("Session's pty is %q, want 40 rows and 100 columns", out)
+	}
+	creates := dockerCalls(t, log, "create")
+	if len(creates) != 1 || !strings.Contains(creates[0], " TERM=xterm ") {
+		t.Errorf("Jails created with %q, want one with TERM=xterm", creates)
+	}
+	if starts := dockerCalls(t, log, "start"); len(starts) != 1 {
+		t.Errorf("Jail started with %q, want one pty", starts)
+	}
+}
+
+func TestExitStatusBeforeEOF(t *testing.T) {
+	log := fakeDocker(t, `case "$1" in
+create) echo id-jail;;
+inspect) echo true;;
+start) seq 1 20000; exit 3;;
+esac
+`)
+	_, addr := startWarden(t, Config{})
+	ch, reqs, err := dialWarden(t, addr, "alice").OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal("OpenChannel:", err)
+	}
+	defer ch.Close()
+	if ok, err := ch.SendRequest("shell", true, nil); !ok || err != nil {
+		t.Fatalf("shell = %v, %v", ok, err)
+	}
+	out, err := ioutil.ReadAll(ch)
+	if err != nil {
+		t.Fatal("Reading output:", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(out)), "\n"); len(lines) != 20000 || lines[len(lines)-1] != "20000" {
+		t.Errorf("Session printed %d lines ending %q, want all of its output", len(lines), lines[len(lines)-1])
+	}
+	// Requests are delivered in order with the channel's data, so the exit
+	// status has arrived by the time its output ends.
+	select {
+	case req := <-reqs:
+		var status struct{ Status uint32 }
+		if req.Type != "exit-status" || ssh.Unmarshal(req.Payload, &status) != nil || status.Status != 3 {
+			t.Errorf("Got %s request %q before EOF, want exit-status 3", req.Type, req.Payload)
+		}
+	default:
+		t.Error("Channel reached EOF before its exit-status")
+	}
+	// Let the jail be removed before the fake's directory is.
+	for deadline := time.Now().Add(5 * time.Second); len(dockerCalls(t, log, "rm")) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Jail wasn't removed")
+		}
+	}
+}
+
+func TestJailScriptChownHome(t *testing.T) {
+	homeVolume := template.Must(template.New("").Parse("home-{{.User}}"))
+	for _, test := range []struct {
+		name       string
+		chownHome  bool
+		homeVolume *template.Template
+		chowns     bool
+	}{
+		{"home volume", true, homeVolume, true},
+		{"off", false, homeVolume, false},
+		// Without a home volume, the home directory is the one adduser
+		// just created.
+		{"no home volume", true, nil, false},
+	} {
+		w := &Warden{jail: Jail{ChownHome: test.chownHome}, homeVolume: test.homeVolume}
+		script := w.jailScript("session", "alice", "", "", "")
+		checkScript(t, script)
+		chown := strings.Index(script, `chown -R "$user:" "/home/$user"`)
+		if (chown >= 0) != test.chowns {
+			t.Errorf("%s: script chowns the home directory: %v, want %v:\n%s", test.name, chown >= 0, test.chowns, script)
+		}
+		if chown >= 0 && chown < strings.Index(script, "adduser") {
+			t.Errorf("%s: script chowns the home directory before creating the user:\n%s", test.name, script)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, s := range []string{"", "plain", "two words", "it's", `"$(reboot)"`, "`id`; rm -rf /", "a\nb", `\'`} {
+		out, err := exec.Command("bash", "-c", "printf %s "+shellQuote(s)).Output()
+		if err != nil || string(out) != s {
+			t.Errorf("shellQuote(%q) printed %q, %v", s, out, err)
+		}
+	}
+}
+
+func TestJailScriptCommandAudit(t *testing.T) {
+	for _, audit := range []string{"", "/var/log/commands"} {
+		w := &Warden{jail: Jail{CommandAudit: audit}}
+		script := w.jailScript("session", "alice", "", "", "")
+		checkScript(t, script)
+		if strings.Contains(script, "PROMPT_COMMAND") != (audit != "") {
+			t.Errorf("Audit file %q: script sets PROMPT_COMMAND: %v:\n%s", audit, strings.Contains(script, "PROMPT_COMMAND"), script)
+		}
+		if audit == "" {
+			continue
+		}
+		// The audit file is only writable by root, and the user's shell
+		// writes to the FIFO its reader copies from.
+		for _, want := range []string{
+			"chown root: '/var/log/commands' && chmod 600 '/var/log/commands'",
+			"mkfifo -m 622 " + shellQuote(auditFIFO("session")),
+			">> '/var/log/commands'",
+			"export PROMPT_COMMAND=" + shellQuote(auditCommand(auditFIFO("session"))),
+		} {
+			if !strings.Contains(script, want) {
+				t.Errorf("Script doesn't contain %q:\n%s", want, script)
+			}
+		}
+		if i := strings.Index(script, "PROMPT_COMMAND"); i > strings.LastIndex(script, "su ") {
+			t.Errorf("Script sets PROMPT_COMMAND after starting the shell:\n%s", script)
+		}
+	}
+}
+
+func TestJailScriptDetachable(t *testing.T) {
+	w := &Warden{jail: Jail{Persistent: true, Detachable: true}}
+	script := w.jailScript("session", "alice", "", "", "warden")
+	checkScript(t, script)
+	// Run the end of the script, from where the user's shell is started,
+	// with su and tmux faked.
+	start := strings.Index(script, "if command -v tmux")
+	if start < 0 {
+		t.Fatalf("Script doesn't start tmux:\n%s", script)
+	}
+	fragment := "user=alice\n" + script[start:]
+	for _, test := range []struct {
+		tmux bool
+		want string
+	}{
+		// Every session attaches to the jail's tmux session, creating
+		// it if the user has none running.
+		{true, "su alice\ntmux new-session -A -s warden\n"},
+		{false, "warden: tmux is not installed in this jail, this session can't be resumed\nsu alice\n"},
+	} {
+		bin := t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(bin, "su"), []byte("#!/bin/sh\necho \"su $1\"\n[ \"$2\" != -c ] || exec /bin/sh -c \"$3\"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if test.tmux {
+			if err := ioutil.WriteFile(filepath.Join(bin, "tmux"), []byte("#!/bin/sh\necho \"tmux $*\"\n"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cmd := exec.Command("/bin/bash", "-c", fragment)
+		cmd.Env = []string{"PATH=" + bin}
+		out, err := cmd.CombinedOutput()
+		if err != nil || string(out) != test.want {
+			t.Errorf("With tmux %v, script ran %q, %v, want %q", test.tmux, out, err, test.want)
+		}
+	}
+
+	// Without detachable jails, the shell is started directly.
+	w.jail.Detachable = false
+	if script := w.jailScript("session", "alice", "", "", ""); strings.Contains(script, "tmux") {
+		t.Errorf("Script for jails that aren't detachable starts tmux:\n%s", script)
+	}
+}
+
+func TestDetachableSessions(t *testing.T) {
+	log := fakeDocker(t, jailDocker)
+	_, addr := startWarden(t, Config{Jail: Jail{Persistent: true, Detachable: true}})
+	// A session, and a reconnection after it was dropped.
+	for i := 0; i < 2; i++ {
+		if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+			t.Fatal("Session failed:", err)
+		}
+	}
+	if runs := dockerCalls(t, log, "run -d"); len(runs) != 1 {
+		t.Errorf("Jails created with %q, want one for both sessions", runs)
+	}
+	// Jail scripts span lines of the log, so look for them in all of it.
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attached := strings.Count(string(b), "exec tmux new-session -A -s"); attached != 2 {
+		t.Errorf("%d sessions attached to the jail's tmux session, want both:\n%s", attached, b)
+	}
+}
+
+func TestJailValidateDetachable(t *testing.T) {
+	if err := (Jail{Detachable: true}).validate(); err == nil {
+		t.Error("Detachable jails that aren't persistent were accepted")
+	}
+	if err := (Jail{Persistent: true, Detachable: true}).validate(); err != nil {
+		t.Errorf("Detachable persistent jails: validate() = %v", err)
+	}
+}
+
+func TestShell(t *testing.T) {
+	w := &Warden{
+		jail:  Jail{Shell: "/bin/bash", Shells: []string{"/bin/zsh"}},
+		users: map[string]User{"alice": {Shell: "/bin/zsh"}, "bob": {}},
+	}
+	for user, want := range map[string]string{"alice": "/bin/zsh", "bob": "/bin/bash", "carol": "/bin/bash"} {
+		if shell := w.shell(user); shell != want {
+			t.Errorf("shell(%q) = %q, want %q", user, shell, want)
+		}
+	}
+	if shell := (&Warden{}).shell("alice"); shell != "" {
+		t.Errorf("shell without a jail shell = %q, want the login shell", shell)
+	}
+}
+
+func TestJailValidateShells(t *testing.T) {
+	j := Jail{Shell: "/bin/bash", Shells: []string{"/bin/zsh", "/usr/bin/fish"}}
+	for shell, ok := range map[string]bool{
+		"":              true,
+		"/bin/bash":     true,
+		"/bin/zsh":      true,
+		"/usr/bin/fish": true,
+		"/bin/sh":       false,
+		"zsh":           false,
+	} {
+		err := j.validateShells(map[string]User{"alice": {Shell: shell}})
+		if ok && err != nil || !ok && (err == nil || !strings.Contains(err.Error(), "is not one of the jail's shells")) {
+			t.Errorf("Shell %q: validateShells() = %v, want ok %v", shell, err, ok)
+		}
+	}
+	for _, j := range []Jail{{Shell: "bash"}, {Shells: []string{"/bin/zsh", "zsh"}}} {
+		if err := j.validate(); err == nil || !strings.Contains(err.Error(), "absolute path") {
+			t.Errorf("%+v.validate() = %v, want relative shells refused", j, err)
+		}
+	}
+}
+
+func TestJailScriptShell(t *testing.T) {
+	w := &Warden{}
+	script := w.jailScript("session", "alice", "/bin/zsh", "", "")
+	checkScript(t, script)
+	if !strings.Contains(script, "shell='/bin/zsh'") || !strings.Contains(script, `su -s "$shell" "$user"`) {
+		t.Errorf("Script doesn't start /bin/zsh:\n%s", script)
+	}
+	// Without a shell, users get their login shell.
+	if script := w.jailScript("session", "alice", "", "", ""); strings.Contains(script, "su -s") {
+		t.Errorf("Script without a shell overrides the login shell:\n%s", script)
+	}
+}
+
+func TestJailValidateShellArgs(t *testing.T) {
+	for arg, ok := range map[string]bool{
+		"-l":           true,
+		"-il":          true,
+		"--login":      true,
+		"--no-profile": true,
+		"l":            false,
+		"-":            false,
+		"--rcfile=x":   false,
+		"--login x":    false,
+		"-l; reboot":   false,
+		"-$(reboot)":   false,
+	} {
+		j := Jail{ShellArgs: []string{arg}}
+		if err := j.validate(); (err == nil) != ok {
+			t.Errorf("Shell argument %q: validate() = %v, want ok %v", arg, err, ok)
+		}
+	}
+}
+
+func TestJailShellArgs(t *testing.T) {
+	w := &Warden{jail: Jail{ShellArgs: []string{"-l", "--norc"}}}
+	script := w.jailScript("session", "alice", "/bin/bash", "", "")
+	checkScript(t, script)
+	if !strings.HasSuffix(strings.TrimSpace(script), `su -s "$shell" "$user" -- '-l' '--norc'`) {
+		t.Errorf("Script doesn't start the shell with its arguments:\n%s", script)
+	}
+	// Shells in tmux are started by tmux, without them.
+	w.jail.Persistent, w.jail.Detachable = true, true
+	script = w.jailScript("session", "alice", "", "", "warden")
+	if tmux := script[strings.Index(script, "command -v tmux"):strings.Index(script, "this session can't be resumed")]; strings.Contains(tmux, "--norc") {
+		t.Errorf("Script starts tmux with the shell's arguments:\n%s", script)
+	}
+
+	log := fakeDocker(t, jailDocker)
+	_, addr := startWarden(t, Config{Jail: Jail{ShellArgs: []string{"-l"}}})
+	if _, err := runShell(t, dialWarden(t, addr, "alice"), nil); err != nil {
+		t.Fatal("Session failed:", err)
+	}
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `su "$user" -- '-l'`) {
+		t.Errorf("Jail started without the shell's arguments:\n%s", b)
+	}
+	// Let the jail be removed before the fake's directory is.
+	for deadline := time.Now().Add(5 * time.Second); len(dockerCalls(t, log, "rm")) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Jail wasn't removed")
+		}
+	}
+}
+
+func TestAuditCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "it's audited")
+	// history -s replaces the line running it, as if the command had been
+	// run before the prompt.
+	script := "set -o history\nhistory -s 'ls -la /tmp'; " + auditCommand(path)
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Env = append(os.Environ(), "USER=alice")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Audit command failed: %v: %s", err, out)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ alice: ls -la /tmp\n$`).Match(b) {
+		t.Errorf("Audited %q", b)
+	}
+}